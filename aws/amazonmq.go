@@ -0,0 +1,261 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/mq"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	RabbitMQEngine = "rabbitmq"
+	// the number of nodes of a RabbitMQ cluster, Amazon MQ only offers single instances and 3 node clusters
+	rabbitMQClusterNodes = 3
+	rabbitMQPort         = 5671
+)
+
+var (
+	userNameRabbitMQ      = "mfsbadmin"
+	engineTypeRabbitMQ    = mq.EngineTypeRabbitmq
+	notPublicRabbitMQ     = false
+	generalLogsRabbitMQ   = true
+	managementHttpClient  = &http.Client{Timeout: 30 * time.Second}
+	allPermissionRabbitMQ = ".*"
+)
+
+// SubmitProvisionRabbitMQ creates a private Amazon MQ RabbitMQ broker in the MQ subnets, a single instance or a cluster (in multiple zones) for plans with max_instances 3
+func SubmitProvisionRabbitMQ(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("RabbitMQ broker creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	if len(conf.MQSubnetIds) == 0 {
+		return failed("aws.mq_subnet_ids (MFSB_MQ_SUBNET_IDS) is not configured")
+	}
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	var instanceType string
+	if plan.IaaS != nil {
+		instanceType = plan.IaaS.InstanceClass
+	}
+	if instanceType == "" {
+		return failed(fmt.Sprintf("could not find host instance type for plan %s", plan.Name))
+	}
+	deploymentMode := mq.DeploymentModeSingleInstance
+	subnets := conf.MQSubnetIds[:1]
+	if plan.IaaS.MaxInstances == rabbitMQClusterNodes {
+		if len(conf.MQSubnetIds) < 2 {
+			return failed("a RabbitMQ cluster needs aws.mq_subnet_ids (MFSB_MQ_SUBNET_IDS) in at least 2 availability zones")
+		}
+		deploymentMode = mq.DeploymentModeClusterMultiAz
+		subnets = conf.MQSubnetIds
+	}
+	iaasInstance.ServiceUser = userNameRabbitMQ
+	// RabbitMQ passwords can not contain commas, colons or equal signs
+	iaasInstance.ServicePassword = util.SafeSubstring(fmt.Sprintf("Pw%s", util.GenerateGUID()), 40)
+	output, err := conf.MQClient.CreateBrokerWithContext(ctx, &mq.CreateBrokerRequest{
+		AutoMinorVersionUpgrade: &spec.AutoMinorVersionUpgrade,
+		BrokerName:              &iaasInstance.InternalId,
+		DeploymentMode:          &deploymentMode,
+		EngineType:              &engineTypeRabbitMQ,
+		EngineVersion:           &spec.Engine,
+		HostInstanceType:        &instanceType,
+		Logs:                    &mq.Logs{General: &generalLogsRabbitMQ},
+		PubliclyAccessible:      &notPublicRabbitMQ,
+		SecurityGroups:          []*string{&conf.MQSecGrpId},
+		SubnetIds:               stringPointers(subnets),
+		Tags:                    getTagsMapForServiceInstance(serviceInstance),
+		Users:                   []*mq.User{{Username: &iaasInstance.ServiceUser, Password: &iaasInstance.ServicePassword}},
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create RabbitMQ broker %s: %s", serviceInstance.InstanceName, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	iaasInstance.ServiceDetails = map[string]string{db.DetailBrokerId: *output.BrokerId}
+	msg := fmt.Sprintf("RabbitMQ broker %s is being created", iaasInstance.InternalId)
+	logger.Info(msg, "engine", spec.Engine, "instance_type", instanceType, "deployment_mode", deploymentMode)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusRabbitMQ(ctx, iaasInstance)
+	return nil
+}
+
+// SubmitDeletionRabbitMQ deletes the RabbitMQ broker, the users and vhosts of the bindings are deleted on unbind
+func SubmitDeletionRabbitMQ(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	logger.Info("deleting RabbitMQ broker...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	brokerId := iaasInstance.ServiceDetails[db.DetailBrokerId]
+	_, err := conf.MQClient.DeleteBrokerWithContext(ctx, &mq.DeleteBrokerInput{BrokerId: &brokerId})
+	if err != nil {
+		LogAwsError(ctx, err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+	}
+	StartPollForStatusRabbitMQ(ctx, iaasInstance)
+	return err
+}
+
+// StartPollForStatusRabbitMQ waits until the broker is running (and records its endpoints), or until it is gone
+func StartPollForStatusRabbitMQ(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	brokerId := iaasInstance.ServiceDetails[db.DetailBrokerId]
+	startPoller(ctx, serviceInstance, "StartPollForStatusRabbitMQ", func(ctx context.Context) bool {
+		output, err := conf.MQClient.DescribeBrokerWithContext(ctx, &mq.DescribeBrokerInput{BrokerId: &brokerId})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == mq.ErrCodeNotFoundException {
+				// this should only happen when a broker deletion ended
+				logger.Info("RabbitMQ broker is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("RabbitMQ broker %s is gone", iaasInstance.InternalId))
+			} else {
+				msg := fmt.Sprintf("failed to describe RabbitMQ broker %s: %s", iaasInstance.InternalId, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		}
+		state := *output.BrokerState
+		logger.Info("RabbitMQ broker status", "broker_state", state)
+		if state == mq.BrokerStateCreationFailed {
+			msg := fmt.Sprintf("RabbitMQ broker %s failed", iaasInstance.InternalId)
+			logger.Error(msg)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, msg)
+			return true
+		}
+		// the broker can still be running right after the deletion was submitted
+		deleting := db.GetIaaSInstances(ctx, iaasInstance.Id)[0].Status == db.StatusDeleteInProgress
+		if deleting || state != mq.BrokerStateRunning {
+			return false
+		}
+		if len(output.BrokerInstances) == 0 || len(output.BrokerInstances[0].Endpoints) == 0 || output.BrokerInstances[0].ConsoleURL == nil {
+			logger.Warn("RabbitMQ broker is running, but has no endpoints yet")
+			return false
+		}
+		endpoint, err := url.Parse(*output.BrokerInstances[0].Endpoints[0])
+		if err != nil {
+			logger.Error("RabbitMQ broker has an invalid endpoint", "endpoint", *output.BrokerInstances[0].Endpoints[0], "error", err)
+			return false
+		}
+		iaasInstance.ServiceUrl = fmt.Sprintf(schemas[RabbitMQEngine], iaasInstance.ServiceUser, iaasInstance.ServicePassword, endpoint.Hostname(), rabbitMQPort)
+		iaasInstance.ServiceDetails = map[string]string{db.DetailBrokerId: brokerId, db.DetailConsoleUrl: *output.BrokerInstances[0].ConsoleURL, db.DetailTLS: "true"}
+		iaasInstance.Status = db.StatusCreateSucceeded
+		iaasInstance.LastStatusUpdate = time.Now()
+		iaasInstance.LastMessage = fmt.Sprintf("RabbitMQ broker %s successfully created", iaasInstance.InternalId)
+		_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+		_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+		return true
+	})
+}
+
+// CreateBindingRabbitMQ creates a vhost and a user with all permissions on it for the binding, with the management API of the broker.
+// The vhost isolates the queues and exchanges of the binding from the ones of the other bindings.
+func CreateBindingRabbitMQ(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error) {
+	logger := util.Logger(ctx)
+	if iaasInstance.ServiceDetails[db.DetailConsoleUrl] == "" {
+		return nil, fmt.Errorf("RabbitMQ broker %s is not created (yet)", iaasInstance.InternalId)
+	}
+	admin, err := url.Parse(iaasInstance.ServiceUrl)
+	if err != nil {
+		return nil, fmt.Errorf("RabbitMQ broker %s has an invalid url: %s", iaasInstance.InternalId, err)
+	}
+	username := bindingUserName(bindingId)
+	vhost := bindingUserName(bindingId)
+	password := util.SafeSubstring(fmt.Sprintf("pw%s", util.GenerateGUID()), 40)
+	// all calls are idempotent, a retried bind gets a new password
+	if err = rabbitMQManagement(ctx, iaasInstance, http.MethodPut, "/api/vhosts/"+url.PathEscape(vhost), nil); err != nil {
+		return nil, fmt.Errorf("could not create vhost %s: %s", vhost, err)
+	}
+	if err = rabbitMQManagement(ctx, iaasInstance, http.MethodPut, "/api/users/"+url.PathEscape(username), map[string]string{"password": password, "tags": ""}); err != nil {
+		return nil, fmt.Errorf("could not create user %s: %s", username, err)
+	}
+	permissions := map[string]string{"configure": allPermissionRabbitMQ, "write": allPermissionRabbitMQ, "read": allPermissionRabbitMQ}
+	if err = rabbitMQManagement(ctx, iaasInstance, http.MethodPut, "/api/permissions/"+url.PathEscape(vhost)+"/"+url.PathEscape(username), permissions); err != nil {
+		return nil, fmt.Errorf("could not give user %s access to vhost %s: %s", username, vhost, err)
+	}
+	logger.Info("created RabbitMQ user and vhost for binding", "user", username, "vhost", vhost)
+	uri := url.URL{Scheme: "amqps", User: url.UserPassword(username, password), Host: admin.Host, Path: "/" + vhost}
+	return map[string]string{
+		"uri":               uri.String(),
+		"host":              admin.Hostname(),
+		"port":              admin.Port(),
+		"vhost":             vhost,
+		credentialUsername:  username,
+		credentialPassword:  password,
+		db.DetailTLS:        "true",
+		db.DetailConsoleUrl: iaasInstance.ServiceDetails[db.DetailConsoleUrl],
+	}, nil
+}
+
+// DeleteBindingRabbitMQ deletes the user and the vhost (with its queues and exchanges) of the binding, they may be gone already
+func DeleteBindingRabbitMQ(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error {
+	logger := util.Logger(ctx)
+	name := bindingUserName(binding.ServiceBindingId)
+	if err := rabbitMQManagement(ctx, iaasInstance, http.MethodDelete, "/api/users/"+url.PathEscape(name), nil); err != nil {
+		return fmt.Errorf("could not delete user %s: %s", name, err)
+	}
+	if err := rabbitMQManagement(ctx, iaasInstance, http.MethodDelete, "/api/vhosts/"+url.PathEscape(name), nil); err != nil {
+		return fmt.Errorf("could not delete vhost %s: %s", name, err)
+	}
+	logger.Info("deleted RabbitMQ user and vhost of binding", "user", name)
+	return nil
+}
+
+// rabbitMQManagement calls the management API of the broker (on its console url) as the admin user, with body as json. A delete of something that does not exist is no error.
+func rabbitMQManagement(ctx context.Context, iaasInstance db.IaaSInstance, method, path string, body any) error {
+	ctx, span := util.Tracer().Start(ctx, method+" rabbitmq management")
+	defer span.End()
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(iaasInstance.ServiceDetails[db.DetailConsoleUrl], "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		util.RecordError(span, err)
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.SetBasicAuth(iaasInstance.ServiceUser, iaasInstance.ServicePassword)
+	response, err := managementHttpClient.Do(request)
+	if err != nil {
+		util.RecordError(span, err)
+		return err
+	}
+	defer response.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 4*1024))
+	if method == http.MethodDelete && response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err = fmt.Errorf("management API responded with %s: %s", response.Status, message)
+		util.RecordError(span, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	// NumInstancesAuroraDefault is one writer and one reader
+	NumInstancesAuroraDefault = 2
+)
+
+var deleteProtectionAurora = false
+var applyImmediately = true
+
+// SubmitProvisionAurora creates an Aurora cluster, and then its instances spread over the availability zones, the first instance becomes the writer, the others are readers
+func SubmitProvisionAurora(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	retentionDays := spec.Parameters.RetentionDays
+	if retentionDays == 0 {
+		retentionDays = RetentionDaysRDSDefault
+	}
+	numInstances := spec.Parameters.NumDBInstances
+	if numInstances == 0 {
+		numInstances = NumInstancesAuroraDefault
+	}
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	vpcSecGrpIds := []*string{&conf.RDSSecGrpId}
+	iaasInstance.ServiceUser = spec.UserName
+	iaasInstance.ServicePassword = util.SafeSubstring(fmt.Sprintf("pw%s", util.GenerateGUID()), 40)
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	var dbInstanceClass string
+	if plan.IaaS != nil {
+		dbInstanceClass = plan.IaaS.InstanceClass
+	}
+	if dbInstanceClass == "" {
+		return failed(fmt.Sprintf("could not find database instance class for plan %s", plan.Name))
+	}
+	azs, err := subnetGroupAZs(ctx, "rds", conf.RDSSubnetGrp, func(subnetGroup *string) (any, error) {
+		return conf.RDSClient.DescribeDBSubnetGroupsWithContext(ctx, &rds.DescribeDBSubnetGroupsInput{DBSubnetGroupName: subnetGroup})
+	})
+	if err != nil {
+		return failed(err.Error())
+	}
+
+	// first create the cluster (and after we create the instances)
+	if spec.RestoreFromSnapshot != "" {
+		if !clusterSnapshotExistsAndAuthorized(ctx, spec.RestoreFromSnapshot, serviceInstance) {
+			return failed(fmt.Sprintf("cluster snapshot with identifier %s was not found or requestor is not authorized", spec.RestoreFromSnapshot))
+		}
+		_, err = conf.RDSClient.RestoreDBClusterFromSnapshotWithContext(ctx, &rds.RestoreDBClusterFromSnapshotInput{
+			AvailabilityZones:           stringPointers(azs),
+			CopyTagsToSnapshot:          &copyTagsToSnapshot,
+			DBClusterIdentifier:         &iaasInstance.InternalId,
+			DBSubnetGroupName:           &conf.RDSSubnetGrp,
+			DeletionProtection:          &deleteProtectionAurora,
+			EnableCloudwatchLogsExports: stringPointers(spec.Logs),
+			Engine:                      &spec.Engine,
+			SnapshotIdentifier:          &spec.RestoreFromSnapshot,
+			Tags:                        getTagsForServiceInstanceRDS(serviceInstance),
+			VpcSecurityGroupIds:         vpcSecGrpIds,
+		})
+	} else {
+		_, err = conf.RDSClient.CreateDBClusterWithContext(ctx, &rds.CreateDBClusterInput{
+			AvailabilityZones:           stringPointers(azs),
+			BackupRetentionPeriod:       &retentionDays,
+			CopyTagsToSnapshot:          &copyTagsToSnapshot,
+			DBClusterIdentifier:         &iaasInstance.InternalId,
+			DBSubnetGroupName:           &conf.RDSSubnetGrp,
+			DatabaseName:                &spec.DBName,
+			DeletionProtection:          &deleteProtectionAurora,
+			EnableCloudwatchLogsExports: stringPointers(spec.Logs),
+			Engine:                      &spec.Engine,
+			MasterUserPassword:          &iaasInstance.ServicePassword,
+			MasterUsername:              &iaasInstance.ServiceUser,
+			StorageEncrypted:            &storageEncrypted,
+			Tags:                        getTagsForServiceInstanceRDS(serviceInstance),
+			VpcSecurityGroupIds:         vpcSecGrpIds,
+		})
+	}
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create cluster %s: %s", serviceInstance.InstanceName, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	logger.Info("aurora cluster created/restored", "cluster", iaasInstance.InternalId)
+
+	memberAZs, azErr := clusterMemberAZs(iaasInstance.InternalId, func(filterName *string, clusterId *string) (any, error) {
+		return conf.RDSClient.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{Filters: []*rds.Filter{{Name: filterName, Values: []*string{clusterId}}}})
+	})
+	if azErr != nil {
+		logger.Warn("could not get the zones of the cluster members, spreading as if there are none", "error", azErr)
+	}
+	instanceAZs := pickAZs(azs, memberAZs, int(numInstances))
+	var createdInstances []string
+	for ix, instanceIdentifier := range instanceIdentifiers(iaasInstance.InternalId, instanceAZs) {
+		instanceIdentifier := instanceIdentifier
+		az := instanceAZs[ix]
+		logger.Info("creating aurora instance for cluster...", "instance", instanceIdentifier, "availability_zone", az)
+		_, err = conf.RDSClient.CreateDBInstanceWithContext(ctx, &rds.CreateDBInstanceInput{
+			AutoMinorVersionUpgrade: &spec.AutoMinorVersionUpgrade,
+			AvailabilityZone:        &az,
+			DBClusterIdentifier:     &iaasInstance.InternalId,
+			DBInstanceClass:         &dbInstanceClass,
+			DBInstanceIdentifier:    &instanceIdentifier,
+			Engine:                  &spec.Engine,
+			PubliclyAccessible:      &publiclyAccessible,
+			Tags:                    getTagsForServiceInstanceRDS(serviceInstance),
+		})
+		if err != nil {
+			LogAwsError(ctx, err)
+			msg := fmt.Sprintf("could not create instance %s: %s", instanceIdentifier, strings.ReplaceAll(err.Error(), "\n", ""))
+			skipFinalSnapshot := true
+			if cleanupErr := deleteFailedCluster(ctx, iaasInstance.InternalId, createdInstances, func(instanceId *string) error {
+				_, err := conf.RDSClient.DeleteDBInstanceWithContext(ctx, &rds.DeleteDBInstanceInput{DBInstanceIdentifier: instanceId})
+				return err
+			}, func(clusterId *string) error {
+				_, err := conf.RDSClient.DeleteDBClusterWithContext(ctx, &rds.DeleteDBClusterInput{DBClusterIdentifier: clusterId, SkipFinalSnapshot: &skipFinalSnapshot})
+				return err
+			}); cleanupErr != nil {
+				msg = fmt.Sprintf("%s, the cluster is left behind: %s", msg, strings.ReplaceAll(cleanupErr.Error(), "\n", ", "))
+			}
+			return failed(msg)
+		}
+		createdInstances = append(createdInstances, instanceIdentifier)
+	}
+	msg := fmt.Sprintf("Aurora cluster %s with %d instance(s) is being created", iaasInstance.InternalId, numInstances)
+	logger.Info(msg)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusAurora(ctx, iaasInstance)
+	return nil
+}
+
+// UpdateAurora creates a manual snapshot of the cluster (CreateSnapshot), with the tags of the service instance so clusterSnapshotExistsAndAuthorized lets the same org and space restore it
+func UpdateAurora(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, parameters model.Parameters) error {
+	if parameters.CreateSnapshot == "" {
+		return errNoSnapshotRequested
+	}
+	_, err := conf.RDSClient.CreateDBClusterSnapshotWithContext(ctx, &rds.CreateDBClusterSnapshotInput{
+		DBClusterIdentifier:         &iaasInstance.InternalId,
+		DBClusterSnapshotIdentifier: &parameters.CreateSnapshot,
+		Tags:                        getTagsForServiceInstanceRDS(serviceInstance),
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return fmt.Errorf("could not create snapshot %s of aurora cluster %s: %s", parameters.CreateSnapshot, iaasInstance.InternalId, strings.ReplaceAll(err.Error(), "\n", ""))
+	}
+	util.Logger(ctx).Info("creating snapshot of aurora cluster", "snapshot", parameters.CreateSnapshot)
+	return nil
+}
+
+// SubmitDeletionAurora deletes the instances of the Aurora cluster, and then the cluster itself
+func SubmitDeletionAurora(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	logger.Info("deleting aurora cluster...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+
+	var snapshotIdentifier *string
+	if !spec.SkipFinalSnapshot {
+		snapshotIdentifier = &iaasInstance.InternalId
+	}
+	logger.Info("delete parameters", "skipFinalSnapshot", spec.SkipFinalSnapshot)
+
+	describeClusterOutput, err := conf.RDSClient.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{DBClusterIdentifier: &iaasInstance.InternalId})
+	if err != nil {
+		msg := fmt.Sprintf("could not describe cluster %s: %s", iaasInstance.InternalId, err)
+		logger.Error(msg)
+		return errors.New(msg)
+	}
+	for _, member := range describeClusterOutput.DBClusters[0].DBClusterMembers {
+		logger.Info("deleting aurora instance", "instance", *member.DBInstanceIdentifier)
+		_, err = conf.RDSClient.DeleteDBInstanceWithContext(ctx, &rds.DeleteDBInstanceInput{DBInstanceIdentifier: member.DBInstanceIdentifier})
+		if err != nil {
+			LogAwsError(ctx, err)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+			return fmt.Errorf("failed to delete aurora instance %s: %w", *member.DBInstanceIdentifier, err)
+		}
+	}
+
+	logger.Info("starting to delete aurora cluster...")
+	_, err = conf.RDSClient.DeleteDBClusterWithContext(ctx, &rds.DeleteDBClusterInput{DBClusterIdentifier: &iaasInstance.InternalId, FinalDBSnapshotIdentifier: snapshotIdentifier, SkipFinalSnapshot: &spec.SkipFinalSnapshot})
+	if err != nil {
+		LogAwsError(ctx, err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+	}
+	StartPollForStatusAurora(ctx, iaasInstance)
+	return err
+}
+
+func StartPollForStatusAurora(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	startPoller(ctx, serviceInstance, "StartPollForStatusAurora", func(ctx context.Context) bool {
+		output, err := conf.RDSClient.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{DBClusterIdentifier: &iaasInstance.InternalId})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == rds.ErrCodeDBClusterNotFoundFault {
+				// this should only happen when a cluster deletion ended
+				logger.Info("aurora cluster is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("aurora cluster %s is gone", iaasInstance.InternalId))
+				if err = deleteIAMRoleIfExists(ctx, &iaasInstance, &serviceInstance); err != nil {
+					logger.Error("failed to delete the IAM role", "error", err)
+					iaasInstance.LastMessage = fmt.Sprintf("aurora cluster %s successfully deleted, IAM role delete failed (%s)", iaasInstance.InternalId, err)
+					_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+					_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+				}
+			} else {
+				msg := fmt.Sprintf("failed to describe aurora cluster %s: %s", iaasInstance.InternalId, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		}
+		if len(output.DBClusters) == 0 {
+			return false
+		}
+		cluster := output.DBClusters[0]
+		logger.Info("aurora cluster status", "db_status", *cluster.Status)
+		if *cluster.Status != "available" {
+			return false
+		}
+		// the cluster is ready, but its instances may not be
+		for _, member := range cluster.DBClusterMembers {
+			instances, err := conf.RDSClient.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{DBInstanceIdentifier: member.DBInstanceIdentifier})
+			if err != nil {
+				logger.Error("failed describing aurora instance", "instance", *member.DBInstanceIdentifier, "error", err)
+				return false
+			}
+			status := *instances.DBInstances[0].DBInstanceStatus
+			logger.Info("aurora instance status", "instance", *member.DBInstanceIdentifier, "db_status", status)
+			if status != "available" {
+				return false
+			}
+		}
+		if cluster.MasterUsername != nil {
+			// a restored cluster keeps the master user of the snapshot
+			iaasInstance.ServiceUser = *cluster.MasterUsername
+		}
+		var dbName string
+		if cluster.DatabaseName != nil {
+			dbName = *cluster.DatabaseName
+		}
+		schema := schemas[*cluster.Engine]
+		iaasInstance.ServiceUrl = fmt.Sprintf(schema, iaasInstance.ServiceUser, iaasInstance.ServicePassword, *cluster.Endpoint, *cluster.Port, dbName)
+		iaasInstance.ServiceDetails = map[string]string{
+			db.DetailReaderHost: *cluster.ReaderEndpoint,
+			db.DetailReaderUri:  fmt.Sprintf(schema, iaasInstance.ServiceUser, iaasInstance.ServicePassword, *cluster.ReaderEndpoint, *cluster.Port, dbName),
+		}
+		iaasInstance.Status = db.StatusCreateSucceeded
+		iaasInstance.LastStatusUpdate = time.Now()
+		iaasInstance.LastMessage = fmt.Sprintf("aurora cluster %s successfully created", iaasInstance.InternalId)
+		_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+		_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+		// a cluster restored from a snapshot has the master password of the snapshot, so (re)set it for all clusters
+		if _, err = conf.RDSClient.ModifyDBClusterWithContext(ctx, &rds.ModifyDBClusterInput{DBClusterIdentifier: cluster.DBClusterIdentifier, MasterUserPassword: &iaasInstance.ServicePassword, ApplyImmediately: &applyImmediately}); err != nil {
+			logger.Error("failed to modify master password for aurora cluster", "error", err)
+		}
+		if err = createIAMRoleIfNotExists(ctx, &iaasInstance, &serviceInstance); err != nil {
+			logger.Error("failed to create the IAM role", "error", err)
+			iaasInstance.LastMessage = fmt.Sprintf("aurora cluster %s successfully created, IAM role creation failed (%s)", iaasInstance.InternalId, err)
+			_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+			_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+		}
+		return true
+	})
+}
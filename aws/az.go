@@ -0,0 +1,152 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/util"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subnetGroupAZsTTL is how long the availability zones of a DB subnet group are cached
+const subnetGroupAZsTTL = time.Hour
+
+type cachedAZs struct {
+	azs     []string
+	fetched time.Time
+}
+
+var (
+	subnetGroupAZsMutex sync.Mutex
+	subnetGroupAZsCache = make(map[string]cachedAZs)
+	// azRotation makes clusters that have no members yet start in different zones
+	azRotation atomic.Uint32
+)
+
+// the (jmespath) paths to the zones in the outputs of the describe calls, DB subnet groups are the same for RDS, DocumentDB and Neptune
+const (
+	subnetGroupAZsPath   = "DBSubnetGroups[].Subnets[].SubnetAvailabilityZone.Name || CacheSubnetGroups[].Subnets[].SubnetAvailabilityZone.Name"
+	clusterMemberAZsPath = "DBInstances[].AvailabilityZone"
+	clusterIdFilter      = "db-cluster-id"
+)
+
+// subnetGroupAZs returns the configured availability zones (aws.availability_zones), or else the distinct zones of the subnets of the subnet group of the service.
+// describe is the DescribeDBSubnetGroups (or DescribeCacheSubnetGroups) call of the service, the zones are cached per service and subnet group.
+func subnetGroupAZs(ctx context.Context, service string, subnetGroup string, describe func(subnetGroup *string) (any, error)) ([]string, error) {
+	if azs := conf.Get().AWS.AvailabilityZones; len(azs) > 0 {
+		return azs, nil
+	}
+	key := service + "/" + subnetGroup
+	subnetGroupAZsMutex.Lock()
+	cached, found := subnetGroupAZsCache[key]
+	subnetGroupAZsMutex.Unlock()
+	if found && time.Since(cached.fetched) < subnetGroupAZsTTL {
+		return cached.azs, nil
+	}
+	// the lock is not held during the AWS call, concurrent misses both describe the subnet group and store the same zones
+	output, err := describe(&subnetGroup)
+	if err != nil {
+		return nil, fmt.Errorf("could not describe subnet group %s: %w", key, err)
+	}
+	names, err := zonesAt(output, subnetGroupAZsPath)
+	if err != nil {
+		return nil, err
+	}
+	var azs []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			azs = append(azs, name)
+		}
+	}
+	if len(azs) == 0 {
+		return nil, fmt.Errorf("subnet group %s has no subnets", key)
+	}
+	sort.Strings(azs)
+	util.Logger(ctx).Info("discovered availability zones", "subnet_group", key, "azs", azs)
+	subnetGroupAZsMutex.Lock()
+	subnetGroupAZsCache[key] = cachedAZs{azs: azs, fetched: time.Now()}
+	subnetGroupAZsMutex.Unlock()
+	return azs, nil
+}
+
+// clusterMemberAZs returns the availability zones of the current instances of a cluster, one entry per instance.
+// describe is the DescribeDBInstances call of the service, with a filter on the cluster id.
+func clusterMemberAZs(clusterId string, describe func(filterName *string, clusterId *string) (any, error)) ([]string, error) {
+	filterName := clusterIdFilter
+	output, err := describe(&filterName, &clusterId)
+	if err != nil {
+		return nil, fmt.Errorf("could not describe the instances of cluster %s: %w", clusterId, err)
+	}
+	return zonesAt(output, clusterMemberAZsPath)
+}
+
+// zonesAt returns the zone names at path in the output of an AWS call, skipping the unset ones
+func zonesAt(output any, path string) ([]string, error) {
+	values, err := awsutil.ValuesAtPath(output, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the zones from %T: %w", output, err)
+	}
+	var zones []string
+	for _, value := range values {
+		if name, isString := value.(*string); isString && name != nil {
+			zones = append(zones, *name)
+		}
+	}
+	return zones, nil
+}
+
+// pickAZs returns the zones for count new instances, every instance goes to the zone with the least instances (counting memberAZs, the zones of the current members), so instances land in distinct zones as long as there are enough zones.
+// It does not share state except for the rotation of the starting zone, so it is safe to call concurrently.
+func pickAZs(azs []string, memberAZs []string, count int) []string {
+	if len(azs) == 0 {
+		return nil
+	}
+	used := make(map[string]int)
+	for _, az := range memberAZs {
+		used[az]++
+	}
+	offset := int(azRotation.Add(1))
+	var picked []string
+	for i := 0; i < count; i++ {
+		best := ""
+		for j := range azs {
+			az := azs[(offset+j)%len(azs)]
+			if best == "" || used[az] < used[best] {
+				best = az
+			}
+		}
+		used[best]++
+		picked = append(picked, best)
+	}
+	return picked
+}
+
+// instanceIdentifiers returns the identifiers for the cluster instances in the given zones, named after their zone (with a sequence number when a zone has more than one instance)
+func instanceIdentifiers(clusterId string, azs []string) []string {
+	var identifiers []string
+	used := make(map[string]bool)
+	for ix, az := range azs {
+		identifier := fmt.Sprintf("%s-%s", clusterId, az)
+		if used[identifier] {
+			identifier = fmt.Sprintf("%s-%s-%d", clusterId, az, ix)
+		}
+		used[identifier] = true
+		identifiers = append(identifiers, identifier)
+	}
+	return identifiers
+}
+
+// stringPointers returns the strings in the form the AWS SDK wants them
+func stringPointers(values []string) []*string {
+	var pointers []*string
+	for i := range values {
+		pointers = append(pointers, &values[i])
+	}
+	return pointers
+}
@@ -0,0 +1,148 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db/dbtest"
+)
+
+func TestMain(m *testing.M) {
+	dbtest.Configure()
+	os.Exit(m.Run())
+}
+
+func TestPickAZs(t *testing.T) {
+	tests := []struct {
+		name      string
+		azs       []string
+		memberAZs []string
+		count     int
+		expected  []string // sorted, the starting zone rotates
+	}{
+		{name: "no zones", count: 2},
+		{name: "distinct zones", azs: []string{"a", "b", "c"}, count: 3, expected: []string{"a", "b", "c"}},
+		{name: "more instances than zones", azs: []string{"a", "b"}, count: 4, expected: []string{"a", "a", "b", "b"}},
+		{name: "the zones of the members count", azs: []string{"a", "b", "c"}, memberAZs: []string{"a", "a", "b"}, count: 1, expected: []string{"c"}},
+		{name: "the members fill the zones", azs: []string{"a", "b", "c"}, memberAZs: []string{"a"}, count: 2, expected: []string{"b", "c"}},
+		{name: "members outside the zones", azs: []string{"a", "b"}, memberAZs: []string{"x", "y"}, count: 2, expected: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the rotation must not matter, so pick a few times
+			for i := 0; i < len(tt.azs)+1; i++ {
+				picked := pickAZs(tt.azs, tt.memberAZs, tt.count)
+				sort.Strings(picked)
+				if !reflect.DeepEqual(picked, tt.expected) {
+					t.Errorf("picked %v, expected %v", picked, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceIdentifiers(t *testing.T) {
+	tests := []struct {
+		azs      []string
+		expected []string
+	}{
+		{azs: nil, expected: nil},
+		{azs: []string{"eu-west-1a", "eu-west-1b"}, expected: []string{"cluster-eu-west-1a", "cluster-eu-west-1b"}},
+		{azs: []string{"eu-west-1a", "eu-west-1b", "eu-west-1a"}, expected: []string{"cluster-eu-west-1a", "cluster-eu-west-1b", "cluster-eu-west-1a-2"}},
+	}
+	for _, tt := range tests {
+		if identifiers := instanceIdentifiers("cluster", tt.azs); !reflect.DeepEqual(identifiers, tt.expected) {
+			t.Errorf("the identifiers for %v are %v, expected %v", tt.azs, identifiers, tt.expected)
+		}
+	}
+}
+
+// subnetGroupsXML is the DescribeDBSubnetGroups response for a subnet group with subnets in the given zones
+func subnetGroupsXML(action string, group string, azs ...string) string {
+	var subnets strings.Builder
+	for _, az := range azs {
+		fmt.Fprintf(&subnets, "<Subnet><SubnetIdentifier>subnet-%s</SubnetIdentifier><SubnetAvailabilityZone><Name>%s</Name></SubnetAvailabilityZone></Subnet>", az, az)
+	}
+	// a subnet without a zone is skipped
+	subnets.WriteString("<Subnet><SubnetIdentifier>subnet-unknown</SubnetIdentifier></Subnet>")
+	return fmt.Sprintf("<%[1]sResponse><%[1]sResult><%[2]ss><%[2]s><Subnets>%[3]s</Subnets></%[2]s></%[2]ss></%[1]sResult></%[1]sResponse>", action, group, subnets.String())
+}
+
+func TestSubnetGroupAZs(t *testing.T) {
+	sess, fake := newFakeAWS(t, func(w http.ResponseWriter, call awsCall) {
+		switch {
+		case strings.Contains(call.Body, "missing"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>DBSubnetGroupNotFoundFault</Code><Message>no such group</Message></Error></ErrorResponse>`)
+		case strings.Contains(call.Body, "empty"):
+			_, _ = fmt.Fprint(w, subnetGroupsXML(call.Action, "DBSubnetGroup"))
+		case call.Action == "DescribeCacheSubnetGroups":
+			_, _ = fmt.Fprint(w, subnetGroupsXML(call.Action, "CacheSubnetGroup", "eu-west-1c", "eu-west-1a"))
+		default:
+			_, _ = fmt.Fprint(w, subnetGroupsXML(call.Action, "DBSubnetGroup", "eu-west-1b", "eu-west-1a", "eu-west-1b"))
+		}
+	})
+	rdsClient, elastiCacheClient := rds.New(sess), elasticache.New(sess)
+	describeRDS := func(subnetGroup *string) (any, error) {
+		return rdsClient.DescribeDBSubnetGroupsWithContext(context.Background(), &rds.DescribeDBSubnetGroupsInput{DBSubnetGroupName: subnetGroup})
+	}
+	describeElastiCache := func(subnetGroup *string) (any, error) {
+		return elastiCacheClient.DescribeCacheSubnetGroupsWithContext(context.Background(), &elasticache.DescribeCacheSubnetGroupsInput{CacheSubnetGroupName: subnetGroup})
+	}
+
+	azs, err := subnetGroupAZs(context.Background(), "rds", "test-rds", describeRDS)
+	if err != nil || !reflect.DeepEqual(azs, []string{"eu-west-1a", "eu-west-1b"}) {
+		t.Errorf("the zones of the DB subnet group are %v (error %v), expected the distinct sorted zones", azs, err)
+	}
+	azs, err = subnetGroupAZs(context.Background(), "elasticache", "test-elasticache", describeElastiCache)
+	if err != nil || !reflect.DeepEqual(azs, []string{"eu-west-1a", "eu-west-1c"}) {
+		t.Errorf("the zones of the cache subnet group are %v (error %v), expected the distinct sorted zones", azs, err)
+	}
+	if _, err = subnetGroupAZs(context.Background(), "rds", "test-rds", describeRDS); err != nil || len(fake.Actions()) != 2 {
+		t.Errorf("the zones should be cached, the calls were %v (error %v)", fake.Actions(), err)
+	}
+	if _, err = subnetGroupAZs(context.Background(), "rds", "missing", describeRDS); err == nil || !strings.Contains(err.Error(), "could not describe subnet group rds/missing") {
+		t.Errorf("a failed describe should fail, got %v", err)
+	}
+	if _, err = subnetGroupAZs(context.Background(), "rds", "empty", describeRDS); err == nil || err.Error() != "subnet group rds/empty has no subnets" {
+		t.Errorf("a subnet group without subnets should fail, got %v", err)
+	}
+
+	config := *conf.Get()
+	config.AWS.AvailabilityZones = []string{"eu-west-1z"}
+	conf.ApplyReloadedConfig(&config)
+	defer dbtest.Configure()
+	calls := len(fake.Actions())
+	if azs, err = subnetGroupAZs(context.Background(), "rds", "configured", describeRDS); err != nil || !reflect.DeepEqual(azs, []string{"eu-west-1z"}) || len(fake.Actions()) != calls {
+		t.Errorf("the configured zones should be used without describing the subnet group, got %v (error %v)", azs, err)
+	}
+}
+
+func TestClusterMemberAZs(t *testing.T) {
+	sess, fake := newFakeAWS(t, func(w http.ResponseWriter, call awsCall) {
+		_, _ = fmt.Fprint(w, `<DescribeDBInstancesResponse><DescribeDBInstancesResult><DBInstances>`+
+			`<DBInstance><DBInstanceIdentifier>cluster-a</DBInstanceIdentifier><AvailabilityZone>eu-west-1a</AvailabilityZone></DBInstance>`+
+			`<DBInstance><DBInstanceIdentifier>cluster-a-2</DBInstanceIdentifier><AvailabilityZone>eu-west-1a</AvailabilityZone></DBInstance>`+
+			`<DBInstance><DBInstanceIdentifier>cluster-creating</DBInstanceIdentifier></DBInstance>`+
+			`</DBInstances></DescribeDBInstancesResult></DescribeDBInstancesResponse>`)
+	})
+	client := rds.New(sess)
+	azs, err := clusterMemberAZs("cluster", func(filterName *string, clusterId *string) (any, error) {
+		return client.DescribeDBInstancesWithContext(context.Background(), &rds.DescribeDBInstancesInput{Filters: []*rds.Filter{{Name: filterName, Values: []*string{clusterId}}}})
+	})
+	if err != nil || !reflect.DeepEqual(azs, []string{"eu-west-1a", "eu-west-1a"}) {
+		t.Errorf("the member zones are %v (error %v), expected one entry per instance with a zone", azs, err)
+	}
+	if call, _ := fake.Call("DescribeDBInstances"); !strings.Contains(call.Body, "Filters.Filter.1.Name=db-cluster-id") || !strings.Contains(call.Body, "Filters.Filter.1.Values.Value.1=cluster") {
+		t.Errorf("the instances should be filtered on the cluster id, the request was %s", call.Body)
+	}
+}
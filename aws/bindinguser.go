@@ -0,0 +1,112 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	// the IAM users of the bindings are created with this path, so they can be told apart from other users
+	bindingUserPath   = "/mfsb/"
+	bindingPolicyName = "mfsb-binding-access"
+)
+
+// the keys of the binding credentials every binding user gets
+const (
+	credentialRegion          = "region"
+	credentialAccessKeyId     = "access_key_id"
+	credentialSecretAccessKey = "secret_access_key"
+)
+
+// bindingUserName returns the name of the IAM user of the binding
+func bindingUserName(bindingId string) string {
+	return "mfsb-" + bindingId
+}
+
+// createBindingUser creates an IAM user for the binding with the (inline) policy and an access key, it returns the region and the access key as binding credentials.
+// With a permissionsBoundary (an ARN) the user can never do more than the boundary allows, whatever the policy says.
+func createBindingUser(ctx context.Context, serviceInstance db.ServiceInstance, bindingId string, policyDoc string, permissionsBoundary string) (map[string]string, error) {
+	logger := util.Logger(ctx)
+	userName := bindingUserName(bindingId)
+	path := bindingUserPath
+	createUserInput := &iam.CreateUserInput{UserName: &userName, Path: &path, Tags: GetIAMTagsForServiceInstance(serviceInstance)}
+	if permissionsBoundary != "" {
+		createUserInput.PermissionsBoundary = &permissionsBoundary
+	}
+	_, err := conf.IAMClient.CreateUserWithContext(ctx, createUserInput)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeEntityAlreadyExistsException {
+		// a retry of a binding that failed halfway, its access keys were never handed out
+		logger.Info("IAM user already exists, replacing its access keys", "user", userName)
+		err = deleteAccessKeys(ctx, userName)
+	}
+	if err != nil {
+		LogAwsError(ctx, err)
+		return nil, fmt.Errorf("could not create IAM user %s: %w", userName, err)
+	}
+	policyName := bindingPolicyName
+	if _, err = conf.IAMClient.PutUserPolicyWithContext(ctx, &iam.PutUserPolicyInput{UserName: &userName, PolicyName: &policyName, PolicyDocument: &policyDoc}); err != nil {
+		LogAwsError(ctx, err)
+		return nil, fmt.Errorf("could not put the access policy on IAM user %s: %w", userName, err)
+	}
+	output, err := conf.IAMClient.CreateAccessKeyWithContext(ctx, &iam.CreateAccessKeyInput{UserName: &userName})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return nil, fmt.Errorf("could not create an access key for IAM user %s: %w", userName, err)
+	}
+	logger.Info("created IAM user for binding", "user", userName)
+	return map[string]string{
+		credentialRegion:          conf.AWSRegion,
+		credentialAccessKeyId:     *output.AccessKey.AccessKeyId,
+		credentialSecretAccessKey: *output.AccessKey.SecretAccessKey,
+	}, nil
+}
+
+// deleteBindingUser deletes the IAM user of the binding, with its access keys and policy, a user that is already gone is no error
+func deleteBindingUser(ctx context.Context, bindingId string) error {
+	userName := bindingUserName(bindingId)
+	policyName := bindingPolicyName
+	if err := deleteAccessKeys(ctx, userName); err != nil {
+		LogAwsError(ctx, err)
+		return fmt.Errorf("could not delete the access keys of IAM user %s: %w", userName, err)
+	}
+	if _, err := conf.IAMClient.DeleteUserPolicyWithContext(ctx, &iam.DeleteUserPolicyInput{UserName: &userName, PolicyName: &policyName}); err != nil && !isNoSuchEntity(err) {
+		LogAwsError(ctx, err)
+		return fmt.Errorf("could not delete the access policy of IAM user %s: %w", userName, err)
+	}
+	if _, err := conf.IAMClient.DeleteUserWithContext(ctx, &iam.DeleteUserInput{UserName: &userName}); err != nil && !isNoSuchEntity(err) {
+		LogAwsError(ctx, err)
+		return fmt.Errorf("could not delete IAM user %s: %w", userName, err)
+	}
+	util.Logger(ctx).Info("deleted IAM user of binding", "user", userName)
+	return nil
+}
+
+// deleteAccessKeys deletes all access keys of the IAM user, a user that does not exist has no keys
+func deleteAccessKeys(ctx context.Context, userName string) error {
+	output, err := conf.IAMClient.ListAccessKeysWithContext(ctx, &iam.ListAccessKeysInput{UserName: &userName})
+	if err != nil {
+		if isNoSuchEntity(err) {
+			return nil
+		}
+		return err
+	}
+	for _, key := range output.AccessKeyMetadata {
+		if _, err = conf.IAMClient.DeleteAccessKeyWithContext(ctx, &iam.DeleteAccessKeyInput{UserName: &userName, AccessKeyId: key.AccessKeyId}); err != nil && !isNoSuchEntity(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func isNoSuchEntity(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == iam.ErrCodeNoSuchEntityException
+}
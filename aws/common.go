@@ -1,17 +1,18 @@
 package aws
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/iam"
-	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/rabobank/mfsb/conf"
 	"github.com/rabobank/mfsb/db"
 	"github.com/rabobank/mfsb/model"
 	"github.com/rabobank/mfsb/util"
 	"strings"
+	"time"
 )
 
 const (
@@ -22,188 +23,352 @@ const (
 
 // fixed values
 var schemas = make(map[string]string)
-var auditLog = "audit"
-var docdbLogs = []*string{&auditLog}
-var errorLog = "error"
-var postgresqlLog = "postgresql"
+
+const (
+	auditLog      = "audit"
+	errorLog      = "error"
+	postgresqlLog = "postgresql"
+)
 
 func init() {
 	schemas["mysql"] = "mysql://%[1]s:%[2]s@%[3]s:%[4]d/%[5]s"
 	schemas["postgres"] = "postgresql://%[1]s:%[2]s@%[3]s:%[4]d/%[5]s"
 	schemas["mariadb"] = "mariadb://%[1]s:%[2]s@%[3]s:%[4]d/%[5]s"
+	schemas["aurora-mysql"] = "mysql://%[1]s:%[2]s@%[3]s:%[4]d/%[5]s"
+	schemas["aurora-postgresql"] = "postgresql://%[1]s:%[2]s@%[3]s:%[4]d/%[5]s"
 	schemas["docdb"] = "mongodb://%[1]s:%[2]s@%[3]s:%[4]d/"
+	schemas[RedisEngine] = "rediss://%[1]s:%[2]s@%[3]s:%[4]d/"
+	schemas[OpenSearchEngine] = "https://%[1]s:%[2]s@%[3]s:%[4]d/"
+	schemas[RabbitMQEngine] = "amqps://%[1]s:%[2]s@%[3]s:%[4]d/"
 	//schemas["docdb"] = "mongodb://%[1]s:%[2]s@%[3]s:%[4]d/?%[5]s"
 	// mongodb://docdbadmin:<insertYourPassword>@docdb-2021-05-18-15-51-41.cluster-ced1datu3hwp.eu-west-1.docdb.amazonaws.com:27017/?ssl=true&ssl_ca_certs=rds-combined-ca-bundle.pem&replicaSet=rs0&readPreference=secondaryPreferred&retryWrites=false
 }
 
-func SubmitProvisioning(iaasInstanceId int64) error {
-	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(conf.CfEnv, iaasInstanceId)
+// provider creates, deletes and polls the IaaS instances of a service. Services that create credentials per binding (instead of sharing the credentials of the IaaS instance) also have createBinding and deleteBinding.
+type provider struct {
+	submitProvision func(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error
+	submitDeletion  func(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error
+	startPoll       func(ctx context.Context, iaasInstance db.IaaSInstance)
+	createBinding   func(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error)
+	deleteBinding   func(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error
+	// update applies the parameters of cf update-service, it is nil if the service can not be updated
+	update func(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, parameters model.Parameters) error
+}
+
+// providerFor returns the provider of the service, the services of the test catalog (with a -test suffix) have the same provider
+func providerFor(serviceName string) (provider, bool) {
+	switch {
+	case strings.HasPrefix(serviceName, "rds-service"):
+		return provider{submitProvision: SubmitProvisionRDSDB, submitDeletion: SubmitDeletionRDSDB, startPoll: StartPollForStatusRDSDB, update: UpdateRDSDB}, true
+	case strings.HasPrefix(serviceName, "documentdb-service"):
+		return provider{submitProvision: SubmitProvisionDOCDB, submitDeletion: SubmitDeletionDOCDB, startPoll: StartPollForStatusDOCDB, update: UpdateDOCDB}, true
+	case strings.HasPrefix(serviceName, "aurora-service"):
+		return provider{submitProvision: SubmitProvisionAurora, submitDeletion: SubmitDeletionAurora, startPoll: StartPollForStatusAurora, update: UpdateAurora}, true
+	case strings.HasPrefix(serviceName, "elasticache-redis"):
+		return provider{submitProvision: SubmitProvisionRedis, submitDeletion: SubmitDeletionRedis, startPoll: StartPollForStatusRedis}, true
+	case strings.HasPrefix(serviceName, "opensearch-service"):
+		return provider{submitProvision: SubmitProvisionOpenSearch, submitDeletion: SubmitDeletionOpenSearch, startPoll: StartPollForStatusOpenSearch}, true
+	case strings.HasPrefix(serviceName, "msk-service"):
+		return provider{submitProvision: SubmitProvisionMSK, submitDeletion: SubmitDeletionMSK, startPoll: StartPollForStatusMSK, createBinding: CreateBindingMSK, deleteBinding: DeleteBindingMSK}, true
+	case strings.HasPrefix(serviceName, "s3-service"):
+		return provider{submitProvision: SubmitProvisionS3, submitDeletion: SubmitDeletionS3, startPoll: StartPollForStatusS3, createBinding: CreateBindingS3, deleteBinding: DeleteBindingS3}, true
+	case strings.HasPrefix(serviceName, "sqs-service"):
+		return provider{submitProvision: SubmitProvisionSQS, submitDeletion: SubmitDeletionSQS, startPoll: StartPollForStatusSQS, createBinding: CreateBindingSQS, deleteBinding: DeleteBindingSQS}, true
+	case strings.HasPrefix(serviceName, "neptune-service"):
+		return provider{submitProvision: SubmitProvisionNeptune, submitDeletion: SubmitDeletionNeptune, startPoll: StartPollForStatusNeptune, createBinding: CreateBindingNeptune, deleteBinding: DeleteBindingNeptune}, true
+	case strings.HasPrefix(serviceName, "amazonmq-service"):
+		return provider{submitProvision: SubmitProvisionRabbitMQ, submitDeletion: SubmitDeletionRabbitMQ, startPoll: StartPollForStatusRabbitMQ, createBinding: CreateBindingRabbitMQ, deleteBinding: DeleteBindingRabbitMQ}, true
+	case strings.HasPrefix(serviceName, "dynamodb-service"):
+		return provider{submitProvision: SubmitProvisionDynamoDB, submitDeletion: SubmitDeletionDynamoDB, startPoll: StartPollForStatusDynamoDB, createBinding: CreateBindingDynamoDB, deleteBinding: DeleteBindingDynamoDB}, true
+	case strings.HasPrefix(serviceName, "secretsmanager-service"):
+		return provider{submitProvision: SubmitProvisionSecret, submitDeletion: SubmitDeletionSecret, startPoll: StartPollForStatusSecret, createBinding: CreateBindingSecret, deleteBinding: DeleteBindingSecret, update: UpdateSecret}, true
+	}
+	return provider{}, false
+}
+
+// IsSupportedService tells if the broker can provision the service
+func IsSupportedService(serviceName string) bool {
+	_, found := providerFor(serviceName)
+	return found
+}
+
+// SubmitProvisioning creates the IaaS instance of the service instance.
+// The dispatchers (SubmitProvisioning, SubmitDeletion and SubmitUpdate) detach ctx from the request, the AWS submission should not be aborted when the cloud controller drops the request.
+func SubmitProvisioning(ctx context.Context, iaasInstanceId int64) error {
+	ctx = context.WithoutCancel(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstanceId)
 	serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
-	iaasInstance := db.GetIaaSInstances(iaasInstanceId)[0]
-	if strings.HasPrefix(serviceName, "rds-service") {
-		return SubmitProvisionRDSDB(iaasInstance, serviceInstance)
+	iaasInstance := db.GetIaaSInstances(ctx, iaasInstanceId)[0]
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	if p, found := providerFor(serviceName); found {
+		return p.submitProvision(ctx, iaasInstance, serviceInstance)
 	}
-	if strings.HasPrefix(serviceName, "documentdb-service") {
-		return SubmitProvisionDOCDB(iaasInstance, serviceInstance)
+	return errors.New(fmt.Sprintf("service %s is not supported", serviceName))
+}
+
+// SubmitDeletion deletes the IaaS instance of the service instance
+func SubmitDeletion(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	ctx = context.WithoutCancel(ctx)
+	serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
+	if p, found := providerFor(serviceName); found {
+		return p.submitDeletion(ctx, iaasInstance, serviceInstance)
 	}
 	return errors.New(fmt.Sprintf("service %s is not supported", serviceName))
 }
 
-func StartPollForStatus(iaasInstanceId int64) {
-	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(conf.CfEnv, iaasInstanceId)
+// SubmitUpdate applies the update parameters to the IaaS instance of the service instance
+func SubmitUpdate(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, parameters model.Parameters) error {
+	ctx = context.WithoutCancel(ctx)
 	serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
-	iaasInstance := db.GetIaaSInstances(iaasInstanceId)[0]
-	if strings.HasPrefix(serviceName, "rds-service") {
-		StartPollForStatusRDSDB(iaasInstance)
-		return
+	p, found := providerFor(serviceName)
+	if !found || p.update == nil {
+		return fmt.Errorf("service %s can not be updated", serviceName)
+	}
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	return p.update(ctx, iaasInstance, serviceInstance, parameters)
+}
+
+// CreateBindingCredentials creates the credentials for a new binding of the service instance, it returns nil if the service has no credentials per binding (the binding gets the credentials of the IaaS instance)
+func CreateBindingCredentials(ctx context.Context, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error) {
+	serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
+	p, found := providerFor(serviceName)
+	if !found || p.createBinding == nil {
+		return nil, nil
+	}
+	iaasInstance := db.GetIaaSInstances(ctx, serviceInstance.IaaSInstanceId)[0]
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	return p.createBinding(ctx, iaasInstance, serviceInstance, bindingId, parameters)
+}
+
+// DeleteBindingCredentials deletes the credentials that were created for the binding (if any)
+func DeleteBindingCredentials(ctx context.Context, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error {
+	serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
+	p, found := providerFor(serviceName)
+	if !found || p.deleteBinding == nil || binding.Credentials == nil {
+		return nil
 	}
-	if strings.HasPrefix(serviceName, "documentdb-service") {
-		StartPollForStatusDOCDB(iaasInstance)
+	iaasInstance := db.GetIaaSInstances(ctx, serviceInstance.IaaSInstanceId)[0]
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	return p.deleteBinding(ctx, iaasInstance, serviceInstance, binding)
+}
+
+func StartPollForStatus(ctx context.Context, iaasInstanceId int64) {
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstanceId)
+	serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
+	iaasInstance := db.GetIaaSInstances(ctx, iaasInstanceId)[0]
+	if p, found := providerFor(serviceName); found {
+		p.startPoll(ctx, iaasInstance)
 		return
 	}
-	fmt.Printf("no polling available for service %s", serviceName)
+	util.Logger(ctx).Warn("no polling available for service", "service", serviceName)
 }
 
-// UpdateInProgressStatus When a database creation or deletion is in progress and mfsb is restarted, then the goroutine(s) that update the status are no longer running, that's why we start it here.
-func UpdateInProgressStatus() {
-	serviceInstances := db.GetServiceInstances(0)
-	for _, serviceInstance := range serviceInstances {
-		if serviceInstance.Status == db.StatusInProgress && serviceInstance.Env == conf.CfEnv {
-			serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
-			if strings.HasPrefix(serviceName, "rds-service") {
-				StartPollForStatusRDSDB(db.GetIaaSInstances(serviceInstance.IaaSInstanceId)[0])
-			} else if strings.HasPrefix(serviceName, "documentdb-service") {
-				StartPollForStatusDOCDB(db.GetIaaSInstances(serviceInstance.IaaSInstanceId)[0])
-			} else {
-				fmt.Printf("service %s is not supported\n", serviceName)
-			}
-		}
+// UpdateInProgressStatus When a database creation or deletion is in progress and mfsb is restarted (or the broker instance that polled it was stopped), then the goroutine(s) that update the status are no longer running, that's why we (re)start them here.
+func UpdateInProgressStatus(ctx context.Context) {
+	for _, serviceInstance := range db.GetOrphanedServiceInstances(ctx, conf.CfEnv, pollerStaleAfter) {
+		instanceCtx := util.WithLogAttrs(ctx, "instance_guid", serviceInstance.InstanceId)
+		util.Logger(instanceCtx).Info("taking over the poller for service instance")
+		StartPollForStatus(instanceCtx, serviceInstance.IaaSInstanceId)
 	}
 }
 
-func LogAwsError(err error) {
+// LogAwsError logs the AWS error code and the AWS request id (if available), so the error can be correlated with the AWS side (CloudTrail, support cases)
+func LogAwsError(ctx context.Context, err error) {
+	logger := util.Logger(ctx)
 	if aerr, ok := err.(awserr.Error); ok {
-		switch aerr.Code() {
-		case rds.ErrCodeDBInstanceAlreadyExistsFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeDBInstanceAlreadyExistsFault, aerr.Error())
-		case rds.ErrCodeInsufficientDBInstanceCapacityFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeInsufficientDBInstanceCapacityFault, aerr.Error())
-		case rds.ErrCodeDBParameterGroupNotFoundFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeDBParameterGroupNotFoundFault, aerr.Error())
-		case rds.ErrCodeDBSecurityGroupNotFoundFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeDBSecurityGroupNotFoundFault, aerr.Error())
-		case rds.ErrCodeInstanceQuotaExceededFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeInstanceQuotaExceededFault, aerr.Error())
-		case rds.ErrCodeStorageQuotaExceededFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeStorageQuotaExceededFault, aerr.Error())
-		case rds.ErrCodeDBSubnetGroupNotFoundFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeDBSubnetGroupNotFoundFault, aerr.Error())
-		case rds.ErrCodeDBSubnetGroupDoesNotCoverEnoughAZs:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeDBSubnetGroupDoesNotCoverEnoughAZs, aerr.Error())
-		case rds.ErrCodeInvalidDBClusterStateFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeInvalidDBClusterStateFault, aerr.Error())
-		case rds.ErrCodeInvalidSubnet:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeInvalidSubnet, aerr.Error())
-		case rds.ErrCodeInvalidVPCNetworkStateFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeInvalidVPCNetworkStateFault, aerr.Error())
-		case rds.ErrCodeProvisionedIopsNotAvailableInAZFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeProvisionedIopsNotAvailableInAZFault, aerr.Error())
-		case rds.ErrCodeOptionGroupNotFoundFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeOptionGroupNotFoundFault, aerr.Error())
-		case rds.ErrCodeDBClusterNotFoundFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeDBClusterNotFoundFault, aerr.Error())
-		case rds.ErrCodeStorageTypeNotSupportedFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeStorageTypeNotSupportedFault, aerr.Error())
-		case rds.ErrCodeAuthorizationNotFoundFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeAuthorizationNotFoundFault, aerr.Error())
-		case rds.ErrCodeKMSKeyNotAccessibleFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeKMSKeyNotAccessibleFault, aerr.Error())
-		case rds.ErrCodeDomainNotFoundFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeDomainNotFoundFault, aerr.Error())
-		case rds.ErrCodeBackupPolicyNotFoundFault:
-			fmt.Printf("AWS error code: %s, error: %s\n", rds.ErrCodeBackupPolicyNotFoundFault, aerr.Error())
-		default:
-			fmt.Printf("AWS error of unknown code, error: %s\n", aerr.Error())
+		args := []any{"code", aerr.Code(), "error", aerr.Message()}
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			args = append(args, "aws_request_id", reqErr.RequestID(), "status_code", reqErr.StatusCode())
 		}
+		logger.Error("AWS error", args...)
 	} else {
-		// Print the error, cast err to awserr.Error to get the Code and
-		// Message from an error.
-		fmt.Printf("AWS error of unknown code, error: %s\n", aerr.Error())
+		logger.Error("AWS error of unknown code", "error", err)
 	}
 }
 
-// go over the given parameters and override the default values
-func processParameters(serviceInstance db.ServiceInstance) (string, model.Parameters, error) {
-	var parameters model.Parameters
-	err := json.Unmarshal([]byte(serviceInstance.Parameters), &parameters)
-	userName := UserNameDefault
-	if err == nil {
-		// RDS parameters
-		allocatedStorageGB = AllocatedStorageGBDefault
-		if parameters.AllocatedStorageGB != 0 {
-			allocatedStorageGB = parameters.AllocatedStorageGB
-			fmt.Printf("parameter override for AllocatedStorageGB:%d\n", allocatedStorageGB)
-		}
-		engine = EngineDefault
-		logs = nil
-		if parameters.Engine != "" {
-			engine = parameters.Engine
-			fmt.Printf("parameter override for Engine:%s\n", engine)
-			switch engine {
-			case "postgres":
-				logs = append(logs, &postgresqlLog)
-				userName = "postgres"
-			default:
-				logs = append(logs, &errorLog, &auditLog)
-			}
-		}
-		dbName = DBNameDefault
-		if parameters.DBName != "" {
-			dbName = parameters.DBName
-			fmt.Printf("parameter override for DBName:%s\n", dbName)
+// deleteFailedCluster deletes the instances that were created for a cluster of which the create failed, and then the cluster itself (without a final snapshot), so the failed create leaves nothing running.
+// It returns the errors of the deletes, what could not be deleted has to be deleted by hand.
+func deleteFailedCluster(ctx context.Context, clusterId string, instanceIds []string, deleteInstance func(instanceId *string) error, deleteCluster func(clusterId *string) error) error {
+	logger := util.Logger(ctx)
+	var errs []error
+	for _, instanceId := range instanceIds {
+		instanceId := instanceId
+		logger.Info("deleting instance of the failed cluster", "instance", instanceId)
+		if err := deleteInstance(&instanceId); err != nil {
+			LogAwsError(ctx, err)
+			errs = append(errs, fmt.Errorf("could not delete instance %s: %s", instanceId, strings.ReplaceAll(err.Error(), "\n", "")))
 		}
-		multiAZ = MultiAZDefault
-		if parameters.MultiAZ {
-			multiAZ = parameters.MultiAZ
-			fmt.Printf("parameter override for MultiAZ:%t\n", multiAZ)
-		}
-		keepBackups = KeepBackupsDefault
-		if parameters.KeepBackups {
-			keepBackups = parameters.KeepBackups
-			fmt.Printf("parameter override for KeepBackups:%t\n", keepBackups)
-		}
-		skipFinalSnapshot = SkipFinalSnapshotDefault
-		if parameters.MakeFinalSnapshot != nil && !*parameters.MakeFinalSnapshot {
-			skipFinalSnapshot = true
-			fmt.Printf("parameter override for skipFinalSnapshot:%t\n", skipFinalSnapshot)
-		}
-		if parameters.RetentionDays != 0 {
-			fmt.Printf("parameter override for RetentionDays:%d\n", parameters.RetentionDays)
-		}
-		autoMinorVersionUpgrade = AutoMinorVersionUpgradeDefault
-		if parameters.AutoMinorVersionUpgrade {
-			autoMinorVersionUpgrade = parameters.AutoMinorVersionUpgrade
-			fmt.Printf("parameter override for AutoMinorVersionUpgrade:%t\n", autoMinorVersionUpgrade)
+	}
+	logger.Info("deleting the failed cluster", "cluster", clusterId)
+	if err := deleteCluster(&clusterId); err != nil {
+		LogAwsError(ctx, err)
+		errs = append(errs, fmt.Errorf("could not delete cluster %s: %s", clusterId, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateParameters checks the given parameters against the IaaS settings of the plan (from the catalog)
+func ValidateParameters(serviceId, planId string, parameters *model.Parameters) error {
+	plan := util.GetPlan(serviceId, planId)
+	if parameters == nil || plan.IaaS == nil {
+		// the catalog only has plans without IaaS settings for services without instances (see conf.ValidateCatalog)
+		return nil
+	}
+	if parameters.Engine != "" && !plan.IaaS.AllowsEngine(parameters.Engine) {
+		return fmt.Errorf("engine %s is not allowed for plan %s, allowed are %s", parameters.Engine, plan.Name, strings.Join(plan.IaaS.AllowedEngines, ", "))
+	}
+	if parameters.NumDBInstances > plan.IaaS.MaxInstances {
+		return fmt.Errorf("you requested %d instances, the allowed maximum for plan %s is %d", parameters.NumDBInstances, plan.Name, plan.IaaS.MaxInstances)
+	}
+	if parameters.RestoreFromInstance != "" && parameters.RestoreFromSnapshot != "" {
+		return errors.New("RestoreFromInstance and RestoreFromSnapshot can not be combined")
+	}
+	if parameters.RestoreTime != "" {
+		if parameters.RestoreFromInstance == "" {
+			return errors.New("RestoreTime is only allowed with RestoreFromInstance")
 		}
-		if parameters.RestoreFromSnapshot != "" {
-			restoreFromSnapshot = parameters.RestoreFromSnapshot
-			fmt.Printf("parameter override for RestoreFromSnapshot:%s\n", restoreFromSnapshot)
+		if _, err := time.Parse(time.RFC3339, parameters.RestoreTime); err != nil {
+			return fmt.Errorf("RestoreTime %s is not a valid time, use the RFC3339 format (like 2024-05-01T13:30:00Z)", parameters.RestoreTime)
 		}
+	}
+	return nil
+}
 
-		// DocDB parameters
-		if parameters.NumDBInstances != 0 {
-			if parameters.NumDBInstances > 3 {
-				err = errors.New(fmt.Sprintf("you requested %d DocumentDB instances, the allowed maximum = 3", parameters.NumDBInstances))
-			} else {
-				fmt.Printf("parameter override for NumDBInstances:%d\n", parameters.NumDBInstances)
-			}
+// restoreSource returns the IaaS instance of RestoreFromInstance (<org>/<space>/<name>) and the RestoreTime (nil for the latest restorable time).
+// The source has to be a successfully created instance of the same service, owned by the org and space of the new service instance.
+func restoreSource(ctx context.Context, serviceInstance db.ServiceInstance, parameters model.Parameters) (db.IaaSInstance, *time.Time, error) {
+	var restoreTime *time.Time
+	if parameters.RestoreTime != "" {
+		t, err := time.Parse(time.RFC3339, parameters.RestoreTime)
+		if err != nil {
+			return db.IaaSInstance{}, nil, fmt.Errorf("RestoreTime %s is not a valid time: %w", parameters.RestoreTime, err)
 		}
+		restoreTime = &t
+	}
+	parts := strings.Split(parameters.RestoreFromInstance, "/")
+	if len(parts) != 3 {
+		return db.IaaSInstance{}, nil, fmt.Errorf("RestoreFromInstance %s should be <org>/<space>/<name>", parameters.RestoreFromInstance)
+	}
+	if parts[0] != serviceInstance.OrganizationName || parts[1] != serviceInstance.SpaceName {
+		util.Logger(ctx).Warn("a restore from another service instance was requested, but it is not in the same org and space", "source", parameters.RestoreFromInstance, "OrganizationName", serviceInstance.OrganizationName, "SpaceName", serviceInstance.SpaceName)
+		return db.IaaSInstance{}, nil, fmt.Errorf("service instance %s was not found or requestor is not authorized", parameters.RestoreFromInstance)
+	}
+	sources := db.GetServicesInstanceByNameAndIaaSStatus(ctx, parts[0], parts[1], parts[2], db.StatusCreateSucceeded)
+	if len(sources) == 0 || sources[0].ServiceId != serviceInstance.ServiceId {
+		return db.IaaSInstance{}, nil, fmt.Errorf("service instance %s was not found or requestor is not authorized", parameters.RestoreFromInstance)
+	}
+	iaasInstances := db.GetIaaSInstances(ctx, sources[0].IaaSInstanceId)
+	if len(iaasInstances) == 0 {
+		return db.IaaSInstance{}, nil, fmt.Errorf("service instance %s has no IaaS instance", parameters.RestoreFromInstance)
+	}
+	return iaasInstances[0], restoreTime, nil
+}
+
+// provisionSpec The settings for creating or deleting one IaaS instance, the defaults overridden by the parameters of the service instance.
+// Every request gets its own spec from processParameters, so concurrent provisions don't see each other's settings.
+type provisionSpec struct {
+	Parameters              model.Parameters
+	UserName                string
+	Engine                  string
+	DBName                  string
+	AllocatedStorageGB      int64
+	StorageType             string
+	MultiAZ                 bool
+	KeepBackups             bool
+	SkipFinalSnapshot       bool
+	AutoMinorVersionUpgrade bool
+	RestoreFromSnapshot     string
+	RestoreFromInstance     string
+	Logs                    []string
+}
+
+// go over the given parameters and override the default values
+func processParameters(ctx context.Context, serviceInstance db.ServiceInstance) (provisionSpec, error) {
+	logger := util.Logger(ctx)
+	spec := provisionSpec{
+		UserName:                UserNameDefault,
+		Engine:                  EngineDefault,
+		DBName:                  DBNameDefault,
+		AllocatedStorageGB:      AllocatedStorageGBDefault,
+		StorageType:             StorageTypeDefault,
+		MultiAZ:                 MultiAZDefault,
+		KeepBackups:             KeepBackupsDefault,
+		SkipFinalSnapshot:       SkipFinalSnapshotDefault,
+		AutoMinorVersionUpgrade: AutoMinorVersionUpgradeDefault,
 	}
+	err := json.Unmarshal([]byte(serviceInstance.Parameters), &spec.Parameters)
 	if err != nil {
-		db.UpdateStatusServiceInstance(serviceInstance, db.StatusFailed)
-		db.UpdateStatusIaaSInstance(db.GetIaaSInstances(serviceInstance.IaaSInstanceId)[0], db.StatusCreateFailed, err.Error())
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, db.GetIaaSInstances(ctx, serviceInstance.IaaSInstanceId)[0], db.StatusCreateFailed, err.Error())
+		return spec, err
+	}
+	parameters := spec.Parameters
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	// RDS parameters
+	if plan.IaaS != nil && plan.IaaS.DefaultStorageGB != 0 {
+		spec.AllocatedStorageGB = plan.IaaS.DefaultStorageGB
+	}
+	if plan.IaaS != nil && plan.IaaS.StorageType != "" {
+		spec.StorageType = plan.IaaS.StorageType
+	}
+	if parameters.AllocatedStorageGB != 0 {
+		spec.AllocatedStorageGB = parameters.AllocatedStorageGB
+		logger.Info("parameter override", "AllocatedStorageGB", spec.AllocatedStorageGB)
+	}
+	if plan.IaaS != nil && len(plan.IaaS.AllowedEngines) > 0 && !plan.IaaS.AllowsEngine(spec.Engine) {
+		// the plan does not offer the default engine, its first allowed engine is the default
+		spec.Engine = plan.IaaS.AllowedEngines[0]
+	}
+	if parameters.Engine != "" {
+		spec.Engine = parameters.Engine
+		logger.Info("parameter override", "Engine", spec.Engine)
+	}
+	if parameters.Engine != "" || spec.Engine != EngineDefault {
+		switch spec.Engine {
+		case "postgres", "aurora-postgresql":
+			spec.Logs = []string{postgresqlLog}
+			spec.UserName = "postgres"
+		default:
+			spec.Logs = []string{errorLog, auditLog}
+		}
+	}
+	if parameters.DBName != "" {
+		spec.DBName = parameters.DBName
+		logger.Info("parameter override", "DBName", spec.DBName)
+	}
+	if parameters.MultiAZ {
+		spec.MultiAZ = parameters.MultiAZ
+		logger.Info("parameter override", "MultiAZ", spec.MultiAZ)
+	}
+	if parameters.KeepBackups {
+		spec.KeepBackups = parameters.KeepBackups
+		logger.Info("parameter override", "KeepBackups", spec.KeepBackups)
+	}
+	if parameters.MakeFinalSnapshot != nil && !*parameters.MakeFinalSnapshot {
+		spec.SkipFinalSnapshot = true
+		logger.Info("parameter override", "skipFinalSnapshot", spec.SkipFinalSnapshot)
+	}
+	if parameters.RetentionDays != 0 {
+		logger.Info("parameter override", "RetentionDays", parameters.RetentionDays)
+	}
+	if parameters.AutoMinorVersionUpgrade {
+		spec.AutoMinorVersionUpgrade = parameters.AutoMinorVersionUpgrade
+		logger.Info("parameter override", "AutoMinorVersionUpgrade", spec.AutoMinorVersionUpgrade)
+	}
+	if parameters.RestoreFromSnapshot != "" {
+		spec.RestoreFromSnapshot = parameters.RestoreFromSnapshot
+		logger.Info("parameter override", "RestoreFromSnapshot", spec.RestoreFromSnapshot)
+	}
+	if parameters.RestoreFromInstance != "" {
+		spec.RestoreFromInstance = parameters.RestoreFromInstance
+		logger.Info("parameter override", "RestoreFromInstance", spec.RestoreFromInstance, "RestoreTime", parameters.RestoreTime)
+	}
+
+	// DocDB parameters
+	if parameters.NumDBInstances != 0 {
+		logger.Info("parameter override", "NumDBInstances", parameters.NumDBInstances)
 	}
-	return userName, parameters, err
+	return spec, nil
 }
 
 func GetIAMTagsForServiceInstance(serviceInstance db.ServiceInstance) []*iam.Tag {
@@ -233,7 +398,7 @@ func GetIAMTagsForServiceInstance(serviceInstance db.ServiceInstance) []*iam.Tag
 }
 
 // createIAMRoleIfNotExists - If the parameter AuthorizedAWSAccount was given, we create the required IAM role if it does not yet exist
-func createIAMRoleIfNotExists(iaasInstanceP *db.IaaSInstance, serviceInstanceP *db.ServiceInstance) error {
+func createIAMRoleIfNotExists(ctx context.Context, iaasInstanceP *db.IaaSInstance, serviceInstanceP *db.ServiceInstance) error {
 	var err error
 	iaasInstance := *iaasInstanceP
 	serviceInstance := *serviceInstanceP
@@ -244,7 +409,7 @@ func createIAMRoleIfNotExists(iaasInstanceP *db.IaaSInstance, serviceInstanceP *
 	}
 	if parameters.AuthorizedAWSAccount != "" {
 		// check if the role already exists
-		listRolesOutput, err := conf.IAMClient.ListRoles(&iam.ListRolesInput{})
+		listRolesOutput, err := conf.IAMClient.ListRolesWithContext(ctx, &iam.ListRolesInput{})
 		if err != nil {
 			return err
 		}
@@ -273,23 +438,23 @@ func createIAMRoleIfNotExists(iaasInstanceP *db.IaaSInstance, serviceInstanceP *
 			RoleName:                 &roleName,
 			Tags:                     GetIAMTagsForServiceInstance(serviceInstance),
 		}
-		createRoleOutput, err := conf.IAMClient.CreateRole(&createRoleInput)
+		createRoleOutput, err := conf.IAMClient.CreateRoleWithContext(ctx, &createRoleInput)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("created IAM role %s\n", *createRoleOutput.Role.RoleName)
+		util.Logger(ctx).Info("created IAM role", "role", *createRoleOutput.Role.RoleName)
 		attachRolePolicyInput := iam.AttachRolePolicyInput{PolicyArn: &conf.PolicyARN, RoleName: &roleName}
-		_, err = conf.IAMClient.AttachRolePolicy(&attachRolePolicyInput)
+		_, err = conf.IAMClient.AttachRolePolicyWithContext(ctx, &attachRolePolicyInput)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("attached IAM role %s\n", roleName)
+		util.Logger(ctx).Info("attached IAM role", "role", roleName)
 	}
 	return err
 }
 
 // deleteIAMRoleIfExists - If the parameter AuthorizedAWSAccount was given, we delete the IAM role if it exists
-func deleteIAMRoleIfExists(iaasInstanceP *db.IaaSInstance, serviceInstanceP *db.ServiceInstance) error {
+func deleteIAMRoleIfExists(ctx context.Context, iaasInstanceP *db.IaaSInstance, serviceInstanceP *db.ServiceInstance) error {
 	var err error
 	iaasInstance := *iaasInstanceP
 	serviceInstance := *serviceInstanceP
@@ -300,27 +465,27 @@ func deleteIAMRoleIfExists(iaasInstanceP *db.IaaSInstance, serviceInstanceP *db.
 	}
 	roleName := fmt.Sprintf("mfsb-%s-%s", iaasInstance.InternalId, parameters.AuthorizedAWSAccount)
 	detachRolePolicyInput := iam.DetachRolePolicyInput{PolicyArn: &conf.PolicyARN, RoleName: &roleName}
-	_, err = conf.IAMClient.DetachRolePolicy(&detachRolePolicyInput)
+	_, err = conf.IAMClient.DetachRolePolicyWithContext(ctx, &detachRolePolicyInput)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case iam.ErrCodeNoSuchEntityException:
-				fmt.Printf("rolePolicy %s did not exist, not deleting it\n", conf.PolicyARN)
+				util.Logger(ctx).Info("rolePolicy did not exist, not deleting it", "policy", conf.PolicyARN)
 				return nil
 			default:
 				return err
 			}
 		}
 	}
-	fmt.Printf("detached IAM role %s from policy %s\n", roleName, conf.PolicyARN)
+	util.Logger(ctx).Info("detached IAM role from policy", "role", roleName, "policy", conf.PolicyARN)
 
 	deleteRoleInput := iam.DeleteRoleInput{RoleName: &roleName}
-	_, err = conf.IAMClient.DeleteRole(&deleteRoleInput)
+	_, err = conf.IAMClient.DeleteRoleWithContext(ctx, &deleteRoleInput)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case iam.ErrCodeNoSuchEntityException:
-				fmt.Printf("role %s did not exist, not deleting it\n", roleName)
+				util.Logger(ctx).Info("role did not exist, not deleting it", "role", roleName)
 				return nil
 			default:
 				return err
@@ -328,6 +493,6 @@ func deleteIAMRoleIfExists(iaasInstanceP *db.IaaSInstance, serviceInstanceP *db.
 		}
 	}
 
-	fmt.Printf("deleted IAM role %s\n", roleName)
+	util.Logger(ctx).Info("deleted IAM role", "role", roleName)
 	return err
 }
@@ -0,0 +1,243 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+	"github.com/rabobank/mfsb/model"
+)
+
+const concurrentProvisions = 20
+
+// useRDSCatalog makes an RDS service with one plan the catalog for the duration of the test
+func useRDSCatalog(t *testing.T) {
+	saved := conf.GetCatalog()
+	conf.SetCatalog(&model.Catalog{Services: []model.Service{{Id: "rds-id", Name: "rds-service", Plans: []model.ServicePlan{{
+		Id:   "micro-id",
+		Name: "micro",
+		IaaS: &model.PlanIaaSSettings{InstanceClass: "db.t3.micro", DefaultStorageGB: 5, StorageType: "gp2", AllowedEngines: []string{"mariadb", "mysql", "postgres"}, MaxInstances: 1},
+	}}}}})
+	t.Cleanup(func() { conf.SetCatalog(saved) })
+}
+
+// rdsServiceInstance returns the i-th service instance of the concurrency tests, every instance has its own parameters
+func rdsServiceInstance(i int) db.ServiceInstance {
+	engine := "mysql"
+	if i%2 == 0 {
+		engine = "postgres"
+	}
+	return db.ServiceInstance{
+		Id:           int64(i),
+		ServiceId:    "rds-id",
+		PlanId:       "micro-id",
+		InstanceId:   fmt.Sprintf("guid-%d", i),
+		InstanceName: fmt.Sprintf("db-%d", i),
+		Parameters:   fmt.Sprintf(`{"Engine": %q, "DBName": "db%d", "AllocatedStorageGB": %d, "MultiAZ": %t}`, engine, i, 10+i, i%3 == 0),
+	}
+}
+
+// expectedSpec is the spec processParameters should return for rdsServiceInstance(i)
+func expectedSpec(i int) provisionSpec {
+	spec := provisionSpec{
+		UserName:                "admin",
+		Engine:                  "mysql",
+		DBName:                  fmt.Sprintf("db%d", i),
+		AllocatedStorageGB:      int64(10 + i),
+		StorageType:             "gp2",
+		MultiAZ:                 i%3 == 0,
+		KeepBackups:             KeepBackupsDefault,
+		SkipFinalSnapshot:       SkipFinalSnapshotDefault,
+		AutoMinorVersionUpgrade: AutoMinorVersionUpgradeDefault,
+		Logs:                    []string{errorLog, auditLog},
+	}
+	if i%2 == 0 {
+		spec.UserName, spec.Engine, spec.Logs = "postgres", "postgres", []string{postgresqlLog}
+	}
+	spec.Parameters = model.Parameters{Engine: spec.Engine, DBName: spec.DBName, AllocatedStorageGB: spec.AllocatedStorageGB, MultiAZ: spec.MultiAZ}
+	return spec
+}
+
+func TestProcessParametersConcurrently(t *testing.T) {
+	useRDSCatalog(t)
+	specs := make([]provisionSpec, concurrentProvisions)
+	var wg sync.WaitGroup
+	for i := range specs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spec, err := processParameters(context.Background(), rdsServiceInstance(i))
+			if err != nil {
+				t.Errorf("processParameters of instance %d failed: %s", i, err)
+			}
+			specs[i] = spec
+		}()
+	}
+	wg.Wait()
+
+	for i, spec := range specs {
+		if !reflect.DeepEqual(spec, expectedSpec(i)) {
+			t.Errorf("the spec of instance %d is %+v, expected %+v", i, spec, expectedSpec(i))
+		}
+	}
+	// a spec that is changed by one provision must not change the others
+	specs[0].Logs[0] = "changed"
+	for i, spec := range specs[1:] {
+		if spec.Logs[0] == "changed" {
+			t.Errorf("the spec of instance %d shares its logs with the spec of instance 0", i+1)
+		}
+	}
+}
+
+func TestSubmitProvisionRDSDBConcurrently(t *testing.T) {
+	useRDSCatalog(t)
+	// the status updates are not part of this test, every query fails (and is logged), which also keeps the pollers from starting
+	dbtest.NewMock(t)
+	sess, fake := newFakeAWS(t, func(w http.ResponseWriter, call awsCall) {
+		values, _ := url.ParseQuery(call.Body)
+		_, _ = fmt.Fprintf(w, `<CreateDBInstanceResponse><CreateDBInstanceResult><DBInstance><DBInstanceIdentifier>%s</DBInstanceIdentifier></DBInstance></CreateDBInstanceResult></CreateDBInstanceResponse>`, values.Get("DBInstanceIdentifier"))
+	})
+	savedClient, savedSecGrpId, savedSubnetGrp := conf.RDSClient, conf.RDSSecGrpId, conf.RDSSubnetGrp
+	conf.RDSClient, conf.RDSSecGrpId, conf.RDSSubnetGrp = rds.New(sess), "sg-rds", "subnets-rds"
+	t.Cleanup(func() {
+		conf.RDSClient, conf.RDSSecGrpId, conf.RDSSubnetGrp = savedClient, savedSecGrpId, savedSubnetGrp
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentProvisions; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			iaasInstance := db.IaaSInstance{Id: int64(i), InternalId: fmt.Sprintf("mfsb-%d", i)}
+			if err := SubmitProvisionRDSDB(context.Background(), iaasInstance, rdsServiceInstance(i)); err != nil {
+				t.Errorf("the provision of instance %d failed: %s", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	requests := make(map[string]url.Values)
+	for _, call := range fake.Calls() {
+		if call.Action == "CreateDBInstance" {
+			values, _ := url.ParseQuery(call.Body)
+			requests[values.Get("DBInstanceIdentifier")] = values
+		}
+	}
+	if len(requests) != concurrentProvisions {
+		t.Fatalf("expected %d CreateDBInstance calls, got the calls %v", concurrentProvisions, fake.Actions())
+	}
+	for i := 0; i < concurrentProvisions; i++ {
+		spec, request := expectedSpec(i), requests[fmt.Sprintf("mfsb-%d", i)]
+		expected := map[string]string{
+			"DBName":                               spec.DBName,
+			"Engine":                               spec.Engine,
+			"MasterUsername":                       spec.UserName,
+			"AllocatedStorage":                     strconv.FormatInt(spec.AllocatedStorageGB, 10),
+			"MultiAZ":                              strconv.FormatBool(spec.MultiAZ),
+			"EnableCloudwatchLogsExports.member.1": spec.Logs[0],
+			"VpcSecurityGroupIds.VpcSecurityGroupId.1": "sg-rds",
+			"DBSubnetGroupName":                        "subnets-rds",
+		}
+		for name, value := range expected {
+			if request.Get(name) != value {
+				t.Errorf("instance %d was created with %s=%s, expected %s", i, name, request.Get(name), value)
+			}
+		}
+		if request.Get("VpcSecurityGroupIds.VpcSecurityGroupId.2") != "" || request.Get("EnableCloudwatchLogsExports.member."+strconv.Itoa(len(spec.Logs)+1)) != "" {
+			t.Errorf("instance %d got the security groups or logs of another instance: %v", i, request)
+		}
+	}
+}
+
+func TestFailedInstanceCreateDeletesTheCluster(t *testing.T) {
+	saved := conf.GetCatalog()
+	conf.SetCatalog(&model.Catalog{Services: []model.Service{
+		{Id: "aurora-id", Name: "aurora-service", Plans: []model.ServicePlan{{Id: "aurora-plan", Name: "small", IaaS: &model.PlanIaaSSettings{InstanceClass: "db.r6g.large", AllowedEngines: []string{"aurora-postgresql"}, MaxInstances: 2}}}},
+		{Id: "neptune-id", Name: "neptune-service", Plans: []model.ServicePlan{{Id: "neptune-plan", Name: "small", IaaS: &model.PlanIaaSSettings{InstanceClass: "db.r5.large", AllowedEngines: []string{"neptune"}, MaxInstances: 2}}}},
+	}})
+	savedRDS, savedRDSSubnetGrp, savedNeptune, savedNeptuneSubnetGrp := conf.RDSClient, conf.RDSSubnetGrp, conf.NeptuneClient, conf.NeptuneSubnetGrp
+	t.Cleanup(func() {
+		conf.SetCatalog(saved)
+		conf.RDSClient, conf.RDSSubnetGrp, conf.NeptuneClient, conf.NeptuneSubnetGrp = savedRDS, savedRDSSubnetGrp, savedNeptune, savedNeptuneSubnetGrp
+	})
+
+	tests := []struct {
+		name          string
+		serviceId     string
+		planId        string
+		submit        func(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error
+		clusterDelete bool
+		err           string
+	}{
+		{name: "aurora", serviceId: "aurora-id", planId: "aurora-plan", submit: SubmitProvisionAurora, clusterDelete: true},
+		{name: "neptune", serviceId: "neptune-id", planId: "neptune-plan", submit: SubmitProvisionNeptune, clusterDelete: true},
+		{name: "cluster delete fails", serviceId: "aurora-id", planId: "aurora-plan", submit: SubmitProvisionAurora, err: "the cluster is left behind: could not delete cluster mfsb-1: InvalidDBClusterStateFault: busy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the status updates are not part of this test, every query fails (and is logged), which also keeps the poller from starting
+			dbtest.NewMock(t)
+			// the zones of the subnet group are described again, also when the test is repeated
+			subnetGroupAZsMutex.Lock()
+			subnetGroupAZsCache = make(map[string]cachedAZs)
+			subnetGroupAZsMutex.Unlock()
+			var instanceCreates atomic.Int32
+			sess, fake := newFakeAWS(t, func(w http.ResponseWriter, call awsCall) {
+				fail := func(code string, message string) {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error></ErrorResponse>`, code, message)
+				}
+				switch {
+				case call.Action == "DescribeDBSubnetGroups":
+					_, _ = fmt.Fprint(w, subnetGroupsXML(call.Action, "DBSubnetGroup", "eu-west-1a", "eu-west-1b"))
+				case call.Action == "CreateDBInstance" && instanceCreates.Add(1) == 2:
+					fail("InsufficientDBInstanceCapacity", "no capacity")
+				case call.Action == "DeleteDBCluster" && !tt.clusterDelete:
+					fail("InvalidDBClusterStateFault", "busy")
+				default:
+					// the other responses are not used
+					_, _ = fmt.Fprintf(w, "<%[1]sResponse><%[1]sResult/></%[1]sResponse>", call.Action)
+				}
+			})
+			// the zones of a subnet group are cached, every test has its own
+			conf.RDSClient, conf.NeptuneClient = rds.New(sess), neptune.New(sess)
+			conf.RDSSubnetGrp, conf.NeptuneSubnetGrp = "subnets-"+tt.name, "subnets-"+tt.name
+
+			serviceInstance := db.ServiceInstance{ServiceId: tt.serviceId, PlanId: tt.planId, InstanceId: "guid-1", InstanceName: "cluster", Parameters: `{"NumDBInstances": 2}`}
+			err := tt.submit(context.Background(), db.IaaSInstance{Id: 1, InternalId: "mfsb-1"}, serviceInstance)
+			if err == nil || !strings.HasPrefix(err.Error(), "could not create instance mfsb-1-eu-west-1") || !strings.Contains(err.Error(), "InsufficientDBInstanceCapacity: no capacity") || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("the create returned %v, expected the failed instance create %s", err, tt.err)
+			}
+			if tt.clusterDelete && strings.Contains(err.Error(), "left behind") {
+				t.Errorf("the cluster was deleted, but the error tells it is left behind: %s", err)
+			}
+			expected := []string{"DescribeDBSubnetGroups", "CreateDBCluster", "DescribeDBInstances", "CreateDBInstance", "CreateDBInstance", "DeleteDBInstance", "DeleteDBCluster"}
+			if actions := fake.Actions(); !reflect.DeepEqual(actions, expected) {
+				t.Fatalf("the calls are %v, expected %v", actions, expected)
+			}
+			created, _ := fake.Call("CreateDBInstance")
+			createdValues, _ := url.ParseQuery(created.Body)
+			deleted, _ := fake.Call("DeleteDBInstance")
+			if deletedValues, _ := url.ParseQuery(deleted.Body); deletedValues.Get("DBInstanceIdentifier") != createdValues.Get("DBInstanceIdentifier") {
+				t.Errorf("the instance %s was deleted, expected the created instance %s", deletedValues.Get("DBInstanceIdentifier"), createdValues.Get("DBInstanceIdentifier"))
+			}
+			if call, _ := fake.Call("DeleteDBCluster"); !strings.Contains(call.Body, "DBClusterIdentifier=mfsb-1") || !strings.Contains(call.Body, "SkipFinalSnapshot=true") {
+				t.Errorf("the cluster was not deleted without a final snapshot: %s", call.Body)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package aws
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/docdb"
@@ -8,8 +10,10 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/rabobank/mfsb/conf"
 	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
 	"github.com/rabobank/mfsb/util"
 )
 
@@ -21,13 +25,14 @@ var userNameDOCDB = "docdbadmin"
 var DOCDBEngineDefault = "docdb"
 var deleteProtection = false
 
-func SubmitProvisionDOCDB(iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
-	_, parameters, err := processParameters(serviceInstance)
+func SubmitProvisionDOCDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
 	if err != nil {
 		return err
 	}
-	retentionDays := parameters.RetentionDays
-	numInstancesDOCDB := parameters.NumDBInstances
+	retentionDays := spec.Parameters.RetentionDays
+	numInstancesDOCDB := spec.Parameters.NumDBInstances
 	if numInstancesDOCDB == 0 {
 		numInstancesDOCDB = NumInstancesDOCDBDefault
 	}
@@ -35,54 +40,131 @@ func SubmitProvisionDOCDB(iaasInstance db.IaaSInstance, serviceInstance db.Servi
 	if retentionDays == 0 {
 		retentionDays = RetentionDaysDOCDBDefault
 	}
-	vpcSecGrpIds = append(vpcSecGrpIds, &conf.DOCDBSecGrpId)
+	vpcSecGrpIds := []*string{&conf.DOCDBSecGrpId}
 	iaasInstance.ServiceUser = userNameDOCDB
 	iaasInstance.ServicePassword = util.SafeSubstring(fmt.Sprintf("pw%s", util.GenerateGUID()), 40)
 	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
-	dbInstanceClass := conf.DOCDBClasses[plan.Name]
+	var dbInstanceClass string
+	if plan.IaaS != nil {
+		dbInstanceClass = plan.IaaS.InstanceClass
+	}
 	if dbInstanceClass == "" {
 		msg := fmt.Sprintf("could not find database instance class for plan %s", plan.Name)
-		fmt.Println(msg)
-		db.UpdateStatusIaaSInstance(iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
 		serviceInstance.Status = db.StatusFailed
-		_ = db.UpdateServiceInstance(serviceInstance)
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
 		return errors.New(msg)
 	}
-
-	// first create the cluster (and after we create the instance(s))
-	createClusterInput := &docdb.CreateDBClusterInput{
-		AvailabilityZones:           conf.AZS,
-		BackupRetentionPeriod:       &retentionDays,
-		DBClusterIdentifier:         &iaasInstance.InternalId,
-		DBSubnetGroupName:           &conf.DOCDBSubnetGrp,
-		DeletionProtection:          &deleteProtection,
-		EnableCloudwatchLogsExports: docdbLogs,
-		Engine:                      &DOCDBEngineDefault,
-		MasterUserPassword:          &iaasInstance.ServicePassword,
-		MasterUsername:              &iaasInstance.ServiceUser,
-		StorageEncrypted:            &storageEncrypted,
-		Tags:                        getTagsForServiceInstanceDOCDB(serviceInstance),
-		VpcSecurityGroupIds:         vpcSecGrpIds,
+	azs, err := subnetGroupAZs(ctx, "docdb", conf.DOCDBSubnetGrp, func(subnetGroup *string) (any, error) {
+		return conf.DOCDBClient.DescribeDBSubnetGroupsWithContext(ctx, &docdb.DescribeDBSubnetGroupsInput{DBSubnetGroupName: subnetGroup})
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", err))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return err
 	}
 
-	createDBClusterOutput, err := conf.DOCDBClient.CreateDBCluster(createClusterInput)
+	// first create (or restore) the cluster (and after we create the instance(s))
+	var dbCluster *docdb.DBCluster
+	if spec.RestoreFromSnapshot != "" {
+		if !docdbClusterSnapshotExistsAndAuthorized(ctx, spec.RestoreFromSnapshot, serviceInstance) {
+			msg := fmt.Sprintf("cluster snapshot with identifier %s was not found or requestor is not authorized", spec.RestoreFromSnapshot)
+			logger.Error(msg)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
+			serviceInstance.Status = db.StatusFailed
+			_ = db.UpdateServiceInstance(ctx, serviceInstance)
+			return errors.New(msg)
+		}
+		// the restored cluster gets the master user and password of the snapshot, the poller resets the password
+		var restoreDBClusterOutput *docdb.RestoreDBClusterFromSnapshotOutput
+		restoreDBClusterOutput, err = conf.DOCDBClient.RestoreDBClusterFromSnapshotWithContext(ctx, &docdb.RestoreDBClusterFromSnapshotInput{
+			AvailabilityZones:           stringPointers(azs),
+			DBClusterIdentifier:         &iaasInstance.InternalId,
+			DBSubnetGroupName:           &conf.DOCDBSubnetGrp,
+			DeletionProtection:          &deleteProtection,
+			EnableCloudwatchLogsExports: stringPointers([]string{auditLog}),
+			Engine:                      &DOCDBEngineDefault,
+			SnapshotIdentifier:          &spec.RestoreFromSnapshot,
+			Tags:                        getTagsForServiceInstanceDOCDB(serviceInstance),
+			VpcSecurityGroupIds:         vpcSecGrpIds,
+		})
+		if err == nil {
+			dbCluster = restoreDBClusterOutput.DBCluster
+		}
+	} else if spec.RestoreFromInstance != "" {
+		source, restoreTime, sourceErr := restoreSource(ctx, serviceInstance, spec.Parameters)
+		if sourceErr != nil {
+			logger.Error(sourceErr.Error())
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", sourceErr))
+			serviceInstance.Status = db.StatusFailed
+			_ = db.UpdateServiceInstance(ctx, serviceInstance)
+			return sourceErr
+		}
+		// like a restore from snapshot, the cluster gets the master user and password of the source
+		useLatestRestorableTime := restoreTime == nil
+		var restoreDBClusterOutput *docdb.RestoreDBClusterToPointInTimeOutput
+		restoreDBClusterOutput, err = conf.DOCDBClient.RestoreDBClusterToPointInTimeWithContext(ctx, &docdb.RestoreDBClusterToPointInTimeInput{
+			DBClusterIdentifier:         &iaasInstance.InternalId,
+			DBSubnetGroupName:           &conf.DOCDBSubnetGrp,
+			DeletionProtection:          &deleteProtection,
+			EnableCloudwatchLogsExports: stringPointers([]string{auditLog}),
+			RestoreToTime:               restoreTime,
+			SourceDBClusterIdentifier:   &source.InternalId,
+			Tags:                        getTagsForServiceInstanceDOCDB(serviceInstance),
+			UseLatestRestorableTime:     &useLatestRestorableTime,
+			VpcSecurityGroupIds:         vpcSecGrpIds,
+		})
+		if err == nil {
+			dbCluster = restoreDBClusterOutput.DBCluster
+		}
+	} else {
+		createClusterInput := &docdb.CreateDBClusterInput{
+			AvailabilityZones:           stringPointers(azs),
+			BackupRetentionPeriod:       &retentionDays,
+			DBClusterIdentifier:         &iaasInstance.InternalId,
+			DBSubnetGroupName:           &conf.DOCDBSubnetGrp,
+			DeletionProtection:          &deleteProtection,
+			EnableCloudwatchLogsExports: stringPointers([]string{auditLog}),
+			Engine:                      &DOCDBEngineDefault,
+			MasterUserPassword:          &iaasInstance.ServicePassword,
+			MasterUsername:              &iaasInstance.ServiceUser,
+			StorageEncrypted:            &storageEncrypted,
+			Tags:                        getTagsForServiceInstanceDOCDB(serviceInstance),
+			VpcSecurityGroupIds:         vpcSecGrpIds,
+		}
+		var createDBClusterOutput *docdb.CreateDBClusterOutput
+		createDBClusterOutput, err = conf.DOCDBClient.CreateDBClusterWithContext(ctx, createClusterInput)
+		if err == nil {
+			dbCluster = createDBClusterOutput.DBCluster
+		}
+	}
 
 	if err != nil {
 		msg := fmt.Sprintf("could not create cluster %s: %s", serviceInstance.InstanceName, err)
-		fmt.Println(msg)
-		db.UpdateStatusIaaSInstance(iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
+		LogAwsError(ctx, err)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
 		serviceInstance.Status = db.StatusFailed
-		_ = db.UpdateServiceInstance(serviceInstance)
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
 		return errors.New(msg)
 	}
-	fmt.Printf("docdb cluster %s created\n", *createDBClusterOutput.DBCluster.DBClusterIdentifier)
+	logger.Info("docdb cluster created/restored", "cluster", *dbCluster.DBClusterIdentifier)
 
-	for ix := 0; ix < int(numInstancesDOCDB); ix++ {
-		az := *util.GetNextAZ()
-		instanceIdentifier := fmt.Sprintf("%s-%s", iaasInstance.InternalId, az)
-		fmt.Printf("creating docdb instance %s for cluster %s...\n", instanceIdentifier, *createDBClusterOutput.DBCluster.DBClusterIdentifier)
+	memberAZs, azErr := clusterMemberAZs(iaasInstance.InternalId, func(filterName *string, clusterId *string) (any, error) {
+		return conf.DOCDBClient.DescribeDBInstancesWithContext(ctx, &docdb.DescribeDBInstancesInput{Filters: []*docdb.Filter{{Name: filterName, Values: []*string{clusterId}}}})
+	})
+	if azErr != nil {
+		logger.Warn("could not get the zones of the cluster members, spreading as if there are none", "error", azErr)
+	}
+	instanceAZs := pickAZs(azs, memberAZs, int(numInstancesDOCDB))
+	for ix, instanceIdentifier := range instanceIdentifiers(iaasInstance.InternalId, instanceAZs) {
+		instanceIdentifier := instanceIdentifier
+		az := instanceAZs[ix]
+		logger.Info("creating docdb instance for cluster...", "instance", instanceIdentifier, "cluster", *dbCluster.DBClusterIdentifier)
 		createDBInstanceInput := &docdb.CreateDBInstanceInput{
-			AutoMinorVersionUpgrade: &autoMinorVersionUpgrade,
+			AutoMinorVersionUpgrade: &spec.AutoMinorVersionUpgrade,
 			AvailabilityZone:        &az,
 			DBClusterIdentifier:     &iaasInstance.InternalId,
 			DBInstanceClass:         &dbInstanceClass,
@@ -92,152 +174,217 @@ func SubmitProvisionDOCDB(iaasInstance db.IaaSInstance, serviceInstance db.Servi
 		}
 
 		// do the actual AWS call to create the DB
-		createDBInstanceOutput, err := conf.DOCDBClient.CreateDBInstance(createDBInstanceInput)
-
+		createDBInstanceOutput, err := conf.DOCDBClient.CreateDBInstanceWithContext(ctx, createDBInstanceInput)
 		if err != nil {
-			LogAwsError(err)
-			db.UpdateStatusServiceInstance(serviceInstance, db.StatusFailed)
-			db.UpdateStatusIaaSInstance(iaasInstance, db.StatusCreateFailed, strings.ReplaceAll(err.Error(), "\n", ""))
-		} else {
-			msg := fmt.Sprintf("DOCDB Database instance %s is being created", iaasInstance.InternalId)
-			fmt.Println(msg)
-			if conf.Debug {
-				fmt.Println(createDBInstanceOutput)
-			}
-			db.UpdateStatusServiceInstance(serviceInstance, db.StatusInProgress)
-			db.UpdateStatusIaaSInstance(iaasInstance, db.StatusCreateInProgress, msg)
-			StartPollForStatusDOCDB(iaasInstance)
+			LogAwsError(ctx, err)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, strings.ReplaceAll(err.Error(), "\n", ""))
+			return err
 		}
+		logger.Debug("create docdb instance output", "output", createDBInstanceOutput.String())
 	}
-	return err
+	msg := fmt.Sprintf("DOCDB cluster %s with %d instance(s) is being created", iaasInstance.InternalId, numInstancesDOCDB)
+	logger.Info(msg)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusDOCDB(ctx, iaasInstance)
+	return nil
 }
 
-func SubmitDeletionDOCDB(iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+func SubmitDeletionDOCDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
 	var err error
-	if _, _, err = processParameters(serviceInstance); err != nil {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
 		return err
 	}
-	fmt.Printf("deleting docdb cluster %s...\n", iaasInstance.InternalId)
-	db.UpdateStatusServiceInstance(serviceInstance, db.StatusInProgress)
-	db.UpdateStatusIaaSInstance(iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	logger.Info("deleting docdb cluster...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
 
 	var snapshotIdentifier = ""
-	if !skipFinalSnapshot {
+	if !spec.SkipFinalSnapshot {
 		snapshotIdentifier = iaasInstance.InternalId
 	}
 
 	// actual delete
-	fmt.Printf("deleting docdb cluster with parameters skipFinalSnapshot:%t and snapshotIdentifier:%s\n", skipFinalSnapshot, snapshotIdentifier)
+	logger.Info("delete parameters", "skipFinalSnapshot", spec.SkipFinalSnapshot, "snapshotIdentifier", snapshotIdentifier)
 
-	describeClusterOutput, err := conf.DOCDBClient.DescribeDBClusters(&docdb.DescribeDBClustersInput{DBClusterIdentifier: &iaasInstance.InternalId})
+	describeClusterOutput, err := conf.DOCDBClient.DescribeDBClustersWithContext(ctx, &docdb.DescribeDBClustersInput{DBClusterIdentifier: &iaasInstance.InternalId})
 	if err != nil {
 		msg := fmt.Sprintf("could not describe cluster %s: %s", iaasInstance.InternalId, err)
-		fmt.Println(msg)
+		logger.Error(msg)
 		return errors.New(msg)
 	}
 	for ix, instance := range describeClusterOutput.DBClusters[0].DBClusterMembers {
-		fmt.Printf("deleting docdb instance (%d) %s\n", ix, *instance.DBInstanceIdentifier)
-		_, err = conf.DOCDBClient.DeleteDBInstance(&docdb.DeleteDBInstanceInput{DBInstanceIdentifier: instance.DBInstanceIdentifier})
+		logger.Info("deleting docdb instance", "index", ix, "instance", *instance.DBInstanceIdentifier)
+		_, err = conf.DOCDBClient.DeleteDBInstanceWithContext(ctx, &docdb.DeleteDBInstanceInput{DBInstanceIdentifier: instance.DBInstanceIdentifier})
 		if err != nil {
-			msg := fmt.Sprintf("failed to delete docdb instance (%d) %s, err: %s\n", ix, iaasInstance.InternalId, err)
-			db.UpdateStatusServiceInstance(serviceInstance, db.StatusFailed)
-			db.UpdateStatusIaaSInstance(iaasInstance, db.StatusDeleteFailed, err.Error())
-			fmt.Println(msg)
+			msg := fmt.Sprintf("failed to delete docdb instance (%d) %s, err: %s", ix, iaasInstance.InternalId, err)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+			logger.Error(msg)
 			return errors.New(msg)
 		}
 	}
 
-	fmt.Printf("starting to delete docdb cluster %s...\n", iaasInstance.InternalId)
-	_, err = conf.DOCDBClient.DeleteDBCluster(&docdb.DeleteDBClusterInput{DBClusterIdentifier: &iaasInstance.InternalId, FinalDBSnapshotIdentifier: &snapshotIdentifier, SkipFinalSnapshot: &skipFinalSnapshot})
+	logger.Info("starting to delete docdb cluster...")
+	_, err = conf.DOCDBClient.DeleteDBClusterWithContext(ctx, &docdb.DeleteDBClusterInput{DBClusterIdentifier: &iaasInstance.InternalId, FinalDBSnapshotIdentifier: &snapshotIdentifier, SkipFinalSnapshot: &spec.SkipFinalSnapshot})
 	if err != nil {
-		fmt.Printf("failed to delete docdb cluster %s, err: %s\n", iaasInstance.InternalId, err)
-		db.UpdateStatusServiceInstance(serviceInstance, db.StatusFailed)
-		db.UpdateStatusIaaSInstance(iaasInstance, db.StatusDeleteFailed, err.Error())
+		logger.Error("failed to delete docdb cluster", "error", err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
 	}
 
-	StartPollForStatusDOCDB(iaasInstance)
+	StartPollForStatusDOCDB(ctx, iaasInstance)
 	return err
 }
 
-func StartPollForStatusDOCDB(iaasInstance db.IaaSInstance) {
-	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(conf.CfEnv, iaasInstance.Id)
-	go func() {
-		channel := time.Tick(20 * time.Second)
-		for range channel {
-			// start polling for the result
-			output, err := conf.DOCDBClient.DescribeDBClusters(&docdb.DescribeDBClustersInput{DBClusterIdentifier: &iaasInstance.InternalId})
-			if err != nil {
-				aerr, _ := err.(awserr.Error)
-				if aerr.Code() == docdb.ErrCodeDBClusterNotFoundFault {
-					// this should only happen when a database cluster deletion ended
-					fmt.Printf("docdb cluster %s is gone, %s\n", iaasInstance.InternalId, aerr.Message())
-					db.DeleteServiceInstanceByServiceInstanceId(serviceInstance.InstanceId)
-					db.UpdateStatusIaaSInstance(iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("docdb cluster %s is gone", iaasInstance.InternalId))
-					err = deleteIAMRoleIfExists(&iaasInstance, &serviceInstance)
-					if err != nil {
-						fmt.Printf("failed to delete the IAM role for %s: %s", iaasInstance.InternalId, err)
-						iaasInstance.LastMessage = fmt.Sprintf("docdb cluster %s successfully deleted, IAM role delete failed (%s)", iaasInstance.InternalId, err)
-						_ = db.UpdateStatusServiceInstanceForIaaSId(serviceInstance.IaaSInstanceId, db.StatusSucceeded)
-						_ = db.UpdateIaaSInstance(iaasInstance)
-					}
-				} else {
-					msg := fmt.Sprintf("failed to describe docdb cluster %s, code : %s error: %s", iaasInstance.InternalId, aerr.Code(), err)
-					fmt.Println(msg)
-					db.UpdateStatusServiceInstance(serviceInstance, db.StatusFailed)
-					db.UpdateStatusIaaSInstance(iaasInstance, db.StatusNotFound, msg)
+func StartPollForStatusDOCDB(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	startPoller(ctx, serviceInstance, "StartPollForStatusDOCDB", func(ctx context.Context) bool {
+		// start polling for the result
+		output, err := conf.DOCDBClient.DescribeDBClustersWithContext(ctx, &docdb.DescribeDBClustersInput{DBClusterIdentifier: &iaasInstance.InternalId})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == docdb.ErrCodeDBClusterNotFoundFault {
+				// this should only happen when a database cluster deletion ended
+				logger.Info("docdb cluster is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("docdb cluster %s is gone", iaasInstance.InternalId))
+				err = deleteIAMRoleIfExists(ctx, &iaasInstance, &serviceInstance)
+				if err != nil {
+					logger.Error("failed to delete the IAM role", "error", err)
+					iaasInstance.LastMessage = fmt.Sprintf("docdb cluster %s successfully deleted, IAM role delete failed (%s)", iaasInstance.InternalId, err)
+					_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+					_ = db.UpdateIaaSInstance(ctx, iaasInstance)
 				}
-				break
 			} else {
-				dbClusters := output.DBClusters
-				if len(dbClusters) > 0 {
-					dbCluster := dbClusters[0]
-					dbStatus := dbCluster.Status
-					msg := fmt.Sprintf("docdb cluster %s : %s", *dbClusters[0].DBClusterIdentifier, *dbStatus)
-					fmt.Println(msg)
-					if *dbStatus == "available" {
-						schema := schemas[*dbClusters[0].Engine]
-						// DB cluster is ready (but DB instances not yet)
-						iaasInstance.ServiceUrl = fmt.Sprintf(schema, iaasInstance.ServiceUser, iaasInstance.ServicePassword, *dbClusters[0].Endpoint, *dbClusters[0].Port)
-						iaasInstance.Status = db.StatusCreateInProgress
-						iaasInstance.LastStatusUpdate = time.Now()
-						iaasInstance.LastMessage = fmt.Sprintf("documentdb cluster %s created, db instance(s) creation in progress", iaasInstance.InternalId)
-						_ = db.UpdateStatusServiceInstanceForIaaSId(serviceInstance.IaaSInstanceId, db.StatusInProgress)
-						_ = db.UpdateIaaSInstance(iaasInstance)
+				msg := fmt.Sprintf("failed to describe docdb cluster %s: %s", iaasInstance.InternalId, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		} else {
+			dbClusters := output.DBClusters
+			if len(dbClusters) > 0 {
+				dbCluster := dbClusters[0]
+				dbStatus := dbCluster.Status
+				logger.Info("docdb cluster status", "db_status", *dbStatus)
+				if *dbStatus == "available" {
+					if dbCluster.MasterUsername != nil {
+						// a restored cluster keeps the master user of the snapshot
+						iaasInstance.ServiceUser = *dbCluster.MasterUsername
+					}
+					schema := schemas[*dbClusters[0].Engine]
+					// DB cluster is ready (but DB instances not yet)
+					iaasInstance.ServiceUrl = fmt.Sprintf(schema, iaasInstance.ServiceUser, iaasInstance.ServicePassword, *dbClusters[0].Endpoint, *dbClusters[0].Port)
+					iaasInstance.Status = db.StatusCreateInProgress
+					iaasInstance.LastStatusUpdate = time.Now()
+					iaasInstance.LastMessage = fmt.Sprintf("documentdb cluster %s created, db instance(s) creation in progress", iaasInstance.InternalId)
+					_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusInProgress)
+					_ = db.UpdateIaaSInstance(ctx, iaasInstance)
 
-						// now check the DB instances
-						allInstancesAvailable := true
-						for _, member := range dbCluster.DBClusterMembers {
-							instances, err := conf.DOCDBClient.DescribeDBInstances(&docdb.DescribeDBInstancesInput{DBInstanceIdentifier: member.DBInstanceIdentifier})
-							if err != nil {
-								fmt.Printf("failed describing docdb instances  %s: %s", *member.DBInstanceIdentifier, err)
-							} else {
-								status := instances.DBInstances[0].DBInstanceStatus
-								fmt.Printf("docdb instance %s : %v\n", *instances.DBInstances[0].DBInstanceIdentifier, *status)
-								if *status != "available" {
-									allInstancesAvailable = false
-								}
+					// now check the DB instances
+					allInstancesAvailable := true
+					for _, member := range dbCluster.DBClusterMembers {
+						instances, err := conf.DOCDBClient.DescribeDBInstancesWithContext(ctx, &docdb.DescribeDBInstancesInput{DBInstanceIdentifier: member.DBInstanceIdentifier})
+						if err != nil {
+							logger.Error("failed describing docdb instance", "instance", *member.DBInstanceIdentifier, "error", err)
+						} else {
+							status := instances.DBInstances[0].DBInstanceStatus
+							logger.Info("docdb instance status", "instance", *instances.DBInstances[0].DBInstanceIdentifier, "db_status", *status)
+							if *status != "available" {
+								allInstancesAvailable = false
 							}
 						}
-						if allInstancesAvailable {
-							iaasInstance.Status = db.StatusCreateSucceeded
-							iaasInstance.LastStatusUpdate = time.Now()
-							iaasInstance.LastMessage = fmt.Sprintf("docdb cluster %s successfully created", iaasInstance.InternalId)
-							_ = db.UpdateStatusServiceInstanceForIaaSId(serviceInstance.IaaSInstanceId, db.StatusSucceeded)
-							_ = db.UpdateIaaSInstance(iaasInstance)
-							err = createIAMRoleIfNotExists(&iaasInstance, &serviceInstance)
-							if err != nil {
-								fmt.Printf("failed to create the IAM role for %s: %s", iaasInstance.InternalId, err)
-								iaasInstance.LastMessage = fmt.Sprintf("docdb cluster %s successfully created, IAM role creation failed (%s)", iaasInstance.InternalId, err)
-								_ = db.UpdateStatusServiceInstanceForIaaSId(serviceInstance.IaaSInstanceId, db.StatusSucceeded)
-								_ = db.UpdateIaaSInstance(iaasInstance)
-							}
-							break
+					}
+					if allInstancesAvailable {
+						iaasInstance.Status = db.StatusCreateSucceeded
+						iaasInstance.LastStatusUpdate = time.Now()
+						iaasInstance.LastMessage = fmt.Sprintf("docdb cluster %s successfully created", iaasInstance.InternalId)
+						_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+						_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+						// a cluster restored from a snapshot has the master password and the backup retention of the snapshot, so (re)set them for all clusters
+						if err = resetDOCDBCluster(ctx, iaasInstance, serviceInstance); err != nil {
+							logger.Error("failed to modify master password for docdb cluster", "error", err)
 						}
+						err = createIAMRoleIfNotExists(ctx, &iaasInstance, &serviceInstance)
+						if err != nil {
+							logger.Error("failed to create the IAM role", "error", err)
+							iaasInstance.LastMessage = fmt.Sprintf("docdb cluster %s successfully created, IAM role creation failed (%s)", iaasInstance.InternalId, err)
+							_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+							_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+						}
+						return true
 					}
 				}
 			}
 		}
-	}()
+		return false
+	})
+}
+
+// resetDOCDBCluster sets the master password and the backup retention (RetentionDays) of the cluster
+func resetDOCDBCluster(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	var parameters model.Parameters
+	_ = json.Unmarshal([]byte(serviceInstance.Parameters), &parameters)
+	retentionDays := parameters.RetentionDays
+	if retentionDays == 0 {
+		retentionDays = RetentionDaysDOCDBDefault
+	}
+	_, err := conf.DOCDBClient.ModifyDBClusterWithContext(ctx, &docdb.ModifyDBClusterInput{
+		ApplyImmediately:      &applyImmediately,
+		BackupRetentionPeriod: &retentionDays,
+		DBClusterIdentifier:   &iaasInstance.InternalId,
+		MasterUserPassword:    &iaasInstance.ServicePassword,
+	})
+	return err
+}
+
+// docdbClusterSnapshotExistsAndAuthorized is snapshotExistsAndAuthorized for the snapshots of DocumentDB clusters, their description has no tags, so these are listed separately
+func docdbClusterSnapshotExistsAndAuthorized(ctx context.Context, snapshotIdentifier string, serviceInstance db.ServiceInstance) bool {
+	logger := util.Logger(ctx)
+	output, err := conf.DOCDBClient.DescribeDBClusterSnapshotsWithContext(ctx, &docdb.DescribeDBClusterSnapshotsInput{DBClusterSnapshotIdentifier: &snapshotIdentifier})
+	if err != nil {
+		logger.Error("failed to describe docdb cluster snapshot", "snapshot", snapshotIdentifier, "error", err)
+		return false
+	}
+	if len(output.DBClusterSnapshots) != 1 {
+		logger.Warn("we did not find exactly 1 docdb cluster snapshot for snapshot identifier", "found", len(output.DBClusterSnapshots), "snapshot", snapshotIdentifier)
+		return false
+	}
+	tagsOutput, err := conf.DOCDBClient.ListTagsForResourceWithContext(ctx, &docdb.ListTagsForResourceInput{ResourceName: output.DBClusterSnapshots[0].DBClusterSnapshotArn})
+	if err != nil {
+		logger.Error("failed to list the tags of docdb cluster snapshot", "snapshot", snapshotIdentifier, "error", err)
+		return false
+	}
+	var tags []*rds.Tag
+	for _, tag := range tagsOutput.TagList {
+		tags = append(tags, &rds.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return snapshotTagsAuthorized(ctx, snapshotIdentifier, tags, serviceInstance)
+}
+
+// UpdateDOCDB creates a manual snapshot of the cluster (CreateSnapshot), with the tags of the service instance so the same org and space can restore it
+func UpdateDOCDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, parameters model.Parameters) error {
+	if parameters.CreateSnapshot == "" {
+		return errNoSnapshotRequested
+	}
+	_, err := conf.DOCDBClient.CreateDBClusterSnapshotWithContext(ctx, &docdb.CreateDBClusterSnapshotInput{
+		DBClusterIdentifier:         &iaasInstance.InternalId,
+		DBClusterSnapshotIdentifier: &parameters.CreateSnapshot,
+		Tags:                        getTagsForServiceInstanceDOCDB(serviceInstance),
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return fmt.Errorf("could not create snapshot %s of docdb cluster %s: %s", parameters.CreateSnapshot, iaasInstance.InternalId, strings.ReplaceAll(err.Error(), "\n", ""))
+	}
+	util.Logger(ctx).Info("creating snapshot of docdb cluster", "snapshot", parameters.CreateSnapshot)
+	return nil
 }
 
 func getTagsForServiceInstanceDOCDB(serviceInstance db.ServiceInstance) []*docdb.Tag {
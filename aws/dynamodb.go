@@ -0,0 +1,287 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	KeyTypeDynamoDBDefault             = dynamodb.ScalarAttributeTypeS
+	BillingModeDynamoDBDefault         = dynamodb.BillingModePayPerRequest
+	CapacityUnitsDynamoDBDefault       = 5
+	PointInTimeRecoveryDynamoDBDefault = true
+)
+
+var sseDynamoDB = true
+
+// tableName returns the name of the DynamoDB table of the IaaS instance
+func tableName(iaasInstance db.IaaSInstance) string {
+	return "mfsb-" + strings.ToLower(iaasInstance.InternalId)
+}
+
+// SubmitProvisionDynamoDB creates the table with the key schema (HashKey and optionally RangeKey) from the parameters, the poller then configures point-in-time recovery and TTL
+func SubmitProvisionDynamoDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	parameters := spec.Parameters
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Table creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	if parameters.HashKey == "" {
+		return failed("the HashKey parameter is missing")
+	}
+	table := tableName(iaasInstance)
+	hashKeyType := KeyTypeDynamoDBDefault
+	if parameters.HashKeyType != "" {
+		hashKeyType = parameters.HashKeyType
+	}
+	keyTypeHash := dynamodb.KeyTypeHash
+	attributes := []*dynamodb.AttributeDefinition{{AttributeName: &parameters.HashKey, AttributeType: &hashKeyType}}
+	keySchema := []*dynamodb.KeySchemaElement{{AttributeName: &parameters.HashKey, KeyType: &keyTypeHash}}
+	if parameters.RangeKey != "" {
+		rangeKeyType := KeyTypeDynamoDBDefault
+		if parameters.RangeKeyType != "" {
+			rangeKeyType = parameters.RangeKeyType
+		}
+		keyTypeRange := dynamodb.KeyTypeRange
+		attributes = append(attributes, &dynamodb.AttributeDefinition{AttributeName: &parameters.RangeKey, AttributeType: &rangeKeyType})
+		keySchema = append(keySchema, &dynamodb.KeySchemaElement{AttributeName: &parameters.RangeKey, KeyType: &keyTypeRange})
+	}
+	billingMode := BillingModeDynamoDBDefault
+	if parameters.BillingMode != "" {
+		billingMode = parameters.BillingMode
+	}
+	createTableInput := &dynamodb.CreateTableInput{
+		AttributeDefinitions: attributes,
+		BillingMode:          &billingMode,
+		KeySchema:            keySchema,
+		SSESpecification:     &dynamodb.SSESpecification{Enabled: &sseDynamoDB},
+		TableName:            &table,
+		Tags:                 getTagsForServiceInstanceDynamoDB(serviceInstance),
+	}
+	if billingMode == dynamodb.BillingModeProvisioned {
+		readCapacityUnits, writeCapacityUnits := parameters.ReadCapacityUnits, parameters.WriteCapacityUnits
+		if readCapacityUnits == 0 {
+			readCapacityUnits = CapacityUnitsDynamoDBDefault
+		}
+		if writeCapacityUnits == 0 {
+			writeCapacityUnits = CapacityUnitsDynamoDBDefault
+		}
+		createTableInput.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{ReadCapacityUnits: &readCapacityUnits, WriteCapacityUnits: &writeCapacityUnits}
+	}
+	output, err := conf.DynamoDBClient.CreateTableWithContext(ctx, createTableInput)
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create table %s: %s", table, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	// the credentials are created per binding
+	iaasInstance.ServiceUrl = "dynamodb://" + table
+	iaasInstance.ServiceUser = ""
+	iaasInstance.ServicePassword = ""
+	iaasInstance.ServiceDetails = map[string]string{db.DetailTableName: table, db.DetailTableArn: *output.TableDescription.TableArn}
+	msg := fmt.Sprintf("table %s is being created", table)
+	logger.Info(msg, "billing_mode", billingMode)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusDynamoDB(ctx, iaasInstance)
+	return nil
+}
+
+// SubmitDeletionDynamoDB deletes the table, unless MakeFinalSnapshot=false it first takes an on-demand backup and the poller deletes the table once the backup is available
+func SubmitDeletionDynamoDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	table := tableName(iaasInstance)
+	logger.Info("delete parameters", "skipFinalSnapshot", spec.SkipFinalSnapshot)
+	if !spec.SkipFinalSnapshot {
+		backupName := table + "-final"
+		output, err := conf.DynamoDBClient.CreateBackupWithContext(ctx, &dynamodb.CreateBackupInput{TableName: &table, BackupName: &backupName})
+		if err != nil {
+			LogAwsError(ctx, err)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, fmt.Sprintf("could not create the final backup of table %s: %s", table, err))
+			return err
+		}
+		logger.Info("creating final backup of table", "table", table, "backup", backupName)
+		if iaasInstance.ServiceDetails == nil {
+			iaasInstance.ServiceDetails = make(map[string]string)
+		}
+		iaasInstance.ServiceDetails[db.DetailBackupArn] = *output.BackupDetails.BackupArn
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, fmt.Sprintf("final backup %s is being created", backupName))
+		StartPollForStatusDynamoDB(ctx, iaasInstance)
+		return nil
+	}
+	logger.Info("deleting table...", "table", table)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	_, err = conf.DynamoDBClient.DeleteTableWithContext(ctx, &dynamodb.DeleteTableInput{TableName: &table})
+	if err != nil {
+		LogAwsError(ctx, err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+	}
+	StartPollForStatusDynamoDB(ctx, iaasInstance)
+	return err
+}
+
+// StartPollForStatusDynamoDB finishes the creation (configures point-in-time recovery and TTL) or the deletion (deletes the table after its final backup) of the IaaS instance, depending on its status
+func StartPollForStatusDynamoDB(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	table := tableName(iaasInstance)
+	startPoller(ctx, serviceInstance, "StartPollForStatusDynamoDB", func(ctx context.Context) bool {
+		iaasInstance := db.GetIaaSInstances(ctx, iaasInstance.Id)[0]
+		output, err := conf.DynamoDBClient.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: &table})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+				// this should only happen when a table deletion ended
+				logger.Info("table is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("table %s is gone", table))
+			} else {
+				msg := fmt.Sprintf("failed to describe table %s: %s", table, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		}
+		status := *output.Table.TableStatus
+		logger.Info("table status", "table_status", status)
+		if status != dynamodb.TableStatusActive {
+			return false
+		}
+		switch iaasInstance.Status {
+		case db.StatusCreateInProgress:
+			if err = configureTable(ctx, table, serviceInstance); err != nil {
+				LogAwsError(ctx, err)
+				msg := fmt.Sprintf("failed to configure table %s: %s", table, strings.ReplaceAll(err.Error(), "\n", ""))
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, msg)
+				return true
+			}
+			iaasInstance.Status = db.StatusCreateSucceeded
+			iaasInstance.LastStatusUpdate = time.Now()
+			iaasInstance.LastMessage = fmt.Sprintf("table %s successfully created", table)
+			_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+			_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+			return true
+		case db.StatusDeleteInProgress:
+			if backupArn := iaasInstance.ServiceDetails[db.DetailBackupArn]; backupArn != "" {
+				backup, err := conf.DynamoDBClient.DescribeBackupWithContext(ctx, &dynamodb.DescribeBackupInput{BackupArn: &backupArn})
+				if err != nil {
+					LogAwsError(ctx, err)
+					return false
+				}
+				backupStatus := *backup.BackupDescription.BackupDetails.BackupStatus
+				if backupStatus != dynamodb.BackupStatusAvailable {
+					logger.Info("final backup is not available yet", "backup_status", backupStatus)
+					return false
+				}
+			}
+			logger.Info("deleting table...", "table", table)
+			if _, err = conf.DynamoDBClient.DeleteTableWithContext(ctx, &dynamodb.DeleteTableInput{TableName: &table}); err != nil {
+				LogAwsError(ctx, err)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+				return true
+			}
+			return false
+		}
+		logger.Warn("nothing to poll for table", "table", table, "status", iaasInstance.Status)
+		return true
+	})
+}
+
+// configureTable turns on point-in-time recovery (unless PointInTimeRecovery=false) and TTL (with TTLAttribute) on the table
+func configureTable(ctx context.Context, table string, serviceInstance db.ServiceInstance) error {
+	var parameters model.Parameters
+	_ = json.Unmarshal([]byte(serviceInstance.Parameters), &parameters)
+	pointInTimeRecovery := PointInTimeRecoveryDynamoDBDefault
+	if parameters.PointInTimeRecovery != nil {
+		pointInTimeRecovery = *parameters.PointInTimeRecovery
+	}
+	if pointInTimeRecovery {
+		_, err := conf.DynamoDBClient.UpdateContinuousBackupsWithContext(ctx, &dynamodb.UpdateContinuousBackupsInput{
+			TableName:                        &table,
+			PointInTimeRecoverySpecification: &dynamodb.PointInTimeRecoverySpecification{PointInTimeRecoveryEnabled: &pointInTimeRecovery},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if parameters.TTLAttribute != "" {
+		enabled := true
+		_, err := conf.DynamoDBClient.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+			TableName:               &table,
+			TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{AttributeName: &parameters.TTLAttribute, Enabled: &enabled},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateBindingDynamoDB creates an IAM user for the binding with an access key, and a policy that only gives access to the items of the table (and its indexes).
+// The user gets the permission boundary of the broker (aws.permission_boundary_arn), like the IAM roles for AuthorizedAWSAccount.
+func CreateBindingDynamoDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error) {
+	tableArn := iaasInstance.ServiceDetails[db.DetailTableArn]
+	if tableArn == "" {
+		return nil, fmt.Errorf("table %s is not created (yet)", tableName(iaasInstance))
+	}
+	policyDoc, _ := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect": "Allow",
+			"Action": []string{"dynamodb:GetItem", "dynamodb:BatchGetItem", "dynamodb:Query", "dynamodb:Scan", "dynamodb:PutItem", "dynamodb:UpdateItem",
+				"dynamodb:DeleteItem", "dynamodb:BatchWriteItem", "dynamodb:ConditionCheckItem", "dynamodb:DescribeTable", "dynamodb:DescribeTimeToLive"},
+			"Resource": []string{tableArn, tableArn + "/index/*"},
+		}},
+	})
+	credentials, err := createBindingUser(ctx, serviceInstance, bindingId, string(policyDoc), conf.PermissionBoundaryARN)
+	if err != nil {
+		return nil, err
+	}
+	credentials[db.DetailTableName] = iaasInstance.ServiceDetails[db.DetailTableName]
+	credentials[db.DetailTableArn] = tableArn
+	return credentials, nil
+}
+
+// DeleteBindingDynamoDB deletes the IAM user of the binding, with its access keys and policy
+func DeleteBindingDynamoDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error {
+	return deleteBindingUser(ctx, binding.ServiceBindingId)
+}
+
+func getTagsForServiceInstanceDynamoDB(serviceInstance db.ServiceInstance) []*dynamodb.Tag {
+	var tagList []*dynamodb.Tag
+	for _, tag := range getTagsForServiceInstanceRDS(serviceInstance) {
+		tagList = append(tagList, &dynamodb.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tagList
+}
@@ -0,0 +1,196 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	// NumCacheClustersRedisDefault is one primary without replicas
+	NumCacheClustersRedisDefault = 1
+	RetentionDaysRedisDefault    = 1
+	RedisEngine                  = "redis"
+)
+
+// transit encryption is required for AUTH tokens, so the Redis settings below are fixed
+var (
+	transitEncryptionRedis = true
+	atRestEncryptionRedis  = true
+)
+
+// replicationGroupId returns the id of the Redis replication group of the IaaS instance, ElastiCache only accepts lowercase ids
+func replicationGroupId(iaasInstance db.IaaSInstance) string {
+	return strings.ToLower(iaasInstance.InternalId)
+}
+
+// SubmitProvisionRedis creates a Redis replication group (cluster mode disabled) with an AUTH token and in-transit encryption, with the primary and its replicas spread over the availability zones
+func SubmitProvisionRedis(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	retentionDays := spec.Parameters.RetentionDays
+	if retentionDays == 0 {
+		retentionDays = RetentionDaysRedisDefault
+	}
+	numCacheClusters := spec.Parameters.NumDBInstances
+	if numCacheClusters == 0 {
+		numCacheClusters = NumCacheClustersRedisDefault
+	}
+	// with replicas the primary fails over to a replica in another zone
+	failover := numCacheClusters > 1
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Redis creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	if conf.ElastiCacheSubnetGrp == "" {
+		return failed("aws.elasticache_subnet_group (MFSB_ELASTICACHE_SUBNETGRP) is not configured")
+	}
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	var cacheNodeType string
+	if plan.IaaS != nil {
+		cacheNodeType = plan.IaaS.InstanceClass
+	}
+	if cacheNodeType == "" {
+		return failed(fmt.Sprintf("could not find cache node type for plan %s", plan.Name))
+	}
+	azs, err := subnetGroupAZs(ctx, "elasticache", conf.ElastiCacheSubnetGrp, func(subnetGroup *string) (any, error) {
+		return conf.ElastiCacheClient.DescribeCacheSubnetGroupsWithContext(ctx, &elasticache.DescribeCacheSubnetGroupsInput{CacheSubnetGroupName: subnetGroup})
+	})
+	if err != nil {
+		return failed(err.Error())
+	}
+	// Redis has no users, clients authenticate with the AUTH token only
+	iaasInstance.ServiceUser = ""
+	iaasInstance.ServicePassword = util.SafeSubstring(fmt.Sprintf("pw%s", util.GenerateGUID()), 40)
+	groupId := replicationGroupId(iaasInstance)
+	description := fmt.Sprintf("mfsb %s (%s/%s)", serviceInstance.InstanceName, serviceInstance.OrganizationName, serviceInstance.SpaceName)
+	engine := RedisEngine
+	_, err = conf.ElastiCacheClient.CreateReplicationGroupWithContext(ctx, &elasticache.CreateReplicationGroupInput{
+		AtRestEncryptionEnabled:     &atRestEncryptionRedis,
+		AuthToken:                   &iaasInstance.ServicePassword,
+		AutoMinorVersionUpgrade:     &spec.AutoMinorVersionUpgrade,
+		AutomaticFailoverEnabled:    &failover,
+		CacheNodeType:               &cacheNodeType,
+		CacheSubnetGroupName:        &conf.ElastiCacheSubnetGrp,
+		Engine:                      &engine,
+		MultiAZEnabled:              &failover,
+		NumCacheClusters:            &numCacheClusters,
+		PreferredCacheClusterAZs:    stringPointers(pickAZs(azs, nil, int(numCacheClusters))),
+		ReplicationGroupDescription: &description,
+		ReplicationGroupId:          &groupId,
+		SecurityGroupIds:            []*string{&conf.ElastiCacheSecGrpId},
+		SnapshotRetentionLimit:      &retentionDays,
+		Tags:                        getTagsForServiceInstanceElastiCache(serviceInstance),
+		TransitEncryptionEnabled:    &transitEncryptionRedis,
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create replication group %s: %s", serviceInstance.InstanceName, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	msg := fmt.Sprintf("Redis replication group %s with %d node(s) is being created", groupId, numCacheClusters)
+	logger.Info(msg)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusRedis(ctx, iaasInstance)
+	return nil
+}
+
+// SubmitDeletionRedis deletes the Redis replication group, with a final snapshot unless MakeFinalSnapshot=false
+func SubmitDeletionRedis(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	logger.Info("deleting redis replication group...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+
+	groupId := replicationGroupId(iaasInstance)
+	var snapshotIdentifier *string
+	if !spec.SkipFinalSnapshot {
+		snapshotIdentifier = &groupId
+	}
+	logger.Info("delete parameters", "skipFinalSnapshot", spec.SkipFinalSnapshot)
+	_, err = conf.ElastiCacheClient.DeleteReplicationGroupWithContext(ctx, &elasticache.DeleteReplicationGroupInput{ReplicationGroupId: &groupId, FinalSnapshotIdentifier: snapshotIdentifier})
+	if err != nil {
+		LogAwsError(ctx, err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+	}
+	StartPollForStatusRedis(ctx, iaasInstance)
+	return err
+}
+
+func StartPollForStatusRedis(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	groupId := replicationGroupId(iaasInstance)
+	startPoller(ctx, serviceInstance, "StartPollForStatusRedis", func(ctx context.Context) bool {
+		output, err := conf.ElastiCacheClient.DescribeReplicationGroupsWithContext(ctx, &elasticache.DescribeReplicationGroupsInput{ReplicationGroupId: &groupId})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == elasticache.ErrCodeReplicationGroupNotFoundFault {
+				// this should only happen when a replication group deletion ended
+				logger.Info("redis replication group is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("redis replication group %s is gone", groupId))
+			} else {
+				msg := fmt.Sprintf("failed to describe redis replication group %s: %s", groupId, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		}
+		if len(output.ReplicationGroups) == 0 {
+			return false
+		}
+		group := output.ReplicationGroups[0]
+		logger.Info("redis replication group status", "redis_status", *group.Status)
+		if *group.Status != "available" {
+			return false
+		}
+		if len(group.NodeGroups) == 0 || group.NodeGroups[0].PrimaryEndpoint == nil {
+			logger.Warn("redis replication group is available, but has no primary endpoint yet")
+			return false
+		}
+		primary := group.NodeGroups[0].PrimaryEndpoint
+		schema := schemas[RedisEngine]
+		iaasInstance.ServiceUrl = fmt.Sprintf(schema, iaasInstance.ServiceUser, iaasInstance.ServicePassword, *primary.Address, *primary.Port)
+		iaasInstance.ServiceDetails = map[string]string{db.DetailTLS: "true"}
+		if reader := group.NodeGroups[0].ReaderEndpoint; reader != nil && len(group.MemberClusters) > 1 {
+			iaasInstance.ServiceDetails[db.DetailReaderHost] = *reader.Address
+			iaasInstance.ServiceDetails[db.DetailReaderUri] = fmt.Sprintf(schema, iaasInstance.ServiceUser, iaasInstance.ServicePassword, *reader.Address, *reader.Port)
+		}
+		iaasInstance.Status = db.StatusCreateSucceeded
+		iaasInstance.LastStatusUpdate = time.Now()
+		iaasInstance.LastMessage = fmt.Sprintf("redis replication group %s successfully created", groupId)
+		_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+		_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+		return true
+	})
+}
+
+func getTagsForServiceInstanceElastiCache(serviceInstance db.ServiceInstance) []*elasticache.Tag {
+	var tagList []*elasticache.Tag
+	for _, tag := range getTagsForServiceInstanceRDS(serviceInstance) {
+		tagList = append(tagList, &elasticache.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tagList
+}
@@ -0,0 +1,96 @@
+package aws
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// awsCall is a request to the fake AWS endpoint, Action is the X-Amz-Target operation (json protocol), the Action form value (query protocol) or the method and path (rest protocols)
+type awsCall struct {
+	Action string
+	Body   string
+}
+
+// fakeAWS is an AWS endpoint for the tests, it remembers the calls and lets respond write the responses
+type fakeAWS struct {
+	mutex sync.Mutex
+	calls []awsCall
+}
+
+// newFakeAWS returns an (instrumented) AWS session of which all clients talk to a fake endpoint
+func newFakeAWS(t *testing.T, respond func(w http.ResponseWriter, call awsCall)) (*session.Session, *fakeAWS) {
+	t.Helper()
+	fake := &fakeAWS{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		call := awsCall{Action: r.Method + " " + r.URL.Path, Body: string(body)}
+		if target := r.Header.Get("X-Amz-Target"); target != "" {
+			call.Action = target[strings.LastIndex(target, ".")+1:]
+		} else if values, err := url.ParseQuery(string(body)); err == nil && values.Get("Action") != "" {
+			call.Action = values.Get("Action")
+		}
+		fake.mutex.Lock()
+		fake.calls = append(fake.calls, call)
+		fake.mutex.Unlock()
+		respond(w, call)
+	}))
+	t.Cleanup(server.Close)
+	sess := session.Must(session.NewSession(&awssdk.Config{
+		Region:           awssdk.String("eu-west-1"),
+		Endpoint:         awssdk.String(server.URL),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       awssdk.Int(0),
+		S3ForcePathStyle: awssdk.Bool(true),
+	}))
+	InstrumentSession(sess)
+	return sess, fake
+}
+
+// Actions returns the actions of the calls, in the order they were done
+func (f *fakeAWS) Actions() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	actions := make([]string, 0, len(f.calls))
+	for _, call := range f.calls {
+		actions = append(actions, call.Action)
+	}
+	return actions
+}
+
+// Calls returns the calls, in the order they were done
+func (f *fakeAWS) Calls() []awsCall {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]awsCall(nil), f.calls...)
+}
+
+// Call returns the first call of the action
+func (f *fakeAWS) Call(action string) (awsCall, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, call := range f.calls {
+		if call.Action == action {
+			return call, true
+		}
+	}
+	return awsCall{}, false
+}
+
+// newSpanRecorder installs a tracer provider that records the spans of the test
+func newSpanRecorder() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder
+}
@@ -0,0 +1,347 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	// MSKServerless is the instance_class (and the engine) of the plans with serverless clusters
+	MSKServerless = "serverless"
+	// the SCRAM secrets of MSK have to be named AmazonMSK_*
+	scramSecretPrefix = "AmazonMSK_"
+	saslScram         = "SCRAM-SHA-512"
+	saslIam           = "AWS_MSK_IAM"
+)
+
+// the keys of the binding credentials of a Kafka cluster (next to the bootstrap_brokers detail)
+const (
+	credentialSaslMechanism    = "sasl_mechanism"
+	credentialSecurityProtocol = "security_protocol"
+	credentialUsername         = "username"
+	credentialPassword         = "password"
+)
+
+var (
+	scramMSK       = true
+	inClusterMSK   = true
+	clientTLSMSK   = kafka.ClientBrokerTls
+	noAnonymousMSK = false
+)
+
+// mskServerless tells if the plan of the service instance is a serverless cluster, these only support IAM authentication (no SCRAM)
+func mskServerless(serviceInstance db.ServiceInstance) bool {
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	return plan.IaaS != nil && plan.IaaS.InstanceClass == MSKServerless
+}
+
+// SubmitProvisionMSK creates a provisioned MSK cluster with SASL/SCRAM and TLS, or a serverless cluster with IAM authentication, in the MSK subnets
+func SubmitProvisionMSK(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Kafka cluster creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	if len(conf.MSKSubnetIds) == 0 {
+		return failed("aws.msk_subnet_ids (MFSB_MSK_SUBNET_IDS) is not configured")
+	}
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	var instanceType string
+	if plan.IaaS != nil {
+		instanceType = plan.IaaS.InstanceClass
+	}
+	if instanceType == "" {
+		return failed(fmt.Sprintf("could not find broker instance type for plan %s", plan.Name))
+	}
+	input := &kafka.CreateClusterV2Input{ClusterName: &iaasInstance.InternalId, Tags: getTagsMapForServiceInstance(serviceInstance)}
+	vpcSecGrpIds := []*string{&conf.MSKSecGrpId}
+	var numBrokers int64
+	if instanceType == MSKServerless {
+		iamEnabled := true
+		input.Serverless = &kafka.ServerlessRequest{
+			ClientAuthentication: &kafka.ServerlessClientAuthentication{Sasl: &kafka.ServerlessSasl{Iam: &kafka.Iam{Enabled: &iamEnabled}}},
+			VpcConfigs:           []*kafka.VpcConfig{{SecurityGroupIds: vpcSecGrpIds, SubnetIds: stringPointers(conf.MSKSubnetIds)}},
+		}
+	} else {
+		// every subnet (zone) gets the same number of brokers
+		numBrokers = spec.Parameters.NumDBInstances
+		if numBrokers == 0 {
+			numBrokers = int64(len(conf.MSKSubnetIds))
+		}
+		if numBrokers%int64(len(conf.MSKSubnetIds)) != 0 {
+			return failed(fmt.Sprintf("the number of brokers (%d) should be a multiple of the number of subnets (%d)", numBrokers, len(conf.MSKSubnetIds)))
+		}
+		input.Provisioned = &kafka.ProvisionedRequest{
+			BrokerNodeGroupInfo: &kafka.BrokerNodeGroupInfo{
+				ClientSubnets:  stringPointers(conf.MSKSubnetIds),
+				InstanceType:   &instanceType,
+				SecurityGroups: vpcSecGrpIds,
+				StorageInfo:    &kafka.StorageInfo{EbsStorageInfo: &kafka.EBSStorageInfo{VolumeSize: &spec.AllocatedStorageGB}},
+			},
+			ClientAuthentication: &kafka.ClientAuthentication{
+				Sasl:            &kafka.Sasl{Scram: &kafka.Scram{Enabled: &scramMSK}},
+				Unauthenticated: &kafka.Unauthenticated{Enabled: &noAnonymousMSK},
+			},
+			EncryptionInfo:      &kafka.EncryptionInfo{EncryptionInTransit: &kafka.EncryptionInTransit{ClientBroker: &clientTLSMSK, InCluster: &inClusterMSK}},
+			KafkaVersion:        &spec.Engine,
+			NumberOfBrokerNodes: &numBrokers,
+		}
+	}
+	output, err := conf.KafkaClient.CreateClusterV2WithContext(ctx, input)
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create kafka cluster %s: %s", serviceInstance.InstanceName, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	// the users are created per binding
+	iaasInstance.ServiceUser = ""
+	iaasInstance.ServicePassword = ""
+	iaasInstance.ServiceDetails = map[string]string{db.DetailClusterArn: *output.ClusterArn}
+	msg := fmt.Sprintf("kafka cluster %s is being created, this can take more than half an hour", iaasInstance.InternalId)
+	logger.Info(msg, "instance_type", instanceType, "brokers", numBrokers)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusMSK(ctx, iaasInstance)
+	return nil
+}
+
+// SubmitDeletionMSK deletes the Kafka cluster, the SCRAM secrets of the bindings are deleted on unbind
+func SubmitDeletionMSK(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	logger.Info("deleting kafka cluster...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	clusterArn := iaasInstance.ServiceDetails[db.DetailClusterArn]
+	_, err := conf.KafkaClient.DeleteClusterWithContext(ctx, &kafka.DeleteClusterInput{ClusterArn: &clusterArn})
+	if err != nil {
+		LogAwsError(ctx, err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+	}
+	StartPollForStatusMSK(ctx, iaasInstance)
+	return err
+}
+
+// StartPollForStatusMSK waits until the cluster is active (and records its bootstrap brokers), or until it is gone
+func StartPollForStatusMSK(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	clusterArn := iaasInstance.ServiceDetails[db.DetailClusterArn]
+	startPoller(ctx, serviceInstance, "StartPollForStatusMSK", func(ctx context.Context) bool {
+		output, err := conf.KafkaClient.DescribeClusterV2WithContext(ctx, &kafka.DescribeClusterV2Input{ClusterArn: &clusterArn})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == kafka.ErrCodeNotFoundException {
+				// this should only happen when a cluster deletion ended
+				logger.Info("kafka cluster is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("kafka cluster %s is gone", iaasInstance.InternalId))
+			} else {
+				msg := fmt.Sprintf("failed to describe kafka cluster %s: %s", iaasInstance.InternalId, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		}
+		state := *output.ClusterInfo.State
+		logger.Info("kafka cluster status", "kafka_status", state)
+		// the cluster can still be active right after the deletion was submitted
+		deleting := db.GetIaaSInstances(ctx, iaasInstance.Id)[0].Status == db.StatusDeleteInProgress
+		if state == kafka.ClusterStateFailed {
+			msg := fmt.Sprintf("kafka cluster %s failed", iaasInstance.InternalId)
+			if info := output.ClusterInfo.StateInfo; info != nil && info.Message != nil {
+				msg = fmt.Sprintf("%s: %s", msg, *info.Message)
+			}
+			status := db.StatusCreateFailed
+			if deleting {
+				status = db.StatusDeleteFailed
+			}
+			logger.Error(msg)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, status, msg)
+			return true
+		}
+		if deleting || state != kafka.ClusterStateActive {
+			return false
+		}
+		brokers, err := conf.KafkaClient.GetBootstrapBrokersWithContext(ctx, &kafka.GetBootstrapBrokersInput{ClusterArn: &clusterArn})
+		if err != nil {
+			LogAwsError(ctx, err)
+			return false
+		}
+		bootstrapBrokers := brokers.BootstrapBrokerStringSaslScram
+		if *output.ClusterInfo.ClusterType == kafka.ClusterTypeServerless {
+			bootstrapBrokers = brokers.BootstrapBrokerStringSaslIam
+		}
+		if bootstrapBrokers == nil {
+			logger.Warn("kafka cluster is active, but has no bootstrap brokers yet")
+			return false
+		}
+		iaasInstance.ServiceUrl = *bootstrapBrokers
+		if iaasInstance.ServiceDetails == nil {
+			iaasInstance.ServiceDetails = map[string]string{db.DetailClusterArn: clusterArn}
+		}
+		iaasInstance.ServiceDetails[db.DetailBootstrapBrokers] = *bootstrapBrokers
+		iaasInstance.ServiceDetails[db.DetailTLS] = "true"
+		iaasInstance.Status = db.StatusCreateSucceeded
+		iaasInstance.LastStatusUpdate = time.Now()
+		iaasInstance.LastMessage = fmt.Sprintf("kafka cluster %s successfully created", iaasInstance.InternalId)
+		_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+		_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+		return true
+	})
+}
+
+// CreateBindingMSK creates a SCRAM user for the binding (a secret in Secrets Manager, associated with the cluster), or an IAM user with an access key for a serverless cluster
+func CreateBindingMSK(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error) {
+	clusterArn := iaasInstance.ServiceDetails[db.DetailClusterArn]
+	bootstrapBrokers := iaasInstance.ServiceDetails[db.DetailBootstrapBrokers]
+	if bootstrapBrokers == "" {
+		return nil, fmt.Errorf("kafka cluster %s is not created (yet)", iaasInstance.InternalId)
+	}
+	var credentials map[string]string
+	var err error
+	if mskServerless(serviceInstance) {
+		credentials, err = createBindingUser(ctx, serviceInstance, bindingId, mskAccessPolicyDoc(clusterArn), "")
+		if err != nil {
+			return nil, err
+		}
+		credentials[credentialSaslMechanism] = saslIam
+	} else {
+		credentials, err = createScramUser(ctx, serviceInstance, clusterArn, bindingId)
+		if err != nil {
+			return nil, err
+		}
+		credentials[credentialSaslMechanism] = saslScram
+	}
+	credentials[db.DetailBootstrapBrokers] = bootstrapBrokers
+	credentials[credentialSecurityProtocol] = "SASL_SSL"
+	return credentials, nil
+}
+
+// DeleteBindingMSK deletes the SCRAM user (or the IAM user) of the binding
+func DeleteBindingMSK(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error {
+	if mskServerless(serviceInstance) {
+		return deleteBindingUser(ctx, binding.ServiceBindingId)
+	}
+	return deleteScramUser(ctx, iaasInstance.ServiceDetails[db.DetailClusterArn], binding.ServiceBindingId)
+}
+
+// mskAccessPolicyDoc returns the IAM policy that gives access to the cluster and its topics, groups and transactional ids
+func mskAccessPolicyDoc(clusterArn string) string {
+	var resources []string
+	for _, kind := range []string{"cluster", "topic", "group", "transactional-id"} {
+		resource := strings.Replace(clusterArn, ":cluster/", ":"+kind+"/", 1)
+		if kind != "cluster" {
+			resource += "/*"
+		}
+		resources = append(resources, resource)
+	}
+	policyDoc, _ := json.Marshal(map[string]any{
+		"Version":   "2012-10-17",
+		"Statement": []map[string]any{{"Effect": "Allow", "Action": "kafka-cluster:*", "Resource": resources}},
+	})
+	return string(policyDoc)
+}
+
+// scramSecretName returns the name of the secret with the SCRAM user of the binding
+func scramSecretName(bindingId string) string {
+	return scramSecretPrefix + bindingUserName(bindingId)
+}
+
+// createScramUser stores a SCRAM user for the binding in Secrets Manager (encrypted with the MSK key) and associates it with the cluster, a secret that already exists gets a new password
+func createScramUser(ctx context.Context, serviceInstance db.ServiceInstance, clusterArn, bindingId string) (map[string]string, error) {
+	logger := util.Logger(ctx)
+	if conf.MSKKmsKeyId == "" {
+		return nil, errors.New("aws.msk_kms_key_id (MFSB_MSK_KMS_KEY_ID) is not configured")
+	}
+	secretName := scramSecretName(bindingId)
+	username := bindingUserName(bindingId)
+	password := util.SafeSubstring(fmt.Sprintf("pw%s", util.GenerateGUID()), 40)
+	secretJson, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	secretString := string(secretJson)
+	var secretArn *string
+	output, err := conf.SecretsManagerClient.CreateSecretWithContext(ctx, &secretsmanager.CreateSecretInput{Name: &secretName, KmsKeyId: &conf.MSKKmsKeyId, SecretString: &secretString, Tags: getTagsForServiceInstanceSecretsManager(serviceInstance)})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == secretsmanager.ErrCodeResourceExistsException {
+		// a previous attempt to bind created the secret, it gets the new password
+		logger.Info("SCRAM secret already exists, replacing its password", "secret", secretName)
+		var putOutput *secretsmanager.PutSecretValueOutput
+		putOutput, err = conf.SecretsManagerClient.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{SecretId: &secretName, SecretString: &secretString})
+		if err == nil {
+			secretArn = putOutput.ARN
+		}
+	} else if err == nil {
+		secretArn = output.ARN
+	}
+	if err != nil {
+		LogAwsError(ctx, err)
+		return nil, fmt.Errorf("could not create SCRAM secret %s: %s", secretName, err)
+	}
+	associateOutput, err := conf.KafkaClient.BatchAssociateScramSecretWithContext(ctx, &kafka.BatchAssociateScramSecretInput{ClusterArn: &clusterArn, SecretArnList: []*string{secretArn}})
+	if err == nil && len(associateOutput.UnprocessedScramSecrets) > 0 {
+		unprocessed := associateOutput.UnprocessedScramSecrets[0]
+		err = fmt.Errorf("%s: %s", *unprocessed.ErrorCode, *unprocessed.ErrorMessage)
+	}
+	if err != nil {
+		LogAwsError(ctx, err)
+		return nil, fmt.Errorf("could not associate SCRAM secret %s with the kafka cluster: %s", secretName, err)
+	}
+	logger.Info("created SCRAM user for binding", "user", username)
+	return map[string]string{credentialUsername: username, credentialPassword: password}, nil
+}
+
+// deleteScramUser disassociates the SCRAM secret of the binding from the cluster and deletes it, a secret that is already gone is no error
+func deleteScramUser(ctx context.Context, clusterArn, bindingId string) error {
+	logger := util.Logger(ctx)
+	secretName := scramSecretName(bindingId)
+	describeOutput, err := conf.SecretsManagerClient.DescribeSecretWithContext(ctx, &secretsmanager.DescribeSecretInput{SecretId: &secretName})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		logger.Info("SCRAM secret of binding is already gone", "secret", secretName)
+		return nil
+	}
+	if err != nil {
+		LogAwsError(ctx, err)
+		return err
+	}
+	// the cluster may be gone already, then there is nothing to disassociate
+	if _, err = conf.KafkaClient.BatchDisassociateScramSecretWithContext(ctx, &kafka.BatchDisassociateScramSecretInput{ClusterArn: &clusterArn, SecretArnList: []*string{describeOutput.ARN}}); err != nil {
+		logger.Warn("could not disassociate SCRAM secret from the kafka cluster", "secret", secretName, "error", err)
+	}
+	force := true
+	if _, err = conf.SecretsManagerClient.DeleteSecretWithContext(ctx, &secretsmanager.DeleteSecretInput{SecretId: describeOutput.ARN, ForceDeleteWithoutRecovery: &force}); err != nil {
+		LogAwsError(ctx, err)
+		return err
+	}
+	logger.Info("deleted SCRAM user of binding", "secret", secretName)
+	return nil
+}
+
+func getTagsForServiceInstanceSecretsManager(serviceInstance db.ServiceInstance) []*secretsmanager.Tag {
+	var tagList []*secretsmanager.Tag
+	for _, tag := range getTagsForServiceInstanceRDS(serviceInstance) {
+		tagList = append(tagList, &secretsmanager.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tagList
+}
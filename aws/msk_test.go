@@ -0,0 +1,158 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kafka"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+)
+
+const (
+	testClusterArn    = "arn:aws:kafka:eu-west-1:123456789012:cluster/mfsb-kafka-1/abcd"
+	testScramKeyId    = "arn:aws:kms:eu-west-1:123456789012:key/msk-key"
+	testScramArn      = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:AmazonMSK_mfsb-binding-1-AbCdEf"
+	testReplacedScram = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:AmazonMSK_mfsb-binding-1-GhIjKl"
+)
+
+// useMSK makes the Kafka and Secrets Manager clients talk to a fake endpoint for the duration of the test
+func useMSK(t *testing.T, respond func(w http.ResponseWriter, call awsCall)) *fakeAWS {
+	sess, fake := newFakeAWS(t, respond)
+	savedKafka, savedSecretsManager, savedKeyId := conf.KafkaClient, conf.SecretsManagerClient, conf.MSKKmsKeyId
+	conf.KafkaClient, conf.SecretsManagerClient, conf.MSKKmsKeyId = kafka.New(sess), secretsmanager.New(sess), testScramKeyId
+	t.Cleanup(func() {
+		conf.KafkaClient, conf.SecretsManagerClient, conf.MSKKmsKeyId = savedKafka, savedSecretsManager, savedKeyId
+	})
+	return fake
+}
+
+// isAssociate tells if the call is a BatchAssociateScramSecret, a rest call with the cluster arn in its path
+func isAssociate(call awsCall) bool {
+	return strings.HasPrefix(call.Action, "POST ") && strings.HasSuffix(call.Action, "/scram-secrets")
+}
+
+// associated returns the secret arns of the BatchAssociateScramSecret call
+func associated(t *testing.T, fake *fakeAWS) []string {
+	t.Helper()
+	for _, call := range fake.Calls() {
+		if isAssociate(call) {
+			var input struct {
+				SecretArnList []string `json:"secretArnList"`
+			}
+			if err := json.Unmarshal([]byte(call.Body), &input); err != nil {
+				t.Fatalf("the associate request %s is invalid: %s", call.Body, err)
+			}
+			return input.SecretArnList
+		}
+	}
+	return nil
+}
+
+func TestCreateScramUser(t *testing.T) {
+	fake := useMSK(t, func(w http.ResponseWriter, call awsCall) {
+		switch {
+		case call.Action == "CreateSecret":
+			_, _ = w.Write([]byte(`{"ARN": "` + testScramArn + `", "Name": "AmazonMSK_mfsb-binding-1"}`))
+		case isAssociate(call):
+			_, _ = w.Write([]byte(`{"clusterArn": "` + testClusterArn + `", "unprocessedScramSecrets": []}`))
+		default:
+			t.Errorf("unexpected call %s", call.Action)
+		}
+	})
+
+	credentials, err := createScramUser(context.Background(), db.ServiceInstance{}, testClusterArn, "binding-1")
+	if err != nil {
+		t.Fatalf("creating the SCRAM user failed: %s", err)
+	}
+	call, found := fake.Call("CreateSecret")
+	if !found {
+		t.Fatalf("no secret was created, got the calls %v", fake.Actions())
+	}
+	var input struct{ Name, KmsKeyId, SecretString string }
+	_ = json.Unmarshal([]byte(call.Body), &input)
+	var secret map[string]string
+	_ = json.Unmarshal([]byte(input.SecretString), &secret)
+	if !strings.HasPrefix(input.Name, "AmazonMSK_") || input.KmsKeyId != testScramKeyId {
+		t.Errorf("the secret should be an MSK secret encrypted with the MSK key, got %s", call.Body)
+	}
+	if secret["username"] != credentials[credentialUsername] || secret["password"] == "" || secret["password"] != credentials[credentialPassword] {
+		t.Errorf("the secret %v should hold the credentials %v", secret, credentials)
+	}
+	if arns := associated(t, fake); len(arns) != 1 || arns[0] != testScramArn {
+		t.Errorf("the created secret should be associated with the cluster, got %v", arns)
+	}
+}
+
+func TestCreateScramUserReplacesAnExistingSecret(t *testing.T) {
+	fake := useMSK(t, func(w http.ResponseWriter, call awsCall) {
+		switch {
+		case call.Action == "CreateSecret":
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "ResourceExistsException", "message": "the secret already exists"}`))
+		case call.Action == "PutSecretValue":
+			_, _ = w.Write([]byte(`{"ARN": "` + testReplacedScram + `", "Name": "AmazonMSK_mfsb-binding-1", "VersionId": "v2"}`))
+		case isAssociate(call):
+			_, _ = w.Write([]byte(`{"clusterArn": "` + testClusterArn + `", "unprocessedScramSecrets": []}`))
+		default:
+			t.Errorf("unexpected call %s", call.Action)
+		}
+	})
+
+	credentials, err := createScramUser(context.Background(), db.ServiceInstance{}, testClusterArn, "binding-1")
+	if err != nil {
+		t.Fatalf("creating the SCRAM user failed: %s", err)
+	}
+	call, found := fake.Call("PutSecretValue")
+	if !found {
+		t.Fatalf("the existing secret should get a new value, got the calls %v", fake.Actions())
+	}
+	var input struct{ SecretId, SecretString string }
+	_ = json.Unmarshal([]byte(call.Body), &input)
+	var secret map[string]string
+	_ = json.Unmarshal([]byte(input.SecretString), &secret)
+	if secret["password"] == "" || secret["password"] != credentials[credentialPassword] {
+		t.Errorf("the secret %v should get the new password of the credentials %v", secret, credentials)
+	}
+	if arns := associated(t, fake); len(arns) != 1 || arns[0] != testReplacedScram {
+		t.Errorf("the replaced secret should be associated with the cluster, got %v", arns)
+	}
+}
+
+func TestCreateScramUserFails(t *testing.T) {
+	t.Run("unprocessed secret", func(t *testing.T) {
+		useMSK(t, func(w http.ResponseWriter, call awsCall) {
+			switch {
+			case call.Action == "CreateSecret":
+				_, _ = w.Write([]byte(`{"ARN": "` + testScramArn + `", "Name": "AmazonMSK_mfsb-binding-1"}`))
+			case isAssociate(call):
+				_, _ = w.Write([]byte(`{"clusterArn": "` + testClusterArn + `", "unprocessedScramSecrets": [{"secretArn": "` + testScramArn + `", "errorCode": "InvalidSecret", "errorMessage": "the secret is not encrypted with a customer managed key"}]}`))
+			default:
+				t.Errorf("unexpected call %s", call.Action)
+			}
+		})
+		credentials, err := createScramUser(context.Background(), db.ServiceInstance{}, testClusterArn, "binding-1")
+		expected := "could not associate SCRAM secret AmazonMSK_mfsb-binding-1 with the kafka cluster: InvalidSecret: the secret is not encrypted with a customer managed key"
+		if err == nil || err.Error() != expected || credentials != nil {
+			t.Errorf("creating the SCRAM user returned %v, %v, expected the error %s", credentials, err, expected)
+		}
+	})
+	t.Run("no key configured", func(t *testing.T) {
+		fake := useMSK(t, func(w http.ResponseWriter, call awsCall) {
+			t.Errorf("unexpected call %s", call.Action)
+		})
+		conf.MSKKmsKeyId = ""
+		credentials, err := createScramUser(context.Background(), db.ServiceInstance{}, testClusterArn, "binding-1")
+		if err == nil || !strings.Contains(err.Error(), "msk_kms_key_id") || credentials != nil {
+			t.Errorf("creating the SCRAM user returned %v, %v, expected an error about the missing key", credentials, err)
+		}
+		if len(fake.Calls()) != 0 {
+			t.Errorf("no AWS calls expected, got %v", fake.Actions())
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const RetentionDaysNeptuneDefault = 7
+
+var neptuneEngine = "neptune"
+
+// SubmitProvisionNeptune creates a Neptune cluster and its instance(s), spread over the zones of the Neptune subnet group, optionally with IAM database authentication
+func SubmitProvisionNeptune(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	parameters := spec.Parameters
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	if conf.NeptuneSubnetGrp == "" {
+		return failed("aws.neptune_subnet_group (MFSB_NEPTUNE_SUBNETGRP) is not configured")
+	}
+	retentionDays := parameters.RetentionDays
+	if retentionDays == 0 {
+		retentionDays = RetentionDaysNeptuneDefault
+	}
+	numInstances := parameters.NumDBInstances
+	if numInstances == 0 {
+		numInstances = NumInstancesDOCDBDefault
+	}
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	var dbInstanceClass string
+	if plan.IaaS != nil {
+		dbInstanceClass = plan.IaaS.InstanceClass
+	}
+	if dbInstanceClass == "" {
+		return failed(fmt.Sprintf("could not find database instance class for plan %s", plan.Name))
+	}
+	azs, err := subnetGroupAZs(ctx, "neptune", conf.NeptuneSubnetGrp, func(subnetGroup *string) (any, error) {
+		return conf.NeptuneClient.DescribeDBSubnetGroupsWithContext(ctx, &neptune.DescribeDBSubnetGroupsInput{DBSubnetGroupName: subnetGroup})
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(err.Error())
+	}
+	// Neptune has no master user, without IAM authentication the access is only limited by the security group
+	iaasInstance.ServiceUser = ""
+	iaasInstance.ServicePassword = ""
+	_, err = conf.NeptuneClient.CreateDBClusterWithContext(ctx, &neptune.CreateDBClusterInput{
+		AvailabilityZones:               stringPointers(azs),
+		BackupRetentionPeriod:           &retentionDays,
+		DBClusterIdentifier:             &iaasInstance.InternalId,
+		DBSubnetGroupName:               &conf.NeptuneSubnetGrp,
+		DeletionProtection:              &deleteProtection,
+		EnableCloudwatchLogsExports:     stringPointers([]string{auditLog}),
+		EnableIAMDatabaseAuthentication: &parameters.IAMAuthentication,
+		Engine:                          &neptuneEngine,
+		StorageEncrypted:                &storageEncrypted,
+		Tags:                            getTagsForServiceInstanceNeptune(serviceInstance),
+		VpcSecurityGroupIds:             []*string{&conf.NeptuneSecGrpId},
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create cluster %s: %s", serviceInstance.InstanceName, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	logger.Info("neptune cluster created", "cluster", iaasInstance.InternalId, "iam_auth", parameters.IAMAuthentication)
+
+	memberAZs, azErr := clusterMemberAZs(iaasInstance.InternalId, func(filterName *string, clusterId *string) (any, error) {
+		return conf.NeptuneClient.DescribeDBInstancesWithContext(ctx, &neptune.DescribeDBInstancesInput{Filters: []*neptune.Filter{{Name: filterName, Values: []*string{clusterId}}}})
+	})
+	if azErr != nil {
+		logger.Warn("could not get the zones of the cluster members, spreading as if there are none", "error", azErr)
+	}
+	instanceAZs := pickAZs(azs, memberAZs, int(numInstances))
+	var createdInstances []string
+	for ix, instanceIdentifier := range instanceIdentifiers(iaasInstance.InternalId, instanceAZs) {
+		instanceIdentifier := instanceIdentifier
+		az := instanceAZs[ix]
+		logger.Info("creating neptune instance for cluster...", "instance", instanceIdentifier, "az", az)
+		_, err = conf.NeptuneClient.CreateDBInstanceWithContext(ctx, &neptune.CreateDBInstanceInput{
+			AutoMinorVersionUpgrade: &spec.AutoMinorVersionUpgrade,
+			AvailabilityZone:        &az,
+			DBClusterIdentifier:     &iaasInstance.InternalId,
+			DBInstanceClass:         &dbInstanceClass,
+			DBInstanceIdentifier:    &instanceIdentifier,
+			Engine:                  &neptuneEngine,
+			Tags:                    getTagsForServiceInstanceNeptune(serviceInstance),
+		})
+		if err != nil {
+			LogAwsError(ctx, err)
+			msg := fmt.Sprintf("could not create instance %s: %s", instanceIdentifier, strings.ReplaceAll(err.Error(), "\n", ""))
+			skipFinalSnapshot := true
+			if cleanupErr := deleteFailedCluster(ctx, iaasInstance.InternalId, createdInstances, func(instanceId *string) error {
+				_, err := conf.NeptuneClient.DeleteDBInstanceWithContext(ctx, &neptune.DeleteDBInstanceInput{DBInstanceIdentifier: instanceId})
+				return err
+			}, func(clusterId *string) error {
+				_, err := conf.NeptuneClient.DeleteDBClusterWithContext(ctx, &neptune.DeleteDBClusterInput{DBClusterIdentifier: clusterId, SkipFinalSnapshot: &skipFinalSnapshot})
+				return err
+			}); cleanupErr != nil {
+				msg = fmt.Sprintf("%s, the cluster is left behind: %s", msg, strings.ReplaceAll(cleanupErr.Error(), "\n", ", "))
+			}
+			return failed(msg)
+		}
+		createdInstances = append(createdInstances, instanceIdentifier)
+	}
+	iaasInstance.ServiceDetails = map[string]string{db.DetailIAMAuth: strconv.FormatBool(parameters.IAMAuthentication)}
+	msg := fmt.Sprintf("neptune cluster %s with %d instance(s) is being created", iaasInstance.InternalId, numInstances)
+	logger.Info(msg)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusNeptune(ctx, iaasInstance)
+	return nil
+}
+
+// SubmitDeletionNeptune deletes the instances and the cluster, with a final snapshot unless MakeFinalSnapshot=false
+func SubmitDeletionNeptune(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	logger.Info("deleting neptune cluster...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	deleteFailed := func(err error) error {
+		LogAwsError(ctx, err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+		return err
+	}
+	output, err := conf.NeptuneClient.DescribeDBClustersWithContext(ctx, &neptune.DescribeDBClustersInput{DBClusterIdentifier: &iaasInstance.InternalId})
+	if err != nil {
+		return deleteFailed(fmt.Errorf("could not describe cluster %s: %w", iaasInstance.InternalId, err))
+	}
+	for _, member := range output.DBClusters[0].DBClusterMembers {
+		logger.Info("deleting neptune instance", "instance", *member.DBInstanceIdentifier)
+		if _, err = conf.NeptuneClient.DeleteDBInstanceWithContext(ctx, &neptune.DeleteDBInstanceInput{DBInstanceIdentifier: member.DBInstanceIdentifier}); err != nil {
+			return deleteFailed(fmt.Errorf("failed to delete neptune instance %s: %w", *member.DBInstanceIdentifier, err))
+		}
+	}
+	deleteClusterInput := &neptune.DeleteDBClusterInput{DBClusterIdentifier: &iaasInstance.InternalId, SkipFinalSnapshot: &spec.SkipFinalSnapshot}
+	if !spec.SkipFinalSnapshot {
+		deleteClusterInput.FinalDBSnapshotIdentifier = &iaasInstance.InternalId
+	}
+	logger.Info("delete parameters", "skipFinalSnapshot", spec.SkipFinalSnapshot)
+	if _, err = conf.NeptuneClient.DeleteDBClusterWithContext(ctx, deleteClusterInput); err != nil {
+		err = deleteFailed(err)
+	}
+	StartPollForStatusNeptune(ctx, iaasInstance)
+	return err
+}
+
+// StartPollForStatusNeptune waits until the cluster and all its instances are available (and records the endpoints), or until the cluster is gone
+func StartPollForStatusNeptune(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	startPoller(ctx, serviceInstance, "StartPollForStatusNeptune", func(ctx context.Context) bool {
+		output, err := conf.NeptuneClient.DescribeDBClustersWithContext(ctx, &neptune.DescribeDBClustersInput{DBClusterIdentifier: &iaasInstance.InternalId})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == neptune.ErrCodeDBClusterNotFoundFault {
+				// this should only happen when a cluster deletion ended
+				logger.Info("neptune cluster is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("neptune cluster %s is gone", iaasInstance.InternalId))
+			} else {
+				msg := fmt.Sprintf("failed to describe neptune cluster %s: %s", iaasInstance.InternalId, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		}
+		if len(output.DBClusters) == 0 {
+			return false
+		}
+		cluster := output.DBClusters[0]
+		logger.Info("neptune cluster status", "db_status", *cluster.Status)
+		// the cluster can still be available right after the deletion was submitted
+		deleting := db.GetIaaSInstances(ctx, iaasInstance.Id)[0].Status == db.StatusDeleteInProgress
+		if deleting || *cluster.Status != "available" {
+			return false
+		}
+		for _, member := range cluster.DBClusterMembers {
+			instances, err := conf.NeptuneClient.DescribeDBInstancesWithContext(ctx, &neptune.DescribeDBInstancesInput{DBInstanceIdentifier: member.DBInstanceIdentifier})
+			if err != nil {
+				logger.Error("failed describing neptune instance", "instance", *member.DBInstanceIdentifier, "error", err)
+				return false
+			}
+			status := *instances.DBInstances[0].DBInstanceStatus
+			logger.Info("neptune instance status", "instance", *member.DBInstanceIdentifier, "db_status", status)
+			if status != "available" {
+				return false
+			}
+		}
+		endpoint, port := *cluster.Endpoint, *cluster.Port
+		iaasInstance.ServiceUrl = fmt.Sprintf("wss://%s:%d/gremlin", endpoint, port)
+		iaasInstance.ServiceDetails = map[string]string{
+			db.DetailGremlinEndpoint: iaasInstance.ServiceUrl,
+			db.DetailSparqlEndpoint:  fmt.Sprintf("https://%s:%d/sparql", endpoint, port),
+			db.DetailReaderHost:      *cluster.ReaderEndpoint,
+			db.DetailResourceId:      *cluster.DbClusterResourceId,
+			db.DetailIAMAuth:         strconv.FormatBool(cluster.IAMDatabaseAuthenticationEnabled != nil && *cluster.IAMDatabaseAuthenticationEnabled),
+			db.DetailTLS:             "true",
+		}
+		iaasInstance.Status = db.StatusCreateSucceeded
+		iaasInstance.LastStatusUpdate = time.Now()
+		iaasInstance.LastMessage = fmt.Sprintf("neptune cluster %s successfully created", iaasInstance.InternalId)
+		_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+		_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+		return true
+	})
+}
+
+// CreateBindingNeptune returns the gremlin and sparql endpoints of the cluster, with IAM authentication the binding also gets an IAM user with an access key that can connect to the cluster
+func CreateBindingNeptune(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error) {
+	details := iaasInstance.ServiceDetails
+	if details[db.DetailGremlinEndpoint] == "" {
+		return nil, fmt.Errorf("neptune cluster %s is not created (yet)", iaasInstance.InternalId)
+	}
+	credentials := make(map[string]string)
+	if details[db.DetailIAMAuth] == "true" {
+		account, err := accountId(ctx)
+		if err != nil {
+			LogAwsError(ctx, err)
+			return nil, fmt.Errorf("could not get the AWS account: %s", err)
+		}
+		policyDoc, _ := json.Marshal(map[string]any{
+			"Version": "2012-10-17",
+			"Statement": []map[string]any{{
+				"Effect":   "Allow",
+				"Action":   "neptune-db:*",
+				"Resource": fmt.Sprintf("arn:aws:neptune-db:%s:%s:%s/*", conf.AWSRegion, account, details[db.DetailResourceId]),
+			}},
+		})
+		if credentials, err = createBindingUser(ctx, serviceInstance, bindingId, string(policyDoc), ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range []string{db.DetailGremlinEndpoint, db.DetailSparqlEndpoint, db.DetailReaderHost, db.DetailIAMAuth, db.DetailTLS} {
+		credentials[key] = details[key]
+	}
+	credentials["uri"] = details[db.DetailGremlinEndpoint]
+	return credentials, nil
+}
+
+// DeleteBindingNeptune deletes the IAM user of the binding, if it got one
+func DeleteBindingNeptune(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error {
+	if binding.Credentials[credentialAccessKeyId] == "" {
+		return nil
+	}
+	return deleteBindingUser(ctx, binding.ServiceBindingId)
+}
+
+func getTagsForServiceInstanceNeptune(serviceInstance db.ServiceInstance) []*neptune.Tag {
+	var tagList []*neptune.Tag
+	for _, tag := range getTagsForServiceInstanceRDS(serviceInstance) {
+		tagList = append(tagList, &neptune.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tagList
+}
@@ -0,0 +1,204 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	NumInstancesOpenSearchDefault = 1
+	OpenSearchEngine              = "opensearch"
+	// the domain endpoint only listens on https
+	openSearchPort = 443
+)
+
+var userNameOpenSearch = "mfsbadmin"
+
+// fine-grained access control (the master user) requires encryption at rest, node-to-node encryption and https, so these are fixed
+var (
+	enabledOpenSearch    = true
+	tlsPolicyOpenSearch  = opensearchservice.TLSSecurityPolicyPolicyMinTls12201907
+	volumeTypeOpenSearch = opensearchservice.VolumeTypeGp3
+)
+
+// domainName returns the name of the OpenSearch domain of the IaaS instance, OpenSearch only accepts lowercase names
+func domainName(iaasInstance db.IaaSInstance) string {
+	return strings.ToLower(iaasInstance.InternalId)
+}
+
+// openSearchZones returns the subnets for a domain with count data nodes, and the number of zones to spread them over (0 without zone awareness).
+// Zone awareness needs as many subnets as zones and a node count that is a multiple of the zones, without it the domain is in one subnet.
+func openSearchZones(count int64) ([]string, int64) {
+	subnets := conf.OpenSearchSubnetIds
+	for _, zones := range []int64{3, 2} {
+		if count > 1 && count%zones == 0 && int64(len(subnets)) >= zones {
+			return subnets[:zones], zones
+		}
+	}
+	return subnets[:1], 0
+}
+
+// SubmitProvisionOpenSearch creates a VPC OpenSearch domain with encryption at rest, node-to-node encryption and a master user in the internal user database
+func SubmitProvisionOpenSearch(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	numInstances := spec.Parameters.NumDBInstances
+	if numInstances == 0 {
+		numInstances = NumInstancesOpenSearchDefault
+	}
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("OpenSearch creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	if len(conf.OpenSearchSubnetIds) == 0 {
+		return failed("aws.opensearch_subnet_ids (MFSB_OPENSEARCH_SUBNET_IDS) is not configured")
+	}
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	var instanceType string
+	if plan.IaaS != nil {
+		instanceType = plan.IaaS.InstanceClass
+	}
+	if instanceType == "" {
+		return failed(fmt.Sprintf("could not find instance type for plan %s", plan.Name))
+	}
+	account, err := accountId(ctx)
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not get the AWS account: %s", err))
+	}
+	domain := domainName(iaasInstance)
+	// the security group limits the network access, the master user (fine-grained access control) the access to the data
+	accessPolicyJson, _ := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect":    "Allow",
+			"Principal": map[string]string{"AWS": "*"},
+			"Action":    "es:ESHttp*",
+			"Resource":  fmt.Sprintf("arn:aws:es:%s:%s:domain/%s/*", conf.AWSRegion, account, domain),
+		}},
+	})
+	accessPolicy := string(accessPolicyJson)
+	iaasInstance.ServiceUser = userNameOpenSearch
+	// the master password needs an uppercase and a lowercase letter, a digit and a special character
+	iaasInstance.ServicePassword = util.SafeSubstring(fmt.Sprintf("Pw%s", util.GenerateGUID()), 40)
+	subnets, zones := openSearchZones(numInstances)
+	clusterConfig := &opensearchservice.ClusterConfig{InstanceCount: &numInstances, InstanceType: &instanceType}
+	if zones > 0 {
+		zoneAwareness := true
+		clusterConfig.ZoneAwarenessEnabled = &zoneAwareness
+		clusterConfig.ZoneAwarenessConfig = &opensearchservice.ZoneAwarenessConfig{AvailabilityZoneCount: &zones}
+	}
+	_, err = conf.OpenSearchClient.CreateDomainWithContext(ctx, &opensearchservice.CreateDomainInput{
+		AccessPolicies: &accessPolicy,
+		AdvancedSecurityOptions: &opensearchservice.AdvancedSecurityOptionsInput_{
+			Enabled:                     &enabledOpenSearch,
+			InternalUserDatabaseEnabled: &enabledOpenSearch,
+			MasterUserOptions:           &opensearchservice.MasterUserOptions{MasterUserName: &iaasInstance.ServiceUser, MasterUserPassword: &iaasInstance.ServicePassword},
+		},
+		ClusterConfig:               clusterConfig,
+		DomainEndpointOptions:       &opensearchservice.DomainEndpointOptions{EnforceHTTPS: &enabledOpenSearch, TLSSecurityPolicy: &tlsPolicyOpenSearch},
+		DomainName:                  &domain,
+		EBSOptions:                  &opensearchservice.EBSOptions{EBSEnabled: &enabledOpenSearch, VolumeSize: &spec.AllocatedStorageGB, VolumeType: &volumeTypeOpenSearch},
+		EncryptionAtRestOptions:     &opensearchservice.EncryptionAtRestOptions{Enabled: &enabledOpenSearch},
+		EngineVersion:               &spec.Engine,
+		NodeToNodeEncryptionOptions: &opensearchservice.NodeToNodeEncryptionOptions{Enabled: &enabledOpenSearch},
+		TagList:                     getTagsForServiceInstanceOpenSearch(serviceInstance),
+		VPCOptions:                  &opensearchservice.VPCOptions{SecurityGroupIds: []*string{&conf.OpenSearchSecGrpId}, SubnetIds: stringPointers(subnets)},
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create domain %s: %s", serviceInstance.InstanceName, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	msg := fmt.Sprintf("OpenSearch domain %s with %d node(s) is being created", domain, numInstances)
+	logger.Info(msg, "engine", spec.Engine, "zones", zones)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusOpenSearch(ctx, iaasInstance)
+	return nil
+}
+
+// SubmitDeletionOpenSearch deletes the OpenSearch domain, OpenSearch makes no final snapshot
+func SubmitDeletionOpenSearch(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	logger.Info("deleting opensearch domain...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	domain := domainName(iaasInstance)
+	_, err := conf.OpenSearchClient.DeleteDomainWithContext(ctx, &opensearchservice.DeleteDomainInput{DomainName: &domain})
+	if err != nil {
+		LogAwsError(ctx, err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+	}
+	StartPollForStatusOpenSearch(ctx, iaasInstance)
+	return err
+}
+
+func StartPollForStatusOpenSearch(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	domain := domainName(iaasInstance)
+	startPoller(ctx, serviceInstance, "StartPollForStatusOpenSearch", func(ctx context.Context) bool {
+		output, err := conf.OpenSearchClient.DescribeDomainWithContext(ctx, &opensearchservice.DescribeDomainInput{DomainName: &domain})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == opensearchservice.ErrCodeResourceNotFoundException {
+				// this should only happen when a domain deletion ended
+				logger.Info("opensearch domain is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("opensearch domain %s is gone", domain))
+			} else {
+				msg := fmt.Sprintf("failed to describe opensearch domain %s: %s", domain, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		}
+		status := output.DomainStatus
+		processing := status.Processing != nil && *status.Processing
+		deleted := status.Deleted != nil && *status.Deleted
+		logger.Info("opensearch domain status", "processing", processing, "deleted", deleted)
+		if processing || deleted {
+			return false
+		}
+		endpoint := status.Endpoints["vpc"]
+		if endpoint == nil {
+			logger.Warn("opensearch domain is ready, but has no vpc endpoint yet")
+			return false
+		}
+		iaasInstance.ServiceUrl = fmt.Sprintf(schemas[OpenSearchEngine], iaasInstance.ServiceUser, iaasInstance.ServicePassword, *endpoint, openSearchPort)
+		iaasInstance.ServiceDetails = map[string]string{db.DetailTLS: "true"}
+		iaasInstance.Status = db.StatusCreateSucceeded
+		iaasInstance.LastStatusUpdate = time.Now()
+		iaasInstance.LastMessage = fmt.Sprintf("opensearch domain %s successfully created", domain)
+		_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+		_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+		return true
+	})
+}
+
+func getTagsForServiceInstanceOpenSearch(serviceInstance db.ServiceInstance) []*opensearchservice.Tag {
+	var tagList []*opensearchservice.Tag
+	for _, tag := range getTagsForServiceInstanceRDS(serviceInstance) {
+		tagList = append(tagList, &opensearchservice.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tagList
+}
@@ -0,0 +1,114 @@
+package aws
+
+import (
+	"context"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/util"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pollInterval is how often a poller polls, the tests replace it with a shorter interval
+var pollInterval = 20 * time.Second
+
+const (
+	// a poller that did not update its heartbeat for this long is considered dead, and can be taken over by another broker instance
+	pollerStaleAfter = 2 * time.Minute
+	// how often we look for pollers that were handed over or died on other broker instances
+	adoptInterval = 1 * time.Minute
+)
+
+var (
+	pollersCtx, stopPollers = context.WithCancel(context.Background())
+	pollers                 sync.WaitGroup
+	// the service instance ids for which this broker instance runs a poller
+	runningPollers sync.Map
+	draining       atomic.Bool
+)
+
+// IsDraining tells if the broker is shutting down, while draining no new provisions are accepted
+func IsDraining() bool {
+	return draining.Load()
+}
+
+// StartDraining stops accepting new provisions, the AWS submissions that are already running (inside the http handlers) will finish
+func StartDraining() {
+	draining.Store(true)
+}
+
+// StopPollers stops all pollers and releases their ownership, so the other broker instances of this env take them over. It waits until all pollers are stopped, or until ctx is done.
+func StopPollers(ctx context.Context) {
+	stopPollers()
+	stopped := make(chan struct{})
+	go func() {
+		pollers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		util.Logger(ctx).Info("all pollers stopped and handed over")
+	case <-ctx.Done():
+		util.Logger(ctx).Warn("not all pollers stopped in time, other broker instances will take them over when their heartbeat is stale")
+	}
+}
+
+// startPoller calls pollOnce every pollInterval in a goroutine, until pollOnce returns true (done) or the broker shuts down.
+// The poller is owned by this broker instance (recorded in the service_instance row), a poller that is owned by another (live) broker instance is not started.
+func startPoller(ctx context.Context, serviceInstance db.ServiceInstance, name string, pollOnce func(ctx context.Context) bool) {
+	// the poller outlives the http request that started it, and collects its own AWS request ids for the audit events
+	ctx = util.WithAWSRequestIds(context.WithoutCancel(ctx))
+	logger := util.Logger(ctx)
+	if pollersCtx.Err() != nil {
+		logger.Info("not starting poller, the broker is shutting down")
+		return
+	}
+	if _, running := runningPollers.LoadOrStore(serviceInstance.Id, true); running {
+		logger.Info("poller is already running")
+		return
+	}
+	if !db.ClaimPoller(ctx, serviceInstance.Id, conf.InstanceId, pollerStaleAfter) {
+		logger.Info("poller is owned by another broker instance")
+		runningPollers.Delete(serviceInstance.Id)
+		return
+	}
+	pollers.Add(1)
+	go func() {
+		defer pollers.Done()
+		defer runningPollers.Delete(serviceInstance.Id)
+		defer db.ReleasePoller(ctx, serviceInstance.Id, conf.InstanceId)
+		ctx, span := startPollSpan(ctx, name)
+		defer span.End()
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pollersCtx.Done():
+				logger.Info("broker is shutting down, handing over the poller to another broker instance")
+				return
+			case <-ticker.C:
+				if pollOnce(ctx) {
+					return
+				}
+				db.HeartbeatPoller(ctx, serviceInstance.Id, conf.InstanceId)
+			}
+		}
+	}()
+}
+
+// StartPollerAdoption periodically takes over the pollers of this env that were handed over (or whose broker instance died)
+func StartPollerAdoption() {
+	go func() {
+		ticker := time.NewTicker(adoptInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pollersCtx.Done():
+				return
+			case <-ticker.C:
+				UpdateInProgressStatus(context.Background())
+			}
+		}
+	}()
+}
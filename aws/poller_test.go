@@ -0,0 +1,154 @@
+package aws
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+)
+
+const testBrokerInstance = "broker-1"
+
+// usePollers lets the pollers of the test poll every interval as broker instance testBrokerInstance, and undoes a shutdown of the pollers when the test ends.
+// The tests wait (pollers.Wait) for their pollers before the sql expectations are checked.
+func usePollers(t *testing.T, interval time.Duration) {
+	savedInterval, savedInstanceId := pollInterval, conf.InstanceId
+	pollInterval, conf.InstanceId = interval, testBrokerInstance
+	t.Cleanup(func() {
+		pollers.Wait()
+		pollInterval, conf.InstanceId = savedInterval, savedInstanceId
+		pollersCtx, stopPollers = context.WithCancel(context.Background())
+		draining.Store(false)
+	})
+}
+
+func expectClaim(mock sqlmock.Sqlmock, claimed bool) {
+	var rowsAffected int64
+	if claimed {
+		rowsAffected = 1
+	}
+	mock.ExpectExec("update service_instance set poller_owner=\\?, poller_heartbeat=current_timestamp where id=\\?").
+		WithArgs(testBrokerInstance, 1, testBrokerInstance, int64(pollerStaleAfter.Seconds())).WillReturnResult(sqlmock.NewResult(0, rowsAffected))
+}
+
+func expectHeartbeat(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("update service_instance set poller_heartbeat=current_timestamp where id=\\? and poller_owner=\\?").WithArgs(1, testBrokerInstance).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func expectRelease(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("update service_instance set poller_owner=null, poller_heartbeat=null where id=\\? and poller_owner=\\?").WithArgs(1, testBrokerInstance).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestPollerClaimsBeatsAndReleases(t *testing.T) {
+	usePollers(t, time.Millisecond)
+	mock := dbtest.NewMock(t)
+	expectClaim(mock, true)
+	expectHeartbeat(mock)
+	expectRelease(mock)
+
+	var polls atomic.Int32
+	startPoller(context.Background(), db.ServiceInstance{Id: 1}, "test", func(ctx context.Context) bool {
+		// the second poll is done
+		return polls.Add(1) == 2
+	})
+	pollers.Wait()
+	if polls.Load() != 2 {
+		t.Errorf("the poller polled %d times, expected 2", polls.Load())
+	}
+	if _, running := runningPollers.Load(int64(1)); running {
+		t.Error("the poller is still registered as running")
+	}
+}
+
+func TestPollerOwnedByAnotherBrokerInstance(t *testing.T) {
+	usePollers(t, time.Millisecond)
+	mock := dbtest.NewMock(t)
+	// the owner of the poller has a fresh heartbeat, so the claim does not update the row
+	expectClaim(mock, false)
+
+	startPoller(context.Background(), db.ServiceInstance{Id: 1}, "test", func(ctx context.Context) bool {
+		t.Error("the poller of another broker instance should not poll")
+		return true
+	})
+	pollers.Wait()
+	if _, running := runningPollers.Load(int64(1)); running {
+		t.Error("the poller that was not claimed is registered as running")
+	}
+}
+
+func TestPollerTakesOverAStalePoller(t *testing.T) {
+	usePollers(t, time.Millisecond)
+	mock := dbtest.NewMock(t)
+	// a stale heartbeat lets the claim update the row, like a poller that nobody owns
+	expectClaim(mock, true)
+	expectRelease(mock)
+
+	var polled atomic.Bool
+	startPoller(context.Background(), db.ServiceInstance{Id: 1}, "test", func(ctx context.Context) bool {
+		polled.Store(true)
+		return true
+	})
+	pollers.Wait()
+	if !polled.Load() {
+		t.Error("the taken over poller did not poll")
+	}
+}
+
+func TestPollerRunsOncePerServiceInstance(t *testing.T) {
+	usePollers(t, time.Millisecond)
+	mock := dbtest.NewMock(t)
+	expectClaim(mock, true)
+	expectRelease(mock)
+
+	proceed := make(chan struct{})
+	startPoller(context.Background(), db.ServiceInstance{Id: 1}, "test", func(ctx context.Context) bool {
+		<-proceed
+		return true
+	})
+	// a second start (a request from another foundation, or the adoption loop) does not claim the poller again
+	startPoller(context.Background(), db.ServiceInstance{Id: 1}, "test", func(ctx context.Context) bool {
+		t.Error("a second poller was started for the same service instance")
+		return true
+	})
+	close(proceed)
+	pollers.Wait()
+}
+
+func TestStopPollersHandsOverThePollers(t *testing.T) {
+	// the poller never polls, it only stops
+	usePollers(t, time.Hour)
+	mock := dbtest.NewMock(t)
+	expectClaim(mock, true)
+	expectRelease(mock)
+
+	startPoller(context.Background(), db.ServiceInstance{Id: 1}, "test", func(ctx context.Context) bool {
+		t.Error("the poller should not poll")
+		return true
+	})
+	StartDraining()
+	if !IsDraining() {
+		t.Error("the broker should be draining")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	StopPollers(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("the poller did not stop in time")
+	}
+	if _, running := runningPollers.Load(int64(1)); running {
+		t.Error("the stopped poller is still registered as running")
+	}
+
+	// once the pollers are stopped no poller is claimed anymore, the other broker instances take them over
+	startPoller(context.Background(), db.ServiceInstance{Id: 2}, "test", func(ctx context.Context) bool {
+		t.Error("a poller was started after the pollers were stopped")
+		return true
+	})
+}
@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -10,11 +11,13 @@ import (
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/rabobank/mfsb/conf"
 	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
 	"github.com/rabobank/mfsb/util"
 )
 
 const (
 	AllocatedStorageGBDefault      = 5
+	StorageTypeDefault             = "gp2"
 	EngineDefault                  = "mariadb"
 	UserNameDefault                = "admin"
 	DBNameDefault                  = "db"
@@ -23,255 +26,307 @@ const (
 	RetentionDaysRDSDefault        = 7
 )
 
-var allocatedStorageGB int64
-var storageType = "gp2"
-
-// var iops int64 = 50
-var engine string
-var keepBackups bool
-var skipFinalSnapshot bool
-var multiAZ bool
-var restoreFromSnapshot string
-var autoMinorVersionUpgrade bool
-var dbName string
-
 // values that are fixed:
 var publiclyAccessible = false
 var storageEncrypted = true
 var copyTagsToSnapshot = true
 
-var logs []*string
-
-var vpcSecGrpIds []*string
-
-func SubmitProvisionRDSDB(iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+func SubmitProvisionRDSDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
 	var err error
-	userName, parameters, err := processParameters(serviceInstance)
-	retentionDays := parameters.RetentionDays
-
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
 	if err != nil {
 		return err
 	}
+	retentionDays := spec.Parameters.RetentionDays
 	// set the proper default for documentdb
 	if retentionDays == 0 {
 		retentionDays = RetentionDaysRDSDefault
 	}
-	vpcSecGrpIds = append(vpcSecGrpIds, &conf.RDSSecGrpId)
-	iaasInstance.ServiceUser = userName
+	vpcSecGrpIds := []*string{&conf.RDSSecGrpId}
+	iaasInstance.ServiceUser = spec.UserName
 	iaasInstance.ServicePassword = util.SafeSubstring(fmt.Sprintf("pw%s", util.GenerateGUID()), 40)
 	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
-	dbInstanceClass := conf.RDSDBClasses[plan.Name]
+	var dbInstanceClass string
+	if plan.IaaS != nil {
+		dbInstanceClass = plan.IaaS.InstanceClass
+	}
 	if dbInstanceClass == "" {
 		msg := fmt.Sprintf("could not find database instance class for plan %s", plan.Name)
-		fmt.Println(msg)
-		db.UpdateStatusIaaSInstance(iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
 		serviceInstance.Status = db.StatusFailed
-		_ = db.UpdateServiceInstance(serviceInstance)
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
 		return errors.New(msg)
 	}
 
 	var dbInstanceCreateOutput *rds.CreateDBInstanceOutput
 	var dbInstanceRestoreOutput *rds.RestoreDBInstanceFromDBSnapshotOutput
+	var dbInstancePointInTimeOutput *rds.RestoreDBInstanceToPointInTimeOutput
 
-	if parameters.RestoreFromSnapshot != "" {
-		if !snapshotExistsAndAuthorized(restoreFromSnapshot, serviceInstance) {
-			msg := fmt.Sprintf("snapshot with identifier %s was not found or requestor is not authorized", restoreFromSnapshot)
-			fmt.Println(msg)
-			db.UpdateStatusIaaSInstance(iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
+	if spec.RestoreFromSnapshot != "" {
+		if !snapshotExistsAndAuthorized(ctx, spec.RestoreFromSnapshot, serviceInstance) {
+			msg := fmt.Sprintf("snapshot with identifier %s was not found or requestor is not authorized", spec.RestoreFromSnapshot)
+			logger.Error(msg)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", msg))
 			serviceInstance.Status = db.StatusFailed
-			_ = db.UpdateServiceInstance(serviceInstance)
+			_ = db.UpdateServiceInstance(ctx, serviceInstance)
 			return errors.New(msg)
 		} else {
 			input := &rds.RestoreDBInstanceFromDBSnapshotInput{
-				AutoMinorVersionUpgrade:     &autoMinorVersionUpgrade,
+				AutoMinorVersionUpgrade:     &spec.AutoMinorVersionUpgrade,
 				CopyTagsToSnapshot:          &copyTagsToSnapshot,
 				DBInstanceClass:             &dbInstanceClass,
 				DBInstanceIdentifier:        &iaasInstance.InternalId,
-				DBSnapshotIdentifier:        &restoreFromSnapshot,
+				DBSnapshotIdentifier:        &spec.RestoreFromSnapshot,
 				DBSubnetGroupName:           &conf.RDSSubnetGrp,
-				EnableCloudwatchLogsExports: logs,
-				Engine:                      &engine,
-				MultiAZ:                     &multiAZ,
+				EnableCloudwatchLogsExports: stringPointers(spec.Logs),
+				Engine:                      &spec.Engine,
+				MultiAZ:                     &spec.MultiAZ,
 				PubliclyAccessible:          &publiclyAccessible,
-				StorageType:                 &storageType,
+				StorageType:                 &spec.StorageType,
 				Tags:                        getTagsForServiceInstanceRDS(serviceInstance),
 				VpcSecurityGroupIds:         vpcSecGrpIds,
 			}
 			// do the actual AWS call to create the DB restoring from snapshot
-			dbInstanceRestoreOutput, err = conf.RDSClient.RestoreDBInstanceFromDBSnapshot(input)
+			dbInstanceRestoreOutput, err = conf.RDSClient.RestoreDBInstanceFromDBSnapshotWithContext(ctx, input)
+		}
+	} else if spec.RestoreFromInstance != "" {
+		source, restoreTime, sourceErr := restoreSource(ctx, serviceInstance, spec.Parameters)
+		if sourceErr != nil {
+			logger.Error(sourceErr.Error())
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Database creation failed, error: %s", sourceErr))
+			serviceInstance.Status = db.StatusFailed
+			_ = db.UpdateServiceInstance(ctx, serviceInstance)
+			return sourceErr
+		}
+		// the restored instance keeps the master user of the source, the poller resets the password
+		iaasInstance.ServiceUser = source.ServiceUser
+		useLatestRestorableTime := restoreTime == nil
+		input := &rds.RestoreDBInstanceToPointInTimeInput{
+			AutoMinorVersionUpgrade:     &spec.AutoMinorVersionUpgrade,
+			CopyTagsToSnapshot:          &copyTagsToSnapshot,
+			DBInstanceClass:             &dbInstanceClass,
+			DBSubnetGroupName:           &conf.RDSSubnetGrp,
+			EnableCloudwatchLogsExports: stringPointers(spec.Logs),
+			MultiAZ:                     &spec.MultiAZ,
+			PubliclyAccessible:          &publiclyAccessible,
+			RestoreTime:                 restoreTime,
+			SourceDBInstanceIdentifier:  &source.InternalId,
+			StorageType:                 &spec.StorageType,
+			Tags:                        getTagsForServiceInstanceRDS(serviceInstance),
+			TargetDBInstanceIdentifier:  &iaasInstance.InternalId,
+			UseLatestRestorableTime:     &useLatestRestorableTime,
+			VpcSecurityGroupIds:         vpcSecGrpIds,
 		}
+		// do the actual AWS call to create the DB restoring the source to a point in time
+		dbInstancePointInTimeOutput, err = conf.RDSClient.RestoreDBInstanceToPointInTimeWithContext(ctx, input)
 	} else {
 		input := &rds.CreateDBInstanceInput{
-			AllocatedStorage:            &allocatedStorageGB,
-			AutoMinorVersionUpgrade:     &autoMinorVersionUpgrade,
+			AllocatedStorage:            &spec.AllocatedStorageGB,
+			AutoMinorVersionUpgrade:     &spec.AutoMinorVersionUpgrade,
 			BackupRetentionPeriod:       &retentionDays,
 			CopyTagsToSnapshot:          &copyTagsToSnapshot,
 			DBInstanceClass:             &dbInstanceClass,
 			DBInstanceIdentifier:        &iaasInstance.InternalId,
-			DBName:                      &dbName,
+			DBName:                      &spec.DBName,
 			DBSubnetGroupName:           &conf.RDSSubnetGrp,
-			EnableCloudwatchLogsExports: logs,
-			Engine:                      &engine,
+			EnableCloudwatchLogsExports: stringPointers(spec.Logs),
+			Engine:                      &spec.Engine,
 			MasterUserPassword:          &iaasInstance.ServicePassword,
 			MasterUsername:              &iaasInstance.ServiceUser,
-			MultiAZ:                     &multiAZ,
+			MultiAZ:                     &spec.MultiAZ,
 			PubliclyAccessible:          &publiclyAccessible,
 			StorageEncrypted:            &storageEncrypted,
-			StorageType:                 &storageType,
+			StorageType:                 &spec.StorageType,
 			Tags:                        getTagsForServiceInstanceRDS(serviceInstance),
 			VpcSecurityGroupIds:         vpcSecGrpIds,
 		}
 
 		// do the actual AWS call to create the DB
-		dbInstanceCreateOutput, err = conf.RDSClient.CreateDBInstance(input)
+		dbInstanceCreateOutput, err = conf.RDSClient.CreateDBInstanceWithContext(ctx, input)
 	}
 	if err != nil {
-		LogAwsError(err)
-		db.DeleteServiceInstanceByServiceInstanceId(serviceInstance.InstanceId)
-		db.UpdateStatusIaaSInstance(iaasInstance, db.StatusCreateFailed, strings.ReplaceAll(err.Error(), "\n", ""))
+		LogAwsError(ctx, err)
+		db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, strings.ReplaceAll(err.Error(), "\n", ""))
 	} else {
 		msg := fmt.Sprintf("RDS Database %s is being created/restored", iaasInstance.InternalId)
-		fmt.Println(msg)
-		if conf.Debug {
-			if parameters.RestoreFromSnapshot != "" {
-				fmt.Println(dbInstanceRestoreOutput)
-			} else {
-				fmt.Println(dbInstanceCreateOutput)
-			}
+		logger.Info(msg)
+		switch {
+		case spec.RestoreFromSnapshot != "":
+			logger.Debug("restore DB instance output", "output", dbInstanceRestoreOutput.String())
+		case spec.RestoreFromInstance != "":
+			logger.Debug("restore DB instance to point in time output", "output", dbInstancePointInTimeOutput.String())
+		default:
+			logger.Debug("create DB instance output", "output", dbInstanceCreateOutput.String())
 		}
-		db.UpdateStatusServiceInstance(serviceInstance, db.StatusInProgress)
-		db.UpdateStatusIaaSInstance(iaasInstance, db.StatusCreateInProgress, msg)
-		StartPollForStatusRDSDB(iaasInstance)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+		StartPollForStatusRDSDB(ctx, iaasInstance)
 	}
 	return err
 }
 
-func snapshotExistsAndAuthorized(snapshotIdentifier string, serviceInstance db.ServiceInstance) bool {
-	var err error
-	input := rds.DescribeDBSnapshotsInput{DBSnapshotIdentifier: &snapshotIdentifier}
-	output := &rds.DescribeDBSnapshotsOutput{}
-	if output, err = conf.RDSClient.DescribeDBSnapshots(&input); err != nil {
-		fmt.Printf("failed to describe rds snapshot with identifier %s: %s", snapshotIdentifier, err)
+func snapshotExistsAndAuthorized(ctx context.Context, snapshotIdentifier string, serviceInstance db.ServiceInstance) bool {
+	logger := util.Logger(ctx)
+	output, err := conf.RDSClient.DescribeDBSnapshotsWithContext(ctx, &rds.DescribeDBSnapshotsInput{DBSnapshotIdentifier: &snapshotIdentifier})
+	if err != nil {
+		logger.Error("failed to describe rds snapshot", "snapshot", snapshotIdentifier, "error", err)
 		return false
-	} else {
-		if len(output.DBSnapshots) == 1 {
-			//  check if given snapshot has the tags that identify if it was requested from the same org, space and instance!
-			var orgNameTagFound, spaceNameTagFound bool
-			for _, tag := range output.DBSnapshots[0].TagList {
-				if *tag.Key == "OrganizationName" && *tag.Value == serviceInstance.OrganizationName {
-					orgNameTagFound = true
-				}
-				if *tag.Key == "SpaceName" && *tag.Value == serviceInstance.SpaceName {
-					spaceNameTagFound = true
-				}
-			}
-			if orgNameTagFound && spaceNameTagFound {
-				return true
-			} else {
-				fmt.Printf("A restore from snapshot %s was requested, but the snapshot is missing one or more tags (OrganizationName:%s, SpaceName:%s)\n", snapshotIdentifier, serviceInstance.OrganizationName, serviceInstance.SpaceName)
-				return false
-			}
-		} else {
-			fmt.Printf("we found more than 1 (%d) snapshots for snapshot identifier %s", len(output.DBSnapshots), snapshotIdentifier)
-			return false
+	}
+	if len(output.DBSnapshots) != 1 {
+		logger.Warn("we did not find exactly 1 snapshot for snapshot identifier", "found", len(output.DBSnapshots), "snapshot", snapshotIdentifier)
+		return false
+	}
+	return snapshotTagsAuthorized(ctx, snapshotIdentifier, output.DBSnapshots[0].TagList, serviceInstance)
+}
+
+// clusterSnapshotExistsAndAuthorized is snapshotExistsAndAuthorized for the snapshots of RDS (Aurora) clusters
+func clusterSnapshotExistsAndAuthorized(ctx context.Context, snapshotIdentifier string, serviceInstance db.ServiceInstance) bool {
+	logger := util.Logger(ctx)
+	output, err := conf.RDSClient.DescribeDBClusterSnapshotsWithContext(ctx, &rds.DescribeDBClusterSnapshotsInput{DBClusterSnapshotIdentifier: &snapshotIdentifier})
+	if err != nil {
+		logger.Error("failed to describe rds cluster snapshot", "snapshot", snapshotIdentifier, "error", err)
+		return false
+	}
+	if len(output.DBClusterSnapshots) != 1 {
+		logger.Warn("we did not find exactly 1 cluster snapshot for snapshot identifier", "found", len(output.DBClusterSnapshots), "snapshot", snapshotIdentifier)
+		return false
+	}
+	return snapshotTagsAuthorized(ctx, snapshotIdentifier, output.DBClusterSnapshots[0].TagList, serviceInstance)
+}
+
+// snapshotTagsAuthorized checks if the snapshot has the tags that identify that it was requested from the same org and space
+func snapshotTagsAuthorized(ctx context.Context, snapshotIdentifier string, tags []*rds.Tag, serviceInstance db.ServiceInstance) bool {
+	var orgNameTagFound, spaceNameTagFound bool
+	for _, tag := range tags {
+		if *tag.Key == "OrganizationName" && *tag.Value == serviceInstance.OrganizationName {
+			orgNameTagFound = true
+		}
+		if *tag.Key == "SpaceName" && *tag.Value == serviceInstance.SpaceName {
+			spaceNameTagFound = true
 		}
 	}
+	if !orgNameTagFound || !spaceNameTagFound {
+		util.Logger(ctx).Warn("a restore from snapshot was requested, but the snapshot is missing one or more tags", "snapshot", snapshotIdentifier, "OrganizationName", serviceInstance.OrganizationName, "SpaceName", serviceInstance.SpaceName)
+		return false
+	}
+	return true
 }
 
-func SubmitDeletionRDSDB(iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+// errNoSnapshotRequested is the error of a database update without CreateSnapshot, the only update parameter of the databases
+var errNoSnapshotRequested = errors.New("nothing to update, the only update parameter is CreateSnapshot")
+
+// UpdateRDSDB creates a manual snapshot of the DB instance (CreateSnapshot), with the tags of the service instance so snapshotExistsAndAuthorized lets the same org and space restore it
+func UpdateRDSDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, parameters model.Parameters) error {
+	if parameters.CreateSnapshot == "" {
+		return errNoSnapshotRequested
+	}
+	_, err := conf.RDSClient.CreateDBSnapshotWithContext(ctx, &rds.CreateDBSnapshotInput{
+		DBInstanceIdentifier: &iaasInstance.InternalId,
+		DBSnapshotIdentifier: &parameters.CreateSnapshot,
+		Tags:                 getTagsForServiceInstanceRDS(serviceInstance),
+	})
+	if err != nil {
+		LogAwsError(ctx, err)
+		return fmt.Errorf("could not create snapshot %s of DB instance %s: %s", parameters.CreateSnapshot, iaasInstance.InternalId, strings.ReplaceAll(err.Error(), "\n", ""))
+	}
+	util.Logger(ctx).Info("creating snapshot of DB instance", "snapshot", parameters.CreateSnapshot)
+	return nil
+}
+
+func SubmitDeletionRDSDB(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
 	var err error
-	if _, _, err = processParameters(serviceInstance); err != nil {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
 		return err
 	}
-	fmt.Printf("deleting database %s...\n", iaasInstance.InternalId)
-	db.UpdateStatusServiceInstance(serviceInstance, db.StatusInProgress)
-	db.UpdateStatusIaaSInstance(iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	logger.Info("deleting database...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
 
 	var snapshotIdentifier = ""
-	if !skipFinalSnapshot {
+	if !spec.SkipFinalSnapshot {
 		snapshotIdentifier = iaasInstance.InternalId
 	}
 
 	// actual delete
-	fmt.Printf("delete parameters, skipFinalSnapshot:%t, snapshotIdentifier:%s\n", skipFinalSnapshot, snapshotIdentifier)
-	_, err = conf.RDSClient.DeleteDBInstance(&rds.DeleteDBInstanceInput{DBInstanceIdentifier: &iaasInstance.InternalId, DeleteAutomatedBackups: &keepBackups, SkipFinalSnapshot: &skipFinalSnapshot, FinalDBSnapshotIdentifier: &snapshotIdentifier})
+	logger.Info("delete parameters", "skipFinalSnapshot", spec.SkipFinalSnapshot, "snapshotIdentifier", snapshotIdentifier)
+	_, err = conf.RDSClient.DeleteDBInstanceWithContext(ctx, &rds.DeleteDBInstanceInput{DBInstanceIdentifier: &iaasInstance.InternalId, DeleteAutomatedBackups: &spec.KeepBackups, SkipFinalSnapshot: &spec.SkipFinalSnapshot, FinalDBSnapshotIdentifier: &snapshotIdentifier})
 
 	if err != nil {
-		fmt.Printf("failed to delete database instance %s, err: %s\n", iaasInstance.InternalId, err)
-		db.UpdateStatusServiceInstance(serviceInstance, db.StatusFailed)
-		db.UpdateStatusIaaSInstance(iaasInstance, db.StatusDeleteFailed, err.Error())
+		logger.Error("failed to delete database instance", "error", err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
 	}
-	StartPollForStatusRDSDB(iaasInstance)
+	StartPollForStatusRDSDB(ctx, iaasInstance)
 	return err
 }
 
-func StartPollForStatusRDSDB(iaasInstance db.IaaSInstance) {
-	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(conf.CfEnv, iaasInstance.Id)
-	go func() {
-		channel := time.Tick(20 * time.Second)
-		for range channel {
-			// start polling for the result
-			output, err := conf.RDSClient.DescribeDBInstances(&rds.DescribeDBInstancesInput{DBInstanceIdentifier: &iaasInstance.InternalId})
-			if err != nil {
-				aerr, _ := err.(awserr.Error)
-				if aerr.Code() == rds.ErrCodeDBInstanceNotFoundFault {
-					// this should only happen when a database deletion ended
-					fmt.Printf("RDS DB instance %s is gone, %s\n", iaasInstance.InternalId, aerr.Message())
-					db.DeleteServiceInstanceByServiceInstanceId(serviceInstance.InstanceId)
-					db.UpdateStatusIaaSInstance(iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("DB instance %s is gone", iaasInstance.InternalId))
-					err = deleteIAMRoleIfExists(&iaasInstance, &serviceInstance)
-					if err != nil {
-						fmt.Printf("failed to delete the IAM role for %s: %s", iaasInstance.InternalId, err)
-						iaasInstance.LastMessage = fmt.Sprintf("DB instance %s successfully deleted, IAM role delete failed (%s)", iaasInstance.InternalId, err)
-						_ = db.UpdateStatusServiceInstanceForIaaSId(serviceInstance.IaaSInstanceId, db.StatusSucceeded)
-						_ = db.UpdateIaaSInstance(iaasInstance)
-					}
-				} else {
-					msg := fmt.Sprintf("failed to describe DB instance %s, code : %s error: %s", iaasInstance.InternalId, aerr.Code(), err)
-					fmt.Println(msg)
-					db.UpdateStatusServiceInstance(serviceInstance, db.StatusFailed)
-					db.UpdateStatusIaaSInstance(iaasInstance, db.StatusNotFound, msg)
+func StartPollForStatusRDSDB(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	startPoller(ctx, serviceInstance, "StartPollForStatusRDSDB", func(ctx context.Context) bool {
+		// start polling for the result
+		output, err := conf.RDSClient.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{DBInstanceIdentifier: &iaasInstance.InternalId})
+		if err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == rds.ErrCodeDBInstanceNotFoundFault {
+				// this should only happen when a database deletion ended
+				logger.Info("RDS DB instance is gone", "message", aerr.Message())
+				db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("DB instance %s is gone", iaasInstance.InternalId))
+				err = deleteIAMRoleIfExists(ctx, &iaasInstance, &serviceInstance)
+				if err != nil {
+					logger.Error("failed to delete the IAM role", "error", err)
+					iaasInstance.LastMessage = fmt.Sprintf("DB instance %s successfully deleted, IAM role delete failed (%s)", iaasInstance.InternalId, err)
+					_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+					_ = db.UpdateIaaSInstance(ctx, iaasInstance)
 				}
-				break
 			} else {
-				dbInstances := output.DBInstances
-				if len(dbInstances) > 0 {
-					dbStatus := dbInstances[0].DBInstanceStatus
-					msg := fmt.Sprintf("rds db %s : %s", *dbInstances[0].DBInstanceIdentifier, *dbStatus)
-					fmt.Println(msg)
-					if *dbStatus == "available" {
-						if conf.Debug {
-							msg = fmt.Sprintf("RDS DB instance %s successfully created:\n%v", iaasInstance.InternalId, dbInstances[0])
-						} else {
-							msg = fmt.Sprintf("RDS DB instance %s successfully created", iaasInstance.InternalId)
-						}
-						fmt.Println(msg)
-						schema := schemas[*dbInstances[0].Engine]
-						iaasInstance.ServiceUrl = fmt.Sprintf(schema, iaasInstance.ServiceUser, iaasInstance.ServicePassword, *dbInstances[0].Endpoint.Address, *dbInstances[0].Endpoint.Port, *dbInstances[0].DBName)
-						iaasInstance.Status = db.StatusCreateSucceeded
-						iaasInstance.LastStatusUpdate = time.Now()
-						iaasInstance.LastMessage = fmt.Sprintf("RDS DB instance %s successfully created", iaasInstance.InternalId)
-						_ = db.UpdateStatusServiceInstanceForIaaSId(serviceInstance.IaaSInstanceId, db.StatusSucceeded)
-						_ = db.UpdateIaaSInstance(iaasInstance)
-						// update the database master user/password (this is actually only required during a RestoreFromSnaphot, but it is easier to do it for all cases)
-						input := &rds.ModifyDBInstanceInput{DBInstanceIdentifier: dbInstances[0].DBInstanceIdentifier, MasterUserPassword: &iaasInstance.ServicePassword}
-						if _, err = conf.RDSClient.ModifyDBInstance(input); err != nil {
-							fmt.Printf("failed to modify master password for rds db %s: %s\n", *dbInstances[0].DBInstanceIdentifier, err)
-						}
+				msg := fmt.Sprintf("failed to describe DB instance %s: %s", iaasInstance.InternalId, err)
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			}
+			return true
+		} else {
+			dbInstances := output.DBInstances
+			if len(dbInstances) > 0 {
+				dbStatus := dbInstances[0].DBInstanceStatus
+				logger.Info("rds db status", "db_status", *dbStatus)
+				if *dbStatus == "available" {
+					logger.Info("RDS DB instance successfully created")
+					logger.Debug("RDS DB instance details", "db_instance", dbInstances[0].String())
+					schema := schemas[*dbInstances[0].Engine]
+					iaasInstance.ServiceUrl = fmt.Sprintf(schema, iaasInstance.ServiceUser, iaasInstance.ServicePassword, *dbInstances[0].Endpoint.Address, *dbInstances[0].Endpoint.Port, *dbInstances[0].DBName)
+					iaasInstance.Status = db.StatusCreateSucceeded
+					iaasInstance.LastStatusUpdate = time.Now()
+					iaasInstance.LastMessage = fmt.Sprintf("RDS DB instance %s successfully created", iaasInstance.InternalId)
+					_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+					_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+					// update the database master user/password (this is actually only required during a RestoreFromSnaphot or RestoreFromInstance, but it is easier to do it for all cases)
+					input := &rds.ModifyDBInstanceInput{DBInstanceIdentifier: dbInstances[0].DBInstanceIdentifier, MasterUserPassword: &iaasInstance.ServicePassword}
+					if _, err = conf.RDSClient.ModifyDBInstanceWithContext(ctx, input); err != nil {
+						logger.Error("failed to modify master password for rds db", "error", err)
+					}
 
-						err = createIAMRoleIfNotExists(&iaasInstance, &serviceInstance)
-						if err != nil {
-							fmt.Printf("failed to create the IAM role for %s: %s", iaasInstance.InternalId, err)
-							iaasInstance.LastMessage = fmt.Sprintf("RDS DB instance %s successfully created, IAM role creation failed (%s)", iaasInstance.InternalId, err)
-							_ = db.UpdateStatusServiceInstanceForIaaSId(serviceInstance.IaaSInstanceId, db.StatusSucceeded)
-							_ = db.UpdateIaaSInstance(iaasInstance)
-						}
-						break
+					err = createIAMRoleIfNotExists(ctx, &iaasInstance, &serviceInstance)
+					if err != nil {
+						logger.Error("failed to create the IAM role", "error", err)
+						iaasInstance.LastMessage = fmt.Sprintf("RDS DB instance %s successfully created, IAM role creation failed (%s)", iaasInstance.InternalId, err)
+						_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+						_ = db.UpdateIaaSInstance(ctx, iaasInstance)
 					}
+					return true
 				}
 			}
 		}
-	}()
+		return false
+	})
 }
 
 func getTagsForServiceInstanceRDS(serviceInstance db.ServiceInstance) []*rds.Tag {
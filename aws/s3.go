@@ -0,0 +1,237 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	// emptyBatchesPerPoll limits the work of one poll when emptying a bucket, a batch deletes up to 1000 object versions
+	emptyBatchesPerPoll = 10
+)
+
+// credentialBucket is the key of the bucket name in the binding credentials
+const credentialBucket = "bucket"
+
+var bucketAccessPolicyDoc = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Action": ["s3:ListBucket", "s3:ListBucketVersions", "s3:ListBucketMultipartUploads", "s3:GetBucketLocation"],
+      "Resource": "arn:aws:s3:::@@BUCKET@@"
+    },
+    {
+      "Effect": "Allow",
+      "Action": ["s3:GetObject", "s3:GetObjectVersion", "s3:PutObject", "s3:DeleteObject", "s3:DeleteObjectVersion", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"],
+      "Resource": "arn:aws:s3:::@@BUCKET@@/*"
+    }
+  ]
+}`
+
+// bucketName returns the name of the bucket of the IaaS instance, bucket names are global and lowercase
+func bucketName(iaasInstance db.IaaSInstance) string {
+	return "mfsb-" + strings.ToLower(iaasInstance.InternalId)
+}
+
+// SubmitProvisionS3 creates the bucket, the poller then configures it (encryption, versioning, public access block and tags)
+func SubmitProvisionS3(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	bucket := bucketName(iaasInstance)
+	objectOwnership := s3.ObjectOwnershipBucketOwnerEnforced
+	createBucketInput := s3.CreateBucketInput{Bucket: &bucket, ObjectOwnership: &objectOwnership}
+	if conf.AWSRegion != "us-east-1" {
+		// us-east-1 is the default location, and it can not be given as location constraint
+		createBucketInput.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: &conf.AWSRegion}
+	}
+	if _, err := conf.S3Client.CreateBucketWithContext(ctx, &createBucketInput); err != nil {
+		LogAwsError(ctx, err)
+		msg := fmt.Sprintf("could not create bucket %s: %s", bucket, strings.ReplaceAll(err.Error(), "\n", ""))
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Bucket creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	// the credentials are created per binding
+	iaasInstance.ServiceUrl = "s3://" + bucket
+	iaasInstance.ServiceUser = ""
+	iaasInstance.ServicePassword = ""
+	msg := fmt.Sprintf("bucket %s is being created", bucket)
+	logger.Info(msg)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusS3(ctx, iaasInstance)
+	return nil
+}
+
+// SubmitDeletionS3 starts the deletion of the bucket, the poller empties and removes it. With KeepBucket the bucket (and its objects) is retained.
+func SubmitDeletionS3(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	bucket := bucketName(iaasInstance)
+	logger.Info("delete parameters", "KeepBucket", spec.Parameters.KeepBucket)
+	if spec.Parameters.KeepBucket {
+		logger.Info("keeping bucket", "bucket", bucket)
+		db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("bucket %s is kept (KeepBucket)", bucket))
+		return nil
+	}
+	logger.Info("deleting bucket...", "bucket", bucket)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	StartPollForStatusS3(ctx, iaasInstance)
+	return nil
+}
+
+// StartPollForStatusS3 finishes the creation (configures the bucket) or the deletion (empties and removes the bucket) of the IaaS instance, depending on its status
+func StartPollForStatusS3(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	bucket := bucketName(iaasInstance)
+	startPoller(ctx, serviceInstance, "StartPollForStatusS3", func(ctx context.Context) bool {
+		iaasInstance := db.GetIaaSInstances(ctx, iaasInstance.Id)[0]
+		switch iaasInstance.Status {
+		case db.StatusCreateInProgress:
+			if err := configureBucket(ctx, bucket, serviceInstance); err != nil {
+				LogAwsError(ctx, err)
+				msg := fmt.Sprintf("failed to configure bucket %s: %s", bucket, strings.ReplaceAll(err.Error(), "\n", ""))
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, msg)
+				return true
+			}
+			iaasInstance.Status = db.StatusCreateSucceeded
+			iaasInstance.LastStatusUpdate = time.Now()
+			iaasInstance.LastMessage = fmt.Sprintf("bucket %s successfully created", bucket)
+			_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+			_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+			return true
+		case db.StatusDeleteInProgress:
+			empty, err := emptyBucket(ctx, bucket)
+			if err == nil && !empty {
+				logger.Info("bucket is being emptied", "bucket", bucket)
+				return false
+			}
+			if err == nil {
+				_, err = conf.S3Client.DeleteBucketWithContext(ctx, &s3.DeleteBucketInput{Bucket: &bucket})
+			}
+			var aerr awserr.Error
+			if err != nil && !(errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchBucket) {
+				LogAwsError(ctx, err)
+				msg := fmt.Sprintf("failed to delete bucket %s: %s", bucket, strings.ReplaceAll(err.Error(), "\n", ""))
+				logger.Error(msg)
+				db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+				db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, msg)
+				return true
+			}
+			logger.Info("bucket is gone", "bucket", bucket)
+			db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("bucket %s is gone", bucket))
+			return true
+		}
+		logger.Warn("nothing to poll for bucket", "bucket", bucket, "status", iaasInstance.Status)
+		return true
+	})
+}
+
+// configureBucket encrypts the bucket, enables versioning, blocks all public access and tags it, every step can be repeated
+func configureBucket(ctx context.Context, bucket string, serviceInstance db.ServiceInstance) error {
+	encryption := s3.ServerSideEncryptionAes256
+	_, err := conf.S3Client.PutBucketEncryptionWithContext(ctx, &s3.PutBucketEncryptionInput{
+		Bucket: &bucket,
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{Rules: []*s3.ServerSideEncryptionRule{
+			{ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{SSEAlgorithm: &encryption}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	versioning := s3.BucketVersioningStatusEnabled
+	if _, err = conf.S3Client.PutBucketVersioningWithContext(ctx, &s3.PutBucketVersioningInput{Bucket: &bucket, VersioningConfiguration: &s3.VersioningConfiguration{Status: &versioning}}); err != nil {
+		return err
+	}
+	blockPublicAccess := true
+	_, err = conf.S3Client.PutPublicAccessBlockWithContext(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: &bucket,
+		PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       &blockPublicAccess,
+			BlockPublicPolicy:     &blockPublicAccess,
+			IgnorePublicAcls:      &blockPublicAccess,
+			RestrictPublicBuckets: &blockPublicAccess,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conf.S3Client.PutBucketTaggingWithContext(ctx, &s3.PutBucketTaggingInput{Bucket: &bucket, Tagging: &s3.Tagging{TagSet: getTagsForServiceInstanceS3(serviceInstance)}})
+	return err
+}
+
+// emptyBucket deletes up to emptyBatchesPerPoll batches of object versions (and delete markers) from the bucket, it returns if the bucket is empty
+func emptyBucket(ctx context.Context, bucket string) (bool, error) {
+	for batch := 0; batch < emptyBatchesPerPoll; batch++ {
+		output, err := conf.S3Client.ListObjectVersionsWithContext(ctx, &s3.ListObjectVersionsInput{Bucket: &bucket})
+		if err != nil {
+			return false, err
+		}
+		var objects []*s3.ObjectIdentifier
+		for _, version := range output.Versions {
+			objects = append(objects, &s3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+		}
+		for _, marker := range output.DeleteMarkers {
+			objects = append(objects, &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+		}
+		if len(objects) == 0 {
+			return true, nil
+		}
+		quiet := true
+		deleted, err := conf.S3Client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{Bucket: &bucket, Delete: &s3.Delete{Objects: objects, Quiet: &quiet}})
+		if err != nil {
+			return false, err
+		}
+		if len(deleted.Errors) > 0 {
+			return false, fmt.Errorf("failed to delete %d object(s), the first is %s: %s", len(deleted.Errors), *deleted.Errors[0].Key, *deleted.Errors[0].Message)
+		}
+		util.Logger(ctx).Info("deleted object versions", "bucket", bucket, "count", len(objects))
+	}
+	return false, nil
+}
+
+// CreateBindingS3 creates an IAM user for the binding with an access key, and a policy that only gives access to the bucket
+func CreateBindingS3(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error) {
+	bucket := bucketName(iaasInstance)
+	credentials, err := createBindingUser(ctx, serviceInstance, bindingId, strings.ReplaceAll(bucketAccessPolicyDoc, "@@BUCKET@@", bucket), "")
+	if err != nil {
+		return nil, err
+	}
+	credentials[credentialBucket] = bucket
+	return credentials, nil
+}
+
+// DeleteBindingS3 deletes the IAM user of the binding, with its access keys and policy
+func DeleteBindingS3(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error {
+	return deleteBindingUser(ctx, binding.ServiceBindingId)
+}
+
+func getTagsForServiceInstanceS3(serviceInstance db.ServiceInstance) []*s3.Tag {
+	var tagList []*s3.Tag
+	for _, tag := range getTagsForServiceInstanceRDS(serviceInstance) {
+		tagList = append(tagList, &s3.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return tagList
+}
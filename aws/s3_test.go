@@ -0,0 +1,135 @@
+package aws
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rabobank/mfsb/conf"
+)
+
+// useS3 makes the S3 client talk to a fake endpoint for the duration of the test
+func useS3(t *testing.T, respond func(w http.ResponseWriter, call awsCall)) *fakeAWS {
+	sess, fake := newFakeAWS(t, respond)
+	savedClient := conf.S3Client
+	conf.S3Client = s3.New(sess)
+	t.Cleanup(func() { conf.S3Client = savedClient })
+	return fake
+}
+
+// objectVersionsXML is a ListObjectVersions response with a version and a delete marker of the batch
+func objectVersionsXML(batch int) string {
+	return fmt.Sprintf(`<ListVersionsResult><Name>bucket-1</Name><IsTruncated>true</IsTruncated>`+
+		`<Version><Key>object-%d</Key><VersionId>version-%d</VersionId></Version>`+
+		`<DeleteMarker><Key>deleted-%d</Key><VersionId>marker-%d</VersionId></DeleteMarker></ListVersionsResult>`, batch, batch, batch, batch)
+}
+
+// deleteRequest is the body of a DeleteObjects request
+type deleteRequest struct {
+	Quiet   bool
+	Objects []struct {
+		Key       string
+		VersionId string
+	} `xml:"Object"`
+}
+
+func TestEmptyBucket(t *testing.T) {
+	listed := 0
+	fake := useS3(t, func(w http.ResponseWriter, call awsCall) {
+		switch call.Action {
+		case "GET /bucket-1":
+			if listed++; listed <= 2 {
+				_, _ = w.Write([]byte(objectVersionsXML(listed)))
+			} else {
+				_, _ = w.Write([]byte(`<ListVersionsResult><Name>bucket-1</Name><IsTruncated>false</IsTruncated></ListVersionsResult>`))
+			}
+		case "POST /bucket-1":
+			_, _ = w.Write([]byte(`<DeleteResult/>`))
+		default:
+			t.Errorf("unexpected call %s", call.Action)
+		}
+	})
+
+	empty, err := emptyBucket(context.Background(), "bucket-1")
+	if err != nil || !empty {
+		t.Fatalf("emptying the bucket returned %t, %v, expected it to be empty", empty, err)
+	}
+	expected := []string{"GET /bucket-1", "POST /bucket-1", "GET /bucket-1", "POST /bucket-1", "GET /bucket-1"}
+	if actions := fake.Actions(); strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Errorf("the calls are %v, expected %v", actions, expected)
+	}
+	var deletes []awsCall
+	for _, call := range fake.Calls() {
+		if call.Action == "POST /bucket-1" {
+			deletes = append(deletes, call)
+		}
+	}
+	for i, call := range deletes {
+		batch := i + 1
+		var request deleteRequest
+		if err = xml.Unmarshal([]byte(call.Body), &request); err != nil {
+			t.Fatalf("delete %d is invalid: %s", batch, err)
+		}
+		objects := map[string]string{}
+		for _, object := range request.Objects {
+			objects[object.Key] = object.VersionId
+		}
+		expected := map[string]string{fmt.Sprintf("object-%d", batch): fmt.Sprintf("version-%d", batch), fmt.Sprintf("deleted-%d", batch): fmt.Sprintf("marker-%d", batch)}
+		if !reflect.DeepEqual(objects, expected) {
+			t.Errorf("delete %d deletes the versions %v, expected %v", batch, objects, expected)
+		}
+		if !request.Quiet {
+			t.Errorf("delete %d should be quiet, the request is %s", batch, call.Body)
+		}
+	}
+}
+
+func TestEmptyBucketStopsAfterTheBatchesOfAPoll(t *testing.T) {
+	listed := 0
+	fake := useS3(t, func(w http.ResponseWriter, call awsCall) {
+		switch call.Action {
+		case "GET /bucket-1":
+			listed++
+			_, _ = w.Write([]byte(objectVersionsXML(listed)))
+		case "POST /bucket-1":
+			_, _ = w.Write([]byte(`<DeleteResult/>`))
+		default:
+			t.Errorf("unexpected call %s", call.Action)
+		}
+	})
+
+	empty, err := emptyBucket(context.Background(), "bucket-1")
+	if err != nil || empty {
+		t.Fatalf("emptying the bucket returned %t, %v, expected it not to be empty yet", empty, err)
+	}
+	if actions := fake.Actions(); len(actions) != 2*emptyBatchesPerPoll {
+		t.Errorf("expected %d lists and deletes, got the calls %v", emptyBatchesPerPoll, actions)
+	}
+}
+
+func TestEmptyBucketFailsOnUndeletedObjects(t *testing.T) {
+	fake := useS3(t, func(w http.ResponseWriter, call awsCall) {
+		switch call.Action {
+		case "GET /bucket-1":
+			_, _ = w.Write([]byte(objectVersionsXML(1)))
+		case "POST /bucket-1":
+			_, _ = w.Write([]byte(`<DeleteResult><Error><Key>object-1</Key><VersionId>version-1</VersionId><Code>AccessDenied</Code><Message>Access Denied</Message></Error></DeleteResult>`))
+		default:
+			t.Errorf("unexpected call %s", call.Action)
+		}
+	})
+
+	empty, err := emptyBucket(context.Background(), "bucket-1")
+	expected := "failed to delete 1 object(s), the first is object-1: Access Denied"
+	if err == nil || err.Error() != expected || empty {
+		t.Errorf("emptying the bucket returned %t, %v, expected the error %s", empty, err, expected)
+	}
+	if actions := fake.Actions(); len(actions) != 2 {
+		t.Errorf("the emptying should stop at the failed delete, got the calls %v", actions)
+	}
+}
@@ -0,0 +1,255 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	SecretLengthDefault = 32
+	// RecoveryWindowDaysDefault is how long a deleted secret can still be restored (by an AWS admin), unless MakeFinalSnapshot=false
+	RecoveryWindowDaysDefault = 7
+	AccessValue               = "value"
+	AccessIAM                 = "iam"
+)
+
+// credentialValue is the key of the secret in the binding credentials
+const credentialValue = "value"
+
+// secretName returns the name of the secret of the IaaS instance
+func secretName(iaasInstance db.IaaSInstance) string {
+	return "mfsb/" + iaasInstance.InternalId
+}
+
+type secretValueKey struct{}
+
+// WithSecretValue returns a copy of ctx that hands the SecretValue of a provision to SubmitProvisionSecret, the value is not stored with the parameters of the service instance
+func WithSecretValue(ctx context.Context, value string) context.Context {
+	if value == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, secretValueKey{}, value)
+}
+
+// SubmitProvisionSecret creates the secret with the SecretValue given to WithSecretValue, or a generated one
+func SubmitProvisionSecret(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	parameters := spec.Parameters
+	parameters.SecretValue, _ = ctx.Value(secretValueKey{}).(string)
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Secret creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	name := secretName(iaasInstance)
+	value, err := secretValue(ctx, parameters)
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not generate a value for secret %s: %s", name, err))
+	}
+	description := fmt.Sprintf("service instance %s of space %s/%s", serviceInstance.InstanceName, serviceInstance.OrganizationName, serviceInstance.SpaceName)
+	createSecretInput := &secretsmanager.CreateSecretInput{Name: &name, Description: &description, SecretString: &value, Tags: getTagsForServiceInstanceSecretsManager(serviceInstance)}
+	if conf.SecretsKmsKeyId != "" {
+		createSecretInput.KmsKeyId = &conf.SecretsKmsKeyId
+	}
+	output, err := conf.SecretsManagerClient.CreateSecretWithContext(ctx, createSecretInput)
+	if err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create secret %s: %s", name, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	// the value is only handed out to the bindings, it is not kept by the broker
+	iaasInstance.ServiceUrl = *output.ARN
+	iaasInstance.ServiceUser = ""
+	iaasInstance.ServicePassword = ""
+	iaasInstance.ServiceDetails = map[string]string{db.DetailSecretName: name, db.DetailSecretArn: *output.ARN}
+	msg := fmt.Sprintf("secret %s is being created", name)
+	logger.Info(msg, "generated", parameters.SecretValue == "")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusSecret(ctx, iaasInstance)
+	return nil
+}
+
+// secretValue returns the SecretValue of the parameters, or a random value of SecretLength characters generated by Secrets Manager
+func secretValue(ctx context.Context, parameters model.Parameters) (string, error) {
+	if parameters.SecretValue != "" {
+		return parameters.SecretValue, nil
+	}
+	length := int64(SecretLengthDefault)
+	if parameters.SecretLength > 0 {
+		length = parameters.SecretLength
+	}
+	// punctuation makes the value awkward to use in a uri or a shell
+	excludePunctuation := true
+	output, err := conf.SecretsManagerClient.GetRandomPasswordWithContext(ctx, &secretsmanager.GetRandomPasswordInput{PasswordLength: &length, ExcludePunctuation: &excludePunctuation})
+	if err != nil {
+		return "", err
+	}
+	return *output.RandomPassword, nil
+}
+
+// SubmitDeletionSecret schedules the deletion of the secret after a recovery window, with MakeFinalSnapshot=false it is deleted right away
+func SubmitDeletionSecret(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	name := secretName(iaasInstance)
+	deleteSecretInput := &secretsmanager.DeleteSecretInput{SecretId: &name}
+	if spec.SkipFinalSnapshot {
+		force := true
+		deleteSecretInput.ForceDeleteWithoutRecovery = &force
+	} else {
+		recoveryWindow := int64(RecoveryWindowDaysDefault)
+		deleteSecretInput.RecoveryWindowInDays = &recoveryWindow
+	}
+	logger.Info("deleting secret...", "secret", name, "skipFinalSnapshot", spec.SkipFinalSnapshot)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	_, err = conf.SecretsManagerClient.DeleteSecretWithContext(ctx, deleteSecretInput)
+	if err != nil {
+		LogAwsError(ctx, err)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+	}
+	StartPollForStatusSecret(ctx, iaasInstance)
+	return err
+}
+
+// StartPollForStatusSecret finishes the creation or the deletion of the IaaS instance, a secret that is scheduled for deletion counts as deleted
+func StartPollForStatusSecret(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	name := secretName(iaasInstance)
+	startPoller(ctx, serviceInstance, "StartPollForStatusSecret", func(ctx context.Context) bool {
+		iaasInstance := db.GetIaaSInstances(ctx, iaasInstance.Id)[0]
+		output, err := conf.SecretsManagerClient.DescribeSecretWithContext(ctx, &secretsmanager.DescribeSecretInput{SecretId: &name})
+		var aerr awserr.Error
+		if (errors.As(err, &aerr) && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException) || (err == nil && output.DeletedDate != nil) {
+			// this should only happen when a secret deletion ended
+			logger.Info("secret is gone", "secret", name)
+			db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("secret %s is gone", name))
+			return true
+		}
+		if err != nil {
+			msg := fmt.Sprintf("failed to describe secret %s: %s", name, err)
+			logger.Error(msg)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			return true
+		}
+		if iaasInstance.Status == db.StatusCreateInProgress {
+			iaasInstance.Status = db.StatusCreateSucceeded
+			iaasInstance.LastStatusUpdate = time.Now()
+			iaasInstance.LastMessage = fmt.Sprintf("secret %s successfully created", name)
+			_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+			_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+			return true
+		}
+		// the deletion of the secret is still in progress
+		return false
+	})
+}
+
+// UpdateSecret puts a new value in the secret, the SecretValue from the parameters or (with RotateSecret) a generated one.
+// The previous value stays available in Secrets Manager as AWSPREVIOUS.
+func UpdateSecret(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, parameters model.Parameters) error {
+	logger := util.Logger(ctx)
+	if parameters.SecretValue == "" && !parameters.RotateSecret {
+		return errors.New("give a new SecretValue, or RotateSecret to generate one")
+	}
+	if parameters.SecretValue != "" && parameters.RotateSecret {
+		return errors.New("give either a new SecretValue or RotateSecret, not both")
+	}
+	if parameters.SecretLength == 0 {
+		// the new value gets the length of the original one
+		var original model.Parameters
+		_ = json.Unmarshal([]byte(serviceInstance.Parameters), &original)
+		parameters.SecretLength = original.SecretLength
+	}
+	name := secretName(iaasInstance)
+	value, err := secretValue(ctx, parameters)
+	if err != nil {
+		LogAwsError(ctx, err)
+		return fmt.Errorf("could not generate a new value for secret %s: %w", name, err)
+	}
+	if _, err = conf.SecretsManagerClient.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{SecretId: &name, SecretString: &value}); err != nil {
+		LogAwsError(ctx, err)
+		return fmt.Errorf("could not put a new value in secret %s: %w", name, err)
+	}
+	msg := fmt.Sprintf("secret %s has a new value", name)
+	logger.Info(msg, "generated", parameters.RotateSecret)
+	db.EnqueueNotification(ctx, db.NotificationPasswordRotated, serviceInstance, msg)
+	return nil
+}
+
+// CreateBindingSecret returns the value of the secret (Access=value), or an IAM user that can read the secret (Access=iam), the latter keeps working after a rotation
+func CreateBindingSecret(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error) {
+	secretArn := iaasInstance.ServiceDetails[db.DetailSecretArn]
+	if secretArn == "" {
+		return nil, fmt.Errorf("secret %s is not created (yet)", secretName(iaasInstance))
+	}
+	var credentials map[string]string
+	switch parameters.Access {
+	case "", AccessValue:
+		output, err := conf.SecretsManagerClient.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: &secretArn})
+		if err != nil {
+			LogAwsError(ctx, err)
+			return nil, fmt.Errorf("could not get the value of secret %s: %w", secretName(iaasInstance), err)
+		}
+		credentials = map[string]string{credentialValue: *output.SecretString}
+	case AccessIAM:
+		statements := []map[string]any{{
+			"Effect":   "Allow",
+			"Action":   []string{"secretsmanager:GetSecretValue", "secretsmanager:DescribeSecret"},
+			"Resource": secretArn,
+		}}
+		if conf.SecretsKmsKeyId != "" {
+			// the default key of Secrets Manager needs no grant, a customer managed key does
+			statements = append(statements, map[string]any{
+				"Effect":    "Allow",
+				"Action":    "kms:Decrypt",
+				"Resource":  conf.SecretsKmsKeyId,
+				"Condition": map[string]any{"StringEquals": map[string]string{"kms:ViaService": fmt.Sprintf("secretsmanager.%s.amazonaws.com", conf.AWSRegion)}},
+			})
+		}
+		policyDoc, _ := json.Marshal(map[string]any{"Version": "2012-10-17", "Statement": statements})
+		var err error
+		if credentials, err = createBindingUser(ctx, serviceInstance, bindingId, string(policyDoc), conf.PermissionBoundaryARN); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("the Access parameter %s is not supported, supported are %s and %s", parameters.Access, AccessValue, AccessIAM)
+	}
+	credentials[db.DetailSecretName] = iaasInstance.ServiceDetails[db.DetailSecretName]
+	credentials[db.DetailSecretArn] = secretArn
+	return credentials, nil
+}
+
+// DeleteBindingSecret deletes the IAM user of the binding (if it has one)
+func DeleteBindingSecret(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error {
+	if binding.Credentials[credentialAccessKeyId] == "" {
+		return nil
+	}
+	return deleteBindingUser(ctx, binding.ServiceBindingId)
+}
@@ -0,0 +1,198 @@
+package aws
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	testSecretArn   = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:mfsb/mfsb-1-AbCdEf"
+	testSecretValue = "s3cr3t-v4lu3"
+)
+
+// useSecretsManager makes the Secrets Manager client talk to a fake endpoint for the duration of the test
+func useSecretsManager(t *testing.T, respond func(w http.ResponseWriter, call awsCall)) *fakeAWS {
+	sess, fake := newFakeAWS(t, respond)
+	savedClient := conf.SecretsManagerClient
+	conf.SecretsManagerClient = secretsmanager.New(sess)
+	t.Cleanup(func() { conf.SecretsManagerClient = savedClient })
+	return fake
+}
+
+func encrypted(t *testing.T, value string) string {
+	t.Helper()
+	encrypted, err := util.Encrypt(value)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	return encrypted
+}
+
+func TestCreateBindingSecret(t *testing.T) {
+	// the secret details are only known from the database, as they are for a binding request
+	details, _ := json.Marshal(map[string]string{db.DetailSecretArn: testSecretArn, db.DetailSecretName: "mfsb/mfsb-1"})
+	mock := dbtest.NewMock(t)
+	mock.ExpectQuery("from iaas_instance where id=\\?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(dbtest.IaaSInstanceColumns).
+			AddRow(7, "mfsb-1", db.StatusCreateSucceeded, time.Now(), "created", encrypted(t, testSecretArn), "", encrypted(t, ""), encrypted(t, string(details))))
+	fake := useSecretsManager(t, func(w http.ResponseWriter, call awsCall) {
+		_, _ = w.Write([]byte(`{"ARN": "` + testSecretArn + `", "Name": "mfsb/mfsb-1", "SecretString": "` + testSecretValue + `"}`))
+	})
+
+	iaasInstance := db.GetIaaSInstances(context.Background(), 7)[0]
+	credentials, err := CreateBindingSecret(context.Background(), iaasInstance, db.ServiceInstance{IaaSInstanceId: 7}, "binding-1", model.BindingParameters{})
+	if err != nil {
+		t.Fatalf("the binding failed: %s", err)
+	}
+	expected := map[string]string{credentialValue: testSecretValue, db.DetailSecretArn: testSecretArn, db.DetailSecretName: "mfsb/mfsb-1"}
+	if len(credentials) != len(expected) {
+		t.Errorf("the credentials are %v, expected %v", credentials, expected)
+	}
+	for name, value := range expected {
+		if credentials[name] != value {
+			t.Errorf("the credential %s is %s, expected %s", name, credentials[name], value)
+		}
+	}
+	if call, found := fake.Call("GetSecretValue"); !found || !strings.Contains(call.Body, `"SecretId":"`+testSecretArn+`"`) {
+		t.Errorf("the value should be read by the arn of the secret, got the calls %v", fake.Calls())
+	}
+}
+
+func TestCreateBindingSecretFails(t *testing.T) {
+	fake := useSecretsManager(t, func(w http.ResponseWriter, call awsCall) {
+		t.Errorf("unexpected call %s", call.Action)
+	})
+	created := db.IaaSInstance{InternalId: "mfsb-1", ServiceDetails: map[string]string{db.DetailSecretArn: testSecretArn, db.DetailSecretName: "mfsb/mfsb-1"}}
+	tests := []struct {
+		name         string
+		iaasInstance db.IaaSInstance
+		access       string
+		err          string
+	}{
+		{name: "not created yet", iaasInstance: db.IaaSInstance{InternalId: "mfsb-1"}, err: "secret mfsb/mfsb-1 is not created (yet)"},
+		{name: "unsupported access", iaasInstance: created, access: "root", err: "the Access parameter root is not supported, supported are value and iam"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credentials, err := CreateBindingSecret(context.Background(), tt.iaasInstance, db.ServiceInstance{}, "binding-1", model.BindingParameters{Access: tt.access})
+			if err == nil || err.Error() != tt.err || credentials != nil {
+				t.Errorf("the binding returned %v, %v, expected the error %s", credentials, err, tt.err)
+			}
+		})
+	}
+	if len(fake.Calls()) != 0 {
+		t.Errorf("no AWS calls expected, got %v", fake.Actions())
+	}
+}
+
+func TestUpdateSecretNotifiesTheRotation(t *testing.T) {
+	saved := conf.GetCatalog()
+	conf.SetCatalog(&model.Catalog{Services: []model.Service{{Id: "secrets-id", Name: "secretsmanager-service", Plans: []model.ServicePlan{{Id: "standard-id", Name: "standard"}}}}})
+	conf.ApplyReloadedConfig(&conf.Config{WebhookURLs: []string{"https://hooks.example.com/mfsb"}})
+	conf.WebhookSecret = "webhook-secret"
+	t.Cleanup(func() {
+		conf.SetCatalog(saved)
+		conf.WebhookSecret = ""
+		dbtest.Configure()
+	})
+	fake := useSecretsManager(t, func(w http.ResponseWriter, call awsCall) {
+		switch call.Action {
+		case "GetRandomPassword":
+			_, _ = w.Write([]byte(`{"RandomPassword": "` + testSecretValue + `"}`))
+		case "PutSecretValue":
+			_, _ = w.Write([]byte(`{"ARN": "` + testSecretArn + `", "Name": "mfsb/mfsb-1", "VersionId": "v2"}`))
+		default:
+			t.Errorf("unexpected call %s", call.Action)
+		}
+	})
+	var payload string
+	mock := dbtest.NewMock(t)
+	mock.ExpectExec("insert into notification_outbox").WithArgs("https://hooks.example.com/mfsb", db.NotificationPasswordRotated, capturedString{&payload}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	serviceInstance := db.ServiceInstance{ServiceId: "secrets-id", PlanId: "standard-id", InstanceId: "guid-1", InstanceName: "secret", Parameters: `{"SecretLength":16}`, Status: db.StatusSucceeded}
+	if err := UpdateSecret(context.Background(), db.IaaSInstance{Id: 7, InternalId: "mfsb-1"}, serviceInstance, model.Parameters{RotateSecret: true}); err != nil {
+		t.Fatalf("the rotation failed: %s", err)
+	}
+	if call, _ := fake.Call("GetRandomPassword"); !strings.Contains(call.Body, `"PasswordLength":16`) {
+		t.Errorf("the new value should get the length of the original one, got %s", call.Body)
+	}
+	var notification model.Notification
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		t.Fatalf("the notification payload %s is not valid: %s", payload, err)
+	}
+	if notification.EventType != db.NotificationPasswordRotated || notification.InstanceId != "guid-1" || notification.ServiceName != "secretsmanager-service" {
+		t.Errorf("unexpected notification %+v", notification)
+	}
+	if strings.Contains(payload, testSecretValue) {
+		t.Errorf("the notification contains the new value: %s", payload)
+	}
+}
+
+// capturedString is a sqlmock argument that matches any string and remembers it
+type capturedString struct {
+	value *string
+}
+
+func (c capturedString) Match(value driver.Value) bool {
+	*c.value, _ = value.(string)
+	return true
+}
+
+func TestSubmitProvisionSecretWithTheGivenValue(t *testing.T) {
+	saved := conf.GetCatalog()
+	conf.SetCatalog(&model.Catalog{Services: []model.Service{{Id: "secrets-id", Name: "secretsmanager-service", Plans: []model.ServicePlan{{Id: "standard-id", Name: "standard"}}}}})
+	t.Cleanup(func() { conf.SetCatalog(saved) })
+	// the status updates are not part of this test, every query fails (and is logged), which also keeps the poller from starting
+	dbtest.NewMock(t)
+	fake := useSecretsManager(t, func(w http.ResponseWriter, call awsCall) {
+		_, _ = w.Write([]byte(`{"ARN": "` + testSecretArn + `", "Name": "mfsb/mfsb-1"}`))
+	})
+
+	serviceInstance := db.ServiceInstance{ServiceId: "secrets-id", PlanId: "standard-id", InstanceId: "guid-1", InstanceName: "secret", Parameters: `{"SecretLength":16}`}
+	if err := SubmitProvisionSecret(WithSecretValue(context.Background(), testSecretValue), db.IaaSInstance{Id: 7, InternalId: "mfsb-1"}, serviceInstance); err != nil {
+		t.Fatalf("the provision failed: %s", err)
+	}
+	if actions := fake.Actions(); len(actions) != 1 || actions[0] != "CreateSecret" {
+		t.Fatalf("expected only a CreateSecret call (no generated value), got %v", actions)
+	}
+	call, _ := fake.Call("CreateSecret")
+	if !strings.Contains(call.Body, `"SecretString":"`+testSecretValue+`"`) || !strings.Contains(call.Body, `"Name":"mfsb/mfsb-1"`) {
+		t.Errorf("the secret was not created with the given value: %s", call.Body)
+	}
+}
+
+func TestSubmitDeletionOutlivesTheRequest(t *testing.T) {
+	saved := conf.GetCatalog()
+	conf.SetCatalog(&model.Catalog{Services: []model.Service{{Id: "secrets-id", Name: "secretsmanager-service", Plans: []model.ServicePlan{{Id: "standard-id", Name: "standard"}}}}})
+	t.Cleanup(func() { conf.SetCatalog(saved) })
+	// the status updates are not part of this test, every query fails (and is logged), which also keeps the poller from starting
+	dbtest.NewMock(t)
+	fake := useSecretsManager(t, func(w http.ResponseWriter, call awsCall) {
+		_, _ = w.Write([]byte(`{"ARN": "` + testSecretArn + `", "Name": "mfsb/mfsb-1"}`))
+	})
+
+	// the cloud controller dropped the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	serviceInstance := db.ServiceInstance{ServiceId: "secrets-id", PlanId: "standard-id", InstanceId: "guid-1", Parameters: `{}`}
+	if err := SubmitDeletion(ctx, db.IaaSInstance{Id: 7, InternalId: "mfsb-1"}, serviceInstance); err != nil {
+		t.Fatalf("the deletion failed: %s", err)
+	}
+	if _, found := fake.Call("DeleteSecret"); !found {
+		t.Errorf("the secret was not deleted, got the calls %v", fake.Actions())
+	}
+}
@@ -0,0 +1,285 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const (
+	MaxReceiveCountDefault = 5
+	// the dead-letter queue keeps its messages as long as SQS allows (14 days), so they outlive the messages of the source queue
+	dlqRetentionSeconds = 14 * 24 * 3600
+	fifoSuffix          = ".fifo"
+	scopeProducer       = "producer"
+	scopeConsumer       = "consumer"
+)
+
+// the keys of the binding credentials of a queue (next to the queue_url, queue_arn and dlq_url details)
+const (
+	credentialScope = "scope"
+	credentialFifo  = "fifo"
+)
+
+// queueNames returns the names of the queue and its dead-letter queue, the names of FIFO queues have to end with .fifo
+func queueNames(iaasInstance db.IaaSInstance, fifo bool) (string, string) {
+	queue := "mfsb-" + strings.ToLower(iaasInstance.InternalId)
+	dlq := queue + "-dlq"
+	if fifo {
+		return queue + fifoSuffix, dlq + fifoSuffix
+	}
+	return queue, dlq
+}
+
+// SubmitProvisionSQS creates the (standard or FIFO) queue, with DeadLetterQueue first its dead-letter queue and a redrive policy to it
+func SubmitProvisionSQS(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	spec, err := processParameters(ctx, serviceInstance)
+	if err != nil {
+		return err
+	}
+	parameters := spec.Parameters
+	failed := func(msg string) error {
+		logger.Error(msg)
+		db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateFailed, fmt.Sprintf("Queue creation failed, error: %s", msg))
+		serviceInstance.Status = db.StatusFailed
+		_ = db.UpdateServiceInstance(ctx, serviceInstance)
+		return errors.New(msg)
+	}
+	queue, dlq := queueNames(iaasInstance, parameters.Fifo)
+	tags := getTagsMapForServiceInstance(serviceInstance)
+	attributes := map[string]string{sqs.QueueAttributeNameSqsManagedSseEnabled: "true"}
+	if parameters.Fifo {
+		attributes[sqs.QueueAttributeNameFifoQueue] = "true"
+		attributes[sqs.QueueAttributeNameContentBasedDeduplication] = "true"
+	}
+	if parameters.DeadLetterQueue {
+		dlqAttributes := map[string]string{sqs.QueueAttributeNameMessageRetentionPeriod: strconv.Itoa(dlqRetentionSeconds)}
+		for name, value := range attributes {
+			dlqAttributes[name] = value
+		}
+		dlqArn, err := createQueue(ctx, dlq, dlqAttributes, tags)
+		if err != nil {
+			LogAwsError(ctx, err)
+			return failed(fmt.Sprintf("could not create dead-letter queue %s: %s", dlq, strings.ReplaceAll(err.Error(), "\n", "")))
+		}
+		maxReceiveCount := parameters.MaxReceiveCount
+		if maxReceiveCount == 0 {
+			maxReceiveCount = MaxReceiveCountDefault
+		}
+		redrivePolicy, _ := json.Marshal(map[string]string{"deadLetterTargetArn": dlqArn, "maxReceiveCount": strconv.FormatInt(maxReceiveCount, 10)})
+		attributes[sqs.QueueAttributeNameRedrivePolicy] = string(redrivePolicy)
+	}
+	if parameters.RetentionDays != 0 {
+		attributes[sqs.QueueAttributeNameMessageRetentionPeriod] = strconv.FormatInt(parameters.RetentionDays*24*3600, 10)
+	}
+	if _, err = createQueue(ctx, queue, attributes, tags); err != nil {
+		LogAwsError(ctx, err)
+		return failed(fmt.Sprintf("could not create queue %s: %s", queue, strings.ReplaceAll(err.Error(), "\n", "")))
+	}
+	// the credentials are created per binding
+	iaasInstance.ServiceUser = ""
+	iaasInstance.ServicePassword = ""
+	msg := fmt.Sprintf("queue %s is being created", queue)
+	logger.Info(msg, "fifo", parameters.Fifo, "dead_letter_queue", parameters.DeadLetterQueue)
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusCreateInProgress, msg)
+	StartPollForStatusSQS(ctx, iaasInstance)
+	return nil
+}
+
+// createQueue creates the queue and returns its ARN, creating a queue that exists with the same attributes is no error
+func createQueue(ctx context.Context, name string, attributes map[string]string, tags map[string]*string) (string, error) {
+	output, err := conf.SQSClient.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{QueueName: &name, Attributes: stringMapPointers(attributes), Tags: tags})
+	if err != nil {
+		return "", err
+	}
+	_, arn, err := queueUrlAndArn(ctx, name)
+	if err == nil && arn == "" {
+		err = fmt.Errorf("queue %s is not found after its creation", *output.QueueUrl)
+	}
+	return arn, err
+}
+
+// queueUrlAndArn returns the url and ARN of the queue, empty if the queue does not exist
+func queueUrlAndArn(ctx context.Context, name string) (string, string, error) {
+	urlOutput, err := conf.SQSClient.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{QueueName: &name})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == sqs.ErrCodeQueueDoesNotExist {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	attributeName := sqs.QueueAttributeNameQueueArn
+	attributesOutput, err := conf.SQSClient.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{QueueUrl: urlOutput.QueueUrl, AttributeNames: []*string{&attributeName}})
+	if err != nil {
+		return "", "", err
+	}
+	return *urlOutput.QueueUrl, *attributesOutput.Attributes[attributeName], nil
+}
+
+// SubmitDeletionSQS deletes the queue and its dead-letter queue, SQS takes up to 60 seconds to delete a queue, the poller waits for that
+func SubmitDeletionSQS(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance) error {
+	logger := util.Logger(ctx)
+	logger.Info("deleting queue...")
+	db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
+	db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteInProgress, "delete in progress")
+	var err error
+	for _, queueUrl := range []string{iaasInstance.ServiceDetails[db.DetailQueueUrl], iaasInstance.ServiceDetails[db.DetailDLQUrl]} {
+		if queueUrl == "" {
+			continue
+		}
+		_, err = conf.SQSClient.DeleteQueueWithContext(ctx, &sqs.DeleteQueueInput{QueueUrl: &queueUrl})
+		var aerr awserr.Error
+		if err != nil && !(errors.As(err, &aerr) && aerr.Code() == sqs.ErrCodeQueueDoesNotExist) {
+			LogAwsError(ctx, err)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteFailed, err.Error())
+			return err
+		}
+	}
+	StartPollForStatusSQS(ctx, iaasInstance)
+	return nil
+}
+
+// StartPollForStatusSQS waits until the queues exist (and records their urls and ARNs), or until they are gone, depending on the status of the IaaS instance
+func StartPollForStatusSQS(ctx context.Context, iaasInstance db.IaaSInstance) {
+	ctx = util.WithLogAttrs(ctx, "internal_id", iaasInstance.InternalId)
+	logger := util.Logger(ctx)
+	serviceInstance := db.GetServiceInstanceByEnvAndIaaSId(ctx, conf.CfEnv, iaasInstance.Id)
+	var parameters model.Parameters
+	_ = json.Unmarshal([]byte(serviceInstance.Parameters), &parameters)
+	queue, dlq := queueNames(iaasInstance, parameters.Fifo)
+	startPoller(ctx, serviceInstance, "StartPollForStatusSQS", func(ctx context.Context) bool {
+		iaasInstance := db.GetIaaSInstances(ctx, iaasInstance.Id)[0]
+		queueUrl, queueArn, err := queueUrlAndArn(ctx, queue)
+		var dlqUrl, dlqArn string
+		if err == nil && parameters.DeadLetterQueue {
+			dlqUrl, dlqArn, err = queueUrlAndArn(ctx, dlq)
+		}
+		if err != nil {
+			LogAwsError(ctx, err)
+			msg := fmt.Sprintf("failed to get queue %s: %s", queue, strings.ReplaceAll(err.Error(), "\n", ""))
+			logger.Error(msg)
+			db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusFailed)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusNotFound, msg)
+			return true
+		}
+		switch iaasInstance.Status {
+		case db.StatusCreateInProgress:
+			if queueUrl == "" || (parameters.DeadLetterQueue && dlqUrl == "") {
+				logger.Info("queue does not exist yet", "queue", queue)
+				return false
+			}
+			iaasInstance.ServiceUrl = queueUrl
+			iaasInstance.ServiceDetails = map[string]string{db.DetailQueueUrl: queueUrl, db.DetailQueueArn: queueArn}
+			if parameters.DeadLetterQueue {
+				iaasInstance.ServiceDetails[db.DetailDLQUrl] = dlqUrl
+				iaasInstance.ServiceDetails[db.DetailDLQArn] = dlqArn
+			}
+			iaasInstance.Status = db.StatusCreateSucceeded
+			iaasInstance.LastStatusUpdate = time.Now()
+			iaasInstance.LastMessage = fmt.Sprintf("queue %s successfully created", queue)
+			_ = db.UpdateStatusServiceInstanceForIaaSId(ctx, serviceInstance.IaaSInstanceId, db.StatusSucceeded)
+			_ = db.UpdateIaaSInstance(ctx, iaasInstance)
+			return true
+		case db.StatusDeleteInProgress:
+			if queueUrl != "" || dlqUrl != "" {
+				logger.Info("queue is being deleted", "queue", queue)
+				return false
+			}
+			logger.Info("queue is gone", "queue", queue)
+			db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstance.InstanceId)
+			db.UpdateStatusIaaSInstance(ctx, iaasInstance, db.StatusDeleteSucceeded, fmt.Sprintf("queue %s is gone", queue))
+			return true
+		}
+		logger.Warn("nothing to poll for queue", "queue", queue, "status", iaasInstance.Status)
+		return true
+	})
+}
+
+// CreateBindingSQS creates an IAM user for the binding with an access key, and a policy that allows to produce and/or consume (the Scope binding parameter), consumers can also consume the dead-letter queue
+func CreateBindingSQS(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, bindingId string, parameters model.BindingParameters) (map[string]string, error) {
+	queueArn := iaasInstance.ServiceDetails[db.DetailQueueArn]
+	dlqArn := iaasInstance.ServiceDetails[db.DetailDLQArn]
+	if queueArn == "" {
+		return nil, fmt.Errorf("queue %s is not created (yet)", iaasInstance.InternalId)
+	}
+	var statements []map[string]any
+	if parameters.Scope == "" || parameters.Scope == scopeProducer {
+		statements = append(statements, map[string]any{
+			"Effect":   "Allow",
+			"Action":   []string{"sqs:SendMessage", "sqs:GetQueueUrl", "sqs:GetQueueAttributes"},
+			"Resource": []string{queueArn},
+		})
+	}
+	if parameters.Scope == "" || parameters.Scope == scopeConsumer {
+		resources := []string{queueArn}
+		if dlqArn != "" {
+			resources = append(resources, dlqArn)
+		}
+		statements = append(statements, map[string]any{
+			"Effect":   "Allow",
+			"Action":   []string{"sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:ChangeMessageVisibility", "sqs:GetQueueUrl", "sqs:GetQueueAttributes"},
+			"Resource": resources,
+		})
+	}
+	if len(statements) == 0 {
+		return nil, fmt.Errorf("scope %s is not supported, supported are %s and %s", parameters.Scope, scopeProducer, scopeConsumer)
+	}
+	policyDoc, err := json.Marshal(map[string]any{"Version": "2012-10-17", "Statement": statements})
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := createBindingUser(ctx, serviceInstance, bindingId, string(policyDoc), "")
+	if err != nil {
+		return nil, err
+	}
+	credentials[db.DetailQueueUrl] = iaasInstance.ServiceDetails[db.DetailQueueUrl]
+	credentials[db.DetailQueueArn] = queueArn
+	if dlqUrl := iaasInstance.ServiceDetails[db.DetailDLQUrl]; dlqUrl != "" && parameters.Scope != scopeProducer {
+		credentials[db.DetailDLQUrl] = dlqUrl
+	}
+	credentials[credentialScope] = parameters.Scope
+	if parameters.Scope == "" {
+		credentials[credentialScope] = scopeProducer + "," + scopeConsumer
+	}
+	credentials[credentialFifo] = strconv.FormatBool(strings.HasSuffix(queueArn, fifoSuffix))
+	return credentials, nil
+}
+
+// DeleteBindingSQS deletes the IAM user of the binding, with its access keys and policy
+func DeleteBindingSQS(ctx context.Context, iaasInstance db.IaaSInstance, serviceInstance db.ServiceInstance, binding db.ServiceBinding) error {
+	return deleteBindingUser(ctx, binding.ServiceBindingId)
+}
+
+// getTagsMapForServiceInstance returns the tags for the services that take them as a map (SQS, MSK)
+func getTagsMapForServiceInstance(serviceInstance db.ServiceInstance) map[string]*string {
+	tags := make(map[string]*string)
+	for _, tag := range getTagsForServiceInstanceRDS(serviceInstance) {
+		tags[*tag.Key] = tag.Value
+	}
+	return tags
+}
+
+// stringMapPointers returns the map in the form the AWS SDK wants it
+func stringMapPointers(values map[string]string) map[string]*string {
+	pointers := make(map[string]*string)
+	for key, value := range values {
+		value := value
+		pointers[key] = &value
+	}
+	return pointers
+}
@@ -0,0 +1,106 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+)
+
+const (
+	testQueueArn = "arn:aws:sqs:eu-west-1:123456789012:mfsb-queue-1"
+	testDLQArn   = "arn:aws:sqs:eu-west-1:123456789012:mfsb-queue-1-dlq"
+)
+
+// useIAM makes the IAM client talk to a fake endpoint for the duration of the test, it creates the users and their access keys
+func useIAM(t *testing.T) *fakeAWS {
+	sess, fake := newFakeAWS(t, func(w http.ResponseWriter, call awsCall) {
+		switch call.Action {
+		case "CreateUser", "PutUserPolicy":
+			_, _ = w.Write([]byte(`<` + call.Action + `Response><` + call.Action + `Result/></` + call.Action + `Response>`))
+		case "CreateAccessKey":
+			_, _ = w.Write([]byte(`<CreateAccessKeyResponse><CreateAccessKeyResult><AccessKey><UserName>user</UserName><AccessKeyId>AKIDEXAMPLE</AccessKeyId><SecretAccessKey>secret-key</SecretAccessKey><Status>Active</Status></AccessKey></CreateAccessKeyResult></CreateAccessKeyResponse>`))
+		default:
+			t.Errorf("unexpected call %s", call.Action)
+		}
+	})
+	savedClient := conf.IAMClient
+	conf.IAMClient = iam.New(sess)
+	t.Cleanup(func() { conf.IAMClient = savedClient })
+	return fake
+}
+
+// policyStatement is a statement of the policy document of a binding user
+type policyStatement struct {
+	Effect   string
+	Action   []string
+	Resource []string
+}
+
+func TestCreateBindingSQS(t *testing.T) {
+	producer := policyStatement{Effect: "Allow", Action: []string{"sqs:SendMessage", "sqs:GetQueueUrl", "sqs:GetQueueAttributes"}, Resource: []string{testQueueArn}}
+	consumer := policyStatement{Effect: "Allow", Action: []string{"sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:ChangeMessageVisibility", "sqs:GetQueueUrl", "sqs:GetQueueAttributes"}, Resource: []string{testQueueArn, testDLQArn}}
+	tests := []struct {
+		scope      string
+		statements []policyStatement
+		credScope  string
+		dlqUrl     bool
+	}{
+		{scope: "producer", statements: []policyStatement{producer}, credScope: "producer"},
+		{scope: "consumer", statements: []policyStatement{consumer}, credScope: "consumer", dlqUrl: true},
+		{scope: "", statements: []policyStatement{producer, consumer}, credScope: "producer,consumer", dlqUrl: true},
+	}
+	iaasInstance := db.IaaSInstance{InternalId: "queue-1", ServiceDetails: map[string]string{
+		db.DetailQueueArn: testQueueArn,
+		db.DetailQueueUrl: "https://sqs.eu-west-1.amazonaws.com/123456789012/mfsb-queue-1",
+		db.DetailDLQArn:   testDLQArn,
+		db.DetailDLQUrl:   "https://sqs.eu-west-1.amazonaws.com/123456789012/mfsb-queue-1-dlq",
+	}}
+	for _, tt := range tests {
+		t.Run("scope "+tt.credScope, func(t *testing.T) {
+			fake := useIAM(t)
+			credentials, err := CreateBindingSQS(context.Background(), iaasInstance, db.ServiceInstance{}, "binding-1", model.BindingParameters{Scope: tt.scope})
+			if err != nil {
+				t.Fatalf("the binding failed: %s", err)
+			}
+			call, found := fake.Call("PutUserPolicy")
+			if !found {
+				t.Fatalf("no policy was put on the binding user, got the calls %v", fake.Actions())
+			}
+			values, _ := url.ParseQuery(call.Body)
+			var policy struct{ Statement []policyStatement }
+			if err = json.Unmarshal([]byte(values.Get("PolicyDocument")), &policy); err != nil {
+				t.Fatalf("the policy document %s is invalid: %s", values.Get("PolicyDocument"), err)
+			}
+			if !reflect.DeepEqual(policy.Statement, tt.statements) {
+				t.Errorf("the policy statements are %+v, expected %+v", policy.Statement, tt.statements)
+			}
+			if credentials[credentialScope] != tt.credScope || credentials[credentialAccessKeyId] != "AKIDEXAMPLE" || credentials[db.DetailQueueArn] != testQueueArn {
+				t.Errorf("the credentials are %v", credentials)
+			}
+			if _, found = credentials[db.DetailDLQUrl]; found != tt.dlqUrl {
+				t.Errorf("the credentials should have the dlq url: %t, got %v", tt.dlqUrl, credentials)
+			}
+		})
+	}
+}
+
+func TestCreateBindingSQSUnsupportedScope(t *testing.T) {
+	fake := useIAM(t)
+	iaasInstance := db.IaaSInstance{InternalId: "queue-1", ServiceDetails: map[string]string{db.DetailQueueArn: testQueueArn}}
+	credentials, err := CreateBindingSQS(context.Background(), iaasInstance, db.ServiceInstance{}, "binding-1", model.BindingParameters{Scope: "admin"})
+	expected := "scope admin is not supported, supported are producer and consumer"
+	if err == nil || err.Error() != expected || credentials != nil {
+		t.Errorf("the binding returned %v, %v, expected the error %s", credentials, err, expected)
+	}
+	if len(fake.Calls()) != 0 {
+		t.Errorf("no binding user should be created, got the calls %v", fake.Actions())
+	}
+}
@@ -0,0 +1,25 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/rabobank/mfsb/conf"
+)
+
+// CheckCredentials verifies the AWS credentials of the broker by asking STS who we are, it returns the ARN of the caller
+func CheckCredentials(ctx context.Context) (string, error) {
+	output, err := conf.STSClient.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return *output.Arn, nil
+}
+
+// accountId returns the id of the AWS account the broker runs in
+func accountId(ctx context.Context) (string, error) {
+	output, err := conf.STSClient.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return *output.Account, nil
+}
@@ -0,0 +1,39 @@
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/rabobank/mfsb/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentSession adds handlers to the AWS session that create a span for every AWS SDK request, it should be called before the service clients are created from the session.
+// Only the *WithContext SDK methods propagate the parent span, and only those report their AWS request id to the audit log (util.AddAWSRequestId).
+func InstrumentSession(sess *session.Session) {
+	sess.Handlers.Validate.PushFront(func(r *request.Request) {
+		ctx, _ := util.Tracer().Start(r.Context(), r.ClientInfo.ServiceID+"."+r.Operation.Name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", r.ClientInfo.ServiceID),
+			attribute.String("rpc.method", r.Operation.Name),
+			attribute.String("cloud.region", r.ClientInfo.SigningRegion),
+		))
+		r.SetContext(ctx)
+	})
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("aws.request_id", r.RequestID), attribute.Int("aws.retry_count", r.RetryCount))
+		if r.HTTPResponse != nil {
+			span.SetAttributes(attribute.Int("http.status_code", r.HTTPResponse.StatusCode))
+		}
+		util.RecordError(span, r.Error)
+		span.End()
+		util.AddAWSRequestId(r.Context(), r.RequestID)
+	})
+}
+
+// startPollSpan starts the root span of a (long running) poller, linked to the span of the request (typically the provision or deprovision) that started the poller.
+func startPollSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return util.Tracer().Start(ctx, name, trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(ctx)))
+}
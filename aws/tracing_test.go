@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/rabobank/mfsb/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestAWSSpansAndPollerLink(t *testing.T) {
+	recorder := newSpanRecorder()
+	sess, _ := newFakeAWS(t, func(w http.ResponseWriter, call awsCall) {
+		w.Header().Set("X-Amzn-Requestid", "request-1")
+		if strings.Contains(call.Body, "QueueName=missing") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>AWS.SimpleQueueService.NonExistentQueue</Code><Message>no such queue</Message></Error><RequestId>request-1</RequestId></ErrorResponse>`)
+			return
+		}
+		_, _ = fmt.Fprint(w, `<GetQueueUrlResponse><GetQueueUrlResult><QueueUrl>https://sqs/queue</QueueUrl></GetQueueUrlResult><ResponseMetadata><RequestId>request-1</RequestId></ResponseMetadata></GetQueueUrlResponse>`)
+	})
+	client := sqs.New(sess)
+	queueName, missing := "queue", "missing"
+
+	ctx, provision := util.Tracer().Start(context.Background(), "PUT /v2/service_instances/{service_instance_guid}")
+	if _, err := client.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{QueueName: &queueName}); err != nil {
+		t.Fatalf("GetQueueUrl failed: %s", err)
+	}
+	pollCtx, poll := startPollSpan(ctx, "StartPollForStatusSQS")
+	if _, err := client.GetQueueUrlWithContext(pollCtx, &sqs.GetQueueUrlInput{QueueName: &missing}); err == nil {
+		t.Fatal("GetQueueUrl of the missing queue should fail")
+	}
+	poll.End()
+	provision.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+	provisionCall, pollCall, pollSpan, provisionSpan := spans[0], spans[1], spans[2], spans[3]
+
+	for _, span := range []sdktrace.ReadOnlySpan{provisionCall, pollCall} {
+		if span.Name() != "SQS.GetQueueUrl" {
+			t.Errorf("the AWS span should be named after the service and operation, got %s", span.Name())
+		}
+		for _, expected := range []attribute.KeyValue{
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.method", "GetQueueUrl"),
+			attribute.String("aws.request_id", "request-1"),
+		} {
+			if !hasAttribute(span.Attributes(), expected) {
+				t.Errorf("the AWS span is missing attribute %s=%s", expected.Key, expected.Value.Emit())
+			}
+		}
+	}
+	if provisionCall.Parent().SpanID() != provisionSpan.SpanContext().SpanID() {
+		t.Error("the AWS span should be a child of the provision span")
+	}
+	if provisionCall.Status().Code == codes.Error || pollCall.Status().Code != codes.Error {
+		t.Error("only the failed AWS call should be marked as failed")
+	}
+
+	if pollSpan.Parent().IsValid() || pollSpan.SpanContext().TraceID() == provisionSpan.SpanContext().TraceID() {
+		t.Error("the poll span should be the root of a new trace")
+	}
+	if links := pollSpan.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != provisionSpan.SpanContext().SpanID() {
+		t.Errorf("the poll span should be linked to the provision span, got links %v", links)
+	}
+	if pollCall.Parent().SpanID() != pollSpan.SpanContext().SpanID() {
+		t.Error("the AWS spans of the poller should be children of the poll span")
+	}
+}
+
+func hasAttribute(attributes []attribute.KeyValue, expected attribute.KeyValue) bool {
+	for _, attr := range attributes {
+		if attr == expected {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rabobank/mfsb/model"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var catalog atomic.Pointer[model.Catalog]
+
+// GetCatalog returns the current catalog, it can be swapped by a reload (SetCatalog), so don't keep it around
+func GetCatalog() *model.Catalog {
+	if current := catalog.Load(); current != nil {
+		return current
+	}
+	return &model.Catalog{}
+}
+
+func SetCatalog(newCatalog *model.Catalog) {
+	catalog.Store(newCatalog)
+}
+
+// CatalogFile returns the location of the catalog of the given configuration
+func CatalogFile(config *Config) string {
+	return fmt.Sprintf("%s/%s.json", config.CatalogDir, config.IaaS)
+}
+
+// LoadCatalog reads and validates the catalog file
+func LoadCatalog(file string) (*model.Catalog, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading catalog file %s: %w", file, err)
+	}
+	var newCatalog model.Catalog
+	if err = json.Unmarshal(data, &newCatalog); err != nil {
+		return nil, fmt.Errorf("failed unmarshalling json from catalog file %s: %w", file, err)
+	}
+	if err = ValidateCatalog(newCatalog); err != nil {
+		return nil, fmt.Errorf("invalid catalog file %s: %w", file, err)
+	}
+	return &newCatalog, nil
+}
+
+// mskMinPollingDuration is the minimum maximum_polling_duration (in seconds) of the msk-service
+const mskMinPollingDuration = 3600
+
+// ValidateCatalog checks that every plan in the catalog has the IaaS settings its service needs, it returns all gaps at once
+func ValidateCatalog(catalog model.Catalog) error {
+	var errs []error
+	if len(catalog.Services) == 0 {
+		errs = append(errs, errors.New("the catalog has no services"))
+	}
+	for _, service := range catalog.Services {
+		if strings.HasPrefix(service.Name, "msk-service") && service.MaxPollInterval < mskMinPollingDuration {
+			// the cloud controller stops polling (and marks the instance as failed) before a cluster can be created
+			errs = append(errs, fmt.Errorf("service %s: maximum_polling_duration should be at least %d, creating a Kafka cluster can take more than half an hour", service.Name, mskMinPollingDuration))
+		}
+		for _, plan := range service.Plans {
+			where := fmt.Sprintf("service %s plan %s", service.Name, plan.Name)
+			if withoutInstances(service.Name) {
+				errs = append(errs, validateSchemas(where, plan)...)
+				continue
+			}
+			settings := plan.IaaS
+			if settings == nil {
+				errs = append(errs, fmt.Errorf("%s: metadata.iaas is missing", where))
+				continue
+			}
+			if settings.InstanceClass == "" {
+				errs = append(errs, fmt.Errorf("%s: metadata.iaas.instance_class is missing", where))
+			}
+			if len(settings.AllowedEngines) == 0 {
+				errs = append(errs, fmt.Errorf("%s: metadata.iaas.allowed_engines is missing", where))
+			}
+			if settings.MaxInstances < 1 {
+				errs = append(errs, fmt.Errorf("%s: metadata.iaas.max_instances should be at least 1", where))
+			}
+			switch {
+			case strings.HasPrefix(service.Name, "rds-service"):
+				if settings.DefaultStorageGB < 5 {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.default_storage_gb should be at least 5", where))
+				}
+				if settings.StorageType == "" {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.storage_type is missing", where))
+				}
+			case strings.HasPrefix(service.Name, "aurora-service"):
+				for _, engine := range settings.AllowedEngines {
+					if engine != "aurora-mysql" && engine != "aurora-postgresql" {
+						errs = append(errs, fmt.Errorf("%s: metadata.iaas.allowed_engines can only have aurora-mysql and aurora-postgresql, not %s", where, engine))
+					}
+				}
+			case strings.HasPrefix(service.Name, "elasticache-redis"):
+				if len(settings.AllowedEngines) > 0 && !settings.AllowsEngine("redis") {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.allowed_engines should be [\"redis\"]", where))
+				}
+				if settings.MaxInstances > 6 {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.max_instances can be at most 6 (a primary and 5 replicas)", where))
+				}
+			case strings.HasPrefix(service.Name, "opensearch-service"):
+				if !strings.HasSuffix(settings.InstanceClass, ".search") {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.instance_class should be an OpenSearch instance type (like t3.medium.search), not %s", where, settings.InstanceClass))
+				}
+				for _, engine := range settings.AllowedEngines {
+					if !strings.HasPrefix(engine, "OpenSearch_") {
+						errs = append(errs, fmt.Errorf("%s: metadata.iaas.allowed_engines should be OpenSearch versions (like OpenSearch_2.11), not %s", where, engine))
+					}
+				}
+				if settings.DefaultStorageGB < 10 {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.default_storage_gb should be at least 10", where))
+				}
+			case strings.HasPrefix(service.Name, "msk-service"):
+				if settings.InstanceClass == "serverless" {
+					if len(settings.AllowedEngines) > 0 && !settings.AllowsEngine("serverless") {
+						errs = append(errs, fmt.Errorf("%s: metadata.iaas.allowed_engines should be [\"serverless\"] for a serverless plan", where))
+					}
+					break
+				}
+				if !strings.HasPrefix(settings.InstanceClass, "kafka.") {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.instance_class should be serverless or a broker instance type (like kafka.m5.large), not %s", where, settings.InstanceClass))
+				}
+				if settings.AllowsEngine("serverless") {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.allowed_engines should be Kafka versions (like 3.5.1) for a provisioned plan", where))
+				}
+				if settings.DefaultStorageGB < 1 {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.default_storage_gb should be at least 1", where))
+				}
+			case strings.HasPrefix(service.Name, "neptune-service"):
+				if len(settings.AllowedEngines) > 0 && !settings.AllowsEngine("neptune") {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.allowed_engines should be [\"neptune\"]", where))
+				}
+				if !strings.HasPrefix(settings.InstanceClass, "db.") {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.instance_class should be a Neptune instance class (like db.r6g.large), not %s", where, settings.InstanceClass))
+				}
+			case strings.HasPrefix(service.Name, "amazonmq-service"):
+				if !strings.HasPrefix(settings.InstanceClass, "mq.") {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.instance_class should be an Amazon MQ instance type (like mq.m5.large), not %s", where, settings.InstanceClass))
+				}
+				// Amazon MQ offers RabbitMQ single instance brokers and clusters of 3 nodes, the smallest instance type only as single instance
+				if settings.MaxInstances != 1 && settings.MaxInstances != 3 {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.max_instances should be 1 (a single instance) or 3 (a cluster), not %d", where, settings.MaxInstances))
+				}
+				if settings.MaxInstances == 3 && settings.InstanceClass == "mq.t3.micro" {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.instance_class mq.t3.micro is only available for a single instance", where))
+				}
+			case strings.HasPrefix(service.Name, "documentdb-service"):
+				if len(settings.AllowedEngines) > 0 && !settings.AllowsEngine("docdb") {
+					errs = append(errs, fmt.Errorf("%s: metadata.iaas.allowed_engines should be [\"docdb\"]", where))
+				}
+			default:
+				errs = append(errs, fmt.Errorf("%s: service is not supported", where))
+			}
+			errs = append(errs, validateSchemas(where, plan)...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// withoutInstances tells if the service has no instances (like a bucket or a table), the plans of these services need no IaaS settings
+func withoutInstances(serviceName string) bool {
+	return strings.HasPrefix(serviceName, "s3-service") || strings.HasPrefix(serviceName, "sqs-service") || strings.HasPrefix(serviceName, "dynamodb-service") || strings.HasPrefix(serviceName, "secretsmanager-service")
+}
+
+// validateSchemas checks the parameter schemas of the plan against the parameters the broker understands (model.Parameters): a schema that offers a parameter the broker would ignore, or with another type, is an error
+func validateSchemas(where string, plan model.ServicePlan) []error {
+	var errs []error
+	if plan.ParameterSchema(model.SchemaServiceInstanceCreate) == nil {
+		errs = append(errs, fmt.Errorf("%s: schemas.service_instance.create.parameters is missing", where))
+	}
+	for _, action := range []string{model.SchemaServiceInstanceCreate, model.SchemaServiceInstanceUpdate, model.SchemaServiceBindingCreate} {
+		schema := plan.ParameterSchema(action)
+		if schema == nil {
+			continue
+		}
+		if schema.Type != "object" {
+			errs = append(errs, fmt.Errorf("%s: schemas.%s.parameters should be of type object", where, action))
+		}
+		parameterTypes := model.ParameterTypes()
+		if action == model.SchemaServiceBindingCreate {
+			parameterTypes = model.BindingParameterTypes()
+		}
+		for name, property := range schema.Properties {
+			parameterType, found := parameterTypes[name]
+			switch {
+			case !found:
+				errs = append(errs, fmt.Errorf("%s: schemas.%s.parameters has property %s, which is not a parameter of the broker", where, action, name))
+			case property.Type != parameterType:
+				errs = append(errs, fmt.Errorf("%s: schemas.%s.parameters property %s should be of type %s", where, action, name, parameterType))
+			}
+			if _, err := regexp.Compile(property.Pattern); err != nil {
+				errs = append(errs, fmt.Errorf("%s: schemas.%s.parameters property %s has an invalid pattern: %s", where, action, name, err))
+			}
+		}
+		if engine := schema.Properties["Engine"]; engine != nil && plan.IaaS != nil {
+			for _, value := range engine.Enum {
+				if allowed, ok := value.(string); !ok || !plan.IaaS.AllowsEngine(allowed) {
+					errs = append(errs, fmt.Errorf("%s: schemas.%s.parameters property Engine allows %v, which is not in metadata.iaas.allowed_engines", where, action, value))
+				}
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,158 @@
+package conf
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rabobank/mfsb/model"
+)
+
+func TestLoadCatalog(t *testing.T) {
+	for _, file := range []string{"../resources/catalog/aws.json", "../resources/catalog-test/aws.json"} {
+		if _, err := LoadCatalog(file); err != nil {
+			t.Errorf("the catalog %s should be valid: %s", file, err)
+		}
+	}
+}
+
+func TestValidateSchemas(t *testing.T) {
+	tests := []struct {
+		name    string
+		schemas string
+		errors  []string
+	}{
+		{
+			name:    "valid",
+			schemas: `{"service_instance": {"create": {"parameters": {"type": "object", "properties": {"Engine": {"type": "string", "enum": ["postgres"]}, "DBName": {"type": "string", "pattern": "^[a-z]+$"}, "NumDBInstances": {"type": "integer"}, "MultiAZ": {"type": "boolean"}}}}}, "service_binding": {"create": {"parameters": {"type": "object", "properties": {"Scope": {"type": "string"}}}}}}`,
+		},
+		{
+			name:    "no create schema",
+			schemas: `{"service_instance": {"update": {"parameters": {"type": "object"}}}}`,
+			errors:  []string{"plan: schemas.service_instance.create.parameters is missing"},
+		},
+		{
+			name:    "not an object",
+			schemas: `{"service_instance": {"create": {"parameters": {"type": "string"}}}}`,
+			errors:  []string{"plan: schemas.service_instance.create.parameters should be of type object"},
+		},
+		{
+			name:    "unknown parameter",
+			schemas: `{"service_instance": {"create": {"parameters": {"type": "object", "properties": {"Size": {"type": "string"}}}}}}`,
+			errors:  []string{"plan: schemas.service_instance.create.parameters has property Size, which is not a parameter of the broker"},
+		},
+		{
+			name:    "wrong type",
+			schemas: `{"service_instance": {"create": {"parameters": {"type": "object", "properties": {"NumDBInstances": {"type": "string"}, "MultiAZ": {"type": "integer"}}}}}}`,
+			errors: []string{
+				"plan: schemas.service_instance.create.parameters property MultiAZ should be of type boolean",
+				"plan: schemas.service_instance.create.parameters property NumDBInstances should be of type integer",
+			},
+		},
+		{
+			name:    "invalid pattern",
+			schemas: `{"service_instance": {"create": {"parameters": {"type": "object", "properties": {"DBName": {"type": "string", "pattern": "^[a-z"}}}}}}`,
+			errors:  []string{"plan: schemas.service_instance.create.parameters property DBName has an invalid pattern: error parsing regexp: missing closing ]: `[a-z`"},
+		},
+		{
+			name:    "engine that is not allowed",
+			schemas: `{"service_instance": {"create": {"parameters": {"type": "object", "properties": {"Engine": {"type": "string", "enum": ["postgres", "oracle-ee"]}}}}}}`,
+			errors:  []string{"plan: schemas.service_instance.create.parameters property Engine allows oracle-ee, which is not in metadata.iaas.allowed_engines"},
+		},
+		{
+			name:    "binding parameters",
+			schemas: `{"service_instance": {"create": {"parameters": {"type": "object", "properties": {"Scope": {"type": "string"}}}}}, "service_binding": {"create": {"parameters": {"type": "object", "properties": {"Engine": {"type": "string"}, "Access": {"type": "string"}}}}}}`,
+			errors: []string{
+				"plan: schemas.service_instance.create.parameters has property Scope, which is not a parameter of the broker",
+				"plan: schemas.service_binding.create.parameters has property Engine, which is not a parameter of the broker",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := model.ServicePlan{Name: "plan", IaaS: &model.PlanIaaSSettings{AllowedEngines: []string{"postgres", "mysql"}}}
+			if err := json.Unmarshal([]byte(tt.schemas), &plan.Schemas); err != nil {
+				t.Fatalf("the test schemas are invalid: %s", err)
+			}
+			var messages []string
+			for _, err := range validateSchemas("plan", plan) {
+				messages = append(messages, err.Error())
+			}
+			// the properties are a map, so the order of the errors of one schema is not fixed
+			if !sameErrors(messages, tt.errors) {
+				t.Errorf("the errors are %v, expected %v", messages, tt.errors)
+			}
+		})
+	}
+}
+
+func TestValidateCatalog(t *testing.T) {
+	tests := []struct {
+		name    string
+		catalog string
+		errors  []string
+	}{
+		{name: "no services", catalog: `{"services": []}`, errors: []string{"the catalog has no services"}},
+		{
+			name:    "missing iaas settings",
+			catalog: `{"services": [{"name": "rds-service", "plans": [{"name": "micro", "schemas": {"service_instance": {"create": {"parameters": {"type": "object"}}}}}]}]}`,
+			errors:  []string{"service rds-service plan micro: metadata.iaas is missing"},
+		},
+		{
+			name:    "service without instances needs no iaas settings, but a schema",
+			catalog: `{"services": [{"name": "s3-service", "plans": [{"name": "standard"}]}]}`,
+			errors:  []string{"service s3-service plan standard: schemas.service_instance.create.parameters is missing"},
+		},
+		{
+			name: "incomplete iaas settings",
+			catalog: `{"services": [{"name": "rds-service", "plans": [{"name": "micro", "metadata": {"iaas": {"default_storage_gb": 1}},
+				"schemas": {"service_instance": {"create": {"parameters": {"type": "object", "properties": {"Engine": {"type": "string", "enum": ["postgres"]}}}}}}}]}]}`,
+			errors: []string{
+				"service rds-service plan micro: metadata.iaas.instance_class is missing",
+				"service rds-service plan micro: metadata.iaas.allowed_engines is missing",
+				"service rds-service plan micro: metadata.iaas.max_instances should be at least 1",
+				"service rds-service plan micro: metadata.iaas.default_storage_gb should be at least 5",
+				"service rds-service plan micro: metadata.iaas.storage_type is missing",
+				"service rds-service plan micro: schemas.service_instance.create.parameters property Engine allows postgres, which is not in metadata.iaas.allowed_engines",
+			},
+		},
+		{
+			name:    "unsupported service",
+			catalog: `{"services": [{"name": "mainframe-service", "plans": [{"name": "big", "metadata": {"iaas": {"instance_class": "z16", "allowed_engines": ["cobol"], "max_instances": 1}}, "schemas": {"service_instance": {"create": {"parameters": {"type": "object"}}}}}]}]}`,
+			errors:  []string{"service mainframe-service plan big: service is not supported"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var catalog model.Catalog
+			if err := json.Unmarshal([]byte(tt.catalog), &catalog); err != nil {
+				t.Fatalf("the test catalog is invalid: %s", err)
+			}
+			var messages []string
+			if err := ValidateCatalog(catalog); err != nil {
+				messages = strings.Split(err.Error(), "\n")
+			}
+			if !sameErrors(messages, tt.errors) {
+				t.Errorf("the errors are %v, expected %v", messages, tt.errors)
+			}
+		})
+	}
+}
+
+// sameErrors tells if the messages are the expected ones, in any order
+func sameErrors(messages []string, expected []string) bool {
+	if len(messages) != len(expected) {
+		return false
+	}
+	remaining := make(map[string]int)
+	for _, message := range expected {
+		remaining[message]++
+	}
+	for _, message := range messages {
+		if remaining[message] == 0 {
+			return false
+		}
+		remaining[message]--
+	}
+	return true
+}
@@ -4,52 +4,78 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/docdb"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/elasticache"
 	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	"github.com/aws/aws-sdk-go/service/mq"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
 	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/cloudfoundry-community/go-cfenv"
-	"github.com/rabobank/mfsb/model"
+	"log/slog"
 	"os"
-	"strconv"
+	"strings"
 )
 
 var (
-	AWSSession  *session.Session
-	RDSClient   *rds.RDS
-	DOCDBClient *docdb.DocDB
-	IAMClient   *iam.IAM
-	Catalog     model.Catalog
-	ListenPort  int
-	Debug       = false
+	AWSSession           *session.Session
+	RDSClient            *rds.RDS
+	DOCDBClient          *docdb.DocDB
+	ElastiCacheClient    *elasticache.ElastiCache
+	S3Client             *s3.S3
+	SQSClient            *sqs.SQS
+	OpenSearchClient     *opensearchservice.OpenSearchService
+	KafkaClient          *kafka.Kafka
+	SecretsManagerClient *secretsmanager.SecretsManager
+	DynamoDBClient       *dynamodb.DynamoDB
+	MQClient             *mq.MQ
+	NeptuneClient        *neptune.Neptune
+	IAMClient            *iam.IAM
+	STSClient            *sts.STS
+	ListenPort           int
+	Debug                = false
+	LogLevel             = new(slog.LevelVar)
 
-	DebugStr              = os.Getenv("MFSB_DEBUG")
-	IaaS                  = os.Getenv("MFSB_IAAS")
-	BrokerUser            = os.Getenv("MFSB_BROKER_USER")
-	BrokerDBUser          = os.Getenv("MFSB_BROKER_DB_USER")
-	BrokerDBName          = os.Getenv("MFSB_BROKER_DB_NAME")
-	BrokerDBHost          = os.Getenv("MFSB_BROKER_DB_HOST")
-	CatalogDir            = os.Getenv("MFSB_CATALOG_DIR")
-	ListenPortStr         = os.Getenv("MFSB_LISTEN_PORT")
+	// the settings below are set from the Config (see LoadConfig) by EnvironmentComplete
+	IaaS                  string
+	BrokerUser            string
+	BrokerDBUser          string
+	BrokerDBName          string
+	BrokerDBHost          string
 	CfEnv                 = os.Getenv("MFSB_CF_ENV")
-	RDSSubnetGrp          = os.Getenv("MFSB_RDS_SUBNETGRP")
-	DOCDBSubnetGrp        = os.Getenv("MFSB_DOCDB_SUBNETGRP")
-	RDSSecGrpId           = os.Getenv("MFSB_RDS_SECGRP_ID")
-	DOCDBSecGrpId         = os.Getenv("MFSB_DOCDB_SECGRP_ID")
-	AWSRegion             = os.Getenv("MFSB_AWS_REGION")
-	PermissionBoundaryARN = os.Getenv("MFSB_PERMISSION_BOUNDARY_ARN")
-	PolicyARN             = os.Getenv("MFSB_POLICY_ARN")
+	RDSSubnetGrp          string
+	DOCDBSubnetGrp        string
+	RDSSecGrpId           string
+	DOCDBSecGrpId         string
+	ElastiCacheSubnetGrp  string
+	ElastiCacheSecGrpId   string
+	OpenSearchSubnetIds   []string
+	OpenSearchSecGrpId    string
+	MSKSubnetIds          []string
+	MSKSecGrpId           string
+	MSKKmsKeyId           string
+	MQSubnetIds           []string
+	MQSecGrpId            string
+	NeptuneSubnetGrp      string
+	NeptuneSecGrpId       string
+	SecretsKmsKeyId       string
+	AWSRegion             string
+	PermissionBoundaryARN string
+	PolicyARN             string
+	OtelExporter          string
+	// InstanceId identifies this broker instance, for example as the owner of a poller
+	InstanceId = os.Getenv("CF_INSTANCE_GUID")
 
 	BrokerPassword   string
 	BrokerDBPassword string
 	EncryptKey       string
-
-	// a map of rds database classes keyed by planname
-	RDSDBClasses = make(map[string]string)
-	DOCDBClasses = make(map[string]string)
-
-	az1 = "eu-west-1a"
-	az2 = "eu-west-1b"
-	az3 = "eu-west-1c"
-	AZS = []*string{&az1, &az2, &az3}
+	// WebhookSecret is the key the webhook notifications are signed with (HMAC-SHA256), optional, without it no notifications are sent
+	WebhookSecret string
 
 	AssumeRolePolicyDoc = `{
   "Version": "2012-10-17",
@@ -70,115 +96,102 @@ var (
 
 const BasicAuthRealm = "MFSB - Multi Foundation Service Broker"
 
-func EnvironmentComplete() {
-	// setup plan to database class // TODO should be externally configurable (envvars or something else)
-	RDSDBClasses["micro"] = "db.t3.micro"
-	RDSDBClasses["small"] = "db.t3.small"
-	RDSDBClasses["medium"] = "db.t3.medium"
-
-	DOCDBClasses["micro"] = "db.t3.medium"
-	DOCDBClasses["small"] = "db.r5.large"
-	DOCDBClasses["medium"] = "db.r5.xlarge"
+// init installs a json logger as the default logger, every entry carries the foundation env, so entries from multiple foundations can be told apart in log aggregation
+func init() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: LogLevel})).With("env", CfEnv))
+}
 
-	envComplete := true
-	if DebugStr == "true" {
-		Debug = true
-	}
-	if IaaS == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_IAAS")
-	}
-	if BrokerUser == "" {
-		envComplete = false
-		fmt.Printf("missing envvar: MFSB_BROKER_USER")
-	}
-	if BrokerDBUser == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_BROKER_DB_USER")
-	}
-	if BrokerDBName == "" {
-		BrokerDBName = "mfsbdb"
-	}
-	if BrokerDBHost == "" {
-		BrokerDBHost = "localhost"
-	}
-	if CatalogDir == "" {
-		CatalogDir = "catalog"
-	}
-	if ListenPortStr == "" {
-		ListenPort = 8080
-	} else {
-		var err error
-		ListenPort, err = strconv.Atoi(ListenPortStr)
-		if err != nil {
-			fmt.Printf("failed reading envvar MFSB_LISTEN_PORT, err: %s\n", err)
-			envComplete = false
+// EnvironmentComplete loads the configuration (MFSB_CONFIG_FILE and/or the MFSB_* envvars) and the credentials from credhub, it reports all configuration problems at once and exits if there are any
+func EnvironmentComplete() {
+	config, err := LoadConfig(os.Getenv("MFSB_CONFIG_FILE"))
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			slog.Error("invalid configuration", "problem", line)
 		}
-	}
-	if CfEnv == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_CF_ENV")
-	}
-	if RDSSubnetGrp == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_RDS_SUBNETGRP")
-	}
-	if RDSSecGrpId == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_RDS_SECGRP_ID")
-	}
-	if AWSRegion == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_AWS_REGION")
-	}
-	if DOCDBSubnetGrp == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_DOCDB_SUBNETGRP")
-	}
-	if DOCDBSecGrpId == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_DOCDB_SECGRP_ID")
-	}
-	if PermissionBoundaryARN == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_PERMISSION_BOUNDARY_ARN")
-	}
-	if PolicyARN == "" {
-		envComplete = false
-		fmt.Println("missing envvar: MFSB_POLICY_ARN")
-	}
-
-	if !envComplete {
-		fmt.Println("one or more required envvars missing, aborting...")
+		slog.Error("the configuration is incomplete or invalid, aborting...")
 		os.Exit(8)
 	}
+	applyConfig(config)
+	if InstanceId == "" {
+		hostname, _ := os.Hostname()
+		InstanceId = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
 
 	initCredentials()
 }
 
+// applyConfig makes config the current configuration, and sets the package level settings from it. The settings that can be reloaded (see CheckReloadable) are only available through Get().
+func applyConfig(config *Config) {
+	current.Store(config)
+	Debug = config.Debug
+	if Debug {
+		LogLevel.Set(slog.LevelDebug)
+	} else {
+		LogLevel.Set(slog.LevelInfo)
+	}
+	if config.CfEnv != CfEnv {
+		// the env of the default logger was taken from the envvar, the config file could have another one
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: LogLevel})).With("env", config.CfEnv))
+	}
+	IaaS = config.IaaS
+	BrokerUser = config.BrokerUser
+	BrokerDBUser = config.BrokerDBUser
+	BrokerDBName = config.BrokerDBName
+	BrokerDBHost = config.BrokerDBHost
+	ListenPort = config.ListenPort
+	CfEnv = config.CfEnv
+	OtelExporter = config.OtelExporter
+	AWSRegion = config.AWS.Region
+	RDSSubnetGrp = config.AWS.RDSSubnetGrp
+	RDSSecGrpId = config.AWS.RDSSecGrpId
+	DOCDBSubnetGrp = config.AWS.DOCDBSubnetGrp
+	DOCDBSecGrpId = config.AWS.DOCDBSecGrpId
+	ElastiCacheSubnetGrp = config.AWS.ElastiCacheSubnetGrp
+	ElastiCacheSecGrpId = config.AWS.ElastiCacheSecGrpId
+	OpenSearchSubnetIds = config.AWS.OpenSearchSubnetIds
+	OpenSearchSecGrpId = config.AWS.OpenSearchSecGrpId
+	MSKSubnetIds = config.AWS.MSKSubnetIds
+	MSKSecGrpId = config.AWS.MSKSecGrpId
+	MSKKmsKeyId = config.AWS.MSKKmsKeyId
+	MQSubnetIds = config.AWS.MQSubnetIds
+	MQSecGrpId = config.AWS.MQSecGrpId
+	NeptuneSubnetGrp = config.AWS.NeptuneSubnetGrp
+	NeptuneSecGrpId = config.AWS.NeptuneSecGrpId
+	SecretsKmsKeyId = config.AWS.SecretsKmsKeyId
+	PermissionBoundaryARN = config.AWS.PermissionBoundaryARN
+	PolicyARN = config.AWS.PolicyARN
+}
+
 // initCredentials - Get the credentials from credhub (VCAP_SERVICES envvar)
 func initCredentials() {
-	fmt.Println("getting credentials from credhub...")
+	slog.Info("getting credentials from credhub...")
 	if appEnv, err := cfenv.Current(); err == nil {
 		services, err := appEnv.Services.WithLabel("credhub")
 		if err == nil {
 			if len(services) != 1 {
-				fmt.Printf("we expected exactly one bound credhub service instance, but found %d\n", len(services))
+				slog.Error("we expected exactly one bound credhub service instance", "found", len(services))
 			} else {
 				EncryptKey = fmt.Sprint(services[0].Credentials["MFSB_ENCRYPT_KEY"])
 				BrokerPassword = fmt.Sprint(services[0].Credentials["MFSB_BROKER_PASSWORD"])
 				BrokerDBPassword = fmt.Sprint(services[0].Credentials["MFSB_BROKER_DB_PASSWORD"])
 				allVarsFound := true
 				if EncryptKey == "" {
-					fmt.Printf("credhub variable MFSB_ENCRYPT_KEY is missing")
+					slog.Error("credhub variable is missing", "name", "MFSB_ENCRYPT_KEY")
 					allVarsFound = false
 				}
 				if BrokerPassword == "" {
-					fmt.Printf("credhub variable MFSB_BROKER_PASSWORD is missing")
+					slog.Error("credhub variable is missing", "name", "MFSB_BROKER_PASSWORD")
 					allVarsFound = false
 				}
 				if BrokerDBPassword == "" {
-					fmt.Printf("credhub variable MFSB_BROKER_DB_PASSWORD is missing")
+					slog.Error("credhub variable is missing", "name", "MFSB_BROKER_DB_PASSWORD")
+					allVarsFound = false
+				}
+				if webhookSecret, found := services[0].Credentials["MFSB_WEBHOOK_SECRET"]; found {
+					WebhookSecret = fmt.Sprint(webhookSecret)
+				}
+				if len(Get().WebhookURLs) > 0 && WebhookSecret == "" {
+					slog.Error("credhub variable is missing, it is required with MFSB_WEBHOOK_URLS", "name", "MFSB_WEBHOOK_SECRET")
 					allVarsFound = false
 				}
 				if !allVarsFound {
@@ -186,11 +199,11 @@ func initCredentials() {
 				}
 			}
 		} else {
-			fmt.Printf("failed getting services from cf env: %s\n", err)
+			slog.Error("failed getting services from cf env", "error", err)
 			os.Exit(8)
 		}
 	} else {
-		fmt.Printf("failed to get the current cf env: %s\n", err)
+		slog.Error("failed to get the current cf env", "error", err)
 		os.Exit(8)
 	}
 }
@@ -0,0 +1,216 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Config The broker configuration (except the secrets, they come from credhub). It is read from the json file in MFSB_CONFIG_FILE (optional), every setting can be overridden with the envvar in its env tag.
+type Config struct {
+	IaaS         string    `json:"iaas" env:"MFSB_IAAS"`
+	CatalogDir   string    `json:"catalog_dir" env:"MFSB_CATALOG_DIR"`
+	BrokerUser   string    `json:"broker_user" env:"MFSB_BROKER_USER"`
+	BrokerDBUser string    `json:"broker_db_user" env:"MFSB_BROKER_DB_USER"`
+	BrokerDBName string    `json:"broker_db_name" env:"MFSB_BROKER_DB_NAME"`
+	BrokerDBHost string    `json:"broker_db_host" env:"MFSB_BROKER_DB_HOST"`
+	ListenPort   int       `json:"listen_port" env:"MFSB_LISTEN_PORT"`
+	CfEnv        string    `json:"cf_env" env:"MFSB_CF_ENV"`
+	Debug        bool      `json:"debug" env:"MFSB_DEBUG"`
+	OtelExporter string    `json:"otel_exporter" env:"MFSB_OTEL_EXPORTER"`
+	WebhookURLs  []string  `json:"webhook_urls" env:"MFSB_WEBHOOK_URLS"`
+	AWS          AWSConfig `json:"aws"`
+}
+
+type AWSConfig struct {
+	Region                string   `json:"region" env:"MFSB_AWS_REGION"`
+	AvailabilityZones     []string `json:"availability_zones" env:"MFSB_AWS_AZS"` // default are the zones of the subnet group of the service
+	RDSSubnetGrp          string   `json:"rds_subnet_group" env:"MFSB_RDS_SUBNETGRP"`
+	RDSSecGrpId           string   `json:"rds_security_group_id" env:"MFSB_RDS_SECGRP_ID"`
+	DOCDBSubnetGrp        string   `json:"docdb_subnet_group" env:"MFSB_DOCDB_SUBNETGRP"`
+	DOCDBSecGrpId         string   `json:"docdb_security_group_id" env:"MFSB_DOCDB_SECGRP_ID"`
+	ElastiCacheSubnetGrp  string   `json:"elasticache_subnet_group" env:"MFSB_ELASTICACHE_SUBNETGRP"` // optional, only needed for the elasticache-redis service
+	ElastiCacheSecGrpId   string   `json:"elasticache_security_group_id" env:"MFSB_ELASTICACHE_SECGRP_ID"`
+	OpenSearchSubnetIds   []string `json:"opensearch_subnet_ids" env:"MFSB_OPENSEARCH_SUBNET_IDS"` // optional, only needed for the opensearch-service
+	OpenSearchSecGrpId    string   `json:"opensearch_security_group_id" env:"MFSB_OPENSEARCH_SECGRP_ID"`
+	MSKSubnetIds          []string `json:"msk_subnet_ids" env:"MFSB_MSK_SUBNET_IDS"` // optional, only needed for the msk-service
+	MSKSecGrpId           string   `json:"msk_security_group_id" env:"MFSB_MSK_SECGRP_ID"`
+	MSKKmsKeyId           string   `json:"msk_kms_key_id" env:"MFSB_MSK_KMS_KEY_ID"` // the SCRAM secrets can not be encrypted with the default key
+	MQSubnetIds           []string `json:"mq_subnet_ids" env:"MFSB_MQ_SUBNET_IDS"`   // optional, only needed for the amazonmq-service
+	MQSecGrpId            string   `json:"mq_security_group_id" env:"MFSB_MQ_SECGRP_ID"`
+	NeptuneSubnetGrp      string   `json:"neptune_subnet_group" env:"MFSB_NEPTUNE_SUBNETGRP"` // optional, only needed for the neptune-service
+	NeptuneSecGrpId       string   `json:"neptune_security_group_id" env:"MFSB_NEPTUNE_SECGRP_ID"`
+	SecretsKmsKeyId       string   `json:"secrets_kms_key_id" env:"MFSB_SECRETS_KMS_KEY_ID"` // optional, the secrets of the secretsmanager-service get the default key without it
+	PermissionBoundaryARN string   `json:"permission_boundary_arn" env:"MFSB_PERMISSION_BOUNDARY_ARN"`
+	PolicyARN             string   `json:"policy_arn" env:"MFSB_POLICY_ARN"`
+}
+
+var current atomic.Pointer[Config]
+
+// Get returns the configuration the broker is running with
+func Get() *Config {
+	return current.Load()
+}
+
+// CheckReloadable returns an error if the new configuration differs from the old one in other settings than the ones that can be changed without a restart: debug, webhook_urls, catalog_dir and aws.availability_zones
+func CheckReloadable(old, new *Config) error {
+	others := *new
+	others.Debug = old.Debug
+	others.WebhookURLs = old.WebhookURLs
+	others.CatalogDir = old.CatalogDir
+	others.AWS.AvailabilityZones = old.AWS.AvailabilityZones
+	if changed := changedFields(reflect.ValueOf(*old), reflect.ValueOf(others), ""); len(changed) > 0 {
+		return fmt.Errorf("changing %s requires a restart", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// changedFields returns the json names of the fields that differ between the two (Config) structs
+func changedFields(old, new reflect.Value, prefix string) []string {
+	var changed []string
+	for i := 0; i < old.NumField(); i++ {
+		name := prefix + strings.Split(old.Type().Field(i).Tag.Get("json"), ",")[0]
+		if old.Field(i).Kind() == reflect.Struct {
+			changed = append(changed, changedFields(old.Field(i), new.Field(i), name+".")...)
+		} else if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// ApplyReloadedConfig makes the (reloadable) settings of config effective, see CheckReloadable
+func ApplyReloadedConfig(config *Config) {
+	current.Store(config)
+	if config.Debug {
+		LogLevel.Set(slog.LevelDebug)
+	} else {
+		LogLevel.Set(slog.LevelInfo)
+	}
+}
+
+// LoadConfig reads the config file (if any), applies the envvar overrides and the defaults, and validates the result. The error lists every problem found, not only the first.
+func LoadConfig(file string) (*Config, error) {
+	config := &Config{BrokerDBName: "mfsbdb", BrokerDBHost: "localhost", CatalogDir: "catalog", ListenPort: 8080}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading config file %s: %w", file, err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(config); err != nil {
+			return nil, fmt.Errorf("failed parsing config file %s: %w", file, err)
+		}
+	}
+	errs := applyEnvOverrides(reflect.ValueOf(config).Elem())
+	errs = append(errs, config.validate()...)
+	return config, errors.Join(errs...)
+}
+
+// applyEnvOverrides sets every field that has an env tag from its envvar, lists are comma separated. Like before the config file existed, an empty envvar counts as not set.
+func applyEnvOverrides(value reflect.Value) []error {
+	var errs []error
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() == reflect.Struct {
+			errs = append(errs, applyEnvOverrides(field)...)
+			continue
+		}
+		name := value.Type().Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		envValue := os.Getenv(name)
+		if envValue == "" {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(envValue)
+		case reflect.Int:
+			number, err := strconv.Atoi(envValue)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("envvar %s should be a number: %s", name, envValue))
+				continue
+			}
+			field.SetInt(int64(number))
+		case reflect.Bool:
+			field.SetBool(envValue == "true")
+		case reflect.Slice:
+			var values []string
+			for _, item := range strings.Split(envValue, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = append(values, item)
+				}
+			}
+			field.Set(reflect.ValueOf(values))
+		}
+	}
+	return errs
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+	required := []struct{ name, value string }{
+		{"iaas (MFSB_IAAS)", c.IaaS},
+		{"broker_user (MFSB_BROKER_USER)", c.BrokerUser},
+		{"broker_db_user (MFSB_BROKER_DB_USER)", c.BrokerDBUser},
+		{"cf_env (MFSB_CF_ENV)", c.CfEnv},
+		{"aws.region (MFSB_AWS_REGION)", c.AWS.Region},
+		{"aws.rds_subnet_group (MFSB_RDS_SUBNETGRP)", c.AWS.RDSSubnetGrp},
+		{"aws.rds_security_group_id (MFSB_RDS_SECGRP_ID)", c.AWS.RDSSecGrpId},
+		{"aws.docdb_subnet_group (MFSB_DOCDB_SUBNETGRP)", c.AWS.DOCDBSubnetGrp},
+		{"aws.docdb_security_group_id (MFSB_DOCDB_SECGRP_ID)", c.AWS.DOCDBSecGrpId},
+		{"aws.permission_boundary_arn (MFSB_PERMISSION_BOUNDARY_ARN)", c.AWS.PermissionBoundaryARN},
+		{"aws.policy_arn (MFSB_POLICY_ARN)", c.AWS.PolicyARN},
+	}
+	for _, setting := range required {
+		if setting.value == "" {
+			errs = append(errs, fmt.Errorf("%s is missing", setting.name))
+		}
+	}
+	if (c.AWS.ElastiCacheSubnetGrp == "") != (c.AWS.ElastiCacheSecGrpId == "") {
+		errs = append(errs, errors.New("aws.elasticache_subnet_group (MFSB_ELASTICACHE_SUBNETGRP) and aws.elasticache_security_group_id (MFSB_ELASTICACHE_SECGRP_ID) should be set together"))
+	}
+	if (len(c.AWS.OpenSearchSubnetIds) == 0) != (c.AWS.OpenSearchSecGrpId == "") {
+		errs = append(errs, errors.New("aws.opensearch_subnet_ids (MFSB_OPENSEARCH_SUBNET_IDS) and aws.opensearch_security_group_id (MFSB_OPENSEARCH_SECGRP_ID) should be set together"))
+	}
+	if (len(c.AWS.MSKSubnetIds) == 0) != (c.AWS.MSKSecGrpId == "") {
+		errs = append(errs, errors.New("aws.msk_subnet_ids (MFSB_MSK_SUBNET_IDS) and aws.msk_security_group_id (MFSB_MSK_SECGRP_ID) should be set together"))
+	}
+	if len(c.AWS.MSKSubnetIds) == 1 || len(c.AWS.MSKSubnetIds) > 3 {
+		errs = append(errs, fmt.Errorf("aws.msk_subnet_ids (MFSB_MSK_SUBNET_IDS) should have 2 or 3 subnets (in different availability zones), not %d", len(c.AWS.MSKSubnetIds)))
+	}
+	if (len(c.AWS.MQSubnetIds) == 0) != (c.AWS.MQSecGrpId == "") {
+		errs = append(errs, errors.New("aws.mq_subnet_ids (MFSB_MQ_SUBNET_IDS) and aws.mq_security_group_id (MFSB_MQ_SECGRP_ID) should be set together"))
+	}
+	if (c.AWS.NeptuneSubnetGrp == "") != (c.AWS.NeptuneSecGrpId == "") {
+		errs = append(errs, errors.New("aws.neptune_subnet_group (MFSB_NEPTUNE_SUBNETGRP) and aws.neptune_security_group_id (MFSB_NEPTUNE_SECGRP_ID) should be set together"))
+	}
+	if c.ListenPort < 1 || c.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port (MFSB_LISTEN_PORT) %d is not a valid port", c.ListenPort))
+	}
+	if c.OtelExporter != "" && c.OtelExporter != "none" && c.OtelExporter != "otlp" {
+		errs = append(errs, fmt.Errorf("otel_exporter (MFSB_OTEL_EXPORTER) %s is not supported, supported are otlp and none", c.OtelExporter))
+	}
+	for _, webhookURL := range c.WebhookURLs {
+		if parsed, err := url.Parse(webhookURL); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+			errs = append(errs, fmt.Errorf("webhook_urls (MFSB_WEBHOOK_URLS) %s is not a valid url", webhookURL))
+		}
+	}
+	for _, az := range c.AWS.AvailabilityZones {
+		if c.AWS.Region != "" && !strings.HasPrefix(az, c.AWS.Region) {
+			errs = append(errs, fmt.Errorf("aws.availability_zones (MFSB_AWS_AZS) %s is not in region %s", az, c.AWS.Region))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,56 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected Config
+		errors   []string
+	}{
+		{
+			name:     "not set",
+			expected: Config{BrokerDBName: "from-file", ListenPort: 8080, AWS: AWSConfig{AvailabilityZones: []string{"a"}}},
+		},
+		{
+			name:     "empty envvars are ignored",
+			env:      map[string]string{"MFSB_BROKER_DB_NAME": "", "MFSB_LISTEN_PORT": "", "MFSB_AWS_AZS": "", "MFSB_DEBUG": ""},
+			expected: Config{BrokerDBName: "from-file", ListenPort: 8080, AWS: AWSConfig{AvailabilityZones: []string{"a"}}},
+		},
+		{
+			name:     "overrides",
+			env:      map[string]string{"MFSB_BROKER_DB_NAME": "from-env", "MFSB_LISTEN_PORT": "9090", "MFSB_AWS_AZS": "b, c,", "MFSB_DEBUG": "true"},
+			expected: Config{BrokerDBName: "from-env", ListenPort: 9090, Debug: true, AWS: AWSConfig{AvailabilityZones: []string{"b", "c"}}},
+		},
+		{
+			name:     "not a number",
+			env:      map[string]string{"MFSB_LISTEN_PORT": "80a"},
+			expected: Config{BrokerDBName: "from-file", ListenPort: 8080, AWS: AWSConfig{AvailabilityZones: []string{"a"}}},
+			errors:   []string{"envvar MFSB_LISTEN_PORT should be a number: 80a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			config := Config{BrokerDBName: "from-file", ListenPort: 8080, AWS: AWSConfig{AvailabilityZones: []string{"a"}}}
+			errs := applyEnvOverrides(reflect.ValueOf(&config).Elem())
+			if !reflect.DeepEqual(config, tt.expected) {
+				t.Errorf("config is %+v, expected %+v", config, tt.expected)
+			}
+			var messages []string
+			for _, err := range errs {
+				messages = append(messages, err.Error())
+			}
+			if strings.Join(messages, "\n") != strings.Join(tt.errors, "\n") {
+				t.Errorf("errors are %v, expected %v", messages, tt.errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/reload"
+	"github.com/rabobank/mfsb/util"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetAuditEvents returns the audit events, newest first. They can be selected with the query parameters instance_id, iaas_instance_id, internal_id, org, space, name, env, since (RFC3339) and limit
+func GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	filter := db.AuditEventFilter{
+		InstanceId:       query.Get("instance_id"),
+		InternalId:       query.Get("internal_id"),
+		OrganizationName: query.Get("org"),
+		SpaceName:        query.Get("space"),
+		InstanceName:     query.Get("name"),
+		Env:              query.Get("env"),
+	}
+	var err error
+	if value := query.Get("iaas_instance_id"); value != "" {
+		if filter.IaaSInstanceId, err = strconv.ParseInt(value, 10, 64); err != nil {
+			util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid iaas_instance_id %s", value))
+			return
+		}
+	}
+	if value := query.Get("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid since %s, expected RFC3339, for example 2024-01-31T12:00:00Z", value))
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %s", value))
+			return
+		}
+	}
+	events, err := db.GetAuditEvents(ctx, filter)
+	if err != nil {
+		util.WriteHttpResponse(w, http.StatusInternalServerError, fmt.Sprintf("failed to query the audit events: %s", err))
+		return
+	}
+	result := make([]model.AuditEvent, 0, len(events))
+	for _, event := range events {
+		var awsRequestIds []string
+		if event.AWSRequestIds != "" {
+			awsRequestIds = strings.Split(event.AWSRequestIds, ",")
+		}
+		result = append(result, model.AuditEvent{
+			Id:                  event.Id,
+			EventTime:           event.EventTime,
+			Env:                 event.Env,
+			BrokerInstance:      event.BrokerInstance,
+			OriginatingIdentity: event.OriginatingIdentity,
+			RequestId:           event.RequestId,
+			EventType:           event.EventType,
+			InstanceId:          event.InstanceId,
+			OrganizationName:    event.OrganizationName,
+			SpaceName:           event.SpaceName,
+			InstanceName:        event.InstanceName,
+			IaaSInstanceId:      event.IaaSInstanceId,
+			InternalId:          event.InternalId,
+			OldStatus:           event.OldStatus,
+			NewStatus:           event.NewStatus,
+			AWSRequestIds:       awsRequestIds,
+			Message:             event.Message,
+		})
+	}
+	util.WriteHttpResponse(w, http.StatusOK, result)
+}
+
+// GetIaaSInstanceStatusHistory returns every status (with its message) the iaas instance had, newest first, optionally limited with the query parameter limit
+func GetIaaSInstanceStatusHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	value := mux.Vars(r)["iaas_instance_id"]
+	iaasInstanceId, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid iaas_instance_id %s", value))
+		return
+	}
+	var limit int
+	if value = r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil {
+			util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %s", value))
+			return
+		}
+	}
+	history, err := db.GetIaaSInstanceStatusHistory(ctx, iaasInstanceId, limit)
+	if err != nil {
+		util.WriteHttpResponse(w, http.StatusInternalServerError, fmt.Sprintf("failed to query the status history: %s", err))
+		return
+	}
+	if len(history) == 0 {
+		util.WriteHttpResponse(w, http.StatusNotFound, fmt.Sprintf("no status history for iaas instance %d", iaasInstanceId))
+		return
+	}
+	result := make([]model.IaaSInstanceStatus, 0, len(history))
+	for _, status := range history {
+		result = append(result, model.IaaSInstanceStatus{Status: status.Status, Message: status.Message, StatusTime: status.StatusTime, Env: status.Env})
+	}
+	util.WriteHttpResponse(w, http.StatusOK, result)
+}
+
+// Reload reloads the configuration file and the catalog of this broker instance, a rejected reload leaves the current configuration and catalog in place
+func Reload(w http.ResponseWriter, r *http.Request) {
+	result, err := reload.Reload(r.Context())
+	if err != nil {
+		util.Logger(r.Context()).Error("reload failed", "error", err)
+		util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	util.WriteHttpResponse(w, http.StatusOK, result)
+}
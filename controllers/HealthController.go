@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rabobank/mfsb/aws"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckTimeout = 5 * time.Second
+	// the AWS credentials are checked at most once per awsCheckInterval, every probe would be an STS call otherwise
+	awsCheckInterval = 30 * time.Second
+)
+
+// awsCheck is the cached result of the last AWS credentials check
+var awsCheck struct {
+	sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// LivenessCheck only tells that the broker process is up and serving http
+func LivenessCheck(w http.ResponseWriter, r *http.Request) {
+	util.WriteHttpResponse(w, http.StatusOK, model.HealthReport{Status: model.HealthUp, Version: conf.GetVersion()})
+}
+
+// ReadinessCheck checks the dependencies of the broker (broker db, schema version, catalog and AWS credentials), and responds with 503 if one of them is down.
+// The endpoint is unauthenticated, so the report only has the status per check, the reasons of a failed check are logged.
+func ReadinessCheck(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(ctx context.Context) error{
+		"database": db.Ping,
+		"schema": func(ctx context.Context) error {
+			version, err := db.GetSchemaVersion(ctx)
+			if err == nil && version != db.SchemaVersion {
+				err = fmt.Errorf("schema version is %d, expected %d", version, db.SchemaVersion)
+			}
+			return err
+		},
+		"catalog": func(ctx context.Context) error {
+			if len(conf.GetCatalog().Services) == 0 {
+				return fmt.Errorf("no services in catalog %s", conf.CatalogFile(conf.Get()))
+			}
+			return nil
+		},
+		"aws": checkAWSCredentials,
+		"draining": func(ctx context.Context) error {
+			if aws.IsDraining() {
+				return errors.New("the broker is shutting down")
+			}
+			return nil
+		},
+	}
+
+	report := model.HealthReport{Status: model.HealthUp, Version: conf.GetVersion(), Checks: make(map[string]model.HealthCheck)}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check(ctx)
+			result := model.HealthCheck{Status: model.HealthUp}
+			if err != nil {
+				result.Status = model.HealthDown
+				util.Logger(r.Context()).Warn("readiness check failed", "check", name, "duration_ms", time.Since(start).Milliseconds(), "error", err)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			report.Checks[name] = result
+			if err != nil {
+				report.Status = model.HealthDown
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	if report.Status == model.HealthUp {
+		util.WriteHttpResponse(w, http.StatusOK, report)
+	} else {
+		util.WriteHttpResponse(w, http.StatusServiceUnavailable, report)
+	}
+}
+
+// checkAWSCredentials checks the AWS credentials (through STS), the result is reused for awsCheckInterval
+func checkAWSCredentials(ctx context.Context) error {
+	awsCheck.Lock()
+	defer awsCheck.Unlock()
+	if time.Since(awsCheck.checkedAt) < awsCheckInterval {
+		return awsCheck.err
+	}
+	arn, err := aws.CheckCredentials(ctx)
+	if err == nil {
+		util.Logger(ctx).Debug("the AWS credentials are valid", "arn", arn)
+	}
+	awsCheck.checkedAt, awsCheck.err = time.Now(), err
+	return err
+}
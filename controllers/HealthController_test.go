@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+	"github.com/rabobank/mfsb/model"
+)
+
+const testCallerArn = "arn:aws:sts::123456789012:assumed-role/mfsb-broker/session"
+
+// useFakeSTS makes the STS client talk to a fake endpoint that responds with the given status, it returns the number of calls
+func useFakeSTS(t *testing.T, status *atomic.Int32) *atomic.Int32 {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(int(status.Load()))
+		if status.Load() != http.StatusOK {
+			_, _ = w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>ExpiredToken</Code><Message>The security token of ` + testCallerArn + ` is expired</Message></Error></ErrorResponse>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<GetCallerIdentityResponse><GetCallerIdentityResult><Arn>` + testCallerArn + `</Arn><Account>123456789012</Account><UserId>AROA:session</UserId></GetCallerIdentityResult></GetCallerIdentityResponse>`))
+	}))
+	sess := session.Must(session.NewSession(&awssdk.Config{
+		Region:      awssdk.String("eu-west-1"),
+		Endpoint:    awssdk.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  awssdk.Int(0),
+	}))
+	savedClient := conf.STSClient
+	conf.STSClient = sts.New(sess)
+	t.Cleanup(func() {
+		server.Close()
+		conf.STSClient = savedClient
+		awsCheck.checkedAt, awsCheck.err = time.Time{}, nil
+	})
+	return &calls
+}
+
+func readiness(t *testing.T) (int, string) {
+	t.Helper()
+	response := httptest.NewRecorder()
+	ReadinessCheck(response, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	return response.Code, response.Body.String()
+}
+
+func TestReadinessCheck(t *testing.T) {
+	dbtest.Configure()
+	savedCatalog, savedDBName, savedDBHost := conf.GetCatalog(), conf.BrokerDBName, conf.BrokerDBHost
+	conf.SetCatalog(&model.Catalog{Services: []model.Service{{Id: "rds-id", Name: "rds-service"}}})
+	conf.BrokerDBName, conf.BrokerDBHost = "mfsbdb", "mfsb-db.internal.example.com"
+	t.Cleanup(func() {
+		conf.SetCatalog(savedCatalog)
+		conf.BrokerDBName, conf.BrokerDBHost = savedDBName, savedDBHost
+	})
+	var stsStatus atomic.Int32
+	stsStatus.Store(http.StatusOK)
+	stsCalls := useFakeSTS(t, &stsStatus)
+	mock := dbtest.NewMock(t)
+	schemaVersion := func(version int) {
+		mock.ExpectQuery("select coalesce\\(max\\(version\\), 0\\) from schema_version").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+	}
+
+	schemaVersion(db.SchemaVersion)
+	code, body := readiness(t)
+	if code != http.StatusOK {
+		t.Errorf("the readiness check responded %d %s, expected 200", code, body)
+	}
+	var report model.HealthReport
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("the report %s is not valid: %s", body, err)
+	}
+	for _, name := range []string{"database", "schema", "catalog", "aws", "draining"} {
+		if report.Checks[name] != (model.HealthCheck{Status: model.HealthUp}) {
+			t.Errorf("the check %s is %+v, expected only UP", name, report.Checks[name])
+		}
+	}
+
+	// the result of the AWS check is reused, also when it changed in the meantime
+	stsStatus.Store(http.StatusForbidden)
+	schemaVersion(db.SchemaVersion)
+	if code, body = readiness(t); code != http.StatusOK || stsCalls.Load() != 1 {
+		t.Errorf("the second readiness check responded %d %s after %d STS calls, expected 200 after 1 call", code, body, stsCalls.Load())
+	}
+
+	// the reasons of the failures are not in the report
+	awsCheck.Lock()
+	awsCheck.checkedAt = time.Time{}
+	awsCheck.Unlock()
+	schemaVersion(db.SchemaVersion - 1)
+	code, body = readiness(t)
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, `"aws":{"status":"DOWN"}`) || !strings.Contains(body, `"schema":{"status":"DOWN"}`) {
+		t.Errorf("the readiness check responded %d %s, expected 503 with aws and schema DOWN", code, body)
+	}
+	for _, detail := range []string{testCallerArn, "expired", "mfsbdb", conf.BrokerDBHost, "schema version is"} {
+		if strings.Contains(body, detail) {
+			t.Errorf("the report shows %q: %s", detail, body)
+		}
+	}
+}
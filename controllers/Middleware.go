@@ -1,11 +1,23 @@
 package controllers
 
 import (
+	"fmt"
+	"github.com/gorilla/mux"
 	"github.com/rabobank/mfsb/conf"
 	"github.com/rabobank/mfsb/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 )
 
+const (
+	RequestIdHeader           = "X-Request-ID"
+	OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+)
+
 func BasicAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if util.BasicAuth(w, r, conf.BrokerUser, conf.BrokerPassword) {
@@ -15,6 +27,71 @@ func BasicAuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// RequestIdMiddleware takes the request id from the X-Request-ID header (or generates one), and puts a logger in the request context that adds the request id and the instance/binding guids to every log entry.
+// The request id, the originating identity and the ids of the AWS requests done for the request are also kept in the context for the audit events
+func RequestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if requestId == "" {
+			requestId = util.GenerateGUID()
+		}
+		w.Header().Set(RequestIdHeader, requestId)
+		args := []any{"request_id", requestId}
+		if serviceInstanceId := mux.Vars(r)["service_instance_guid"]; serviceInstanceId != "" {
+			args = append(args, "instance_guid", serviceInstanceId)
+		}
+		if serviceBindingId := mux.Vars(r)["service_binding_guid"]; serviceBindingId != "" {
+			args = append(args, "binding_guid", serviceBindingId)
+		}
+		// Call the next handler, which can be another middleware in the chain, or the final handler.
+		ctx := util.WithRequestInfo(r.Context(), requestId, util.DecodeOriginatingIdentity(r.Header.Get(OriginatingIdentityHeader)))
+		ctx = util.WithAWSRequestIds(ctx)
+		next.ServeHTTP(w, r.WithContext(util.WithLogAttrs(ctx, args...)))
+	})
+}
+
+// statusRecorder remembers the status code written by the handler, so it can be put on the span
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// TracingMiddleware starts a span for every http request (continuing the trace from the traceparent header if there is one), and adds the trace_id to the logger in the request context
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if currentRoute := mux.CurrentRoute(r); currentRoute != nil {
+			if template, err := currentRoute.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := util.Tracer().Start(ctx, fmt.Sprintf("%s %s", r.Method, route), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+		))
+		defer span.End()
+		if serviceInstanceId := mux.Vars(r)["service_instance_guid"]; serviceInstanceId != "" {
+			span.SetAttributes(attribute.String("mfsb.instance_guid", serviceInstanceId))
+		}
+		if span.SpanContext().IsValid() {
+			ctx = util.WithLogAttrs(ctx, "trace_id", span.SpanContext().TraceID().String())
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		// Call the next handler, which can be another middleware in the chain, or the final handler.
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
 func DebugMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		util.DumpRequest(r)
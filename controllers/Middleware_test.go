@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rabobank/mfsb/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	router := mux.NewRouter()
+	router.Use(RequestIdMiddleware)
+	router.Use(TracingMiddleware)
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}", func(w http.ResponseWriter, r *http.Request) {
+		// the spans of the handler (db queries, AWS calls) are children of the http span
+		_, span := util.Tracer().Start(r.Context(), "db.InsertServiceInstance")
+		span.End()
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/guid-1", nil)
+	request.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/v2/service_instances/guid-2", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans (a handler and an http span per request), got %d", len(spans))
+	}
+	handler, put, deleteSpan := spans[0], spans[1], spans[3]
+	if put.Name() != "PUT /v2/service_instances/{service_instance_guid}" {
+		t.Errorf("the http span should be named after the route template, got %s", put.Name())
+	}
+	if put.SpanContext().TraceID().String() != traceId {
+		t.Errorf("the http span should continue the trace of the traceparent header, got trace %s", put.SpanContext().TraceID())
+	}
+	if handler.Parent().SpanID() != put.SpanContext().SpanID() {
+		t.Error("the span of the handler should be a child of the http span")
+	}
+	for _, expected := range []attribute.KeyValue{
+		attribute.String("http.route", "/v2/service_instances/{service_instance_guid}"),
+		attribute.String("mfsb.instance_guid", "guid-1"),
+		attribute.Int("http.status_code", http.StatusAccepted),
+	} {
+		if !hasAttribute(put.Attributes(), expected) {
+			t.Errorf("the http span is missing attribute %s=%s", expected.Key, expected.Value.Emit())
+		}
+	}
+	if put.Status().Code == codes.Error {
+		t.Error("a 202 should not mark the http span as failed")
+	}
+	if deleteSpan.Status().Code != codes.Error {
+		t.Error("a 500 should mark the http span as failed")
+	}
+}
+
+func hasAttribute(attributes []attribute.KeyValue, expected attribute.KeyValue) bool {
+	for _, attr := range attributes {
+		if attr == expected {
+			return true
+		}
+	}
+	return false
+}
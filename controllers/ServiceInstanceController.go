@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
@@ -10,26 +11,28 @@ import (
 	"github.com/rabobank/mfsb/model"
 	"github.com/rabobank/mfsb/util"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 )
 
 func Catalog(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("get service broker catalog from %s...\n", r.RemoteAddr)
-	util.WriteHttpResponse(w, http.StatusOK, conf.Catalog)
+	util.Logger(r.Context()).Info("get service broker catalog", "remote_addr", r.RemoteAddr)
+	util.WriteHttpResponse(w, http.StatusOK, conf.GetCatalog())
 }
 
 func GetServiceInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
-	fmt.Printf("get service instance for %s...\n", serviceInstanceId)
-	serviceInstance := db.GetServiceInstanceByInstanceId(serviceInstanceId)
+	util.Logger(ctx).Info("get service instance...")
+	serviceInstance := db.GetServiceInstanceByInstanceId(ctx, serviceInstanceId)
 	if serviceInstance.InstanceName == "" {
-		util.WriteHttpResponse(w, http.StatusNotFound, fmt.Sprintf("service instance with guid %s not found", serviceInstanceId))
+		util.WriteHttpResponse(w, http.StatusNotFound, describeMissingServiceInstance(ctx, serviceInstanceId))
 	} else {
-		iaasInstance := db.GetIaaSInstances(serviceInstance.IaaSInstanceId)[0]
+		iaasInstance := db.GetIaaSInstances(ctx, serviceInstance.IaaSInstanceId)[0]
 		lastOperation := &model.LastOperation{
 			State:       serviceInstance.Status,
-			Description: iaasInstance.LastMessage,
+			Description: describeIaaSInstance(ctx, iaasInstance),
 		}
 		response := model.CreateServiceInstanceResponse{
 			ServiceId:     serviceInstance.ServiceId,
@@ -42,28 +45,57 @@ func GetServiceInstance(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetServiceInstanceLastOperation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
-	fmt.Printf("get service instance LastOperation for %s...\n", serviceInstanceId)
-	serviceInstance := db.GetServiceInstanceByInstanceId(serviceInstanceId)
+	util.Logger(ctx).Info("get service instance LastOperation...")
+	serviceInstance := db.GetServiceInstanceByInstanceId(ctx, serviceInstanceId)
 	if serviceInstance.InstanceName == "" {
 		response := &model.LastOperation{
 			State:       db.StatusSucceeded,
-			Description: fmt.Sprintf("service instance with guid %s not found", serviceInstanceId),
+			Description: describeMissingServiceInstance(ctx, serviceInstanceId),
 		}
 		util.WriteHttpResponse(w, http.StatusOK, response)
 	} else {
-		iaasInstance := db.GetIaaSInstances(serviceInstance.IaaSInstanceId)[0]
+		iaasInstance := db.GetIaaSInstances(ctx, serviceInstance.IaaSInstanceId)[0]
 		response := &model.LastOperation{
 			State:       serviceInstance.Status,
-			Description: iaasInstance.LastMessage,
+			Description: describeIaaSInstance(ctx, iaasInstance),
 		}
 		util.WriteHttpResponse(w, http.StatusOK, response)
 	}
 }
 
+// describeIaaSInstance returns the last message of the iaas instance, together with its status and (from the status history) since when it has that status
+func describeIaaSInstance(ctx context.Context, iaasInstance db.IaaSInstance) string {
+	since := db.StatusSince(ctx, iaasInstance)
+	if since.IsZero() {
+		return iaasInstance.LastMessage
+	}
+	return fmt.Sprintf("%s (%s since %s)", iaasInstance.LastMessage, iaasInstance.Status, since.UTC().Format(time.RFC3339))
+}
+
+// describeMissingServiceInstance tells if the service instance never existed, or when and by which foundation it was deleted
+func describeMissingServiceInstance(ctx context.Context, serviceInstanceId string) string {
+	deleted := db.GetDeletedServiceInstanceByInstanceId(ctx, serviceInstanceId)
+	if deleted.InstanceName == "" {
+		return fmt.Sprintf("service instance with guid %s not found", serviceInstanceId)
+	}
+	description := fmt.Sprintf("service instance with guid %s was deleted at %s by foundation %s", serviceInstanceId, deleted.DeletedAt.UTC().Format(time.RFC3339), deleted.DeletedByEnv)
+	if iaasInstances := db.GetIaaSInstances(ctx, deleted.IaaSInstanceId); len(iaasInstances) == 1 {
+		description = fmt.Sprintf("%s, %s: %s", description, iaasInstances[0].Status, iaasInstances[0].LastMessage)
+	}
+	return description
+}
+
 func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := util.Logger(ctx)
 	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
-	fmt.Printf("create service instance for %s...\n", serviceInstanceId)
+	logger.Info("create service instance...")
+	if aws.IsDraining() {
+		util.WriteHttpResponse(w, http.StatusServiceUnavailable, "the broker is shutting down, please retry")
+		return
+	}
 	var err error
 	var serviceInstance model.ServiceInstance
 	err = util.ProvisionObjectFromRequest(r, &serviceInstance)
@@ -71,6 +103,23 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 		util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	// validate before anything is written to the db, the schema of the plan is stricter than decoding into model.Parameters
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	if !validateParameterSchema(w, r, plan.ParameterSchema(model.SchemaServiceInstanceCreate), serviceInstance.RawParameters) {
+		return
+	}
+	if len(serviceInstance.RawParameters) > 0 {
+		if err = json.Unmarshal(serviceInstance.RawParameters, &serviceInstance.Parameters); err != nil {
+			util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	// the SecretValue (secretsmanager-service) only goes to the provisioning, it is neither logged nor stored with the parameters
+	var secretValue string
+	if serviceInstance.Parameters != nil {
+		secretValue = serviceInstance.Parameters.SecretValue
+		serviceInstance.Parameters.SecretValue = ""
+	}
 	// read the supported parameters (they have to be stored in the db)
 	parmsBA, err := json.Marshal(serviceInstance.Parameters)
 	if err != nil {
@@ -78,19 +127,23 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	parameters := string(parmsBA)
-	fmt.Printf("got parameters: %s\n", parameters)
+	logger.Info("got parameters", "parameters", parameters)
 	if len(parameters) > 2048 {
 		util.WriteHttpResponse(w, http.StatusBadRequest, "The given parameter string is more than 2048 chars")
 		return
 	}
 	serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
-	if !strings.HasPrefix(serviceName, "rds-service") && !strings.HasPrefix(serviceName, "documentdb-service") {
+	if !aws.IsSupportedService(serviceName) {
 		util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("service %s is not supported", serviceName))
 		return
 	}
+	if err = aws.ValidateParameters(serviceInstance.ServiceId, serviceInstance.PlanId, serviceInstance.Parameters); err != nil {
+		util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	var lastOperation *model.LastOperation
-	serviceInstancesInProgress := db.GetServicesInstanceByNameAndStatus(serviceInstance.Context.OrgName, serviceInstance.Context.SpaceName, serviceInstance.Context.InstanceName, db.StatusInProgress)
-	serviceInstancesCreated := db.GetServicesInstanceByNameAndIaaSStatus(serviceInstance.Context.OrgName, serviceInstance.Context.SpaceName, serviceInstance.Context.InstanceName, db.StatusCreateSucceeded)
+	serviceInstancesInProgress := db.GetServicesInstanceByNameAndStatus(ctx, serviceInstance.Context.OrgName, serviceInstance.Context.SpaceName, serviceInstance.Context.InstanceName, db.StatusInProgress)
+	serviceInstancesCreated := db.GetServicesInstanceByNameAndIaaSStatus(ctx, serviceInstance.Context.OrgName, serviceInstance.Context.SpaceName, serviceInstance.Context.InstanceName, db.StatusCreateSucceeded)
 	if (len(serviceInstancesInProgress) > 0 && serviceInstancesInProgress[0].PlanId != serviceInstance.PlanId) || (len(serviceInstancesCreated) > 0 && serviceInstancesCreated[0].PlanId != serviceInstance.PlanId) {
 		util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("requested plan Id (%s) is not equal to plan Id of already existing service", serviceInstance.PlanId))
 		return
@@ -111,7 +164,7 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 				IaaSInstanceId:   serviceInstancesCreated[0].IaaSInstanceId,
 				Status:           db.StatusSucceeded,
 			}
-			_, err := db.InsertServiceInstance(serviceInstanceDB)
+			_, err := db.InsertServiceInstance(ctx, serviceInstanceDB)
 			if err != nil {
 				util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
 				return
@@ -124,7 +177,7 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 		// nothing created or in progress for this database, so we create it here and now
 		iaasInstance := db.IaaSInstance{
 			InternalId:       "s" + strings.ReplaceAll(time.Now().Format("20060102T150405.999"), ".", "-"),
-			Status:           "preparing for create",
+			Status:           db.StatusPreparingForCreate,
 			LastStatusUpdate: time.Now(),
 			LastMessage:      "no last message yet",
 			ServiceUrl:       "no service URL",
@@ -132,7 +185,7 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 			ServicePassword:  "no password yet",
 		}
 
-		iaasInstanceId, err := db.InsertIaaSInstance(iaasInstance)
+		iaasInstanceId, err := db.InsertIaaSInstance(ctx, iaasInstance)
 		if err != nil {
 			util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
 			return
@@ -149,14 +202,14 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 			IaaSInstanceId:   iaasInstanceId,
 			Status:           db.StatusInProgress,
 		}
-		_, err = db.InsertServiceInstance(serviceInstance)
+		_, err = db.InsertServiceInstance(ctx, serviceInstance)
 		if err != nil {
 			util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
 		// fire up the provisioning in the background
-		err = aws.SubmitProvisioning(iaasInstanceId)
+		err = aws.SubmitProvisioning(aws.WithSecretValue(ctx, secretValue), iaasInstanceId)
 
 		if err == nil {
 			lastOperation = &model.LastOperation{State: "in progress", Description: "creating service instance..."}
@@ -168,7 +221,7 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// an operation (create or delete) is already in progress from another foundation, only return current status
-	iaasInstance := db.GetIaaSInstances(serviceInstancesInProgress[0].IaaSInstanceId)[0]
+	iaasInstance := db.GetIaaSInstances(ctx, serviceInstancesInProgress[0].IaaSInstanceId)[0]
 	if iaasInstance.Status == db.StatusCreateInProgress {
 		serviceInstance := db.ServiceInstance{
 			ServiceId:        serviceInstance.ServiceId,
@@ -181,13 +234,13 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 			IaaSInstanceId:   iaasInstance.Id,
 			Status:           db.StatusInProgress,
 		}
-		_, err := db.InsertServiceInstance(serviceInstance)
+		_, err := db.InsertServiceInstance(ctx, serviceInstance)
 		if err != nil {
 			util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
 			return
 		}
 		lastOperation = &model.LastOperation{State: "in progress", Description: fmt.Sprintf("service instance create is in progress from foundation %s...", serviceInstancesInProgress[0].Env)}
-		aws.StartPollForStatus(iaasInstance.Id)
+		aws.StartPollForStatus(ctx, iaasInstance.Id)
 		response := model.CreateServiceInstanceResponse{LastOperation: lastOperation}
 		util.WriteHttpResponse(w, http.StatusAccepted, response)
 		return
@@ -195,51 +248,114 @@ func CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
 	util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("a DELETE request is already in progress from foundation %s", serviceInstancesInProgress[0].Env))
 }
 
+// UpdateServiceInstance applies the parameters of "cf update-service -c" to the IaaS instance, the plans are not updateable
+func UpdateServiceInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := util.Logger(ctx)
+	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
+	logger.Info("update service instance...")
+	if aws.IsDraining() {
+		util.WriteHttpResponse(w, http.StatusServiceUnavailable, "the broker is shutting down, please retry")
+		return
+	}
+	var update model.ServiceInstance
+	if err := util.ProvisionObjectFromRequest(r, &update); err != nil {
+		util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	serviceInstance := db.GetServiceInstanceByInstanceId(ctx, serviceInstanceId)
+	if serviceInstance.InstanceName == "" {
+		util.WriteHttpResponse(w, http.StatusNotFound, describeMissingServiceInstance(ctx, serviceInstanceId))
+		return
+	}
+	if update.PlanId != "" && update.PlanId != serviceInstance.PlanId {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.UpdateServiceInstanceResponse{Result: "changing the plan of a service instance is not supported"})
+		return
+	}
+	plan := util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId)
+	if !validateParameterSchema(w, r, plan.ParameterSchema(model.SchemaServiceInstanceUpdate), update.RawParameters) {
+		return
+	}
+	var parameters model.Parameters
+	if len(update.RawParameters) > 0 {
+		if err := json.Unmarshal(update.RawParameters, &parameters); err != nil {
+			util.WriteHttpResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	iaasInstance := db.GetIaaSInstances(ctx, serviceInstance.IaaSInstanceId)[0]
+	if iaasInstance.Status != db.StatusCreateSucceeded {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.UpdateServiceInstanceResponse{Result: fmt.Sprintf("the service instance can not be updated, its status is %s", iaasInstance.Status)})
+		return
+	}
+	if err := aws.SubmitUpdate(ctx, iaasInstance, serviceInstance, parameters); err != nil {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.UpdateServiceInstanceResponse{Result: fmt.Sprintf("Update failed, error: %s", err)})
+		return
+	}
+	db.InsertAuditEvent(ctx, db.AuditEvent{
+		EventType:        db.EventServiceInstanceUpdated,
+		InstanceId:       serviceInstance.InstanceId,
+		OrganizationName: serviceInstance.OrganizationName,
+		SpaceName:        serviceInstance.SpaceName,
+		InstanceName:     serviceInstance.InstanceName,
+		IaaSInstanceId:   serviceInstance.IaaSInstanceId,
+		InternalId:       iaasInstance.InternalId,
+		NewStatus:        serviceInstance.Status,
+		Message:          "updated with parameter(s) " + strings.Join(parameterNames(update.RawParameters), ", "),
+	})
+	util.WriteHttpResponse(w, http.StatusOK, model.UpdateServiceInstanceResponse{})
+}
+
+// parameterNames returns the names of the given parameters, without their values (they can be secret)
+func parameterNames(parameters json.RawMessage) []string {
+	var values map[string]json.RawMessage
+	_ = json.Unmarshal(parameters, &values)
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func DeleteServiceInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
-	fmt.Printf("delete service instance %s...\n", serviceInstanceId)
-	serviceInstance := db.GetServiceInstanceByInstanceId(serviceInstanceId)
-	serviceName := util.GetServiceById(serviceInstance.ServiceId).Name
+	util.Logger(ctx).Info("delete service instance...")
+	serviceInstance := db.GetServiceInstanceByInstanceId(ctx, serviceInstanceId)
 	if serviceInstance.InstanceName == "" {
 		util.WriteHttpResponse(w, http.StatusGone, fmt.Sprintf("service instance with guid %s not found", serviceInstanceId))
 		return
 	}
-	iaasInstance := db.GetIaaSInstances(serviceInstance.IaaSInstanceId)[0]
+	iaasInstance := db.GetIaaSInstances(ctx, serviceInstance.IaaSInstanceId)[0]
 	if iaasInstance.Status == db.StatusCreateInProgress {
 		response := model.DeleteServiceInstanceResponse{Result: fmt.Sprint("There is still a create in progress (from another foundation)")}
 		util.WriteHttpResponse(w, http.StatusBadRequest, response)
 		return
 	}
 	if iaasInstance.Status == db.StatusDeleteInProgress {
-		db.UpdateStatusServiceInstance(serviceInstance, db.StatusInProgress)
+		db.UpdateStatusServiceInstance(ctx, serviceInstance, db.StatusInProgress)
 		response := model.DeleteServiceInstanceResponse{Result: fmt.Sprint("There is still a delete in progress (from another foundation)")}
-		aws.StartPollForStatus(iaasInstance.Id)
+		aws.StartPollForStatus(ctx, iaasInstance.Id)
 		util.WriteHttpResponse(w, http.StatusAccepted, response)
 		return
 	}
 	if iaasInstance.Status == db.StatusDeleteSucceeded {
 		response := model.DeleteServiceInstanceResponse{Result: fmt.Sprint("The database was already deleted (from another foundation)")}
-		db.DeleteServiceInstanceByServiceInstanceId(serviceInstanceId)
+		db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstanceId)
 		util.WriteHttpResponse(w, http.StatusOK, response)
 		return
 	}
 	// all looks good so far, now check if we are the last service instance for the same iaas_instance, if so then do the actual delete of the service, if not, respond with StatusDeleteSucceeded.
-	if !db.IsLastServiceInstanceForIaaS(iaasInstance.Id) {
+	if !db.IsLastServiceInstanceForIaaS(ctx, iaasInstance.Id) {
 		response := model.DeleteServiceInstanceResponse{Result: fmt.Sprint("The physical database was not yet deleted (still in use by another foundation)")}
-		db.DeleteServiceInstanceByServiceInstanceId(serviceInstanceId)
+		db.DeleteServiceInstanceByServiceInstanceId(ctx, serviceInstanceId)
 		util.WriteHttpResponse(w, http.StatusOK, response)
 		return
 	}
 
 	// submit the actual delete
-	var err error
-	if strings.HasPrefix(serviceName, "rds-service") {
-		err = aws.SubmitDeletionRDSDB(iaasInstance, serviceInstance)
-	}
-	if strings.HasPrefix(serviceName, "documentdb-service") {
-		err = aws.SubmitDeletionDOCDB(iaasInstance, serviceInstance)
-	}
-	if err != nil {
+	if err := aws.SubmitDeletion(ctx, iaasInstance, serviceInstance); err != nil {
 		response := model.DeleteServiceInstanceResponse{Result: fmt.Sprintf("Delete failed, error: %s", err)}
 		util.WriteHttpResponse(w, http.StatusBadRequest, response)
 		return
@@ -247,3 +363,25 @@ func DeleteServiceInstance(w http.ResponseWriter, r *http.Request) {
 	response := model.DeleteServiceInstanceResponse{Result: fmt.Sprintf("Delete of %s in progress...", iaasInstance.InternalId)}
 	util.WriteHttpResponse(w, http.StatusAccepted, response)
 }
+
+// validateParameterSchema validates the parameters against the schema (if any), and responds with a 400 listing every field that does not match. It returns if the parameters are valid.
+func validateParameterSchema(w http.ResponseWriter, r *http.Request, schema *model.Schema, parameters json.RawMessage) bool {
+	if schema == nil {
+		return true
+	}
+	fieldErrors := schema.ValidateParameters(parameters)
+	if len(fieldErrors) == 0 {
+		return true
+	}
+	var descriptions []string
+	for _, fieldError := range fieldErrors {
+		descriptions = append(descriptions, strings.TrimSpace(fieldError.Field+" "+fieldError.Message))
+	}
+	util.Logger(r.Context()).Info("invalid parameters", "errors", descriptions)
+	util.WriteHttpResponse(w, http.StatusBadRequest, model.ParameterErrorResponse{
+		Error:       "InvalidParameters",
+		Description: fmt.Sprintf("invalid parameters: %s", strings.Join(descriptions, "; ")),
+		Fields:      fieldErrors,
+	})
+	return false
+}
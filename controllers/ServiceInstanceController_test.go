@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/rabobank/mfsb/aws"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+)
+
+const testSecretValue = "s3cr3t-v4lu3"
+
+func TestCreateServiceInstanceDoesNotStoreOrLogTheSecretValue(t *testing.T) {
+	dbtest.Configure()
+	saved := conf.GetCatalog()
+	conf.SetCatalog(&model.Catalog{Services: []model.Service{{Id: "secrets-id", Name: "secretsmanager-service", Plans: []model.ServicePlan{{Id: "standard-id", Name: "standard"}}}}})
+	t.Cleanup(func() { conf.SetCatalog(saved) })
+
+	// the secret exists already (created from another foundation), the new service instance shares it
+	mock := dbtest.NewMock(t)
+	mock.ExpectQuery("from service_instance where deleted_at is null and status=\\?").WithArgs(db.StatusInProgress, "org", "space", "secret").
+		WillReturnRows(sqlmock.NewRows(dbtest.ServiceInstanceColumns))
+	mock.ExpectQuery("from service_instance s, iaas_instance i where").WithArgs(db.StatusCreateSucceeded, "org", "space", "secret").
+		WillReturnRows(sqlmock.NewRows(dbtest.ServiceInstanceColumns).AddRow(1, "secrets-id", "guid-0", "standard-id", `{"SecretLength":16}`, "other", "org", "space", "secret", 7, db.StatusSucceeded, nil, nil))
+	mock.ExpectExec("insert into service_instance").WithArgs(dbtest.Args(10, map[int]driver.Value{1: "guid-1", 3: `{"SecretLength":16}`, 8: 7})...).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectQuery("from iaas_instance where id=\\?").WithArgs(7).WillReturnRows(sqlmock.NewRows(dbtest.IaaSInstanceColumns))
+	mock.ExpectExec("insert into audit_event").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	var logs bytes.Buffer
+	ctx := util.WithLogger(context.Background(), slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	body := `{"service_id":"secrets-id","plan_id":"standard-id","context":{"organization_name":"org","space_name":"space","instance_name":"secret"},"parameters":{"SecretValue":"` + testSecretValue + `","SecretLength":16}}`
+	request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/guid-1", strings.NewReader(body)).WithContext(ctx)
+	request = mux.SetURLVars(request, map[string]string{"service_instance_guid": "guid-1"})
+	response := httptest.NewRecorder()
+	util.DumpRequest(request)
+	CreateServiceInstance(response, request)
+
+	if response.Code != http.StatusCreated {
+		t.Errorf("the response is %d %s, expected 201", response.Code, response.Body)
+	}
+	if strings.Contains(logs.String(), testSecretValue) {
+		t.Errorf("the SecretValue was logged:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `\"SecretValue\":\"<redacted>\"`) {
+		t.Errorf("the dumped request should show that a SecretValue was given:\n%s", logs.String())
+	}
+}
+
+func TestDrainingRejectsProvisionsAndUpdates(t *testing.T) {
+	if os.Getenv("MFSB_TEST_DRAINING") == "" {
+		// draining can not be undone, so the broker drains in a test process of its own
+		command := exec.Command(os.Args[0], "-test.run=^TestDrainingRejectsProvisionsAndUpdates$")
+		command.Env = append(os.Environ(), "MFSB_TEST_DRAINING=1")
+		if output, err := command.CombinedOutput(); err != nil {
+			t.Fatalf("the draining test failed: %s\n%s", err, output)
+		}
+		return
+	}
+	dbtest.Configure()
+	// nothing is expected in the database, every query fails
+	dbtest.NewMock(t)
+	aws.StartDraining()
+	body := `{"service_id":"secrets-id","plan_id":"standard-id","context":{"organization_name":"org","space_name":"space","instance_name":"secret"},"parameters":{"SecretLength":16}}`
+	for method, handler := range map[string]http.HandlerFunc{http.MethodPut: CreateServiceInstance, http.MethodPatch: UpdateServiceInstance} {
+		request := mux.SetURLVars(httptest.NewRequest(method, "/v2/service_instances/guid-1", strings.NewReader(body)), map[string]string{"service_instance_guid": "guid-1"})
+		response := httptest.NewRecorder()
+		handler(response, request)
+		if response.Code != http.StatusServiceUnavailable {
+			t.Errorf("the %s while draining responded %d %s, expected 503", method, response.Code, response.Body)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/util"
+	"strings"
+	"time"
+)
+
+const (
+	EventIaaSInstanceCreated          = "iaas_instance.created"
+	EventIaaSInstanceStatusChanged    = "iaas_instance.status_changed"
+	EventServiceInstanceCreated       = "service_instance.created"
+	EventServiceInstanceStatusChanged = "service_instance.status_changed"
+	EventServiceInstanceUpdated       = "service_instance.updated"
+	EventServiceInstanceDeleted       = "service_instance.deleted"
+	EventServiceBindingCreated        = "service_binding.created"
+	EventServiceBindingDeleted        = "service_binding.deleted"
+
+	// MaxAuditEvents is the maximum number of audit events returned by GetAuditEvents
+	MaxAuditEvents = 1000
+)
+
+// AuditEvent An append-only record of a state change, the env, broker instance, request id, originating identity and AWS request ids are taken from the context by InsertAuditEvent
+type AuditEvent struct {
+	Id                  int64
+	EventTime           time.Time
+	Env                 string
+	BrokerInstance      string
+	OriginatingIdentity string
+	RequestId           string
+	EventType           string
+	InstanceId          string
+	OrganizationName    string
+	SpaceName           string
+	InstanceName        string
+	IaaSInstanceId      int64
+	InternalId          string
+	OldStatus           string
+	NewStatus           string
+	AWSRequestIds       string
+	Message             string
+}
+
+// AuditEventFilter selects audit events, empty fields are not used in the selection
+type AuditEventFilter struct {
+	InstanceId       string
+	IaaSInstanceId   int64
+	InternalId       string
+	OrganizationName string
+	SpaceName        string
+	InstanceName     string
+	Env              string
+	Since            time.Time
+	Limit            int
+}
+
+// InsertAuditEvent writes an audit event, a failure to do so is logged, but does not fail the operation that caused the event
+func InsertAuditEvent(ctx context.Context, event AuditEvent) {
+	ctx, span := startSpan(ctx, "InsertAuditEvent", "audit_event")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	event.Env = conf.CfEnv
+	event.BrokerInstance = conf.InstanceId
+	event.OriginatingIdentity = util.OriginatingIdentity(ctx)
+	event.RequestId = util.RequestId(ctx)
+	event.AWSRequestIds = strings.Join(util.TakeAWSRequestIds(ctx), ",")
+	_, err := db.Exec("insert into audit_event(env, broker_instance, originating_identity, request_id, event_type, instance_id, organization_name, space_name, instance_name, iaas_instance_id, internal_id, old_status, new_status, aws_request_ids, message) values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		event.Env, event.BrokerInstance, event.OriginatingIdentity, event.RequestId, event.EventType, event.InstanceId, event.OrganizationName, event.SpaceName, event.InstanceName, event.IaaSInstanceId, event.InternalId, event.OldStatus, event.NewStatus, event.AWSRequestIds, util.SafeSubstring(event.Message, 2048))
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to insert audit event", "event_type", event.EventType, "error", err)
+	}
+}
+
+// auditServiceInstance writes an audit event for a service instance, and queues the webhook notification for it (if any)
+func auditServiceInstance(ctx context.Context, eventType string, serviceInstance ServiceInstance, oldStatus, message string) {
+	notifyServiceInstance(ctx, eventType, serviceInstance, oldStatus)
+	InsertAuditEvent(ctx, AuditEvent{
+		EventType:        eventType,
+		InstanceId:       serviceInstance.InstanceId,
+		OrganizationName: serviceInstance.OrganizationName,
+		SpaceName:        serviceInstance.SpaceName,
+		InstanceName:     serviceInstance.InstanceName,
+		IaaSInstanceId:   serviceInstance.IaaSInstanceId,
+		OldStatus:        oldStatus,
+		NewStatus:        serviceInstance.Status,
+		Message:          message,
+	})
+}
+
+// GetAuditEvents returns the audit events selected by the filter, newest first
+func GetAuditEvents(ctx context.Context, filter AuditEventFilter) ([]AuditEvent, error) {
+	ctx, span := startSpan(ctx, "GetAuditEvents", "audit_event")
+	defer span.End()
+	result := make([]AuditEvent, 0)
+	db := GetDB()
+	defer db.Close()
+	var conditions []string
+	var args []any
+	addCondition := func(condition string, arg any) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if filter.InstanceId != "" {
+		addCondition("instance_id=?", filter.InstanceId)
+	}
+	if filter.IaaSInstanceId != 0 {
+		addCondition("iaas_instance_id=?", filter.IaaSInstanceId)
+	}
+	if filter.InternalId != "" {
+		addCondition("internal_id=?", filter.InternalId)
+	}
+	if filter.OrganizationName != "" {
+		addCondition("organization_name=?", filter.OrganizationName)
+	}
+	if filter.SpaceName != "" {
+		addCondition("space_name=?", filter.SpaceName)
+	}
+	if filter.InstanceName != "" {
+		addCondition("instance_name=?", filter.InstanceName)
+	}
+	if filter.Env != "" {
+		addCondition("env=?", filter.Env)
+	}
+	if !filter.Since.IsZero() {
+		addCondition("event_time>=?", filter.Since)
+	}
+	if filter.Limit <= 0 || filter.Limit > MaxAuditEvents {
+		filter.Limit = MaxAuditEvents
+	}
+	query := "select id, event_time, env, broker_instance, originating_identity, request_id, event_type, instance_id, organization_name, space_name, instance_name, iaas_instance_id, internal_id, old_status, new_status, aws_request_ids, message from audit_event"
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	query += fmt.Sprintf(" order by id desc limit %d", filter.Limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the audit_events", "error", err)
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event AuditEvent
+		var originatingIdentity, requestId, instanceId, organizationName, spaceName, instanceName, internalId, oldStatus, newStatus, awsRequestIds, message sql.NullString
+		var iaasInstanceId sql.NullInt64
+		err = rows.Scan(&event.Id, &event.EventTime, &event.Env, &event.BrokerInstance, &originatingIdentity, &requestId, &event.EventType, &instanceId, &organizationName, &spaceName, &instanceName, &iaasInstanceId, &internalId, &oldStatus, &newStatus, &awsRequestIds, &message)
+		if err != nil {
+			util.RecordError(span, err)
+			util.Logger(ctx).Error("failed to scan the audit_event row", "error", err)
+			return result, err
+		}
+		event.OriginatingIdentity = originatingIdentity.String
+		event.RequestId = requestId.String
+		event.InstanceId = instanceId.String
+		event.OrganizationName = organizationName.String
+		event.SpaceName = spaceName.String
+		event.InstanceName = instanceName.String
+		event.IaaSInstanceId = iaasInstanceId.Int64
+		event.InternalId = internalId.String
+		event.OldStatus = oldStatus.String
+		event.NewStatus = newStatus.String
+		event.AWSRequestIds = awsRequestIds.String
+		event.Message = message.String
+		result = append(result, event)
+	}
+	return result, nil
+}
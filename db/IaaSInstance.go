@@ -1,21 +1,49 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/rabobank/mfsb/util"
-	"log"
+	"log/slog"
 	"time"
 )
 
 const (
-	StatusCreateInProgress = "create in progress"
-	StatusCreateFailed     = "create failed"
-	StatusCreateSucceeded  = "create succeeded"
-	StatusDeleteInProgress = "delete in progress"
-	StatusDeleteFailed     = "delete failed"
-	StatusDeleteSucceeded  = "delete succeeded"
-	StatusNotFound         = "not found"
+	// the iaas instance is in the database, but its create is not submitted to AWS yet
+	StatusPreparingForCreate = "preparing for create"
+	StatusCreateInProgress   = "create in progress"
+	StatusCreateFailed       = "create failed"
+	StatusCreateSucceeded    = "create succeeded"
+	StatusDeleteInProgress   = "delete in progress"
+	StatusDeleteFailed       = "delete failed"
+	StatusDeleteSucceeded    = "delete succeeded"
+	StatusNotFound           = "not found"
+)
+
+// the keys of IaaSInstance.ServiceDetails
+const (
+	DetailReaderHost       = "reader_host"
+	DetailReaderUri        = "reader_uri"
+	DetailTLS              = "tls"
+	DetailQueueUrl         = "queue_url"
+	DetailQueueArn         = "queue_arn"
+	DetailDLQUrl           = "dlq_url"
+	DetailDLQArn           = "dlq_arn"
+	DetailClusterArn       = "cluster_arn"
+	DetailBootstrapBrokers = "bootstrap_brokers"
+	DetailTableName        = "table_name"
+	DetailTableArn         = "table_arn"
+	DetailBackupArn        = "backup_arn"
+	DetailBrokerId         = "broker_id"
+	DetailConsoleUrl       = "console_url"
+	DetailGremlinEndpoint  = "gremlin_endpoint"
+	DetailSparqlEndpoint   = "sparql_endpoint"
+	DetailResourceId       = "resource_id"
+	DetailIAMAuth          = "iam_auth"
+	DetailSecretName       = "secret_name"
+	DetailSecretArn        = "secret_arn"
 )
 
 type IaaSInstance struct {
@@ -27,13 +55,23 @@ type IaaSInstance struct {
 	ServiceUrl       string
 	ServiceUser      string
 	ServicePassword  string
+	// ServiceDetails are the service specific details that are added to the binding credentials, see the Detail* consts
+	ServiceDetails map[string]string
 }
 
 func (ii IaaSInstance) String() string {
 	return fmt.Sprintf("IaaSInstance: Id:%d, InternalId:%s, Status:%s, LastStatusUpdate:%s, LastMessage:%s, ServiceUrl:%s, ServiceUser:%s, ServicePasswd:redacted", ii.Id, ii.InternalId, ii.Status, ii.LastStatusUpdate, ii.LastMessage, ii.ServiceUrl, ii.ServiceUser)
 }
 
-func InsertIaaSInstance(iaasInstance IaaSInstance) (int64, error) {
+// LogValue makes sure that neither the service password nor the service url (which contains the password) end up in the logs
+func (ii IaaSInstance) LogValue() slog.Value {
+	return slog.GroupValue(slog.Int64("id", ii.Id), slog.String("internal_id", ii.InternalId), slog.String("status", ii.Status), slog.String("last_message", ii.LastMessage), slog.String("service_user", ii.ServiceUser))
+}
+
+func InsertIaaSInstance(ctx context.Context, iaasInstance IaaSInstance) (int64, error) {
+	ctx, span := startSpan(ctx, "InsertIaaSInstance", "iaas_instance")
+	defer span.End()
+	logger := util.Logger(ctx)
 	var err error
 	var Id int64
 	db := GetDB()
@@ -46,19 +84,28 @@ func InsertIaaSInstance(iaasInstance IaaSInstance) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	result, err := db.Exec("insert into iaas_instance(internal_id, Status, last_status_update, last_message, service_url, service_user, service_password) values(?,?,?,?,?,?,?)",
-		iaasInstance.InternalId, iaasInstance.Status, iaasInstance.LastStatusUpdate, iaasInstance.LastMessage, urlEncrypted, iaasInstance.ServiceUser, passwordEncrypted)
+	detailsEncrypted, err := encryptServiceDetails(iaasInstance.ServiceDetails)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec("insert into iaas_instance(internal_id, Status, last_status_update, last_message, service_url, service_user, service_password, service_details) values(?,?,?,?,?,?,?,?)",
+		iaasInstance.InternalId, iaasInstance.Status, iaasInstance.LastStatusUpdate, iaasInstance.LastMessage, urlEncrypted, iaasInstance.ServiceUser, passwordEncrypted, detailsEncrypted)
 	if err != nil {
-		fmt.Printf("failed to insert IaaSInstance %v, error: %s\n", iaasInstance, err)
+		util.RecordError(span, err)
+		logger.Error("failed to insert IaaSInstance", "iaas_instance", iaasInstance, "error", err)
 	} else {
 		Id, _ = result.LastInsertId()
 		iaasInstance.Id = Id
-		fmt.Printf("inserted %v\n", iaasInstance)
+		logger.Info("inserted IaaSInstance", "iaas_instance", iaasInstance)
+		insertIaaSInstanceStatus(ctx, db, iaasInstance)
+		InsertAuditEvent(ctx, AuditEvent{EventType: EventIaaSInstanceCreated, IaaSInstanceId: Id, InternalId: iaasInstance.InternalId, NewStatus: iaasInstance.Status, Message: iaasInstance.LastMessage})
 	}
 	return Id, err
 }
 
-func UpdateIaaSInstance(iaasInstance IaaSInstance) error {
+func UpdateIaaSInstance(ctx context.Context, iaasInstance IaaSInstance) error {
+	ctx, span := startSpan(ctx, "UpdateIaaSInstance", "iaas_instance")
+	defer span.End()
 	var err error
 	db := GetDB()
 	defer db.Close()
@@ -70,52 +117,69 @@ func UpdateIaaSInstance(iaasInstance IaaSInstance) error {
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("update iaas_instance set internal_id=?, status=?, last_status_update=?, last_message=?, service_url=?, service_user=?, service_password=? where id=?",
-		iaasInstance.InternalId, iaasInstance.Status, iaasInstance.LastStatusUpdate, iaasInstance.LastMessage, urlEncrypted, iaasInstance.ServiceUser, passwordEncrypted, iaasInstance.Id)
+	detailsEncrypted, err := encryptServiceDetails(iaasInstance.ServiceDetails)
+	if err != nil {
+		return err
+	}
+	var oldStatus, oldMessage sql.NullString
+	_ = db.QueryRow("select status, last_message from iaas_instance where id=?", iaasInstance.Id).Scan(&oldStatus, &oldMessage)
+	_, err = db.Exec("update iaas_instance set internal_id=?, status=?, last_status_update=?, last_message=?, service_url=?, service_user=?, service_password=?, service_details=? where id=?",
+		iaasInstance.InternalId, iaasInstance.Status, iaasInstance.LastStatusUpdate, iaasInstance.LastMessage, urlEncrypted, iaasInstance.ServiceUser, passwordEncrypted, detailsEncrypted, iaasInstance.Id)
 	if err != nil {
-		fmt.Printf("failed to update IaaSInstance %v, error: %s\n", iaasInstance, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to update IaaSInstance", "iaas_instance", iaasInstance, "error", err)
+	} else if oldStatus.String != iaasInstance.Status || oldMessage.String != iaasInstance.LastMessage {
+		insertIaaSInstanceStatus(ctx, db, iaasInstance)
+		InsertAuditEvent(ctx, AuditEvent{EventType: EventIaaSInstanceStatusChanged, IaaSInstanceId: iaasInstance.Id, InternalId: iaasInstance.InternalId, OldStatus: oldStatus.String, NewStatus: iaasInstance.Status, Message: iaasInstance.LastMessage})
 	}
 	return err
 }
 
-func UpdateStatusIaaSInstance(iaasInstance IaaSInstance, status string, lastMessage string) {
+func UpdateStatusIaaSInstance(ctx context.Context, iaasInstance IaaSInstance, status string, lastMessage string) {
 	iaasInstance.Status = status
 	iaasInstance.LastStatusUpdate = time.Now()
 	iaasInstance.LastMessage = lastMessage
-	_ = UpdateIaaSInstance(iaasInstance)
+	util.Logger(ctx).Info("updating IaaSInstance status", "status", status, "message", lastMessage)
+	_ = UpdateIaaSInstance(ctx, iaasInstance)
 }
 
 // GetIaaSInstances get one or all IaasInstances. Specify Id=0 to get all instances
-func GetIaaSInstances(id int64) []IaaSInstance {
+func GetIaaSInstances(ctx context.Context, id int64) []IaaSInstance {
+	ctx, span := startSpan(ctx, "GetIaaSInstances", "iaas_instance")
+	defer span.End()
 	var err error
 	result := make([]IaaSInstance, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
 	if id == 0 {
-		rows, err = db.Query("select Id, internal_id, Status, last_status_update, last_message,service_url,service_user, service_password from iaas_instance")
+		rows, err = db.Query("select Id, internal_id, Status, last_status_update, last_message,service_url,service_user, service_password, service_details from iaas_instance")
 	} else {
-		rows, err = db.Query("select Id, internal_id, Status, last_status_update, last_message,service_url,service_user, service_password from iaas_instance where id=?", id)
+		rows, err = db.Query("select Id, internal_id, Status, last_status_update, last_message,service_url,service_user, service_password, service_details from iaas_instance where id=?", id)
 	}
 	if err != nil {
-		fmt.Printf("failed to query the iaas_instances, err: %s\n", err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the iaas_instances", "error", err)
 	} else {
-		result = getIaaSInstances(rows)
+		result = getIaaSInstances(ctx, rows)
 	}
 	return result
 }
 
-func GetIaaSInstanceByBindingId(id string) IaaSInstance {
+func GetIaaSInstanceByBindingId(ctx context.Context, id string) IaaSInstance {
+	ctx, span := startSpan(ctx, "GetIaaSInstanceByBindingId", "iaas_instance")
+	defer span.End()
 	var err error
 	result := make([]IaaSInstance, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
-	rows, err = db.Query("select i.Id, internal_id, i.Status, i.last_status_update, i.last_message,i.service_url,i.service_user, i.service_password from iaas_instance i, service_instance s, service_binding b where b.service_instance_id=s.instance_id and s.iaas_instance_id=i.id and b.service_binding_id=?", id)
+	rows, err = db.Query("select i.Id, internal_id, i.Status, i.last_status_update, i.last_message,i.service_url,i.service_user, i.service_password, i.service_details from iaas_instance i, service_instance s, service_binding b where b.service_instance_id=s.instance_id and s.iaas_instance_id=i.id and s.deleted_at is null and b.service_binding_id=?", id)
 	if err != nil {
-		fmt.Printf("failed to query the iaas_instances for binding_id %s, err: %s\n", id, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the iaas_instances for binding_id", "binding_id", id, "error", err)
 	} else {
-		result = getIaaSInstances(rows)
+		result = getIaaSInstances(ctx, rows)
 	}
 	if len(result) == 1 {
 		return result[0]
@@ -123,26 +187,32 @@ func GetIaaSInstanceByBindingId(id string) IaaSInstance {
 	return IaaSInstance{}
 }
 
-func getIaaSInstances(rows *sql.Rows) []IaaSInstance {
+func getIaaSInstances(ctx context.Context, rows *sql.Rows) []IaaSInstance {
 	var err error
+	logger := util.Logger(ctx)
 	result := make([]IaaSInstance, 0)
 	if rows != nil {
 		defer rows.Close()
 		var Id int64
 		var lastStatusUpdate time.Time
 		var internalId, status, lastMessage, serviceUrl, serviceUser, servicePassword string
+		var serviceDetails sql.NullString
 		for rows.Next() {
-			err = rows.Scan(&Id, &internalId, &status, &lastStatusUpdate, &lastMessage, &serviceUrl, &serviceUser, &servicePassword)
+			err = rows.Scan(&Id, &internalId, &status, &lastStatusUpdate, &lastMessage, &serviceUrl, &serviceUser, &servicePassword, &serviceDetails)
 			if err != nil {
-				fmt.Printf("failed to scan the iaas_instance row, error:%s\n", err)
+				logger.Error("failed to scan the iaas_instance row", "error", err)
 			} else {
 				passwordDecrypted, err := util.Decrypt(servicePassword)
 				if err != nil {
-					log.Printf("failed to decrypt the service password for iaas_instance with id %d, error: %s", Id, err)
+					logger.Error("failed to decrypt the service password for iaas_instance", "id", Id, "error", err)
 				}
 				urlDecrypted, err := util.Decrypt(serviceUrl)
 				if err != nil {
-					log.Printf("failed to decrypt the service url for iaas_instance with id %d, error: %s", Id, err)
+					logger.Error("failed to decrypt the service url for iaas_instance", "id", Id, "error", err)
+				}
+				detailsDecrypted, err := decryptServiceDetails(serviceDetails.String)
+				if err != nil {
+					logger.Error("failed to decrypt the service details for iaas_instance", "id", Id, "error", err)
 				}
 				result = append(result, IaaSInstance{
 					Id:               Id,
@@ -153,6 +223,7 @@ func getIaaSInstances(rows *sql.Rows) []IaaSInstance {
 					ServiceUrl:       urlDecrypted,
 					ServiceUser:      serviceUser,
 					ServicePassword:  passwordDecrypted,
+					ServiceDetails:   detailsDecrypted,
 				})
 			}
 		}
@@ -160,21 +231,26 @@ func getIaaSInstances(rows *sql.Rows) []IaaSInstance {
 	return result
 }
 
-func IsLastServiceInstanceForIaaS(instanceId int64) bool {
+func IsLastServiceInstanceForIaaS(ctx context.Context, instanceId int64) bool {
+	ctx, span := startSpan(ctx, "IsLastServiceInstanceForIaaS", "iaas_instance")
+	defer span.End()
 	var err error
+	logger := util.Logger(ctx)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
-	rows, err = db.Query("select count(*) from service_instance si, iaas_instance ii where si.iaas_instance_id=ii.id and si.iaas_instance_id=?", instanceId)
+	rows, err = db.Query("select count(*) from service_instance si, iaas_instance ii where si.iaas_instance_id=ii.id and si.iaas_instance_id=? and si.deleted_at is null", instanceId)
 	if err != nil {
-		fmt.Printf("failed to query for last service_instance for IaaS Id %d: %s\n", instanceId, err)
+		util.RecordError(span, err)
+		logger.Error("failed to query for last service_instance for IaaS Id", "iaas_instance_id", instanceId, "error", err)
 		return false
 	} else {
 		if rows.Next() {
 			var numInstances int
 			err = rows.Scan(&numInstances)
 			if err != nil {
-				log.Printf("failed to get the number of service_instance for IaaS id %d: %s\n", instanceId, err)
+				util.RecordError(span, err)
+				logger.Error("failed to get the number of service_instance for IaaS id", "iaas_instance_id", instanceId, "error", err)
 				return false
 			}
 			if numInstances == 1 {
@@ -184,3 +260,28 @@ func IsLastServiceInstanceForIaaS(instanceId int64) bool {
 	}
 	return false
 }
+
+// encryptServiceDetails returns the encrypted json of the details, or nil (null in the db) if there are none
+func encryptServiceDetails(details map[string]string) (any, error) {
+	if len(details) == 0 {
+		return nil, nil
+	}
+	detailsJson, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	return util.Encrypt(string(detailsJson))
+}
+
+func decryptServiceDetails(encrypted string) (map[string]string, error) {
+	if encrypted == "" {
+		return nil, nil
+	}
+	detailsJson, err := util.Decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	var details map[string]string
+	err = json.Unmarshal([]byte(detailsJson), &details)
+	return details, err
+}
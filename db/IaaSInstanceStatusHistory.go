@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/util"
+	"time"
+)
+
+// MaxStatusHistory is the maximum number of status history entries returned by GetIaaSInstanceStatusHistory
+const MaxStatusHistory = 500
+
+type IaaSInstanceStatus struct {
+	Id             int64
+	IaaSInstanceId int64
+	Status         string
+	Message        string
+	StatusTime     time.Time
+	Env            string
+}
+
+// insertIaaSInstanceStatus adds the current status and last message of the iaas instance to its status history
+func insertIaaSInstanceStatus(ctx context.Context, db *sql.DB, iaasInstance IaaSInstance) {
+	_, err := db.Exec("insert into iaas_instance_status_history(iaas_instance_id, status, message, env) values(?,?,?,?)",
+		iaasInstance.Id, iaasInstance.Status, util.SafeSubstring(iaasInstance.LastMessage, 2048), conf.CfEnv)
+	if err != nil {
+		util.Logger(ctx).Error("failed to insert the iaas_instance_status_history", "iaas_instance_id", iaasInstance.Id, "error", err)
+	}
+}
+
+// GetIaaSInstanceStatusHistory returns the status history of an iaas instance, newest first
+func GetIaaSInstanceStatusHistory(ctx context.Context, iaasInstanceId int64, limit int) ([]IaaSInstanceStatus, error) {
+	ctx, span := startSpan(ctx, "GetIaaSInstanceStatusHistory", "iaas_instance_status_history")
+	defer span.End()
+	result := make([]IaaSInstanceStatus, 0)
+	if limit <= 0 || limit > MaxStatusHistory {
+		limit = MaxStatusHistory
+	}
+	db := GetDB()
+	defer db.Close()
+	rows, err := db.Query("select id, iaas_instance_id, status, message, status_time, env from iaas_instance_status_history where iaas_instance_id=? order by id desc limit ?", iaasInstanceId, limit)
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the iaas_instance_status_history", "iaas_instance_id", iaasInstanceId, "error", err)
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status IaaSInstanceStatus
+		if err = rows.Scan(&status.Id, &status.IaaSInstanceId, &status.Status, &status.Message, &status.StatusTime, &status.Env); err != nil {
+			util.RecordError(span, err)
+			util.Logger(ctx).Error("failed to scan the iaas_instance_status_history row", "error", err)
+			return result, err
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
+
+// StatusSince returns the time the iaas instance got its current status, the zero time if the history does not tell
+func StatusSince(ctx context.Context, iaasInstance IaaSInstance) time.Time {
+	var since time.Time
+	history, _ := GetIaaSInstanceStatusHistory(ctx, iaasInstance.Id, MaxStatusHistory)
+	for _, status := range history {
+		if status.Status != iaasInstance.Status {
+			break
+		}
+		since = status.StatusTime
+	}
+	return since
+}
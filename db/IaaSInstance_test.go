@@ -0,0 +1,83 @@
+package db_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+	"github.com/rabobank/mfsb/util"
+)
+
+// captured is a sqlmock argument that matches anything and remembers the value
+type captured struct {
+	value *driver.Value
+}
+
+func (c captured) Match(value driver.Value) bool {
+	*c.value = value
+	return true
+}
+
+func encrypt(t *testing.T, value string) string {
+	t.Helper()
+	encrypted, err := util.Encrypt(value)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	return encrypted
+}
+
+func TestIaaSInstanceServiceDetailsRoundTrip(t *testing.T) {
+	details := map[string]string{db.DetailSecretArn: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:mfsb-1", db.DetailSecretName: "mfsb-1"}
+	detailsJson, _ := json.Marshal(details)
+	mock := dbtest.NewMock(t)
+	mock.ExpectQuery("select Id, internal_id, .*, service_details from iaas_instance where id=\\?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(dbtest.IaaSInstanceColumns).
+			AddRow(7, "mfsb-1", db.StatusCreateSucceeded, time.Now(), "created", encrypt(t, "https://secret"), "user", encrypt(t, "password"), encrypt(t, string(detailsJson))))
+
+	instances := db.GetIaaSInstances(context.Background(), 7)
+	if len(instances) != 1 {
+		t.Fatalf("expected 1 iaas instance, got %d", len(instances))
+	}
+	instance := instances[0]
+	if instance.ServiceUrl != "https://secret" || instance.ServicePassword != "password" || !reflect.DeepEqual(instance.ServiceDetails, details) {
+		t.Errorf("the iaas instance was not decrypted: url %s, password %s, details %v", instance.ServiceUrl, instance.ServicePassword, instance.ServiceDetails)
+	}
+
+	// an update of an instance that was read keeps its details
+	var updatedDetails driver.Value
+	mock.ExpectQuery("select status, last_message from iaas_instance where id=\\?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "last_message"}).AddRow(db.StatusCreateSucceeded, "created"))
+	mock.ExpectExec("update iaas_instance set .*service_details=\\? where id=\\?").WithArgs(dbtest.Args(9, map[int]driver.Value{7: captured{&updatedDetails}, 8: 7})...).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := db.UpdateIaaSInstance(context.Background(), instance); err != nil {
+		t.Fatalf("the update failed: %s", err)
+	}
+	encrypted, _ := updatedDetails.(string)
+	decrypted, err := util.Decrypt(encrypted)
+	if err != nil {
+		t.Fatalf("the updated details are not encrypted: %v", updatedDetails)
+	}
+	var roundTripped map[string]string
+	if err = json.Unmarshal([]byte(decrypted), &roundTripped); err != nil || !reflect.DeepEqual(roundTripped, details) {
+		t.Errorf("the update stored the details %s, expected %v", decrypted, details)
+	}
+}
+
+func TestIaaSInstanceWithoutServiceDetails(t *testing.T) {
+	mock := dbtest.NewMock(t)
+	mock.ExpectQuery("from iaas_instance i, service_instance s, service_binding b where .* and b.service_binding_id=\\?").WithArgs("binding-1").
+		WillReturnRows(sqlmock.NewRows(dbtest.IaaSInstanceColumns).
+			AddRow(7, "mfsb-1", db.StatusCreateSucceeded, time.Now(), "created", encrypt(t, "https://secret"), "user", encrypt(t, "password"), nil))
+
+	instance := db.GetIaaSInstanceByBindingId(context.Background(), "binding-1")
+	if instance.Id != 7 || instance.ServiceDetails != nil {
+		t.Errorf("expected iaas instance 7 without details, got %d with %v", instance.Id, instance.ServiceDetails)
+	}
+}
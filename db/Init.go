@@ -1,17 +1,37 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Driver and DataSourceName tell GetDB how to open the broker database, the tests replace it with a sqlmock database (see dbtest)
+var (
+	Driver         = "mysql"
+	DataSourceName = func() string {
+		return fmt.Sprintf("%s:%s@(%s)/%s?parseTime=true", conf.BrokerDBUser, conf.BrokerDBPassword, conf.BrokerDBHost, conf.BrokerDBName)
+	}
 )
 
 func GetDB() (db *sql.DB) {
-	dbDriver := "mysql"
-	db, err := sql.Open(dbDriver, fmt.Sprintf("%s:%s@(%s)/%s?parseTime=true", conf.BrokerDBUser, conf.BrokerDBPassword, conf.BrokerDBHost, conf.BrokerDBName))
+	db, err := sql.Open(Driver, DataSourceName())
 	if err != nil {
 		panic(err.Error())
 	}
 	return db
 }
+
+// startSpan starts a span for a db package query, the caller has to end it
+func startSpan(ctx context.Context, name string, table string) (context.Context, trace.Span) {
+	return util.Tracer().Start(ctx, "db."+name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "mysql"),
+		attribute.String("db.name", conf.BrokerDBName),
+		attribute.String("db.sql.table", table),
+	))
+}
@@ -0,0 +1,78 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMain(m *testing.M) {
+	dbtest.Configure()
+	os.Exit(m.Run())
+}
+
+// newSpanRecorder installs a tracer provider that records the spans of the test
+func newSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder
+}
+
+func TestQuerySpans(t *testing.T) {
+	mock := dbtest.NewMock(t)
+	recorder := newSpanRecorder(t)
+	mock.ExpectQuery("select coalesce\\(max\\(version\\), 0\\) from schema_version").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(db.SchemaVersion))
+	mock.ExpectQuery("select coalesce").WillReturnError(errors.New("connection refused"))
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	version, err := db.GetSchemaVersion(ctx)
+	if err != nil || version != db.SchemaVersion {
+		t.Fatalf("GetSchemaVersion returned %d, %v, expected %d", version, err, db.SchemaVersion)
+	}
+	if _, err = db.GetSchemaVersion(ctx); err == nil {
+		t.Fatal("GetSchemaVersion should return the error of the query")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans (2 queries and the request), got %d", len(spans))
+	}
+	for i, span := range spans[:2] {
+		if span.Name() != "db.GetSchemaVersion" {
+			t.Errorf("span %d is named %s, expected db.GetSchemaVersion", i, span.Name())
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("span %d is not a child of the request span", i)
+		}
+		if !hasAttribute(span.Attributes(), attribute.String("db.sql.table", "schema_version")) || !hasAttribute(span.Attributes(), attribute.String("db.system", "mysql")) {
+			t.Errorf("span %d is missing the db attributes: %v", i, span.Attributes())
+		}
+	}
+	if spans[0].Status().Code == codes.Error {
+		t.Error("the successful query should not be marked as failed")
+	}
+	if spans[1].Status().Code != codes.Error {
+		t.Error("the failed query should be marked as failed")
+	}
+}
+
+func hasAttribute(attributes []attribute.KeyValue, expected attribute.KeyValue) bool {
+	for _, attr := range attributes {
+		if attr == expected {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+	"strings"
+	"time"
+)
+
+// the event types of the webhook notifications
+const (
+	NotificationProvisionStarted     = "provision.started"
+	NotificationProvisionSucceeded   = "provision.succeeded"
+	NotificationProvisionFailed      = "provision.failed"
+	NotificationDeprovisionSucceeded = "deprovision.succeeded"
+	NotificationDeprovisionFailed    = "deprovision.failed"
+	NotificationPasswordRotated      = "password.rotated"
+)
+
+const (
+	NotificationPending   = "pending"
+	NotificationDelivered = "delivered"
+	NotificationFailed    = "failed"
+)
+
+type Notification struct {
+	Id        int64
+	Endpoint  string
+	EventType string
+	Payload   string
+	Attempts  int
+}
+
+// EnqueueNotification puts a notification about the service instance in the outbox, once for every webhook endpoint. Nothing is queued if no webhooks are configured.
+func EnqueueNotification(ctx context.Context, eventType string, serviceInstance ServiceInstance, message string) {
+	webhookURLs := conf.Get().WebhookURLs
+	if len(webhookURLs) == 0 || conf.WebhookSecret == "" {
+		return
+	}
+	ctx, span := startSpan(ctx, "EnqueueNotification", "notification_outbox")
+	defer span.End()
+	logger := util.Logger(ctx)
+	payload, err := json.Marshal(model.Notification{
+		EventId:          util.GenerateGUID(),
+		EventType:        eventType,
+		EventTime:        time.Now().UTC(),
+		BrokerEnv:        conf.CfEnv,
+		Env:              serviceInstance.Env,
+		InstanceId:       serviceInstance.InstanceId,
+		OrganizationName: serviceInstance.OrganizationName,
+		SpaceName:        serviceInstance.SpaceName,
+		InstanceName:     serviceInstance.InstanceName,
+		ServiceName:      util.GetServiceById(serviceInstance.ServiceId).Name,
+		PlanName:         util.GetPlan(serviceInstance.ServiceId, serviceInstance.PlanId).Name,
+		Status:           serviceInstance.Status,
+		Message:          message,
+	})
+	if err != nil {
+		util.RecordError(span, err)
+		logger.Error("failed to marshal notification", "event_type", eventType, "error", err)
+		return
+	}
+	db := GetDB()
+	defer db.Close()
+	for _, endpoint := range webhookURLs {
+		if _, err = db.Exec("insert into notification_outbox(endpoint, event_type, payload) values(?,?,?)", endpoint, eventType, string(payload)); err != nil {
+			util.RecordError(span, err)
+			logger.Error("failed to insert notification in the outbox", "event_type", eventType, "endpoint", endpoint, "error", err)
+		}
+	}
+}
+
+// notifyServiceInstance translates a service instance audit event into a webhook notification.
+// Whether a status change (or a delete) is about a provision or a deprovision is told by the status of the iaas instance.
+func notifyServiceInstance(ctx context.Context, auditEventType string, serviceInstance ServiceInstance, oldStatus string) {
+	var eventType, message string
+	var iaasStatus string
+	if iaasInstances := GetIaaSInstances(ctx, serviceInstance.IaaSInstanceId); len(iaasInstances) == 1 {
+		iaasStatus = iaasInstances[0].Status
+		message = iaasInstances[0].LastMessage
+	}
+	deleting := strings.HasPrefix(iaasStatus, "delete")
+	switch auditEventType {
+	case EventServiceInstanceCreated:
+		if serviceInstance.Status == StatusSucceeded {
+			eventType = NotificationProvisionSucceeded
+		} else {
+			eventType = NotificationProvisionStarted
+		}
+	case EventServiceInstanceDeleted:
+		if oldStatus == StatusInProgress && !deleting {
+			// the service instance is removed because the create was rejected by the IaaS
+			eventType = NotificationProvisionFailed
+			serviceInstance.Status = StatusFailed
+		} else {
+			eventType = NotificationDeprovisionSucceeded
+			serviceInstance.Status = StatusSucceeded
+		}
+	case EventServiceInstanceStatusChanged:
+		switch {
+		case serviceInstance.Status == StatusFailed && deleting:
+			eventType = NotificationDeprovisionFailed
+		case serviceInstance.Status == StatusFailed:
+			eventType = NotificationProvisionFailed
+		case serviceInstance.Status == StatusSucceeded && oldStatus == StatusInProgress && !deleting:
+			eventType = NotificationProvisionSucceeded
+		}
+	}
+	if eventType != "" {
+		EnqueueNotification(ctx, eventType, serviceInstance, message)
+	}
+}
+
+// ClaimDueNotifications claims (at most limit) pending notifications that are due, for the given lease. Other broker instances will not claim them until the lease expired.
+// The lease and the next attempts are computed with the clock of the database server, like the due check, so the clock and time zone of the broker instance do not matter.
+func ClaimDueNotifications(ctx context.Context, lease time.Duration, limit int) ([]Notification, error) {
+	ctx, span := startSpan(ctx, "ClaimDueNotifications", "notification_outbox")
+	defer span.End()
+	result := make([]Notification, 0)
+	db := GetDB()
+	defer db.Close()
+	claimToken := util.GenerateGUID()
+	_, err := db.Exec("update notification_outbox set claim_token=?, next_attempt_at=current_timestamp(3) + interval ? microsecond where status=? and next_attempt_at<=current_timestamp(3) order by id limit ?",
+		claimToken, lease.Microseconds(), NotificationPending, limit)
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to claim the due notifications", "error", err)
+		return result, err
+	}
+	var rows *sql.Rows
+	rows, err = db.Query("select id, endpoint, event_type, payload, attempts from notification_outbox where claim_token=? and status=?", claimToken, NotificationPending)
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the claimed notifications", "error", err)
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var notification Notification
+		if err = rows.Scan(&notification.Id, &notification.Endpoint, &notification.EventType, &notification.Payload, &notification.Attempts); err != nil {
+			util.RecordError(span, err)
+			util.Logger(ctx).Error("failed to scan the notification_outbox row", "error", err)
+			return result, err
+		}
+		result = append(result, notification)
+	}
+	return result, nil
+}
+
+func MarkNotificationDelivered(ctx context.Context, id int64) {
+	ctx, span := startSpan(ctx, "MarkNotificationDelivered", "notification_outbox")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	if _, err := db.Exec("update notification_outbox set status=?, attempts=attempts+1, delivered_at=current_timestamp(3), claim_token=null where id=?", NotificationDelivered, id); err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to mark notification delivered", "notification_id", id, "error", err)
+	}
+}
+
+// MarkNotificationAttemptFailed records a failed delivery, the notification is retried after retryAfter, or is marked failed if giveUp is true
+func MarkNotificationAttemptFailed(ctx context.Context, id int64, lastError string, retryAfter time.Duration, giveUp bool) {
+	ctx, span := startSpan(ctx, "MarkNotificationAttemptFailed", "notification_outbox")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	status := NotificationPending
+	if giveUp {
+		status = NotificationFailed
+	}
+	if _, err := db.Exec("update notification_outbox set status=?, attempts=attempts+1, next_attempt_at=current_timestamp(3) + interval ? microsecond, last_error=?, claim_token=null where id=?", status, retryAfter.Microseconds(), util.SafeSubstring(lastError, 2048), id); err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to record the failed notification attempt", "notification_id", id, "error", err)
+	}
+}
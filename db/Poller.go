@@ -0,0 +1,70 @@
+package db
+
+import (
+	"context"
+	"github.com/rabobank/mfsb/util"
+	"time"
+)
+
+// ClaimPoller makes the given broker instance the owner of the poller for the service instance, this only succeeds if nobody owns it, the broker instance itself owns it already, or the heartbeat of the owner is older than staleAfter.
+// The heartbeat is written and compared with the clock of the database server, the clock and time zone of the broker instance do not matter.
+func ClaimPoller(ctx context.Context, serviceInstanceId int64, owner string, staleAfter time.Duration) bool {
+	ctx, span := startSpan(ctx, "ClaimPoller", "service_instance")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	result, err := db.Exec("update service_instance set poller_owner=?, poller_heartbeat=current_timestamp where id=? and (poller_owner is null or poller_owner=? or poller_heartbeat is null or poller_heartbeat < current_timestamp - interval ? second)",
+		owner, serviceInstanceId, owner, int64(staleAfter.Seconds()))
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to claim the poller for service instance", "id", serviceInstanceId, "error", err)
+		return false
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected == 1
+}
+
+// HeartbeatPoller tells other broker instances that the poller of the service instance is still alive
+func HeartbeatPoller(ctx context.Context, serviceInstanceId int64, owner string) {
+	ctx, span := startSpan(ctx, "HeartbeatPoller", "service_instance")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	_, err := db.Exec("update service_instance set poller_heartbeat=current_timestamp where id=? and poller_owner=?", serviceInstanceId, owner)
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to update the poller heartbeat for service instance", "id", serviceInstanceId, "error", err)
+	}
+}
+
+// ReleasePoller gives up the ownership of the poller, so another broker instance can take it over
+func ReleasePoller(ctx context.Context, serviceInstanceId int64, owner string) {
+	ctx, span := startSpan(ctx, "ReleasePoller", "service_instance")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	_, err := db.Exec("update service_instance set poller_owner=null, poller_heartbeat=null where id=? and poller_owner=?", serviceInstanceId, owner)
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to release the poller for service instance", "id", serviceInstanceId, "error", err)
+	}
+}
+
+// GetOrphanedServiceInstances returns the service instances of the given env that are in progress, but are not polled (anymore) by any broker instance.
+// A service instance of which the create is not submitted yet is skipped, it is not orphaned, the broker instance that handles the provision request starts its poller.
+func GetOrphanedServiceInstances(ctx context.Context, env string, staleAfter time.Duration) []ServiceInstance {
+	ctx, span := startSpan(ctx, "GetOrphanedServiceInstances", "service_instance")
+	defer span.End()
+	result := make([]ServiceInstance, 0)
+	db := GetDB()
+	defer db.Close()
+	rows, err := db.Query("select s.Id, s.service_id, s.instance_id, s.plan_id, s.parameters, s.env, s.organization_name, s.space_name, s.instance_name, s.iaas_instance_id, s.status, s.deleted_at, s.deleted_by_env from service_instance s, iaas_instance i where s.iaas_instance_id=i.id and s.deleted_at is null and s.env=? and s.status=? and i.status<>? and (s.poller_owner is null or s.poller_heartbeat is null or s.poller_heartbeat < current_timestamp - interval ? second)",
+		env, StatusInProgress, StatusPreparingForCreate, int64(staleAfter.Seconds()))
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the orphaned service_instances", "error", err)
+	} else {
+		result = getServiceInstances(ctx, rows)
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+)
+
+func TestGetOrphanedServiceInstances(t *testing.T) {
+	mock := dbtest.NewMock(t)
+	// a service instance of which the create is not submitted yet is not orphaned, the staleness is decided by the clock of the database server
+	mock.ExpectQuery("from service_instance s, iaas_instance i where s.iaas_instance_id=i.id and .* and i.status<>\\? and \\(.* or s.poller_heartbeat < current_timestamp - interval \\? second\\)").
+		WithArgs("test", db.StatusInProgress, db.StatusPreparingForCreate, 120).
+		WillReturnRows(sqlmock.NewRows(dbtest.ServiceInstanceColumns).AddRow(1, "service", "guid-1", "plan", "{}", "test", "org", "space", "db", 7, db.StatusInProgress, nil, nil))
+
+	orphans := db.GetOrphanedServiceInstances(context.Background(), "test", 2*time.Minute)
+	if len(orphans) != 1 || orphans[0].InstanceId != "guid-1" {
+		t.Errorf("expected the orphaned service instance guid-1, got %v", orphans)
+	}
+}
+
+func TestClaimPoller(t *testing.T) {
+	tests := []struct {
+		name    string
+		updated int64
+		err     error
+		claimed bool
+	}{
+		{name: "unowned, owned by itself or with a stale heartbeat", updated: 1, claimed: true},
+		{name: "owned by a live broker instance", updated: 0},
+		{name: "database error", err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := dbtest.NewMock(t)
+			expectation := mock.ExpectExec("update service_instance set poller_owner=\\?, poller_heartbeat=current_timestamp where id=\\? and \\(poller_owner is null or poller_owner=\\? or poller_heartbeat is null or poller_heartbeat < current_timestamp - interval \\? second\\)").
+				WithArgs("broker-1", 1, "broker-1", 120)
+			if tt.err != nil {
+				expectation.WillReturnError(tt.err)
+			} else {
+				expectation.WillReturnResult(sqlmock.NewResult(0, tt.updated))
+			}
+			if claimed := db.ClaimPoller(context.Background(), 1, "broker-1", 2*time.Minute); claimed != tt.claimed {
+				t.Errorf("the claim returned %t, expected %t", claimed, tt.claimed)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"context"
+	"github.com/rabobank/mfsb/util"
+)
+
+// SchemaVersion is the version of the schema (resources/sql/create-tables.sql) this broker expects
+const SchemaVersion = 7
+
+// Ping checks if the broker database can be reached
+func Ping(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "Ping", "")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	err := db.PingContext(ctx)
+	util.RecordError(span, err)
+	return err
+}
+
+// GetSchemaVersion returns the highest schema version applied to the broker database
+func GetSchemaVersion(ctx context.Context) (int, error) {
+	ctx, span := startSpan(ctx, "GetSchemaVersion", "schema_version")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	var version int
+	err := db.QueryRowContext(ctx, "select coalesce(max(version), 0) from schema_version").Scan(&version)
+	util.RecordError(span, err)
+	return version, err
+}
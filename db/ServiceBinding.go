@@ -1,81 +1,115 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"github.com/rabobank/mfsb/util"
+	"log/slog"
 )
 
 type ServiceBinding struct {
 	Id                int64
 	ServiceBindingId  string
 	ServiceInstanceId string
+	// Credentials are the credentials created for this binding (for example IAM access keys), nil if the binding gets the credentials of the iaas instance
+	Credentials map[string]string
 }
 
 func (si ServiceBinding) String() string {
 	return fmt.Sprintf("ServiceBinding: Id:%d, ServiceBindingId:%s, ServiceInstanceId:%s", si.Id, si.ServiceBindingId, si.ServiceInstanceId)
 }
 
-func InsertServiceBinding(serviceBinding ServiceBinding) (int64, error) {
+func (si ServiceBinding) LogValue() slog.Value {
+	return slog.GroupValue(slog.Int64("id", si.Id), slog.String("service_binding_id", si.ServiceBindingId), slog.String("service_instance_id", si.ServiceInstanceId))
+}
+
+func InsertServiceBinding(ctx context.Context, serviceBinding ServiceBinding) (int64, error) {
+	ctx, span := startSpan(ctx, "InsertServiceBinding", "service_binding")
+	defer span.End()
+	logger := util.Logger(ctx)
 	var err error
 	var Id int64
 	db := GetDB()
 	defer db.Close()
-	result, err := db.Exec("insert into service_binding(service_binding_id, service_instance_id) values(?,?)", serviceBinding.ServiceBindingId, serviceBinding.ServiceInstanceId)
+	credentialsEncrypted, err := encryptServiceDetails(serviceBinding.Credentials)
 	if err != nil {
-		fmt.Printf("failed to insert %v, error: %s\n", serviceBinding, err)
+		util.RecordError(span, err)
+		logger.Error("failed to encrypt the credentials of ServiceBinding", "service_binding", serviceBinding, "error", err)
+		return 0, err
+	}
+	result, err := db.Exec("insert into service_binding(service_binding_id, service_instance_id, credentials) values(?,?,?)", serviceBinding.ServiceBindingId, serviceBinding.ServiceInstanceId, credentialsEncrypted)
+	if err != nil {
+		util.RecordError(span, err)
+		logger.Error("failed to insert ServiceBinding", "service_binding", serviceBinding, "error", err)
 	} else {
 		Id, _ = result.LastInsertId()
 		serviceBinding.Id = Id
-		fmt.Printf("inserted %v\n", serviceBinding)
+		logger.Info("inserted ServiceBinding", "service_binding", serviceBinding)
+		InsertAuditEvent(ctx, AuditEvent{EventType: EventServiceBindingCreated, InstanceId: serviceBinding.ServiceInstanceId, Message: "binding " + serviceBinding.ServiceBindingId})
 	}
 	return Id, err
 }
 
-func UpdateServiceBinding(serviceBinding ServiceBinding) error {
-	var err error
+func UpdateServiceBinding(ctx context.Context, serviceBinding ServiceBinding) error {
+	ctx, span := startSpan(ctx, "UpdateServiceBinding", "service_binding")
+	defer span.End()
 	db := GetDB()
 	defer db.Close()
-	_, err = db.Exec("update service_binding set service_binding_id=?, service_instance_id=? where id=?", serviceBinding.ServiceBindingId, serviceBinding.ServiceInstanceId, serviceBinding.Id)
+	credentialsEncrypted, err := encryptServiceDetails(serviceBinding.Credentials)
 	if err != nil {
-		fmt.Printf("failed to update %v, error: %s\n", serviceBinding, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to encrypt the credentials of ServiceBinding", "service_binding", serviceBinding, "error", err)
+		return err
+	}
+	_, err = db.Exec("update service_binding set service_binding_id=?, service_instance_id=?, credentials=? where id=?", serviceBinding.ServiceBindingId, serviceBinding.ServiceInstanceId, credentialsEncrypted, serviceBinding.Id)
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to update ServiceBinding", "service_binding", serviceBinding, "error", err)
 	}
 	return err
 }
 
-func GetServiceBindings(id int64) []ServiceBinding {
+func GetServiceBindings(ctx context.Context, id int64) []ServiceBinding {
+	ctx, span := startSpan(ctx, "GetServiceBindings", "service_binding")
+	defer span.End()
 	var err error
 	result := make([]ServiceBinding, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
 	if id == 0 {
-		rows, err = db.Query("select Id, service_binding_id, service_instance_id from service_binding")
+		rows, err = db.Query("select Id, service_binding_id, service_instance_id, credentials from service_binding")
 	} else {
-		rows, err = db.Query("select Id, service_binding_id, service_instance_id from service_binding where id=?", id)
+		rows, err = db.Query("select Id, service_binding_id, service_instance_id, credentials from service_binding where id=?", id)
 	}
 	if err != nil {
-		fmt.Printf("failed to query the service_bindings, err: %s\n", err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the service_bindings", "error", err)
 	} else {
-		result = getServiceBindings(rows)
+		result = getServiceBindings(ctx, rows)
 	}
 	return result
 }
 
-func GetServiceBindingByBindingId(id string) ServiceBinding {
+func GetServiceBindingByBindingId(ctx context.Context, id string) ServiceBinding {
+	ctx, span := startSpan(ctx, "GetServiceBindingByBindingId", "service_binding")
+	defer span.End()
 	var err error
 	var serviceBinding ServiceBinding
 	result := make([]ServiceBinding, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
-	rows, err = db.Query("select Id, service_binding_id, service_instance_id from service_binding where service_binding_id=?", id)
+	rows, err = db.Query("select Id, service_binding_id, service_instance_id, credentials from service_binding where service_binding_id=?", id)
 	if err != nil {
-		fmt.Printf("failed to query the service_binding for binding_id %s, err: %s\n", id, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the service_binding for binding_id", "binding_id", id, "error", err)
 	} else {
-		result = getServiceBindings(rows)
+		result = getServiceBindings(ctx, rows)
 	}
 	if len(result) != 1 {
-		fmt.Printf("no servicebinding found for service_binding_id %s\n", id)
+		util.Logger(ctx).Info("no servicebinding found for service_binding_id", "binding_id", id)
 		return serviceBinding
 	}
 	if len(result) == 1 {
@@ -84,34 +118,48 @@ func GetServiceBindingByBindingId(id string) ServiceBinding {
 	return ServiceBinding{}
 }
 
-func getServiceBindings(rows *sql.Rows) []ServiceBinding {
+func getServiceBindings(ctx context.Context, rows *sql.Rows) []ServiceBinding {
 	result := make([]ServiceBinding, 0)
 	if rows != nil {
 		defer rows.Close()
 		var Id int64
 		var serviceBindingId, serviceInstanceId string
+		var credentialsEncrypted sql.NullString
 		for rows.Next() {
-			err := rows.Scan(&Id, &serviceBindingId, &serviceInstanceId)
+			err := rows.Scan(&Id, &serviceBindingId, &serviceInstanceId, &credentialsEncrypted)
 			if err != nil {
-				fmt.Printf("failed to scan the service_binding row, error:%s\n", err)
-			} else {
-				result = append(result, ServiceBinding{
-					Id:                Id,
-					ServiceBindingId:  serviceBindingId,
-					ServiceInstanceId: serviceInstanceId,
-				})
+				util.Logger(ctx).Error("failed to scan the service_binding row", "error", err)
+				continue
 			}
+			credentials, err := decryptServiceDetails(credentialsEncrypted.String)
+			if err != nil {
+				util.Logger(ctx).Error("failed to decrypt the credentials of the service_binding", "binding_id", serviceBindingId, "error", err)
+				continue
+			}
+			result = append(result, ServiceBinding{
+				Id:                Id,
+				ServiceBindingId:  serviceBindingId,
+				ServiceInstanceId: serviceInstanceId,
+				Credentials:       credentials,
+			})
 		}
 	}
 	return result
 }
 
-func DeleteServiceBinding(Id int64) {
+func DeleteServiceBinding(ctx context.Context, Id int64) {
+	ctx, span := startSpan(ctx, "DeleteServiceBinding", "service_binding")
+	defer span.End()
 	var err error
 	db := GetDB()
 	defer db.Close()
+	var serviceBindingId, serviceInstanceId sql.NullString
+	_ = db.QueryRow("select service_binding_id, service_instance_id from service_binding where id=?", Id).Scan(&serviceBindingId, &serviceInstanceId)
 	_, err = db.Exec("delete from service_binding where id=?", Id)
 	if err != nil {
-		fmt.Printf("failed to delete ServiceBinding Id %d, error: %s\n", Id, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to delete ServiceBinding", "id", Id, "error", err)
+	} else {
+		InsertAuditEvent(ctx, AuditEvent{EventType: EventServiceBindingDeleted, InstanceId: serviceInstanceId.String, Message: "binding " + serviceBindingId.String})
 	}
 }
@@ -1,8 +1,13 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/util"
+	"log/slog"
+	"time"
 )
 
 const (
@@ -23,13 +28,22 @@ type ServiceInstance struct {
 	InstanceName     string
 	IaaSInstanceId   int64
 	Status           string
+	DeletedAt        time.Time // the zero time if the service instance is not (soft) deleted
+	DeletedByEnv     string
 }
 
 func (si ServiceInstance) String() string {
 	return fmt.Sprintf("ServiceInstance: Id:%d, ServiceId:%s, PlanId:%s, InstanceId:%s, Env:%s, OrganizationName:%s, SpaceName:%s, InstanceName:%s, IaaSInstanceId:%d, Status:%s", si.Id, si.ServiceId, si.PlanId, si.InstanceId, si.Env, si.OrganizationName, si.SpaceName, si.InstanceName, si.IaaSInstanceId, si.Status)
 }
 
-func InsertServiceInstance(serviceInstance ServiceInstance) (int64, error) {
+func (si ServiceInstance) LogValue() slog.Value {
+	return slog.GroupValue(slog.Int64("id", si.Id), slog.String("service_id", si.ServiceId), slog.String("plan_id", si.PlanId), slog.String("instance_id", si.InstanceId), slog.String("env", si.Env), slog.String("organization_name", si.OrganizationName), slog.String("space_name", si.SpaceName), slog.String("instance_name", si.InstanceName), slog.Int64("iaas_instance_id", si.IaaSInstanceId), slog.String("status", si.Status))
+}
+
+func InsertServiceInstance(ctx context.Context, serviceInstance ServiceInstance) (int64, error) {
+	ctx, span := startSpan(ctx, "InsertServiceInstance", "service_instance")
+	defer span.End()
+	logger := util.Logger(ctx)
 	var err error
 	var Id int64
 	db := GetDB()
@@ -37,97 +51,130 @@ func InsertServiceInstance(serviceInstance ServiceInstance) (int64, error) {
 	result, err := db.Exec("insert into service_instance(service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status) values(?,?,?,?,?,?,?,?,?,?)",
 		serviceInstance.ServiceId, serviceInstance.InstanceId, serviceInstance.PlanId, serviceInstance.Parameters, serviceInstance.Env, serviceInstance.OrganizationName, serviceInstance.SpaceName, serviceInstance.InstanceName, serviceInstance.IaaSInstanceId, serviceInstance.Status)
 	if err != nil {
-		fmt.Printf("failed to insert %v, error: %s\n", serviceInstance, err)
+		util.RecordError(span, err)
+		logger.Error("failed to insert ServiceInstance", "service_instance", serviceInstance, "error", err)
 	} else {
 		Id, _ = result.LastInsertId()
 		serviceInstance.Id = Id
-		fmt.Printf("inserted %v\n", serviceInstance)
+		logger.Info("inserted ServiceInstance", "service_instance", serviceInstance)
+		auditServiceInstance(ctx, EventServiceInstanceCreated, serviceInstance, "", "")
 	}
 	return Id, err
 }
 
-func UpdateServiceInstance(serviceInstance ServiceInstance) error {
+func UpdateServiceInstance(ctx context.Context, serviceInstance ServiceInstance) error {
+	ctx, span := startSpan(ctx, "UpdateServiceInstance", "service_instance")
+	defer span.End()
 	var err error
 	db := GetDB()
 	defer db.Close()
+	var oldStatus sql.NullString
+	_ = db.QueryRow("select status from service_instance where id=?", serviceInstance.Id).Scan(&oldStatus)
 	_, err = db.Exec("update service_instance set service_id=?, instance_id=?, plan_id=?, parameters=?, env=?, organization_name=?, space_name=?, instance_name=?, iaas_instance_id=?, status=? where id=?",
 		serviceInstance.ServiceId, serviceInstance.InstanceId, serviceInstance.PlanId, serviceInstance.Parameters, serviceInstance.Env, serviceInstance.OrganizationName, serviceInstance.SpaceName, serviceInstance.InstanceName, serviceInstance.IaaSInstanceId, serviceInstance.Status, serviceInstance.Id)
 	if err != nil {
-		fmt.Printf("failed to update %v, error: %s\n", serviceInstance, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to update ServiceInstance", "service_instance", serviceInstance, "error", err)
+	} else if oldStatus.String != serviceInstance.Status {
+		auditServiceInstance(ctx, EventServiceInstanceStatusChanged, serviceInstance, oldStatus.String, "")
 	}
 	return err
 }
 
-func UpdateStatusServiceInstanceForIaaSId(iaasInstanceId int64, status string) error {
+func UpdateStatusServiceInstanceForIaaSId(ctx context.Context, iaasInstanceId int64, status string) error {
+	ctx, span := startSpan(ctx, "UpdateStatusServiceInstanceForIaaSId", "service_instance")
+	defer span.End()
 	var err error
 	db := GetDB()
 	defer db.Close()
-	_, err = db.Exec("update service_instance set status=? where iaas_instance_id=?", status, iaasInstanceId)
+	var serviceInstances []ServiceInstance
+	rows, err := db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status, deleted_at, deleted_by_env from service_instance where iaas_instance_id=? and deleted_at is null", iaasInstanceId)
+	if err == nil {
+		serviceInstances = getServiceInstances(ctx, rows)
+	}
+	_, err = db.Exec("update service_instance set status=? where iaas_instance_id=? and deleted_at is null", status, iaasInstanceId)
 	if err != nil {
-		fmt.Printf("failed to update status to %s, for IaaSInstanceId %d error: %s\n", status, iaasInstanceId, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to update status for IaaSInstanceId", "status", status, "iaas_instance_id", iaasInstanceId, "error", err)
+		return err
 	}
-	return err
+	for _, serviceInstance := range serviceInstances {
+		if oldStatus := serviceInstance.Status; oldStatus != status {
+			serviceInstance.Status = status
+			auditServiceInstance(ctx, EventServiceInstanceStatusChanged, serviceInstance, oldStatus, "")
+		}
+	}
+	return nil
 }
 
-func UpdateStatusServiceInstance(serviceInstance ServiceInstance, status string) {
+func UpdateStatusServiceInstance(ctx context.Context, serviceInstance ServiceInstance, status string) {
 	serviceInstance.Status = status
-	_ = UpdateServiceInstance(serviceInstance)
+	_ = UpdateServiceInstance(ctx, serviceInstance)
 }
 
-func GetServiceInstances(id int64) []ServiceInstance {
+func GetServiceInstances(ctx context.Context, id int64) []ServiceInstance {
+	ctx, span := startSpan(ctx, "GetServiceInstances", "service_instance")
+	defer span.End()
 	var err error
 	result := make([]ServiceInstance, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
 	if id == 0 {
-		rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status from service_instance")
+		rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status, deleted_at, deleted_by_env from service_instance where deleted_at is null")
 	} else {
-		rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status from service_instance where id=?", id)
+		rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status, deleted_at, deleted_by_env from service_instance where id=? and deleted_at is null", id)
 	}
 	if err != nil {
-		fmt.Printf("failed to query the service_instances, err: %s\n", err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the service_instances", "error", err)
 	} else {
-		result = getServiceInstances(rows)
+		result = getServiceInstances(ctx, rows)
 	}
 	return result
 }
 
-func GetServiceInstanceByInstanceId(id string) ServiceInstance {
+func GetServiceInstanceByInstanceId(ctx context.Context, id string) ServiceInstance {
+	ctx, span := startSpan(ctx, "GetServiceInstanceByInstanceId", "service_instance")
+	defer span.End()
 	var err error
 	var serviceInstance ServiceInstance
 	result := make([]ServiceInstance, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
-	rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status from service_instance where instance_id=?", id)
+	rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status, deleted_at, deleted_by_env from service_instance where instance_id=? and deleted_at is null", id)
 	if err != nil {
-		fmt.Printf("failed to query the service_instances for instance_id %s, err: %s\n", id, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the service_instances for instance_id", "instance_id", id, "error", err)
 	} else {
-		result = getServiceInstances(rows)
+		result = getServiceInstances(ctx, rows)
 	}
 	if len(result) != 1 {
-		fmt.Printf("no serviceinstance found for id %s\n", id)
+		util.Logger(ctx).Info("no serviceinstance found for instance_id", "instance_id", id)
 		return serviceInstance
 	}
 	return result[0]
 }
 
-func GetServiceInstanceByEnvAndIaaSId(env string, iaasId int64) ServiceInstance {
+func GetServiceInstanceByEnvAndIaaSId(ctx context.Context, env string, iaasId int64) ServiceInstance {
+	ctx, span := startSpan(ctx, "GetServiceInstanceByEnvAndIaaSId", "service_instance")
+	defer span.End()
 	var err error
 	var serviceInstance ServiceInstance
 	result := make([]ServiceInstance, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
-	rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status from service_instance where env=? and iaas_instance_id=?", env, iaasId)
+	rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status, deleted_at, deleted_by_env from service_instance where env=? and iaas_instance_id=? and deleted_at is null", env, iaasId)
 	if err != nil {
-		fmt.Printf("failed to query the service_instances for env %s and iaasId %d, err: %s\n", env, iaasId, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the service_instances for env and iaasId", "for_env", env, "iaas_instance_id", iaasId, "error", err)
 	} else {
-		result = getServiceInstances(rows)
+		result = getServiceInstances(ctx, rows)
 	}
 	if len(result) != 1 {
-		fmt.Printf("no serviceinstance found for env %s and iaasId %d\n", env, iaasId)
+		util.Logger(ctx).Info("no serviceinstance found for env and iaasId", "for_env", env, "iaas_instance_id", iaasId)
 		return serviceInstance
 	}
 	if len(result) == 1 {
@@ -137,47 +184,55 @@ func GetServiceInstanceByEnvAndIaaSId(env string, iaasId int64) ServiceInstance
 }
 
 // GetServicesInstanceByNameAndStatus We return instances for all cf envs.
-func GetServicesInstanceByNameAndStatus(orgName, spaceName, instanceName, status string) []ServiceInstance {
+func GetServicesInstanceByNameAndStatus(ctx context.Context, orgName, spaceName, instanceName, status string) []ServiceInstance {
+	ctx, span := startSpan(ctx, "GetServicesInstanceByNameAndStatus", "service_instance")
+	defer span.End()
 	var err error
 	result := make([]ServiceInstance, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
-	rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status from service_instance where status=? and organization_name=? and space_name=? and instance_name=?", status, orgName, spaceName, instanceName)
+	rows, err = db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status, deleted_at, deleted_by_env from service_instance where deleted_at is null and status=? and organization_name=? and space_name=? and instance_name=?", status, orgName, spaceName, instanceName)
 	if err != nil {
-		fmt.Printf("failed to query the service_instances, err: %s\n", err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the service_instances", "error", err)
 	} else {
-		result = getServiceInstances(rows)
+		result = getServiceInstances(ctx, rows)
 	}
 	return result
 }
 
 // GetServicesInstanceByNameAndIaaSStatus We return instances for all cf envs.
-func GetServicesInstanceByNameAndIaaSStatus(orgName, spaceName, instanceName, status string) []ServiceInstance {
+func GetServicesInstanceByNameAndIaaSStatus(ctx context.Context, orgName, spaceName, instanceName, status string) []ServiceInstance {
+	ctx, span := startSpan(ctx, "GetServicesInstanceByNameAndIaaSStatus", "service_instance")
+	defer span.End()
 	var err error
 	result := make([]ServiceInstance, 0)
 	db := GetDB()
 	defer db.Close()
 	var rows *sql.Rows
-	rows, err = db.Query("select s.Id, s.service_id, s.instance_id, s.plan_id, s.parameters, s.env, s.organization_name, s.space_name, s.instance_name, s.iaas_instance_id, s.status from service_instance s, iaas_instance i where s.iaas_instance_id=i.id and i.status=? and s.organization_name=? and s.space_name=? and s.instance_name=?", status, orgName, spaceName, instanceName)
+	rows, err = db.Query("select s.Id, s.service_id, s.instance_id, s.plan_id, s.parameters, s.env, s.organization_name, s.space_name, s.instance_name, s.iaas_instance_id, s.status, s.deleted_at, s.deleted_by_env from service_instance s, iaas_instance i where s.iaas_instance_id=i.id and s.deleted_at is null and i.status=? and s.organization_name=? and s.space_name=? and s.instance_name=?", status, orgName, spaceName, instanceName)
 	if err != nil {
-		fmt.Printf("failed to query the service_instances, err: %s\n", err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the service_instances", "error", err)
 	} else {
-		result = getServiceInstances(rows)
+		result = getServiceInstances(ctx, rows)
 	}
 	return result
 }
 
-func getServiceInstances(rows *sql.Rows) []ServiceInstance {
+func getServiceInstances(ctx context.Context, rows *sql.Rows) []ServiceInstance {
 	result := make([]ServiceInstance, 0)
 	if rows != nil {
 		defer rows.Close()
 		var Id, iaasInstanceId int64
 		var serviceId, instanceId, planId, parameters, env, organizationName, spaceName, instanceName, status string
+		var deletedAt sql.NullTime
+		var deletedByEnv sql.NullString
 		for rows.Next() {
-			err := rows.Scan(&Id, &serviceId, &instanceId, &planId, &parameters, &env, &organizationName, &spaceName, &instanceName, &iaasInstanceId, &status)
+			err := rows.Scan(&Id, &serviceId, &instanceId, &planId, &parameters, &env, &organizationName, &spaceName, &instanceName, &iaasInstanceId, &status, &deletedAt, &deletedByEnv)
 			if err != nil {
-				fmt.Printf("failed to scan the service_instance row, error:%s\n", err)
+				util.Logger(ctx).Error("failed to scan the service_instance row", "error", err)
 			} else {
 				result = append(result, ServiceInstance{
 					Id:               Id,
@@ -191,6 +246,8 @@ func getServiceInstances(rows *sql.Rows) []ServiceInstance {
 					InstanceName:     instanceName,
 					IaaSInstanceId:   iaasInstanceId,
 					Status:           status,
+					DeletedAt:        deletedAt.Time,
+					DeletedByEnv:     deletedByEnv.String,
 				})
 			}
 		}
@@ -198,12 +255,104 @@ func getServiceInstances(rows *sql.Rows) []ServiceInstance {
 	return result
 }
 
-func DeleteServiceInstanceByServiceInstanceId(instanceId string) {
-	var err error
+// DeleteServiceInstanceByServiceInstanceId soft-deletes the service instance, the row is kept (with the time and the foundation of the delete) for post-mortems, but is ignored by all other queries.
+// The "on delete cascade" of service_binding does not fire for a soft-delete, so the bindings of the service instance are deleted in the same transaction.
+func DeleteServiceInstanceByServiceInstanceId(ctx context.Context, instanceId string) {
+	ctx, span := startSpan(ctx, "DeleteServiceInstanceByServiceInstanceId", "service_instance")
+	defer span.End()
 	db := GetDB()
 	defer db.Close()
-	_, err = db.Exec("delete from service_instance where instance_id=?", instanceId)
+	serviceInstance := GetServiceInstanceByInstanceId(ctx, instanceId)
+	deleted, deletedBindings, err := softDeleteServiceInstance(ctx, db, instanceId)
 	if err != nil {
-		fmt.Printf("failed to delete ServiceInstance for ServiceInstanceId %s, error: %s\n", instanceId, err)
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to delete ServiceInstance for ServiceInstanceId", "instance_id", instanceId, "error", err)
+		return
+	}
+	if deleted > 0 {
+		oldStatus := serviceInstance.Status
+		serviceInstance.InstanceId = instanceId
+		serviceInstance.Status = ""
+		message := "deleted by " + conf.CfEnv
+		if deletedBindings > 0 {
+			message = fmt.Sprintf("%s, with %d binding(s)", message, deletedBindings)
+		}
+		auditServiceInstance(ctx, EventServiceInstanceDeleted, serviceInstance, oldStatus, message)
+	}
+}
+
+// softDeleteServiceInstance marks the service instance as deleted and deletes its bindings, it returns the number of deleted service instances and bindings
+func softDeleteServiceInstance(ctx context.Context, db *sql.DB, instanceId string) (int64, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	result, err := tx.Exec("update service_instance set deleted_at=current_timestamp, deleted_by_env=?, poller_owner=null, poller_heartbeat=null where instance_id=? and deleted_at is null", conf.CfEnv, instanceId)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, 0, err
+	}
+	deleted, _ := result.RowsAffected()
+	if deleted == 0 {
+		// the service instance was deleted already
+		return 0, 0, tx.Rollback()
+	}
+	result, err = tx.Exec("delete from service_binding where service_instance_id=?", instanceId)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, 0, err
+	}
+	deletedBindings, _ := result.RowsAffected()
+	return deleted, deletedBindings, tx.Commit()
+}
+
+// GetDeletedServiceInstanceByInstanceId returns the soft-deleted service instance, an empty ServiceInstance if there is none
+func GetDeletedServiceInstanceByInstanceId(ctx context.Context, id string) ServiceInstance {
+	ctx, span := startSpan(ctx, "GetDeletedServiceInstanceByInstanceId", "service_instance")
+	defer span.End()
+	db := GetDB()
+	defer db.Close()
+	rows, err := db.Query("select Id, service_id, instance_id, plan_id, parameters, env, organization_name, space_name, instance_name, iaas_instance_id, status, deleted_at, deleted_by_env from service_instance where instance_id=? and deleted_at is not null", id)
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the deleted service_instances for instance_id", "instance_id", id, "error", err)
+		return ServiceInstance{}
+	}
+	result := getServiceInstances(ctx, rows)
+	if len(result) != 1 {
+		return ServiceInstance{}
+	}
+	return result[0]
+}
+
+// PlanInUse is a plan of a service with the number of (not deleted) service instances of it
+type PlanInUse struct {
+	ServiceId string
+	PlanId    string
+	Count     int
+}
+
+// GetPlansInUse returns the plans that have service instances, across all envs
+func GetPlansInUse(ctx context.Context) ([]PlanInUse, error) {
+	ctx, span := startSpan(ctx, "GetPlansInUse", "service_instance")
+	defer span.End()
+	result := make([]PlanInUse, 0)
+	db := GetDB()
+	defer db.Close()
+	rows, err := db.Query("select service_id, plan_id, count(*) from service_instance where deleted_at is null group by service_id, plan_id")
+	if err != nil {
+		util.RecordError(span, err)
+		util.Logger(ctx).Error("failed to query the plans in use", "error", err)
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var plan PlanInUse
+		if err = rows.Scan(&plan.ServiceId, &plan.PlanId, &plan.Count); err != nil {
+			util.RecordError(span, err)
+			return result, err
+		}
+		result = append(result, plan)
 	}
+	return result, nil
 }
@@ -0,0 +1,49 @@
+package db_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+)
+
+func TestDeleteServiceInstanceDeletesBindings(t *testing.T) {
+	tests := []struct {
+		name            string
+		deleted         int64
+		bindingsError   error
+		expectedMessage string
+	}{
+		{name: "with bindings", deleted: 1, expectedMessage: "deleted by test, with 2 binding(s)"},
+		{name: "already deleted", deleted: 0},
+		{name: "bindings delete fails", deleted: 1, bindingsError: errors.New("lock wait timeout")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := dbtest.NewMock(t)
+			mock.ExpectQuery("select .* from service_instance where instance_id=\\? and deleted_at is null").WithArgs("guid-1").
+				WillReturnRows(sqlmock.NewRows(dbtest.ServiceInstanceColumns).AddRow(1, "service", "guid-1", "plan", "{}", "test", "org", "space", "db", 7, db.StatusSucceeded, nil, nil))
+			mock.ExpectBegin()
+			mock.ExpectExec("update service_instance set deleted_at=current_timestamp").WithArgs("test", "guid-1").WillReturnResult(sqlmock.NewResult(0, tt.deleted))
+			switch {
+			case tt.deleted == 0:
+				mock.ExpectRollback()
+			case tt.bindingsError != nil:
+				mock.ExpectExec("delete from service_binding where service_instance_id=\\?").WithArgs("guid-1").WillReturnError(tt.bindingsError)
+				mock.ExpectRollback()
+			default:
+				mock.ExpectExec("delete from service_binding where service_instance_id=\\?").WithArgs("guid-1").WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+				// the notification looks up the iaas instance, the audit event tells how many bindings were deleted
+				mock.ExpectQuery("from iaas_instance where id=\\?").WithArgs(7).WillReturnRows(sqlmock.NewRows(dbtest.IaaSInstanceColumns))
+				mock.ExpectExec("insert into audit_event").WithArgs(dbtest.Args(15, map[int]driver.Value{4: db.EventServiceInstanceDeleted, 5: "guid-1", 14: tt.expectedMessage})...).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			db.DeleteServiceInstanceByServiceInstanceId(context.Background(), "guid-1")
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Package dbtest replaces the broker database with a sqlmock database in the tests
+package dbtest
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+)
+
+// the columns of the queries that return iaas instances and service instances
+var (
+	IaaSInstanceColumns    = []string{"Id", "internal_id", "Status", "last_status_update", "last_message", "service_url", "service_user", "service_password", "service_details"}
+	ServiceInstanceColumns = []string{"Id", "service_id", "instance_id", "plan_id", "parameters", "env", "organization_name", "space_name", "instance_name", "iaas_instance_id", "status", "deleted_at", "deleted_by_env"}
+)
+
+// Configure sets the configuration the db package needs: an (empty) configuration, the env and the encryption key
+func Configure() {
+	conf.ApplyReloadedConfig(&conf.Config{})
+	conf.CfEnv = "test"
+	conf.EncryptKey = "0123456789abcdef0123456789abcdef"
+}
+
+// NewMock makes db.GetDB return a sqlmock database for the duration of the test, the expectations are checked when the test ends.
+// The queries are matched with regular expressions.
+func NewMock(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	dsn := "mfsb_" + t.Name()
+	mockDB, mock, err := sqlmock.NewWithDSN(dsn)
+	if err != nil {
+		t.Fatalf("failed to create the sqlmock database: %s", err)
+	}
+	savedDriver, savedDataSourceName := db.Driver, db.DataSourceName
+	db.Driver, db.DataSourceName = "sqlmock", func() string { return dsn }
+	t.Cleanup(func() {
+		db.Driver, db.DataSourceName = savedDriver, savedDataSourceName
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet sql expectations: %s", err)
+		}
+		_ = mockDB.Close()
+	})
+	return mock
+}
+
+// Args returns n sqlmock.AnyArg arguments, except for the given positions
+func Args(n int, positions map[int]driver.Value) []driver.Value {
+	args := make([]driver.Value, n)
+	for i := range args {
+		if value, found := positions[i]; found {
+			args[i] = value
+		} else {
+			args[i] = sqlmock.AnyArg()
+		}
+	}
+	return args
+}
@@ -1,33 +1,58 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/docdb"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/elasticache"
 	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	"github.com/aws/aws-sdk-go/service/mq"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
 	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sts"
 	aws2 "github.com/rabobank/mfsb/aws"
 	"github.com/rabobank/mfsb/conf"
 	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/notify"
+	"github.com/rabobank/mfsb/reload"
 	"github.com/rabobank/mfsb/server"
+	"github.com/rabobank/mfsb/util"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
+// shutdownTracing flushes the spans that are not yet exported
+var shutdownTracing func(context.Context) error
+
 func main() {
-	fmt.Printf("mfsb starting for cf env %s, version:%s, commit:%s\n", conf.CfEnv, conf.VERSION, conf.COMMIT)
+	slog.Info("mfsb starting", "version", conf.VERSION, "commit", conf.COMMIT)
 
 	conf.EnvironmentComplete()
 
 	initialize()
 
 	// test the db access to tables
-	fmt.Printf("found %d service instances\n", len(db.GetServiceInstances(0)))
-	fmt.Printf("found %d iaas instances\n", len(db.GetIaaSInstances(0)))
-	fmt.Printf("found %d service bindings\n", len(db.GetServiceBindings(0)))
+	ctx := context.Background()
+	slog.Info("found service instances", "count", len(db.GetServiceInstances(ctx, 0)))
+	slog.Info("found iaas instances", "count", len(db.GetIaaSInstances(ctx, 0)))
+	slog.Info("found service bindings", "count", len(db.GetServiceBindings(ctx, 0)))
 
-	server.StartServer()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	aws2.StartPollerAdoption()
+	notify.StartDelivery(ctx)
+	reload.StartWatcher(ctx)
+	server.StartServer(ctx)
+	_ = shutdownTracing(context.Background())
 }
 
 // initialize mfsb:
@@ -36,42 +61,58 @@ func main() {
 //   - test database
 //   - startup updating "in progress" IaaSInstances
 func initialize() {
-	catalogFile := fmt.Sprintf("%s/%s.json", conf.CatalogDir, conf.IaaS)
-	file, err := os.ReadFile(catalogFile)
+	catalogFile := conf.CatalogFile(conf.Get())
+	catalog, err := conf.LoadCatalog(catalogFile)
 	if err != nil {
-		fmt.Printf("failed reading catalog file %s: %s\n", catalogFile, err)
+		slog.Error("failed loading the catalog", "file", catalogFile, "error", err)
 		os.Exit(8)
 	}
-	err = json.Unmarshal(file, &conf.Catalog)
+	conf.SetCatalog(catalog)
+
+	spanExporter, err := util.NewSpanExporter(context.Background(), conf.OtelExporter)
 	if err != nil {
-		fmt.Printf("failed unmarshalling json from file %s, error: %s\n", catalogFile, err)
+		slog.Error("failed to create the otel span exporter", "error", err)
 		os.Exit(8)
 	}
+	shutdownTracing = util.InitTracing(spanExporter)
 
 	conf.AWSSession, err = session.NewSession(&aws.Config{Region: aws.String(conf.AWSRegion)})
 	if err != nil {
-		fmt.Printf("failed to create new AWS Session, error: %s\n", err)
+		slog.Error("failed to create new AWS Session", "error", err)
 		os.Exit(8)
 	}
-	if conf.Debug {
-		fmt.Println("AWS session created")
-	}
+	aws2.InstrumentSession(conf.AWSSession)
+	slog.Debug("AWS session created")
 	conf.RDSClient = rds.New(conf.AWSSession)
-	if conf.Debug {
-		fmt.Println("AWS RDS client created")
-	}
+	slog.Debug("AWS RDS client created")
 	conf.DOCDBClient = docdb.New(conf.AWSSession)
-	if conf.Debug {
-		fmt.Println("AWS DocumentDB client created")
-	}
+	slog.Debug("AWS DocumentDB client created")
+	conf.ElastiCacheClient = elasticache.New(conf.AWSSession)
+	slog.Debug("AWS ElastiCache client created")
+	conf.OpenSearchClient = opensearchservice.New(conf.AWSSession)
+	slog.Debug("AWS OpenSearch client created")
+	conf.KafkaClient = kafka.New(conf.AWSSession)
+	slog.Debug("AWS MSK client created")
+	conf.SecretsManagerClient = secretsmanager.New(conf.AWSSession)
+	slog.Debug("AWS Secrets Manager client created")
+	conf.DynamoDBClient = dynamodb.New(conf.AWSSession)
+	slog.Debug("AWS DynamoDB client created")
+	conf.MQClient = mq.New(conf.AWSSession)
+	slog.Debug("AWS MQ client created")
+	conf.NeptuneClient = neptune.New(conf.AWSSession)
+	slog.Debug("AWS Neptune client created")
+	conf.S3Client = s3.New(conf.AWSSession)
+	slog.Debug("AWS S3 client created")
+	conf.SQSClient = sqs.New(conf.AWSSession)
+	slog.Debug("AWS SQS client created")
 	conf.IAMClient = iam.New(conf.AWSSession)
-	if conf.Debug {
-		fmt.Println("AWS IAM client created")
-	}
+	slog.Debug("AWS IAM client created")
+	conf.STSClient = sts.New(conf.AWSSession)
+	slog.Debug("AWS STS client created")
 
 	// test if the DB can be opened
 	database := db.GetDB()
 	defer database.Close()
 
-	aws2.UpdateInProgressStatus()
+	aws2.UpdateInProgressStatus(context.Background())
 }
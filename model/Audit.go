@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+// AuditEvent is an entry of the response of the /admin/audit_events endpoint
+type AuditEvent struct {
+	Id                  int64     `json:"id"`
+	EventTime           time.Time `json:"event_time"`
+	Env                 string    `json:"env"`
+	BrokerInstance      string    `json:"broker_instance"`
+	OriginatingIdentity string    `json:"originating_identity,omitempty"`
+	RequestId           string    `json:"request_id,omitempty"`
+	EventType           string    `json:"event_type"`
+	InstanceId          string    `json:"instance_id,omitempty"`
+	OrganizationName    string    `json:"organization_name,omitempty"`
+	SpaceName           string    `json:"space_name,omitempty"`
+	InstanceName        string    `json:"instance_name,omitempty"`
+	IaaSInstanceId      int64     `json:"iaas_instance_id,omitempty"`
+	InternalId          string    `json:"internal_id,omitempty"`
+	OldStatus           string    `json:"old_status,omitempty"`
+	NewStatus           string    `json:"new_status,omitempty"`
+	AWSRequestIds       []string  `json:"aws_request_ids,omitempty"`
+	Message             string    `json:"message,omitempty"`
+}
+
+// IaaSInstanceStatus is an entry of the response of the /admin/iaas_instances/{iaas_instance_id}/status_history endpoint
+type IaaSInstanceStatus struct {
+	Status     string    `json:"status"`
+	Message    string    `json:"message"`
+	StatusTime time.Time `json:"status_time"`
+	Env        string    `json:"env"`
+}
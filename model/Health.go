@@ -0,0 +1,18 @@
+package model
+
+const (
+	HealthUp   = "UP"
+	HealthDown = "DOWN"
+)
+
+// HealthReport is the response of the /health endpoints
+type HealthReport struct {
+	Status  string                 `json:"status"`
+	Version string                 `json:"version"`
+	Checks  map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthCheck is the result of one readiness check, the reason of a failure is only logged
+type HealthCheck struct {
+	Status string `json:"status"`
+}
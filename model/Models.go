@@ -1,5 +1,11 @@
 package model
 
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
 type Catalog struct {
 	Services []Service `json:"services"`
 }
@@ -19,9 +25,53 @@ type Service struct {
 }
 
 type ServicePlan struct {
-	Name        string      `json:"name"`
-	Id          string      `json:"id"`
-	Description string      `json:"description"`
-	Metadata    interface{} `json:"metadata,omitempty"`
-	Free        bool        `json:"free,omitempty"`
+	Name        string       `json:"name"`
+	Id          string       `json:"id"`
+	Description string       `json:"description"`
+	Metadata    interface{}  `json:"metadata,omitempty"`
+	Free        bool         `json:"free,omitempty"`
+	Schemas     *PlanSchemas `json:"schemas,omitempty"`
+	// IaaS holds the IaaS settings of the plan, taken from metadata.iaas in the catalog
+	IaaS *PlanIaaSSettings `json:"-"`
+}
+
+// PlanIaaSSettings The settings for creating the IaaS instance of a plan, which of them are required depends on the service, see conf.ValidateCatalog
+type PlanIaaSSettings struct {
+	InstanceClass    string   `json:"instance_class"`
+	DefaultStorageGB int64    `json:"default_storage_gb,omitempty"`
+	StorageType      string   `json:"storage_type,omitempty"`
+	AllowedEngines   []string `json:"allowed_engines,omitempty"`
+	MaxInstances     int64    `json:"max_instances,omitempty"`
+}
+
+// UnmarshalJSON keeps the plan metadata as is (it is passed on to the cloud controller), and additionally reads the IaaS settings from it
+func (p *ServicePlan) UnmarshalJSON(data []byte) error {
+	type plainServicePlan ServicePlan
+	var plan plainServicePlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return err
+	}
+	var metadata struct {
+		IaaS *PlanIaaSSettings `json:"iaas"`
+	}
+	if raw, err := json.Marshal(plan.Metadata); err == nil {
+		if err = json.Unmarshal(raw, &metadata); err != nil {
+			return fmt.Errorf("invalid iaas settings in the metadata of plan %s: %s", plan.Name, err)
+		}
+	}
+	plan.IaaS = metadata.IaaS
+	*p = ServicePlan(plan)
+	return nil
+}
+
+// AllowsEngine tells if the engine is one of the allowed engines of the plan
+func (s *PlanIaaSSettings) AllowsEngine(engine string) bool {
+	return slices.Contains(s.AllowedEngines, engine)
+}
+
+// ReloadResult is the response of the /admin/reload endpoint
+type ReloadResult struct {
+	CatalogFile string `json:"catalog_file"`
+	Services    int    `json:"services"`
+	Plans       int    `json:"plans"`
 }
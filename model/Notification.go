@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// Notification is the (signed) json body that is POSTed to the webhook endpoints
+type Notification struct {
+	EventId          string    `json:"event_id"`
+	EventType        string    `json:"event_type"`
+	EventTime        time.Time `json:"event_time"`
+	BrokerEnv        string    `json:"broker_env"` // the foundation whose broker sent the notification
+	Env              string    `json:"env"`        // the foundation of the service instance
+	InstanceId       string    `json:"instance_id"`
+	OrganizationName string    `json:"organization_name"`
+	SpaceName        string    `json:"space_name"`
+	InstanceName     string    `json:"instance_name"`
+	ServiceName      string    `json:"service_name"`
+	PlanName         string    `json:"plan_name"`
+	Status           string    `json:"status"`
+	Message          string    `json:"message,omitempty"`
+}
@@ -0,0 +1,211 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// the actions a plan can have a parameters schema for, named after their place in the schemas block of the catalog
+const (
+	SchemaServiceInstanceCreate = "service_instance.create"
+	SchemaServiceInstanceUpdate = "service_instance.update"
+	SchemaServiceBindingCreate  = "service_binding.create"
+)
+
+// PlanSchemas The schemas block of a plan in the catalog, the json schemas the parameters (cf create-service -c) are validated against
+type PlanSchemas struct {
+	ServiceInstance *ServiceInstanceSchemas `json:"service_instance,omitempty"`
+	ServiceBinding  *ServiceBindingSchemas  `json:"service_binding,omitempty"`
+}
+
+type ServiceInstanceSchemas struct {
+	Create *InputParametersSchema `json:"create,omitempty"`
+	Update *InputParametersSchema `json:"update,omitempty"`
+}
+
+type ServiceBindingSchemas struct {
+	Create *InputParametersSchema `json:"create,omitempty"`
+}
+
+type InputParametersSchema struct {
+	Parameters *Schema `json:"parameters,omitempty"`
+}
+
+// Schema The subset of json schema the broker can validate with, a catalog that uses other keywords is rejected (see UnmarshalJSON)
+type Schema struct {
+	SchemaVersion        string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Default              any                `json:"default,omitempty"`
+}
+
+// FieldError is a parameter that does not match the schema, Field is the path of the parameter (empty for the parameters object itself)
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ParameterErrorResponse is the (OSB error) response for parameters that do not match the schema of the plan
+type ParameterErrorResponse struct {
+	Error       string       `json:"error"`
+	Description string       `json:"description"`
+	Fields      []FieldError `json:"fields"`
+}
+
+// UnmarshalJSON rejects the json schema keywords the broker does not support, silently ignoring them would accept parameters the schema author meant to reject
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type plainSchema Schema
+	var schema plainSchema
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&schema); err != nil {
+		return fmt.Errorf("unsupported json schema: %s", err)
+	}
+	*s = Schema(schema)
+	return nil
+}
+
+// ParameterSchema returns the parameters schema of the plan for the action (one of the Schema* consts), nil if the plan has none
+func (p *ServicePlan) ParameterSchema(action string) *Schema {
+	var input *InputParametersSchema
+	switch {
+	case p.Schemas == nil:
+	case action == SchemaServiceInstanceCreate && p.Schemas.ServiceInstance != nil:
+		input = p.Schemas.ServiceInstance.Create
+	case action == SchemaServiceInstanceUpdate && p.Schemas.ServiceInstance != nil:
+		input = p.Schemas.ServiceInstance.Update
+	case action == SchemaServiceBindingCreate && p.Schemas.ServiceBinding != nil:
+		input = p.Schemas.ServiceBinding.Create
+	}
+	if input == nil {
+		return nil
+	}
+	return input.Parameters
+}
+
+// ValidateParameters validates the raw json parameters against the schema, absent parameters are validated as an empty object. It returns all fields that do not match.
+func (s *Schema) ValidateParameters(parameters json.RawMessage) []FieldError {
+	var value any = map[string]any{}
+	if trimmed := bytes.TrimSpace(parameters); len(trimmed) > 0 && !bytes.Equal(trimmed, []byte("null")) {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return []FieldError{{Message: fmt.Sprintf("the parameters are not valid json: %s", err)}}
+		}
+	}
+	return s.validate("", value)
+}
+
+func (s *Schema) validate(field string, value any) []FieldError {
+	var errs []FieldError
+	fail := func(format string, args ...any) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.Type != "" && !hasType(value, s.Type) {
+		fail("should be of type %s", s.Type)
+		return errs
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(allowed any) bool { return sameValue(allowed, value) }) {
+		var allowed []string
+		for _, a := range s.Enum {
+			allowed = append(allowed, fmt.Sprint(a))
+		}
+		fail("should be one of %s", strings.Join(allowed, ", "))
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, found := v[name]; !found {
+				errs = append(errs, FieldError{Field: joinField(field, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, found := s.Properties[name]; found {
+				errs = append(errs, property.validate(joinField(field, name), v[name])...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, FieldError{Field: joinField(field, name), Message: "is not a supported parameter"})
+			}
+		}
+	case string:
+		if s.MinLength != nil && len(v) < *s.MinLength {
+			fail("should be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && len(v) > *s.MaxLength {
+			fail("should be at most %d characters", *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			if matched, err := regexp.MatchString(s.Pattern, v); err != nil || !matched {
+				fail("should match %s", s.Pattern)
+			}
+		}
+	case json.Number:
+		number, _ := v.Float64()
+		if s.Minimum != nil && number < *s.Minimum {
+			fail("should be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			fail("should be at most %v", *s.Maximum)
+		}
+	}
+	return errs
+}
+
+func hasType(value any, schemaType string) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		return schemaType == "object"
+	case []any:
+		return schemaType == "array"
+	case string:
+		return schemaType == "string"
+	case bool:
+		return schemaType == "boolean"
+	case json.Number:
+		if schemaType == "number" {
+			return true
+		}
+		number, err := v.Float64()
+		return schemaType == "integer" && err == nil && number == math.Trunc(number)
+	case nil:
+		return schemaType == "null"
+	}
+	return false
+}
+
+// sameValue compares a value from the schema (decoded without UseNumber) with a value from the parameters
+func sameValue(allowed, value any) bool {
+	if number, ok := value.(json.Number); ok {
+		f, err := number.Float64()
+		return err == nil && allowed == f
+	}
+	return reflect.DeepEqual(allowed, value)
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
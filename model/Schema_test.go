@@ -0,0 +1,99 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSchema is a parameters schema like the ones in the catalog
+const testSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"type": "object",
+	"additionalProperties": false,
+	"required": ["Engine"],
+	"properties": {
+		"Engine": {"type": "string", "enum": ["postgres", "mysql"]},
+		"DBName": {"type": "string", "pattern": "^[a-z][a-z0-9_]*$", "minLength": 2, "maxLength": 8},
+		"NumDBInstances": {"type": "integer", "enum": [1, 2, 3]},
+		"AllocatedStorageGB": {"type": "integer", "minimum": 5, "maximum": 100},
+		"RetentionDays": {"type": "number"},
+		"MultiAZ": {"type": "boolean"},
+		"Tags": {"type": "object", "properties": {"Team": {"type": "string"}}}
+	}
+}`
+
+func TestValidateParameters(t *testing.T) {
+	var schema Schema
+	if err := json.Unmarshal([]byte(testSchema), &schema); err != nil {
+		t.Fatalf("the test schema is invalid: %s", err)
+	}
+	tests := []struct {
+		name       string
+		parameters string
+		expected   []FieldError
+	}{
+		{name: "valid", parameters: `{"Engine": "postgres", "DBName": "orders", "NumDBInstances": 2, "AllocatedStorageGB": 20, "RetentionDays": 7.5, "MultiAZ": true, "Tags": {"Team": "a"}}`},
+		{name: "absent parameters are an empty object", parameters: ``, expected: []FieldError{{Field: "Engine", Message: "is required"}}},
+		{name: "null parameters are an empty object", parameters: `null`, expected: []FieldError{{Field: "Engine", Message: "is required"}}},
+		{name: "not json", parameters: `{"Engine":`, expected: []FieldError{{Message: "the parameters are not valid json: unexpected EOF"}}},
+		{name: "not an object", parameters: `["postgres"]`, expected: []FieldError{{Message: "should be of type object"}}},
+		{name: "type", parameters: `{"Engine": "mysql", "MultiAZ": "yes", "DBName": 5, "Tags": "a"}`, expected: []FieldError{
+			{Field: "DBName", Message: "should be of type string"},
+			{Field: "MultiAZ", Message: "should be of type boolean"},
+			{Field: "Tags", Message: "should be of type object"},
+		}},
+		{name: "enum", parameters: `{"Engine": "oracle", "NumDBInstances": 4}`, expected: []FieldError{
+			{Field: "Engine", Message: "should be one of postgres, mysql"},
+			{Field: "NumDBInstances", Message: "should be one of 1, 2, 3"},
+		}},
+		{name: "enum of numbers matches the json number", parameters: `{"Engine": "mysql", "NumDBInstances": 3.0}`},
+		{name: "additional properties", parameters: `{"Engine": "mysql", "Unknown": 1, "Tags": {"Owner": "b"}}`, expected: []FieldError{
+			{Field: "Unknown", Message: "is not a supported parameter"},
+		}},
+		{name: "pattern and length", parameters: `{"Engine": "mysql", "DBName": "Orders-and-more"}`, expected: []FieldError{
+			{Field: "DBName", Message: "should be at most 8 characters"},
+			{Field: "DBName", Message: "should match ^[a-z][a-z0-9_]*$"},
+		}},
+		{name: "min length", parameters: `{"Engine": "mysql", "DBName": "o"}`, expected: []FieldError{{Field: "DBName", Message: "should be at least 2 characters"}}},
+		{name: "integer", parameters: `{"Engine": "mysql", "AllocatedStorageGB": 20.5, "NumDBInstances": 2.0}`, expected: []FieldError{
+			{Field: "AllocatedStorageGB", Message: "should be of type integer"},
+		}},
+		{name: "minimum and maximum", parameters: `{"Engine": "mysql", "AllocatedStorageGB": 4}`, expected: []FieldError{{Field: "AllocatedStorageGB", Message: "should be at least 5"}}},
+		{name: "maximum", parameters: `{"Engine": "mysql", "AllocatedStorageGB": 101}`, expected: []FieldError{{Field: "AllocatedStorageGB", Message: "should be at most 100"}}},
+		{name: "nested properties", parameters: `{"Engine": "mysql", "Tags": {"Team": 1}}`, expected: []FieldError{{Field: "Tags.Team", Message: "should be of type string"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := schema.ValidateParameters(json.RawMessage(tt.parameters)); !reflect.DeepEqual(errs, tt.expected) {
+				t.Errorf("the errors are %v, expected %v", errs, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSchemaUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{name: "supported keywords", schema: testSchema},
+		{name: "unknown keyword", schema: `{"type": "object", "patternProperties": {"^x": {"type": "string"}}}`, err: `unsupported json schema: json: unknown field "patternProperties"`},
+		{name: "unknown keyword in a property", schema: `{"type": "object", "properties": {"DBName": {"type": "string", "format": "hostname"}}}`, err: `unsupported json schema: json: unknown field "format"`},
+		{name: "wrong keyword type", schema: `{"type": "object", "required": "Engine"}`, err: "unsupported json schema: json: cannot unmarshal string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema Schema
+			err := json.Unmarshal([]byte(tt.schema), &schema)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("the schema should be accepted, got %s", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("the schema should be rejected with %s, got %v", tt.err, err)
+			}
+		})
+	}
+}
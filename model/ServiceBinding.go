@@ -1,12 +1,23 @@
 package model
 
+import "encoding/json"
+
 type ServiceBinding struct {
-	ServiceId         string        `json:"service_id"`
-	PlanId            string        `json:"plan_id"`
-	AppGuid           string        `json:"app_guid"`
-	ServiceInstanceId string        `json:"service_instance_id"`
-	BindResource      *BindResource `json:"bind_resource"`
-	Context           *Context      `json:"context"`
+	ServiceId         string          `json:"service_id"`
+	PlanId            string          `json:"plan_id"`
+	AppGuid           string          `json:"app_guid"`
+	ServiceInstanceId string          `json:"service_instance_id"`
+	BindResource      *BindResource   `json:"bind_resource"`
+	Context           *Context        `json:"context"`
+	Parameters        json.RawMessage `json:"parameters,omitempty"`
+}
+
+// BindingParameters This is a superset of all potential parameters that can be given on the -c parameter of "cf bind-service"
+type BindingParameters struct {
+	// SQS parameters: producer or consumer, both if absent
+	Scope string `json:"Scope,omitempty"`
+	// Secrets Manager parameters: value (the secret itself) or iam (an IAM user that can read the secret), value if absent
+	Access string `json:"Access,omitempty"`
 }
 
 type BindResource struct {
@@ -16,7 +27,8 @@ type BindResource struct {
 
 type CreateServiceBindingResponse struct {
 	// SyslogDrainUrl string      `json:"syslog_drain_url, omitempty"`
-	Credentials *Credentials `json:"credentials"`
+	// Credentials are the Credentials of the IaaS instance, or the credentials created for the binding (a map, see db.ServiceBinding)
+	Credentials any `json:"credentials"`
 }
 
 type Credentials struct {
@@ -26,4 +38,9 @@ type Credentials struct {
 	Host     string `json:"host"`
 	Port     string `json:"port"`
 	Database string `json:"database"`
+	// the reader endpoint of a cluster (Aurora), writes have to go to Uri/Host
+	ReaderUri  string `json:"reader_uri,omitempty"`
+	ReaderHost string `json:"reader_host,omitempty"`
+	// the connection has to use TLS (Redis with in-transit encryption)
+	TLS bool `json:"tls,omitempty"`
 }
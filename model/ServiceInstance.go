@@ -1,5 +1,11 @@
 package model
 
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
 type ServiceInstance struct {
 	ServiceId        string      `json:"service_id"`
 	PlanId           string      `json:"plan_id"`
@@ -7,6 +13,23 @@ type ServiceInstance struct {
 	SpaceGuid        string      `json:"space_guid"`
 	Context          *Context    `json:"context"`
 	Parameters       *Parameters `json:"parameters,omitempty"`
+	// RawParameters are the parameters as given, to validate them against the schema of the plan before they are decoded into Parameters
+	RawParameters json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON only keeps the raw parameters, decoding them into Parameters would drop unknown keys and fail on a wrong type without telling which field
+func (s *ServiceInstance) UnmarshalJSON(data []byte) error {
+	type plainServiceInstance ServiceInstance
+	var instance struct {
+		plainServiceInstance
+		Parameters json.RawMessage `json:"parameters"`
+	}
+	if err := json.Unmarshal(data, &instance); err != nil {
+		return err
+	}
+	*s = ServiceInstance(instance.plainServiceInstance)
+	s.RawParameters = instance.Parameters
+	return nil
 }
 
 type CreateServiceInstanceResponse struct {
@@ -16,6 +39,10 @@ type CreateServiceInstanceResponse struct {
 	LastOperation *LastOperation `json:"last_operation,omitempty"`
 }
 
+type UpdateServiceInstanceResponse struct {
+	Result string `json:"result,omitempty"`
+}
+
 type DeleteServiceInstanceResponse struct {
 	Result string `json:"result,omitempty"`
 }
@@ -36,4 +63,62 @@ type Parameters struct {
 	// DOCDB parameters:
 	NumDBInstances      int64  `json:"NumDBInstances,omitempty"`
 	RestoreFromSnapshot string `json:"RestoreFromSnapshot,omitempty"`
+	// RDS and DOCDB parameters: restore another service instance (<org>/<space>/<name>) to a point in time (RFC3339), the latest restorable time if RestoreTime is absent
+	RestoreFromInstance string `json:"RestoreFromInstance,omitempty"`
+	RestoreTime         string `json:"RestoreTime,omitempty"`
+	// RDS, Aurora and DOCDB update parameter: the identifier of a manual snapshot to create
+	CreateSnapshot string `json:"CreateSnapshot,omitempty"`
+	// S3 parameters
+	KeepBucket bool `json:"KeepBucket,omitempty"`
+	// SQS parameters
+	Fifo            bool  `json:"Fifo,omitempty"`
+	DeadLetterQueue bool  `json:"DeadLetterQueue,omitempty"`
+	MaxReceiveCount int64 `json:"MaxReceiveCount,omitempty"`
+	// DynamoDB parameters
+	HashKey             string `json:"HashKey,omitempty"`
+	HashKeyType         string `json:"HashKeyType,omitempty"`
+	RangeKey            string `json:"RangeKey,omitempty"`
+	RangeKeyType        string `json:"RangeKeyType,omitempty"`
+	BillingMode         string `json:"BillingMode,omitempty"`
+	ReadCapacityUnits   int64  `json:"ReadCapacityUnits,omitempty"`
+	WriteCapacityUnits  int64  `json:"WriteCapacityUnits,omitempty"`
+	TTLAttribute        string `json:"TTLAttribute,omitempty"`
+	PointInTimeRecovery *bool  `json:"PointInTimeRecovery,omitempty"` // a pointer, it is on unless it is explicitly false
+	// Neptune parameters
+	IAMAuthentication bool `json:"IAMAuthentication,omitempty"`
+	// Secrets Manager parameters, SecretValue is only handed to the provisioning (see aws.WithSecretValue), it is neither logged nor stored
+	SecretValue  string `json:"SecretValue,omitempty"`
+	SecretLength int64  `json:"SecretLength,omitempty"`
+	RotateSecret bool   `json:"RotateSecret,omitempty"`
+}
+
+// ParameterTypes returns the json schema type of every field of Parameters, by json name
+func ParameterTypes() map[string]string {
+	return jsonSchemaTypes(reflect.TypeOf(Parameters{}))
+}
+
+// BindingParameterTypes returns the json schema type of every field of BindingParameters, by json name
+func BindingParameterTypes() map[string]string {
+	return jsonSchemaTypes(reflect.TypeOf(BindingParameters{}))
+}
+
+func jsonSchemaTypes(parametersType reflect.Type) map[string]string {
+	types := make(map[string]string)
+	for i := 0; i < parametersType.NumField(); i++ {
+		field := parametersType.Field(i)
+		kind := field.Type.Kind()
+		if kind == reflect.Pointer {
+			kind = field.Type.Elem().Kind()
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch kind {
+		case reflect.String:
+			types[name] = "string"
+		case reflect.Int, reflect.Int64:
+			types[name] = "integer"
+		case reflect.Bool:
+			types[name] = "boolean"
+		}
+	}
+	return types
 }
@@ -0,0 +1,134 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/util"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// deliveryInterval is how often the outbox is checked for due notifications
+	deliveryInterval = 10 * time.Second
+	// deliveryLease is how long a claimed notification is left alone by the other broker instances, it must be longer than a delivery attempt
+	deliveryLease = 1 * time.Minute
+	deliveryBatch = 50
+	// maxAttempts is the number of deliveries that are tried (backing off exponentially, up to maxBackoff) before a notification is marked failed, roughly 2 days
+	maxAttempts = 60
+	minBackoff  = 30 * time.Second
+	maxBackoff  = 1 * time.Hour
+
+	EventHeader     = "X-MFSB-Event"
+	DeliveryHeader  = "X-MFSB-Delivery"
+	TimestampHeader = "X-MFSB-Timestamp"
+	SignatureHeader = "X-MFSB-Signature"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// StartDelivery delivers the notifications from the outbox in the background, until ctx is done. Notifications that were not delivered (for example because the broker restarted) are picked up by any broker instance.
+func StartDelivery(ctx context.Context) {
+	if len(conf.Get().WebhookURLs) == 0 || conf.WebhookSecret == "" {
+		util.Logger(ctx).Info("no webhooks configured, notifications are not sent")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(deliveryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				deliverDue(ctx)
+			}
+		}
+	}()
+}
+
+func deliverDue(ctx context.Context) {
+	notifications, err := db.ClaimDueNotifications(ctx, deliveryLease, deliveryBatch)
+	if err != nil {
+		return
+	}
+	for _, notification := range notifications {
+		if ctx.Err() != nil {
+			// the claim expires, another broker instance will deliver it
+			return
+		}
+		deliver(ctx, notification)
+	}
+}
+
+func deliver(ctx context.Context, notification db.Notification) {
+	ctx = util.WithLogAttrs(ctx, "notification_id", notification.Id, "event_type", notification.EventType, "endpoint", notification.Endpoint)
+	logger := util.Logger(ctx)
+	err := post(ctx, notification)
+	if err == nil {
+		logger.Info("notification delivered")
+		db.MarkNotificationDelivered(ctx, notification.Id)
+		return
+	}
+	attempts := notification.Attempts + 1
+	giveUp := attempts >= maxAttempts
+	if giveUp {
+		logger.Error("notification delivery failed, giving up", "attempts", attempts, "error", err)
+	} else {
+		logger.Warn("notification delivery failed, will retry", "attempts", attempts, "error", err)
+	}
+	db.MarkNotificationAttemptFailed(ctx, notification.Id, err.Error(), backoff(attempts), giveUp)
+}
+
+func post(ctx context.Context, notification db.Notification) error {
+	ctx, span := util.Tracer().Start(ctx, "POST webhook")
+	defer span.End()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, notification.Endpoint, bytes.NewBufferString(notification.Payload))
+	if err != nil {
+		util.RecordError(span, err)
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, notification.EventType)
+	request.Header.Set(DeliveryHeader, strconv.FormatInt(notification.Id, 10))
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, "sha256="+Sign(conf.WebhookSecret, timestamp, notification.Payload))
+	response, err := httpClient.Do(request)
+	if err != nil {
+		util.RecordError(span, err)
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err = fmt.Errorf("webhook responded with %s", response.Status)
+		util.RecordError(span, err)
+		return err
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<payload>", a receiver verifies a notification by computing the same signature with the shared secret (and rejects old timestamps to prevent replays)
+func Sign(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the time to wait before the next delivery attempt, doubling from minBackoff up to maxBackoff
+func backoff(attempts int) time.Duration {
+	wait := minBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBackoff)
+}
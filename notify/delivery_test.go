@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/db/dbtest"
+)
+
+const testSecret = "webhook-secret"
+
+func TestMain(m *testing.M) {
+	dbtest.Configure()
+	conf.WebhookSecret = testSecret
+	os.Exit(m.Run())
+}
+
+func TestSign(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(`1700000000.{"event_type":"provision.succeeded"}`))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if signature := Sign(testSecret, "1700000000", `{"event_type":"provision.succeeded"}`); signature != expected {
+		t.Errorf("signature is %s, expected %s", signature, expected)
+	}
+	if Sign(testSecret, "1700000001", `{"event_type":"provision.succeeded"}`) == expected {
+		t.Error("the timestamp should be part of the signature, to prevent replays")
+	}
+	if Sign("other-secret", "1700000000", `{"event_type":"provision.succeeded"}`) == expected {
+		t.Error("the secret should be part of the signature")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{maxAttempts, time.Hour},
+	}
+	for _, tt := range tests {
+		if wait := backoff(tt.attempts); wait != tt.expected {
+			t.Errorf("backoff after %d attempts is %s, expected %s", tt.attempts, wait, tt.expected)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	const payload = `{"event_type":"provision.succeeded","instance_id":"guid-1"}`
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		expect   func(mock sqlmock.Sqlmock)
+	}{
+		{name: "delivered", status: http.StatusNoContent, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("update notification_outbox set status=\\?, attempts=attempts\\+1, delivered_at").WithArgs(db.NotificationDelivered, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "retried", status: http.StatusServiceUnavailable, attempts: 2, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("update notification_outbox set status=\\?, attempts=attempts\\+1, next_attempt_at=current_timestamp\\(3\\) \\+ interval \\? microsecond, last_error=\\?").
+				WithArgs(db.NotificationPending, (2 * time.Minute).Microseconds(), "webhook responded with 503 Service Unavailable", 5).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "given up", status: http.StatusInternalServerError, attempts: maxAttempts - 1, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("update notification_outbox set status=\\?, attempts=attempts\\+1, next_attempt_at=current_timestamp\\(3\\) \\+ interval \\? microsecond, last_error=\\?").
+				WithArgs(db.NotificationFailed, maxBackoff.Microseconds(), "webhook responded with 500 Internal Server Error", 5).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := dbtest.NewMock(t)
+			tt.expect(mock)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != payload {
+					t.Errorf("the webhook got body %s, expected %s", body, payload)
+				}
+				timestamp := r.Header.Get(TimestampHeader)
+				if signature := r.Header.Get(SignatureHeader); signature != "sha256="+Sign(testSecret, timestamp, payload) {
+					t.Errorf("the webhook got signature %s, which does not match the timestamp %s and the payload", signature, timestamp)
+				}
+				if r.Header.Get(EventHeader) != "provision.succeeded" || r.Header.Get(DeliveryHeader) != "5" {
+					t.Errorf("the webhook got event %s and delivery %s", r.Header.Get(EventHeader), r.Header.Get(DeliveryHeader))
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			deliver(context.Background(), db.Notification{Id: 5, Endpoint: server.URL, EventType: "provision.succeeded", Payload: payload, Attempts: tt.attempts})
+		})
+	}
+}
+
+func TestDeliverDueClaimsThePendingNotifications(t *testing.T) {
+	mock := dbtest.NewMock(t)
+	var delivered atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered.Add(1)
+	}))
+	defer server.Close()
+	mock.ExpectExec("update notification_outbox set claim_token=\\?, next_attempt_at=current_timestamp\\(3\\) \\+ interval \\? microsecond where status=\\? and next_attempt_at<=current_timestamp\\(3\\) order by id limit \\?").
+		WithArgs(sqlmock.AnyArg(), deliveryLease.Microseconds(), db.NotificationPending, deliveryBatch).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("select id, endpoint, event_type, payload, attempts from notification_outbox where claim_token=\\? and status=\\?").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "endpoint", "event_type", "payload", "attempts"}).
+			AddRow(1, server.URL, "provision.started", "{}", 0).
+			AddRow(2, server.URL, "provision.succeeded", "{}", 3))
+	mock.ExpectExec("update notification_outbox set status=\\?, attempts=attempts\\+1, delivered_at").WithArgs(db.NotificationDelivered, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update notification_outbox set status=\\?, attempts=attempts\\+1, delivered_at").WithArgs(db.NotificationDelivered, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	deliverDue(context.Background())
+	if delivered.Load() != 2 {
+		t.Errorf("%d notifications were posted, expected 2", delivered.Load())
+	}
+}
@@ -0,0 +1,122 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rabobank/mfsb/conf"
+	"github.com/rabobank/mfsb/db"
+	"github.com/rabobank/mfsb/model"
+	"github.com/rabobank/mfsb/util"
+	"os"
+	"sync"
+	"time"
+)
+
+// watchInterval is how often the config and catalog files are checked for changes
+const watchInterval = 30 * time.Second
+
+var mutex sync.Mutex
+
+// Reload reloads the configuration file and the catalog, and swaps them in if they are valid. The catalog is rejected if it lacks a plan that still has service instances.
+// Only the reloadable settings of the configuration can change (see conf.CheckReloadable), the others require a restart.
+func Reload(ctx context.Context) (model.ReloadResult, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	ctx, span := util.Tracer().Start(ctx, "Reload")
+	defer span.End()
+	var result model.ReloadResult
+	config, err := conf.LoadConfig(os.Getenv("MFSB_CONFIG_FILE"))
+	if err == nil {
+		err = conf.CheckReloadable(conf.Get(), config)
+	}
+	if err != nil {
+		util.RecordError(span, err)
+		return result, fmt.Errorf("configuration not reloaded: %w", err)
+	}
+	catalogFile := conf.CatalogFile(config)
+	catalog, err := conf.LoadCatalog(catalogFile)
+	if err == nil {
+		err = checkPlansInUse(ctx, catalog)
+	}
+	if err != nil {
+		util.RecordError(span, err)
+		return result, fmt.Errorf("catalog %s not reloaded: %w", catalogFile, err)
+	}
+	conf.ApplyReloadedConfig(config)
+	conf.SetCatalog(catalog)
+	result.CatalogFile = catalogFile
+	for _, service := range catalog.Services {
+		result.Services++
+		result.Plans += len(service.Plans)
+	}
+	util.Logger(ctx).Info("configuration and catalog reloaded", "catalog_file", catalogFile, "services", result.Services, "plans", result.Plans)
+	return result, nil
+}
+
+// checkPlansInUse returns an error for every plan that has service instances, but is not in the catalog
+func checkPlansInUse(ctx context.Context, catalog *model.Catalog) error {
+	plansInUse, err := db.GetPlansInUse(ctx)
+	if err != nil {
+		return fmt.Errorf("could not check the plans in use: %w", err)
+	}
+	var errs []error
+	for _, planInUse := range plansInUse {
+		if !hasPlan(catalog, planInUse.ServiceId, planInUse.PlanId) {
+			current := util.GetPlan(planInUse.ServiceId, planInUse.PlanId)
+			errs = append(errs, fmt.Errorf("plan %s (%s) of service %s (%s) is missing, it is used by %d service instances", current.Name, planInUse.PlanId, util.GetServiceById(planInUse.ServiceId).Name, planInUse.ServiceId, planInUse.Count))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func hasPlan(catalog *model.Catalog, serviceId, planId string) bool {
+	for _, service := range catalog.Services {
+		if service.Id == serviceId {
+			for _, plan := range service.Plans {
+				if plan.Id == planId {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// StartWatcher reloads when the config file or the catalog file changed (modification time), until ctx is done
+func StartWatcher(ctx context.Context) {
+	logger := util.Logger(ctx)
+	lastChange := modTimes()
+	go func() {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if changed := modTimes(); changed != lastChange {
+					lastChange = changed
+					logger.Info("config or catalog file changed, reloading")
+					if _, err := Reload(ctx); err != nil {
+						logger.Error("reload failed, keeping the current configuration and catalog", "error", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// modTimes returns the modification times of the config file and the catalog file
+func modTimes() [2]time.Time {
+	var times [2]time.Time
+	if configFile := os.Getenv("MFSB_CONFIG_FILE"); configFile != "" {
+		if info, err := os.Stat(configFile); err == nil {
+			times[0] = info.ModTime()
+		}
+	}
+	if info, err := os.Stat(conf.CatalogFile(conf.Get())); err == nil {
+		times[1] = info.ModTime()
+	}
+	return times
+}
@@ -1,3 +1,7 @@
+drop table if exists schema_version;
+drop table if exists audit_event;
+drop table if exists notification_outbox;
+drop table if exists iaas_instance_status_history;
 drop table if exists service_binding;
 drop table if exists service_instance;
 drop table if exists iaas_instance;
@@ -11,7 +15,8 @@ create table iaas_instance
     last_message       text(2048)       not null,
     service_url        text(1024)       not null,                        -- for a database, this could be the URL
     service_user       char(128)        not null default 'unknown_user', -- the user required to login to the database or other service
-    service_password   text(1024)       not null                         -- the password to login to the database or other service
+    service_password   text(1024)       not null,                        -- the password to login to the database or other service
+    service_details    text(4096)                                        -- encrypted json object with the service specific details that are added to the binding credentials
 );
 
 create table service_instance
@@ -28,7 +33,12 @@ create table service_instance
     iaas_instance_id  integer         not null,
     status            char(16)        not null check ( status in ('succeeded', 'failed', 'in progress')),
     last_update       timestamp on update current_timestamp default current_timestamp,
-    unique key (env, iaas_instance_id),
+    poller_owner      char(64),                 -- the broker instance that is polling the iaas instance for this env, null if nobody is polling
+    poller_heartbeat  timestamp       null,     -- updated by the poller_owner on every poll, a stale heartbeat means the poller died and another broker instance can take over
+    deleted_at        timestamp       null,     -- service instances are soft-deleted, a deleted service instance is ignored by the broker
+    deleted_by_env    char(5),                  -- the identifier of the Cloud Foundry foundation whose broker deleted the service instance
+    active            tinyint as (if(deleted_at is null, 1, null)) stored, -- null for deleted rows, so they do not count in the unique key below
+    unique key active_env_iaas (env, iaas_instance_id, active),
     constraint service2iaas foreign key (iaas_instance_id) references iaas_instance (id) on delete cascade
 );
 
@@ -37,5 +47,66 @@ create table service_binding
     id                  integer         not null primary key auto_increment,
     service_binding_id  char(36) unique not null, -- the guid generated by the CC
     service_instance_id char(36)        not null,
+    credentials         text(4096),               -- encrypted json object with the credentials of the binding, null if the binding uses the credentials of the iaas instance
     constraint binding2service foreign key (service_instance_id) references service_instance (instance_id) on delete cascade
 );
+
+create table iaas_instance_status_history
+(
+    id               bigint       not null primary key auto_increment,
+    iaas_instance_id integer      not null,
+    status           char(128)    not null,
+    message          text(2048)   not null,
+    status_time      timestamp(3) not null default current_timestamp(3),
+    env              char(5)      not null, -- the identifier of the Cloud Foundry foundation of the broker that made the status update
+    index (iaas_instance_id, id),
+    constraint history2iaas foreign key (iaas_instance_id) references iaas_instance (id) on delete cascade
+);
+
+create table notification_outbox
+(
+    id              bigint        not null primary key auto_increment,
+    endpoint        varchar(1024) not null, -- the webhook url the notification is POSTed to
+    event_type      char(64)      not null, -- for example provision.succeeded, see db/Notification.go
+    payload         text          not null, -- the json body of the POST
+    status          char(16)      not null default 'pending' check ( status in ('pending', 'delivered', 'failed')),
+    created_at      timestamp(3)  not null default current_timestamp(3),
+    attempts        integer       not null default 0,
+    next_attempt_at timestamp(3)  not null default current_timestamp(3),
+    claim_token     char(36),               -- set by the broker instance that is delivering the notification, see db.ClaimDueNotifications
+    last_error      text(2048),
+    delivered_at    timestamp(3)  null,
+    index (status, next_attempt_at)
+);
+
+create table schema_version
+(
+    version    integer   not null primary key, -- the version of this schema, the broker checks it in its readiness check (db.SchemaVersion)
+    applied_at timestamp not null default current_timestamp
+);
+
+create table audit_event
+(
+    id                   bigint        not null primary key auto_increment,
+    event_time           timestamp(3)  not null default current_timestamp(3),
+    env                  char(5)       not null, -- the identifier of the Cloud Foundry foundation of the broker that wrote the event
+    broker_instance      char(64)      not null, -- the broker instance that wrote the event
+    originating_identity varchar(1024),          -- the decoded X-Broker-API-Originating-Identity header of the request that caused the event
+    request_id           char(64),               -- the X-Request-ID of the request that caused the event, null for events written by a poller
+    event_type           char(64)      not null, -- for example service_instance.status_changed, see db/AuditEvent.go
+    instance_id          char(36),               -- no foreign keys, audit events outlive the rows they describe
+    organization_name    char(128),
+    space_name           char(128),
+    instance_name        char(128),
+    iaas_instance_id     integer,
+    internal_id          char(128),
+    old_status           char(128),
+    new_status           char(128),
+    aws_request_ids      varchar(1024),          -- comma separated ids of the AWS requests that led to the event
+    message              text(2048),
+    index (instance_id),
+    index (iaas_instance_id),
+    index (internal_id)
+);
+
+insert into schema_version(version) values (7);
@@ -9,4 +9,8 @@ create user 'mfsb-user'@'%' identified by "mfsb-password";
 
 grant select,update,insert,delete on mfsbdb.iaas_instance to 'mfsb-user'@'%';
 grant select,update,insert,delete on mfsbdb.service_instance to 'mfsb-user'@'%';
-grant select,update,insert,delete on mfsbdb.service_binding to 'mfsb-user'@'%';
\ No newline at end of file
+grant select,update,insert,delete on mfsbdb.service_binding to 'mfsb-user'@'%';
+grant select,update,insert,delete on mfsbdb.notification_outbox to 'mfsb-user'@'%';
+grant select on mfsbdb.schema_version to 'mfsb-user'@'%';
+grant select,insert on mfsbdb.iaas_instance_status_history to 'mfsb-user'@'%';
+grant select,insert on mfsbdb.audit_event to 'mfsb-user'@'%';
@@ -0,0 +1,11 @@
+-- upgrades an existing mfsb database (created before schema versioning) to schema version 1
+
+create table schema_version
+(
+    version    integer   not null primary key, -- the version of this schema, the broker checks it in its readiness check (db.SchemaVersion)
+    applied_at timestamp not null default current_timestamp
+);
+
+insert into schema_version(version) values (1);
+
+grant select on mfsbdb.schema_version to 'mfsb-user'@'%';
@@ -0,0 +1,7 @@
+-- upgrades the mfsb database from schema version 1 to 2, adds the poller ownership that allows broker instances to hand over their pollers
+
+alter table service_instance
+    add column poller_owner     char(64),          -- the broker instance that is polling the iaas instance for this env, null if nobody is polling
+    add column poller_heartbeat timestamp null;    -- updated by the poller_owner on every poll, a stale heartbeat means the poller died and another broker instance can take over
+
+insert into schema_version(version) values (2);
@@ -0,0 +1,27 @@
+-- upgrades the mfsb database from schema version 2 to 3, adds the append-only audit_event table
+
+create table audit_event
+(
+    id                   bigint        not null primary key auto_increment,
+    event_time           timestamp(3)  not null default current_timestamp(3),
+    env                  char(5)       not null, -- the identifier of the Cloud Foundry foundation of the broker that wrote the event
+    broker_instance      char(64)      not null, -- the broker instance that wrote the event
+    originating_identity varchar(1024),          -- the decoded X-Broker-API-Originating-Identity header of the request that caused the event
+    request_id           char(64),               -- the X-Request-ID of the request that caused the event, null for events written by a poller
+    event_type           char(64)      not null, -- for example service_instance.status_changed, see db/AuditEvent.go
+    instance_id          char(36),               -- no foreign keys, audit events outlive the rows they describe
+    organization_name    char(128),
+    space_name           char(128),
+    instance_name        char(128),
+    iaas_instance_id     integer,
+    internal_id          char(128),
+    old_status           char(128),
+    new_status           char(128),
+    aws_request_ids      varchar(1024),          -- comma separated ids of the AWS requests that led to the event
+    message              text(2048),
+    index (instance_id),
+    index (iaas_instance_id),
+    index (internal_id)
+);
+
+insert into schema_version(version) values (3);
@@ -0,0 +1,26 @@
+-- upgrades the mfsb database from schema version 3 to 4, service instances are soft-deleted and every iaas instance status is kept in iaas_instance_status_history
+
+alter table service_instance
+    add column deleted_at     timestamp null, -- service instances are soft-deleted, a deleted service instance is ignored by the broker
+    add column deleted_by_env char(5),        -- the identifier of the Cloud Foundry foundation whose broker deleted the service instance
+    add column active         tinyint as (if(deleted_at is null, 1, null)) stored,
+    add unique key active_env_iaas (env, iaas_instance_id, active),
+    drop index env;
+
+create table iaas_instance_status_history
+(
+    id               bigint       not null primary key auto_increment,
+    iaas_instance_id integer      not null,
+    status           char(128)    not null,
+    message          text(2048)   not null,
+    status_time      timestamp(3) not null default current_timestamp(3),
+    env              char(5)      not null, -- the identifier of the Cloud Foundry foundation of the broker that made the status update
+    index (iaas_instance_id, id),
+    constraint history2iaas foreign key (iaas_instance_id) references iaas_instance (id) on delete cascade
+);
+
+-- the current status of the existing iaas instances is the start of their history
+insert into iaas_instance_status_history(iaas_instance_id, status, message, status_time, env)
+select id, status, last_message, last_status_update, 'n/a' from iaas_instance;
+
+insert into schema_version(version) values (4);
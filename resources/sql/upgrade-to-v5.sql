@@ -0,0 +1,19 @@
+-- upgrades the mfsb database from schema version 4 to 5, adds the outbox of the webhook notifications
+
+create table notification_outbox
+(
+    id              bigint        not null primary key auto_increment,
+    endpoint        varchar(1024) not null, -- the webhook url the notification is POSTed to
+    event_type      char(64)      not null, -- for example provision.succeeded, see db/Notification.go
+    payload         text          not null, -- the json body of the POST
+    status          char(16)      not null default 'pending' check ( status in ('pending', 'delivered', 'failed')),
+    created_at      timestamp(3)  not null default current_timestamp(3),
+    attempts        integer       not null default 0,
+    next_attempt_at timestamp(3)  not null default current_timestamp(3),
+    claim_token     char(36),               -- set by the broker instance that is delivering the notification, see db.ClaimDueNotifications
+    last_error      text(2048),
+    delivered_at    timestamp(3)  null,
+    index (status, next_attempt_at)
+);
+
+insert into schema_version(version) values (5);
@@ -0,0 +1,6 @@
+-- upgrades the mfsb database from schema version 5 to 6, adds the service specific details of an iaas instance (for example the reader endpoint of an aurora cluster)
+
+alter table iaas_instance
+    add column service_details text(4096); -- encrypted json object with the service specific details that are added to the binding credentials
+
+insert into schema_version(version) values (6);
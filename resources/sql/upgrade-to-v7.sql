@@ -0,0 +1,6 @@
+-- upgrades the mfsb database from schema version 6 to 7, adds the credentials of a binding, for services that create credentials per binding (for example the IAM access keys of an s3 bucket)
+
+alter table service_binding
+    add column credentials text(4096); -- encrypted json object with the credentials of the binding, null if the binding uses the credentials of the iaas instance
+
+insert into schema_version(version) values (7);
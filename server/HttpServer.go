@@ -1,37 +1,78 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/rabobank/mfsb/aws"
 	"github.com/rabobank/mfsb/conf"
 	"github.com/rabobank/mfsb/controllers"
+	"log/slog"
 	"net/http"
 	"os"
+	"time"
 )
 
-func StartServer() {
+// shutdownTimeout is the time we take to drain, cloud foundry kills the app 10 seconds after it sent the SIGTERM
+const shutdownTimeout = 8 * time.Second
+
+// StartServer starts the http server and blocks until ctx is done (the broker got a SIGTERM), then drains:
+//   - no new provisions are accepted
+//   - the running requests (including their AWS submissions) are finished
+//   - the pollers are stopped and handed over to the other broker instances of this env
+func StartServer(ctx context.Context) {
 	router := mux.NewRouter()
 
-	router.Use(controllers.DebugMiddleware)
-	router.Use(controllers.BasicAuthMiddleware)
+	router.Use(controllers.RequestIdMiddleware)
+	router.Use(controllers.TracingMiddleware)
+	router.Use(controllers.AddHeadersMiddleware)
+
+	// the health endpoints are not authenticated, so the platform can use them for its health checks
+	router.HandleFunc("/health/live", controllers.LivenessCheck).Methods("GET")
+	router.HandleFunc("/health/ready", controllers.ReadinessCheck).Methods("GET")
 
-	router.HandleFunc("/v2/catalog", controllers.Catalog).Methods("GET")
-	router.HandleFunc("/v2/service_instances/{service_instance_guid}", controllers.GetServiceInstance).Methods("GET")
-	router.HandleFunc("/v2/service_instances/{service_instance_guid}/last_operation", controllers.GetServiceInstanceLastOperation).Methods("GET")
-	router.HandleFunc("/v2/service_instances/{service_instance_guid}", controllers.CreateServiceInstance).Methods("PUT")
-	router.HandleFunc("/v2/service_instances/{service_instance_guid}", controllers.DeleteServiceInstance).Methods("DELETE")
-	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.GetServiceBinding).Methods("GET")
-	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.CreateServiceBinding).Methods("PUT")
-	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.DeleteServiceBinding).Methods("DELETE")
+	broker := router.PathPrefix("/v2").Subrouter()
+	broker.Use(controllers.DebugMiddleware)
+	broker.Use(controllers.BasicAuthMiddleware)
 
-	http.Handle("/", router)
+	broker.HandleFunc("/catalog", controllers.Catalog).Methods("GET")
+	broker.HandleFunc("/service_instances/{service_instance_guid}", controllers.GetServiceInstance).Methods("GET")
+	broker.HandleFunc("/service_instances/{service_instance_guid}/last_operation", controllers.GetServiceInstanceLastOperation).Methods("GET")
+	broker.HandleFunc("/service_instances/{service_instance_guid}", controllers.CreateServiceInstance).Methods("PUT")
+	broker.HandleFunc("/service_instances/{service_instance_guid}", controllers.UpdateServiceInstance).Methods("PATCH")
+	broker.HandleFunc("/service_instances/{service_instance_guid}", controllers.DeleteServiceInstance).Methods("DELETE")
+	broker.HandleFunc("/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.GetServiceBinding).Methods("GET")
+	broker.HandleFunc("/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.CreateServiceBinding).Methods("PUT")
+	broker.HandleFunc("/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.DeleteServiceBinding).Methods("DELETE")
 
-	router.Use(controllers.AddHeadersMiddleware)
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(controllers.BasicAuthMiddleware)
 
-	fmt.Printf("server started, listening on port %d...\n", conf.ListenPort)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", conf.ListenPort), nil)
-	if err != nil {
-		fmt.Printf("failed to start http server on port %d, err: %s\n", conf.ListenPort, err)
+	admin.HandleFunc("/audit_events", controllers.GetAuditEvents).Methods("GET")
+	admin.HandleFunc("/iaas_instances/{iaas_instance_id}/status_history", controllers.GetIaaSInstanceStatusHistory).Methods("GET")
+	admin.HandleFunc("/reload", controllers.Reload).Methods("POST")
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", conf.ListenPort), Handler: router}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+	slog.Info("server started, listening...", "port", conf.ListenPort)
+
+	select {
+	case err := <-serverErr:
+		slog.Error("failed to start http server", "port", conf.ListenPort, "error", err)
 		os.Exit(8)
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutdown requested, draining...")
+	aws.StartDraining()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to gracefully shutdown the http server", "error", err)
 	}
+	aws.StopPollers(shutdownCtx)
+	slog.Info("server stopped")
 }
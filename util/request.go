@@ -0,0 +1,81 @@
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"sync"
+)
+
+// maxAWSRequestIds is the maximum number of AWS request ids we remember per context, a poller can do many AWS requests between two status updates
+const maxAWSRequestIds = 20
+
+type requestInfoKey struct{}
+type awsRequestIdsKey struct{}
+
+type requestInfo struct {
+	requestId           string
+	originatingIdentity string
+}
+
+type awsRequestIds struct {
+	mutex sync.Mutex
+	ids   []string
+}
+
+// WithRequestInfo returns a copy of ctx that carries the request id and the originating identity of the request
+func WithRequestInfo(ctx context.Context, requestId, originatingIdentity string) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, requestInfo{requestId: requestId, originatingIdentity: originatingIdentity})
+}
+
+func RequestId(ctx context.Context) string {
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info.requestId
+}
+
+func OriginatingIdentity(ctx context.Context) string {
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info.originatingIdentity
+}
+
+// DecodeOriginatingIdentity decodes the X-Broker-API-Originating-Identity header ("<platform> <base64 encoded json>"), into "<platform> <json>", for example: cloudfoundry {"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}
+func DecodeOriginatingIdentity(header string) string {
+	platform, value, found := strings.Cut(header, " ")
+	if !found {
+		return header
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return header
+	}
+	return platform + " " + string(decoded)
+}
+
+// WithAWSRequestIds returns a copy of ctx that collects the ids of the AWS requests done with it (see AddAWSRequestId)
+func WithAWSRequestIds(ctx context.Context) context.Context {
+	return context.WithValue(ctx, awsRequestIdsKey{}, &awsRequestIds{})
+}
+
+// AddAWSRequestId remembers the id of an AWS request done with ctx, if ctx collects them
+func AddAWSRequestId(ctx context.Context, id string) {
+	if collector, ok := ctx.Value(awsRequestIdsKey{}).(*awsRequestIds); ok && id != "" {
+		collector.mutex.Lock()
+		defer collector.mutex.Unlock()
+		collector.ids = append(collector.ids, id)
+		if len(collector.ids) > maxAWSRequestIds {
+			collector.ids = collector.ids[len(collector.ids)-maxAWSRequestIds:]
+		}
+	}
+}
+
+// TakeAWSRequestIds returns the ids of the AWS requests done with ctx since the previous call
+func TakeAWSRequestIds(ctx context.Context) []string {
+	if collector, ok := ctx.Value(awsRequestIdsKey{}).(*awsRequestIds); ok {
+		collector.mutex.Lock()
+		defer collector.mutex.Unlock()
+		ids := collector.ids
+		collector.ids = nil
+		return ids
+	}
+	return nil
+}
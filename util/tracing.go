@@ -0,0 +1,58 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"github.com/rabobank/mfsb/conf"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TracerName = "github.com/rabobank/mfsb"
+
+// NewSpanExporter creates the span exporter configured with MFSB_OTEL_EXPORTER, "otlp" exports over http to the endpoint configured with the standard OTEL_EXPORTER_OTLP_* envvars, "none" (the default) disables tracing.
+func NewSpanExporter(ctx context.Context, exporter string) (sdktrace.SpanExporter, error) {
+	switch exporter {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported otel exporter %s, supported are otlp and none", exporter)
+	}
+}
+
+// InitTracing installs a tracer provider that exports to the given exporter (for example a tracetest.InMemoryExporter in tests), with a nil exporter the (noop) default tracer provider stays in place.
+// The returned function flushes and stops the tracer provider.
+func InitTracing(exporter sdktrace.SpanExporter) func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if exporter == nil {
+		return func(context.Context) error { return nil }
+	}
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "mfsb"),
+		attribute.String("service.version", conf.GetVersion()),
+		attribute.String("deployment.environment", conf.CfEnv),
+	)
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	return tracerProvider.Shutdown
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// RecordError marks the span as failed, nil errors are ignored
+func RecordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// keepSpansExporter keeps the spans on shutdown, a tracetest.InMemoryExporter forgets them
+type keepSpansExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keepSpansExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestInitTracingExportsSpans(t *testing.T) {
+	exporter := keepSpansExporter{tracetest.NewInMemoryExporter()}
+	shutdown := InitTracing(exporter)
+
+	_, span := Tracer().Start(context.Background(), "provision")
+	span.End()
+	// the provider batches, the spans are only exported after a flush (shutdown)
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "provision" {
+		t.Fatalf("expected the provision span to be exported, got %v", spans)
+	}
+	if spans[0].InstrumentationLibrary.Name != TracerName {
+		t.Errorf("span was created by tracer %s, expected %s", spans[0].InstrumentationLibrary.Name, TracerName)
+	}
+	if !spans[0].Resource.Set().HasValue(attribute.Key("service.name")) {
+		t.Errorf("the resource of the span has no service.name: %v", spans[0].Resource)
+	}
+}
+
+func TestInitTracingWithoutExporter(t *testing.T) {
+	saved := otel.GetTracerProvider()
+	if err := InitTracing(nil)(context.Background()); err != nil {
+		t.Fatalf("shutdown without an exporter failed: %s", err)
+	}
+	if otel.GetTracerProvider() != saved {
+		t.Error("without an exporter the tracer provider should not be replaced")
+	}
+}
+
+func TestNewSpanExporter(t *testing.T) {
+	for _, exporter := range []string{"", "none"} {
+		if spanExporter, err := NewSpanExporter(context.Background(), exporter); spanExporter != nil || err != nil {
+			t.Errorf("exporter %q should disable tracing, got %v, %v", exporter, spanExporter, err)
+		}
+	}
+	if _, err := NewSpanExporter(context.Background(), "jaeger"); err == nil {
+		t.Error("an unsupported exporter should be an error")
+	}
+}
@@ -13,13 +13,10 @@ import (
 	"github.com/rabobank/mfsb/conf"
 	"github.com/rabobank/mfsb/model"
 	"io"
-	mathrand "math/rand"
+	"log/slog"
 	"net/http"
-	"sync/atomic"
 )
 
-var lastUsedAZIndex int32 = 99
-
 func WriteHttpResponse(w http.ResponseWriter, code int, object interface{}) {
 	data, err := json.Marshal(object)
 	if err != nil {
@@ -46,44 +43,62 @@ func BasicAuth(w http.ResponseWriter, r *http.Request, username, password string
 }
 
 func DumpRequest(r *http.Request) {
-	if conf.Debug {
-		fmt.Printf("dumping %s request for URL: %s\n", r.Method, r.URL)
-		fmt.Println("dumping request headers...")
+	logger := Logger(r.Context())
+	if logger.Enabled(r.Context(), slog.LevelDebug) {
 		// Loop over header names
+		var headers []any
 		for name, values := range r.Header {
 			if name == "Authorization" {
-				fmt.Printf(" %s: %s\n", name, "<redacted>")
+				headers = append(headers, slog.String(name, "<redacted>"))
 			} else {
-				// Loop over all values for the name.
-				for _, value := range values {
-					fmt.Printf(" %s: %s\n", name, value)
-				}
+				headers = append(headers, slog.Any(name, values))
 			}
 		}
 
 		// dump the request body
-		fmt.Println("dumping request body...")
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			fmt.Printf("Error reading body: %v\n", err)
-		} else {
-			fmt.Println(string(body))
+			logger.Debug("error reading body", "error", err)
 		}
+		logger.Debug("dumping request", "method", r.Method, "url", r.URL.String(), slog.Group("headers", headers...), "body", redactedBody(body))
 		// Restore the io.ReadCloser to it's original state
 		r.Body = io.NopCloser(bytes.NewBuffer(body))
 	}
 }
 
+// redactedBody returns the request body for the logs, with the secret parameters (SecretValue of the secretsmanager-service) redacted
+func redactedBody(body []byte) string {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil || request["parameters"] == nil {
+		return string(body)
+	}
+	var parameters map[string]json.RawMessage
+	if err := json.Unmarshal(request["parameters"], &parameters); err != nil || parameters["SecretValue"] == nil {
+		return string(body)
+	}
+	parameters["SecretValue"] = json.RawMessage(`"<redacted>"`)
+	// like the body itself, without escaping < and >
+	encode := func(value any) []byte {
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		_ = encoder.Encode(value)
+		return bytes.TrimSpace(buffer.Bytes())
+	}
+	request["parameters"] = encode(parameters)
+	return string(encode(request))
+}
+
 func ProvisionObjectFromRequest(r *http.Request, object interface{}) error {
+	logger := Logger(r.Context())
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		fmt.Printf("failed to read json object from request, error: %s\n", err)
+		logger.Error("failed to read json object from request", "error", err)
 		return err
 	}
-	fmt.Printf("received body:%v\n", string(body))
 	err = json.Unmarshal(body, object)
 	if err != nil {
-		fmt.Printf("failed to parse json object from request, error: %s\n", err)
+		logger.Error("failed to parse json object from request", "error", err)
 		return err
 	}
 	return nil
@@ -100,14 +115,14 @@ func GenerateGUID() string {
 	ba := make([]byte, 16)
 	_, err := rand.Read(ba)
 	if err != nil {
-		fmt.Printf("failed to generate guid, err: %s\n", err)
+		slog.Error("failed to generate guid", "error", err)
 	}
 	return fmt.Sprintf("%x-%x-%x-%x-%x", ba[0:4], ba[4:6], ba[6:8], ba[8:10], ba[10:])
 }
 
 func GetPlan(serviceId, planId string) model.ServicePlan {
 	var planNotFound model.ServicePlan
-	for _, service := range conf.Catalog.Services {
+	for _, service := range conf.GetCatalog().Services {
 		if service.Id == serviceId {
 			for _, plan := range service.Plans {
 				if plan.Id == planId {
@@ -121,7 +136,7 @@ func GetPlan(serviceId, planId string) model.ServicePlan {
 
 func GetServiceById(serviceId string) model.Service {
 	var service model.Service
-	for _, service := range conf.Catalog.Services {
+	for _, service := range conf.GetCatalog().Services {
 		if service.Id == serviceId {
 			return service
 		}
@@ -203,16 +218,3 @@ func Decrypt(encryptedString string) (string, error) {
 	decryptedString = fmt.Sprintf("%s", plaintext)
 	return decryptedString, nil
 }
-
-// GetNextAZ this will return the "next" AZ, in order to evenly spread the instances
-func GetNextAZ() *string {
-	// get a random starting point between 0,1,2
-	if lastUsedAZIndex == 99 {
-		lastUsedAZIndex = int32(mathrand.Intn(len(conf.AZS)))
-	}
-	atomic.AddInt32(&lastUsedAZIndex, 1)
-	if lastUsedAZIndex >= int32(len(conf.AZS)) {
-		atomic.StoreInt32(&lastUsedAZIndex, 0)
-	}
-	return conf.AZS[lastUsedAZIndex]
-}
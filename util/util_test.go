@@ -0,0 +1,24 @@
+package util
+
+import "testing"
+
+func TestRedactedBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "no parameters", body: `{"service_id":"rds-id","plan_id":"micro-id"}`, expected: `{"service_id":"rds-id","plan_id":"micro-id"}`},
+		{name: "no SecretValue", body: `{"service_id":"secrets-id","parameters":{"SecretLength":16}}`, expected: `{"service_id":"secrets-id","parameters":{"SecretLength":16}}`},
+		{name: "SecretValue", body: `{"service_id":"secrets-id","parameters":{"SecretValue":"s3cr3t","SecretLength":16}}`, expected: `{"parameters":{"SecretLength":16,"SecretValue":"<redacted>"},"service_id":"secrets-id"}`},
+		{name: "not json", body: `service_id=secrets-id`, expected: `service_id=secrets-id`},
+		{name: "parameters are not an object", body: `{"parameters":"SecretValue"}`, expected: `{"parameters":"SecretValue"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if redacted := redactedBody([]byte(tt.body)); redacted != tt.expected {
+				t.Errorf("the body is logged as %s, expected %s", redacted, tt.expected)
+			}
+		})
+	}
+}